@@ -3,6 +3,7 @@ package conf
 import (
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/btcsuite/btcd/chaincfg"
 )
@@ -13,34 +14,114 @@ const (
 
 	REGTEST_START_HEIGHT = 0
 	MAINNET_START_HEIGHT = 650000
+)
 
-	PARTITION_BLOCK_COUNT = 10
+type PeerConfig struct {
+	Host   string `required:"true" format:"hostport"`
+	Pubkey string `required:"true" format:"pubkey"`
+}
 
-	COMPARE_PARTITIONS_COUNT = 10
+type ConsolidateConfig struct {
+	Enable   bool
+	MaxVins  int `min:"0"`
+	MinUtxos int `min:"0"`
+}
 
-	RE_CONPUTE_PARTITION_COUNT = 1
-)
+type PayoutConfig struct {
+	MaxOutputsPerTx int `min:"0"`
+}
 
-type PeerConfig struct {
-	Host   string
-	Pubkey string
+// admin token is also accepted by user endpoints,Insecure is required to run without auth
+type HttpAuthConfig struct {
+	Enable         bool
+	Insecure       bool
+	AdminToken     string
+	AdminTokenFile string
+}
+
+// peers announced by a trusted introducer are allowed and dialed,AnnounceHost is where others reach our P2pHost
+type DiscoveryConfig struct {
+	Enable             bool
+	AnnounceHost       string   `format:"hostport"`
+	TrustedIntroducers []string `format:"pubkey"`
+}
+
+// partition settings must be the same on every peer,or partition hashes never match
+type TunablesConfig struct {
+	PartitionBlockCount         int64 `min:"1"`
+	ComparePartitionsCount      int64 `min:"1"`
+	RecomputePartitionCount     int64 `min:"0"`
+	SpentDepth                  int64 `min:"1"`
+	BadgeDustLimit              int64 `min:"1"`
+	SetSpentIntervalSeconds     int64 `min:"1"`
+	SyncStateIntervalSeconds    int64 `min:"1"`
+	CheckTxStateIntervalSeconds int64 `min:"1"`
+	ConsolidateIntervalSeconds  int64 `min:"1"`
+	PayoutIntervalSeconds       int64 `min:"1"`
+	WebhookIntervalSeconds      int64 `min:"1"`
+	LoopPausedIntervalSeconds   int64 `min:"1"`
+	DiscoveryIntervalSeconds    int64 `min:"1"`
 }
 
 type Config struct {
-	Env                        string
-	MongoHost                  string
-	MempoolHost                string
-	MempoolPkiMnemonic         string
-	MempoolPkiMnemonicPassword string
-	ServerPrivatekey           string
-	PeersConfigs               []*PeerConfig
-	P2pHost                    string
-	HttpHost                   string
-	DbName                     string
+	Env                            string `required:"true" enum:"regtest,mainnet"`
+	MongoHost                      string `required:"true"`
+	MempoolHost                    string `required:"true"`
+	MempoolPkiMnemonic             string `required:"true"`
+	MempoolPkiMnemonicFile         string
+	MempoolPkiMnemonicPassword     string
+	MempoolPkiMnemonicPasswordFile string
+	ServerPrivatekey               string `required:"true" format:"privkey"`
+	ServerPrivatekeyFile           string
+	PeersConfigs                   []*PeerConfig
+	P2pHost                        string `required:"true" format:"hostport"`
+	HttpHost                       string `required:"true" format:"hostport"`
+	GrpcApiHost                    string `format:"hostport"`
+	DbName                         string `required:"true"`
+	ConsolidateConfig              *ConsolidateConfig
+	PayoutConfig                   *PayoutConfig
+	HttpAuthConfig                 *HttpAuthConfig
+	DiscoveryConfig                *DiscoveryConfig
+	Tunables                       *TunablesConfig `required:"true"`
 }
 
+func DefaultTunablesConfig() *TunablesConfig {
+	return &TunablesConfig{
+		PartitionBlockCount:         10,
+		ComparePartitionsCount:      10,
+		RecomputePartitionCount:     1,
+		SpentDepth:                  20,
+		BadgeDustLimit:              888,
+		SetSpentIntervalSeconds:     10 * 60,
+		SyncStateIntervalSeconds:    5 * 60,
+		CheckTxStateIntervalSeconds: 60,
+		ConsolidateIntervalSeconds:  10 * 60,
+		PayoutIntervalSeconds:       60,
+		WebhookIntervalSeconds:      10,
+		LoopPausedIntervalSeconds:   10,
+		DiscoveryIntervalSeconds:    5 * 60,
+	}
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Env:      ENV_MAINNET,
+		DbName:   "touchstone",
+		Tunables: DefaultTunablesConfig(),
+	}
+}
+
+func Seconds(seconds int64) time.Duration {
+	return time.Duration(seconds) * time.Second
+}
+
+var GEnv string
+
 var GStartHeight *int64
 
+// replaced by Tunables of the loaded config
+var GTunables = DefaultTunablesConfig()
+
 var GNetParam *chaincfg.Params
 
 func InitGConfig(env string) error {
@@ -56,6 +137,7 @@ func InitGConfig(env string) error {
 		errStr := fmt.Sprintf("not support env %s", env)
 		return errors.New(errStr)
 	}
+	GEnv = env
 	GStartHeight = &startHeight
 	return nil
 }
@@ -0,0 +1,389 @@
+package conf
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+const (
+	ENV_PREFIX = "TOUCHSTONE_"
+
+	FORMAT_HOSTPORT = "hostport"
+	FORMAT_PRIVKEY  = "privkey"
+	FORMAT_PUBKEY   = "pubkey"
+)
+
+// key is the path of the field,like Tunables.PartitionBlockCount or PeersConfigs[0].Pubkey
+type ConfigError struct {
+	Key string
+	Msg string
+}
+
+func (this *ConfigError) Error() string {
+	return fmt.Sprintf("config %s: %s", this.Key, this.Msg)
+}
+
+// flag value of repeated -set Key.Path=value
+type ConfigSets []string
+
+func (this *ConfigSets) String() string {
+	return strings.Join(*this, ",")
+}
+
+func (this *ConfigSets) Set(value string) error {
+	*this = append(*this, value)
+	return nil
+}
+
+// defaults,then the file,then environ,then sets,then validate,
+// secret files are read by the layer setting them
+func LoadConfig(path string, environ []string, sets []string) (*Config, error) {
+	config := DefaultConfig()
+	if path != "" {
+		configJSON, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		err = ApplyLayer(config, func(config *Config) error {
+			return DecodeConfig(configJSON, config)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := ApplyLayer(config, func(config *Config) error {
+		return ApplyEnv(config, environ)
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = ApplyLayer(config, func(config *Config) error {
+		return ApplySets(config, sets)
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// the layer is applied to an empty config too,to tell the secrets it sets
+func ApplyLayer(config *Config, apply func(config *Config) error) error {
+	err := apply(config)
+	if err != nil {
+		return err
+	}
+	layer := &Config{}
+	err = apply(layer)
+	if err != nil {
+		return err
+	}
+	return ResolveSecrets(config, layer)
+}
+
+func ApplySets(config *Config, sets []string) error {
+	for _, set := range sets {
+		kv := strings.SplitN(set, "=", 2)
+		if len(kv) != 2 {
+			return &ConfigError{Key: set, Msg: "should be Key=value"}
+		}
+		err := SetConfigValue(config, kv[0], kv[1])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unknown keys are rejected,they are mostly typos
+func DecodeConfig(configJSON []byte, config *Config) error {
+	decoder := json.NewDecoder(bytes.NewReader(configJSON))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(config)
+	if err == nil {
+		return nil
+	}
+	if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+		return &ConfigError{Key: typeErr.Field, Msg: "should be " + typeErr.Type.String()}
+	}
+	if strings.HasPrefix(err.Error(), "json: unknown field ") {
+		key := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), "\"")
+		return &ConfigError{Key: key, Msg: "unknown key"}
+	}
+	return err
+}
+
+// MempoolPkiMnemonic is TOUCHSTONE_MEMPOOL_PKI_MNEMONIC,Tunables.SpentDepth is TOUCHSTONE_TUNABLES_SPENT_DEPTH
+func EnvName(key string) string {
+	name := ENV_PREFIX
+	for i, part := range strings.Split(key, ".") {
+		if i > 0 {
+			name += "_"
+		}
+		runes := []rune(part)
+		for j, r := range runes {
+			if j > 0 && unicode.IsUpper(r) && !unicode.IsUpper(runes[j-1]) {
+				name += "_"
+			}
+			name += string(unicode.ToUpper(r))
+		}
+	}
+	return name
+}
+
+// every settable key,slices like PeersConfigs are one key with a json value
+func ConfigKeys(t reflect.Type, prefix string) []string {
+	keys := make([]string, 0)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := prefix + field.Name
+		if field.Type.Kind() == reflect.Ptr && field.Type.Elem().Kind() == reflect.Struct {
+			keys = append(keys, ConfigKeys(field.Type.Elem(), key+".")...)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func ApplyEnv(config *Config, environ []string) error {
+	envs := make(map[string]string)
+	for _, env := range environ {
+		kv := strings.SplitN(env, "=", 2)
+		if len(kv) == 2 && strings.HasPrefix(kv[0], ENV_PREFIX) {
+			envs[kv[0]] = kv[1]
+		}
+	}
+	for _, key := range ConfigKeys(reflect.TypeOf(config).Elem(), "") {
+		value, ok := envs[EnvName(key)]
+		if !ok {
+			continue
+		}
+		err := SetConfigValue(config, key, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// strings are taken as is,other values are json,optional sections are created when needed
+func SetConfigValue(config *Config, key string, value string) error {
+	v := reflect.ValueOf(config).Elem()
+	parts := strings.Split(key, ".")
+	for i, part := range parts {
+		field := v.FieldByNameFunc(func(name string) bool {
+			return strings.EqualFold(name, part)
+		})
+		if !field.IsValid() {
+			return &ConfigError{Key: key, Msg: "unknown key"}
+		}
+		if i < len(parts)-1 {
+			if field.Kind() != reflect.Ptr || field.Type().Elem().Kind() != reflect.Struct {
+				return &ConfigError{Key: key, Msg: "unknown key"}
+			}
+			if field.IsNil() {
+				field.Set(reflect.New(field.Type().Elem()))
+			}
+			v = field.Elem()
+			continue
+		}
+		if field.Kind() == reflect.String {
+			field.SetString(value)
+			return nil
+		}
+		err := json.Unmarshal([]byte(value), field.Addr().Interface())
+		if err != nil {
+			return &ConfigError{Key: key, Msg: "should be " + field.Type().String()}
+		}
+	}
+	return nil
+}
+
+func ReadSecretFile(key string, path string, secret *string) error {
+	if path == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return &ConfigError{Key: key, Msg: err.Error()}
+	}
+	*secret = strings.TrimSpace(string(content))
+	return nil
+}
+
+// a secret and the key of the file holding it
+type SecretField struct {
+	Key     string
+	FileKey string
+	Secret  *string
+	File    *string
+}
+
+func SecretFields(config *Config) []*SecretField {
+	secretFields := []*SecretField{
+		{Key: "ServerPrivatekey", FileKey: "ServerPrivatekeyFile", Secret: &config.ServerPrivatekey, File: &config.ServerPrivatekeyFile},
+		{Key: "MempoolPkiMnemonic", FileKey: "MempoolPkiMnemonicFile", Secret: &config.MempoolPkiMnemonic, File: &config.MempoolPkiMnemonicFile},
+		{Key: "MempoolPkiMnemonicPassword", FileKey: "MempoolPkiMnemonicPasswordFile", Secret: &config.MempoolPkiMnemonicPassword, File: &config.MempoolPkiMnemonicPasswordFile},
+	}
+	if config.HttpAuthConfig != nil {
+		secretFields = append(secretFields, &SecretField{Key: "HttpAuthConfig.AdminToken", FileKey: "HttpAuthConfig.AdminTokenFile", Secret: &config.HttpAuthConfig.AdminToken, File: &config.HttpAuthConfig.AdminTokenFile})
+	}
+	return secretFields
+}
+
+// the later layer wins,a secret and its file set by the same layer is an error
+func ResolveSecrets(config *Config, layer *Config) error {
+	layerFields := make(map[string]*SecretField)
+	for _, secretField := range SecretFields(layer) {
+		layerFields[secretField.Key] = secretField
+	}
+	for _, secretField := range SecretFields(config) {
+		layerField, ok := layerFields[secretField.Key]
+		if !ok {
+			continue
+		}
+		if *layerField.Secret != "" && *layerField.File != "" {
+			return &ConfigError{Key: secretField.FileKey, Msg: "should not be set with " + secretField.Key}
+		}
+		if *layerField.Secret != "" {
+			*secretField.File = ""
+			continue
+		}
+		err := ReadSecretFile(secretField.FileKey, *layerField.File, secretField.Secret)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func CheckFormat(format string, value string) string {
+	switch format {
+	case FORMAT_HOSTPORT:
+		_, port, err := net.SplitHostPort(value)
+		if err != nil {
+			return "should be host:port"
+		}
+		_, err = strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return "should be host:port"
+		}
+	case FORMAT_PRIVKEY:
+		privkey, err := hex.DecodeString(value)
+		if err != nil || len(privkey) != btcec.PrivKeyBytesLen {
+			return "should be a hex private key of 32 bytes"
+		}
+	case FORMAT_PUBKEY:
+		pubkey, err := hex.DecodeString(value)
+		if err != nil {
+			return "should be a hex pubkey"
+		}
+		_, err = btcec.ParsePubKey(pubkey, btcec.S256())
+		if err != nil {
+			return "should be a hex pubkey"
+		}
+	}
+	return ""
+}
+
+// rules are the tags required,enum,format and min
+func ValidateStruct(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		value := v.Field(i)
+		key := prefix + field.Name
+		if field.Tag.Get("required") == "true" && value.IsZero() {
+			return &ConfigError{Key: key, Msg: "is required"}
+		}
+		switch value.Kind() {
+		case reflect.String:
+			str := value.String()
+			if str == "" {
+				continue
+			}
+			if enum := field.Tag.Get("enum"); enum != "" {
+				found := false
+				for _, item := range strings.Split(enum, ",") {
+					if item == str {
+						found = true
+					}
+				}
+				if !found {
+					return &ConfigError{Key: key, Msg: "should be one of " + enum}
+				}
+			}
+			if msg := CheckFormat(field.Tag.Get("format"), str); msg != "" {
+				return &ConfigError{Key: key, Msg: msg}
+			}
+		case reflect.Int, reflect.Int64:
+			if min := field.Tag.Get("min"); min != "" {
+				minValue, err := strconv.ParseInt(min, 10, 64)
+				if err != nil {
+					return err
+				}
+				if value.Int() < minValue {
+					return &ConfigError{Key: key, Msg: "should be at least " + min}
+				}
+			}
+		case reflect.Ptr:
+			if value.IsNil() || value.Elem().Kind() != reflect.Struct {
+				continue
+			}
+			err := ValidateStruct(value.Elem(), key+".")
+			if err != nil {
+				return err
+			}
+		case reflect.Slice:
+			for j := 0; j < value.Len(); j++ {
+				item := value.Index(j)
+				itemKey := fmt.Sprintf("%s[%d]", key, j)
+				if item.Kind() == reflect.String {
+					if msg := CheckFormat(field.Tag.Get("format"), item.String()); msg != "" {
+						return &ConfigError{Key: itemKey, Msg: msg}
+					}
+					continue
+				}
+				if item.Kind() != reflect.Ptr || item.Type().Elem().Kind() != reflect.Struct {
+					continue
+				}
+				if item.IsNil() {
+					return &ConfigError{Key: itemKey, Msg: "is required"}
+				}
+				err := ValidateStruct(item.Elem(), itemKey+".")
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (this *Config) Validate() error {
+	err := ValidateStruct(reflect.ValueOf(this).Elem(), "")
+	if err != nil {
+		return err
+	}
+	if this.HttpAuthConfig == nil || (!this.HttpAuthConfig.Enable && !this.HttpAuthConfig.Insecure) {
+		return &ConfigError{Key: "HttpAuthConfig.Enable", Msg: "is required unless HttpAuthConfig.Insecure is set"}
+	}
+	if this.DiscoveryConfig != nil && this.DiscoveryConfig.Enable && this.DiscoveryConfig.AnnounceHost == "" {
+		return &ConfigError{Key: "DiscoveryConfig.AnnounceHost", Msg: "is required when discovery is enabled"}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package conf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testConfigJSON = `{
+	"Env": "regtest",
+	"MongoHost": "127.0.0.1:27017",
+	"MempoolHost": "https://api.ddpurse.com",
+	"MempoolPkiMnemonic": "earn economy machine gauge grass during gain pencil spread absent wall ugly",
+	"ServerPrivatekey": "9a4d8f5f2f7ad34f90bfcafe2961aabc71bdee0df63f3c4cc2b95fbc93a5572f",
+	"PeersConfigs": [
+		{
+			"Host": "127.0.0.1:7788",
+			"Pubkey": "036af584f4f274e3b6831f9c8cfb8cce56d441887a9349cc93b180eb9a913d06cd"
+		}
+	],
+	"P2pHost": "0.0.0.0:7788",
+	"HttpHost": "0.0.0.0:7789",
+	"HttpAuthConfig": {
+		"Insecure": true
+	},
+	"Tunables": {
+		"SpentDepth": 30
+	}
+}`
+
+func writeTestFile(t *testing.T, dir string, name string, content string) string {
+	path := filepath.Join(dir, name)
+	err := ioutil.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "touchstone_conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeTestFile(t, dir, "config.json", testConfigJSON)
+	keyPath := writeTestFile(t, dir, "privkey", "1015e88bfaccd79c3f896e99cdf39cde76a8c36d311c4b0be8cc4ab47c5e6c48\n")
+	environ := []string{
+		"TOUCHSTONE_DB_NAME=touchstone_env",
+		"TOUCHSTONE_TUNABLES_PARTITION_BLOCK_COUNT=20",
+		"TOUCHSTONE_SERVER_PRIVATEKEY_FILE=" + keyPath,
+		"TOUCHSTONE_HTTP_AUTH_CONFIG_ENABLE=true",
+	}
+	config, err := LoadConfig(path, environ, []string{"Tunables.PartitionBlockCount=30"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.DbName != "touchstone_env" {
+		t.Fatalf("DbName %s", config.DbName)
+	}
+	if config.Tunables.SpentDepth != 30 || config.Tunables.BadgeDustLimit != 888 {
+		t.Fatalf("file should keep defaults of other keys %+v", config.Tunables)
+	}
+	if config.Tunables.PartitionBlockCount != 30 {
+		t.Fatalf("flag should override env %d", config.Tunables.PartitionBlockCount)
+	}
+	if config.ServerPrivatekey != "1015e88bfaccd79c3f896e99cdf39cde76a8c36d311c4b0be8cc4ab47c5e6c48" {
+		t.Fatalf("ServerPrivatekey %s", config.ServerPrivatekey)
+	}
+	if config.HttpAuthConfig == nil || !config.HttpAuthConfig.Enable {
+		t.Fatal("HttpAuthConfig.Enable should be set by env")
+	}
+}
+
+func TestLoadConfigErrorKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "touchstone_conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeTestFile(t, dir, "config.json", testConfigJSON)
+	cases := []struct {
+		environ []string
+		sets    []string
+		key     string
+	}{
+		{sets: []string{"Tunables.PartitionBlockCount=0"}, key: "Tunables.PartitionBlockCount"},
+		{sets: []string{"Tunables.SpentDepth=abc"}, key: "Tunables.SpentDepth"},
+		{sets: []string{"Tunable.SpentDepth=1"}, key: "Tunable.SpentDepth"},
+		{environ: []string{"TOUCHSTONE_ENV=testnet"}, key: "Env"},
+		{environ: []string{"TOUCHSTONE_P2P_HOST=7788"}, key: "P2pHost"},
+		{environ: []string{`TOUCHSTONE_PEERS_CONFIGS=[{"Host":"127.0.0.1:7788","Pubkey":"02"}]`}, key: "PeersConfigs[0].Pubkey"},
+		{environ: []string{"TOUCHSTONE_SERVER_PRIVATEKEY="}, key: "ServerPrivatekey"},
+		{sets: []string{"HttpAuthConfig.Insecure=false"}, key: "HttpAuthConfig.Enable"},
+		{sets: []string{"DiscoveryConfig.Enable=true"}, key: "DiscoveryConfig.AnnounceHost"},
+		{environ: []string{`TOUCHSTONE_DISCOVERY_CONFIG_TRUSTED_INTRODUCERS=["02"]`}, key: "DiscoveryConfig.TrustedIntroducers[0]"},
+	}
+	for _, c := range cases {
+		_, err := LoadConfig(path, c.environ, c.sets)
+		configErr, ok := err.(*ConfigError)
+		if !ok || configErr.Key != c.key {
+			t.Fatalf("expect error of %s,got %v", c.key, err)
+		}
+	}
+	unknownPath := writeTestFile(t, dir, "unknown.json", `{"DbNmae": "touchstone"}`)
+	_, err = LoadConfig(unknownPath, nil, nil)
+	configErr, ok := err.(*ConfigError)
+	if !ok || configErr.Key != "DbNmae" {
+		t.Fatalf("expect error of DbNmae,got %v", err)
+	}
+}
+
+func TestLoadConfigSecretLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "touchstone_conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyPath := writeTestFile(t, dir, "privkey", "1015e88bfaccd79c3f896e99cdf39cde76a8c36d311c4b0be8cc4ab47c5e6c48\n")
+	fileConfigJSON := strings.Replace(testConfigJSON, `"ServerPrivatekey": "9a4d8f5f2f7ad34f90bfcafe2961aabc71bdee0df63f3c4cc2b95fbc93a5572f",`, `"ServerPrivatekeyFile": "`+keyPath+`",`, 1)
+	path := writeTestFile(t, dir, "config.json", fileConfigJSON)
+	config, err := LoadConfig(path, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ServerPrivatekey != "1015e88bfaccd79c3f896e99cdf39cde76a8c36d311c4b0be8cc4ab47c5e6c48" {
+		t.Fatalf("secret file of the file layer %s", config.ServerPrivatekey)
+	}
+	// a flag overrides a secret file of the file
+	config, err = LoadConfig(path, nil, []string{"ServerPrivatekey=9a4d8f5f2f7ad34f90bfcafe2961aabc71bdee0df63f3c4cc2b95fbc93a5572f"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ServerPrivatekey != "9a4d8f5f2f7ad34f90bfcafe2961aabc71bdee0df63f3c4cc2b95fbc93a5572f" || config.ServerPrivatekeyFile != "" {
+		t.Fatalf("flag should win %s %s", config.ServerPrivatekey, config.ServerPrivatekeyFile)
+	}
+	environ := []string{
+		"TOUCHSTONE_SERVER_PRIVATEKEY=9a4d8f5f2f7ad34f90bfcafe2961aabc71bdee0df63f3c4cc2b95fbc93a5572f",
+		"TOUCHSTONE_SERVER_PRIVATEKEY_FILE=" + keyPath,
+	}
+	_, err = LoadConfig(path, environ, nil)
+	configErr, ok := err.(*ConfigError)
+	if !ok || configErr.Key != "ServerPrivatekeyFile" {
+		t.Fatalf("a secret and its file of one layer should be refused,got %v", err)
+	}
+}
@@ -0,0 +1,205 @@
+package controller
+
+import (
+	"net/http"
+
+	"github.com/dotwallet/touchstone/interceptor"
+)
+
+type AdminSyncStateReq struct {
+}
+
+func (this *AdminSyncStateReq) NewHttpReqBody() interceptor.HttpReqBody {
+	return &AdminSyncStateReq{}
+}
+
+func (this *HttpController) AdminSyncState(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
+	return this.TouchstoneServer.StartSyncStateJob()
+}
+
+type AdminSyncPartitionsReq struct {
+	Start *int64 `json:"start"`
+	End   *int64 `json:"end"`
+	Peer  string `json:"peer"`
+}
+
+func (this *AdminSyncPartitionsReq) NewHttpReqBody() interceptor.HttpReqBody {
+	return &AdminSyncPartitionsReq{}
+}
+
+func (this *HttpController) AdminSyncPartitions(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
+	request := httpReqStruct.(*AdminSyncPartitionsReq)
+	return this.TouchstoneServer.StartSyncPartitionsJob(*request.Start, *request.End, request.Peer)
+}
+
+type AdminRecomputePartitionHashesReq struct {
+	Start *int64 `json:"start"`
+	End   *int64 `json:"end"`
+}
+
+func (this *AdminRecomputePartitionHashesReq) NewHttpReqBody() interceptor.HttpReqBody {
+	return &AdminRecomputePartitionHashesReq{}
+}
+
+func (this *HttpController) AdminRecomputePartitionHashes(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
+	request := httpReqStruct.(*AdminRecomputePartitionHashesReq)
+	return this.TouchstoneServer.StartRecomputePartitionHashesJob(*request.Start, *request.End)
+}
+
+type AdminReprocessTxReq struct {
+	Txid *string `json:"txid"`
+}
+
+func (this *AdminReprocessTxReq) NewHttpReqBody() interceptor.HttpReqBody {
+	return &AdminReprocessTxReq{}
+}
+
+func (this *HttpController) AdminReprocessTx(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
+	request := httpReqStruct.(*AdminReprocessTxReq)
+	return this.TouchstoneServer.StartReprocessTxJob(*request.Txid)
+}
+
+type AdminClearTxReq struct {
+	Txid *string `json:"txid"`
+}
+
+func (this *AdminClearTxReq) NewHttpReqBody() interceptor.HttpReqBody {
+	return &AdminClearTxReq{}
+}
+
+func (this *HttpController) AdminClearTx(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
+	request := httpReqStruct.(*AdminClearTxReq)
+	return this.TouchstoneServer.StartClearTxJob(*request.Txid)
+}
+
+type AdminSetSpentReq struct {
+}
+
+func (this *AdminSetSpentReq) NewHttpReqBody() interceptor.HttpReqBody {
+	return &AdminSetSpentReq{}
+}
+
+func (this *HttpController) AdminSetSpent(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
+	return this.TouchstoneServer.StartSetSpentJob()
+}
+
+type AdminBootstrapSnapshotReq struct {
+	Peer   string `json:"peer"`
+	Height int64  `json:"height"`
+}
+
+func (this *AdminBootstrapSnapshotReq) NewHttpReqBody() interceptor.HttpReqBody {
+	return &AdminBootstrapSnapshotReq{}
+}
+
+func (this *HttpController) AdminBootstrapSnapshot(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
+	request := httpReqStruct.(*AdminBootstrapSnapshotReq)
+	return this.TouchstoneServer.StartBootstrapSnapshotJob(request.Peer, request.Height)
+}
+
+type AdminGetJobReq struct {
+	JobId *string `json:"job_id"`
+}
+
+func (this *AdminGetJobReq) NewHttpReqBody() interceptor.HttpReqBody {
+	return &AdminGetJobReq{}
+}
+
+func (this *HttpController) AdminGetJob(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
+	request := httpReqStruct.(*AdminGetJobReq)
+	return this.TouchstoneServer.GetJob(*request.JobId)
+}
+
+type AdminGetJobsReq struct {
+}
+
+func (this *AdminGetJobsReq) NewHttpReqBody() interceptor.HttpReqBody {
+	return &AdminGetJobsReq{}
+}
+
+func (this *HttpController) AdminGetJobs(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
+	return this.TouchstoneServer.GetJobs(), nil
+}
+
+type AdminGetPeersReq struct {
+}
+
+func (this *AdminGetPeersReq) NewHttpReqBody() interceptor.HttpReqBody {
+	return &AdminGetPeersReq{}
+}
+
+func (this *HttpController) AdminGetPeers(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
+	return this.TouchstoneServer.GetPeers(), nil
+}
+
+type AdminReloadPeersReq struct {
+}
+
+func (this *AdminReloadPeersReq) NewHttpReqBody() interceptor.HttpReqBody {
+	return &AdminReloadPeersReq{}
+}
+
+func (this *HttpController) AdminReloadPeers(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
+	return this.TouchstoneServer.ReloadPeers()
+}
+
+type AdminUnbanPeerReq struct {
+	Pubkey *string `json:"pubkey"`
+}
+
+func (this *AdminUnbanPeerReq) NewHttpReqBody() interceptor.HttpReqBody {
+	return &AdminUnbanPeerReq{}
+}
+
+func (this *HttpController) AdminUnbanPeer(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
+	request := httpReqStruct.(*AdminUnbanPeerReq)
+	return this.TouchstoneServer.UnbanPeer(*request.Pubkey)
+}
+
+type AdminGetNodesReq struct {
+}
+
+func (this *AdminGetNodesReq) NewHttpReqBody() interceptor.HttpReqBody {
+	return &AdminGetNodesReq{}
+}
+
+func (this *HttpController) AdminGetNodes(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
+	return this.TouchstoneServer.GetKnownNodes()
+}
+
+type AdminPauseLoopReq struct {
+	Loop *string `json:"loop"`
+}
+
+func (this *AdminPauseLoopReq) NewHttpReqBody() interceptor.HttpReqBody {
+	return &AdminPauseLoopReq{}
+}
+
+func (this *HttpController) AdminPauseLoop(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
+	request := httpReqStruct.(*AdminPauseLoopReq)
+	return this.TouchstoneServer.SetLoopPaused(*request.Loop, true)
+}
+
+type AdminResumeLoopReq struct {
+	Loop *string `json:"loop"`
+}
+
+func (this *AdminResumeLoopReq) NewHttpReqBody() interceptor.HttpReqBody {
+	return &AdminResumeLoopReq{}
+}
+
+func (this *HttpController) AdminResumeLoop(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
+	request := httpReqStruct.(*AdminResumeLoopReq)
+	return this.TouchstoneServer.SetLoopPaused(*request.Loop, false)
+}
+
+type AdminGetLoopsReq struct {
+}
+
+func (this *AdminGetLoopsReq) NewHttpReqBody() interceptor.HttpReqBody {
+	return &AdminGetLoopsReq{}
+}
+
+func (this *HttpController) AdminGetLoops(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
+	return this.TouchstoneServer.GetLoops(), nil
+}
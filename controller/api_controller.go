@@ -0,0 +1,294 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/dotwallet/touchstone/interceptor"
+	"github.com/dotwallet/touchstone/message"
+	"github.com/dotwallet/touchstone/models"
+	"github.com/dotwallet/touchstone/services"
+	"github.com/dotwallet/touchstone/util"
+	"github.com/golang/glog"
+)
+
+const (
+	API_DEFAULT_PAGE_LIMIT   = 10
+	API_STREAM_PAGE_LIMIT    = 100
+	API_REQUIRED_FIELDS_MSG  = "required fields are missing"
+	API_AMOUNT2BURN_LESS_MSG = "Amount2Burn < 0"
+)
+
+// client-facing grpc api,same as http api
+type ApiController struct {
+	TouchstoneServer *services.TouchstoneServer
+}
+
+func CheckRequired(values ...string) error {
+	for _, value := range values {
+		if value == "" {
+			return util.NewCodeError(util.ERR_PARAMETERS_CODE, API_REQUIRED_FIELDS_MSG)
+		}
+	}
+	return nil
+}
+
+func ApiPageLimit(limit int32, defaultLimit int) int {
+	if limit == 0 {
+		return defaultLimit
+	}
+	return int(limit)
+}
+
+func TxPoint2Msg(txPoint *models.TxPoint) *message.TxPointMsg {
+	return &message.TxPointMsg{
+		Addr:      txPoint.Addr,
+		Txid:      txPoint.Txid,
+		Index:     int32(txPoint.Index),
+		Value:     txPoint.Value,
+		Pretxid:   txPoint.PreTxid,
+		Preindex:  int32(txPoint.PreIndex),
+		BadgeCode: txPoint.BadgeCode,
+		Timestamp: txPoint.Timestamp,
+	}
+}
+
+func TxPoints2Msgs(txPoints []*models.TxPoint) []*message.TxPointMsg {
+	msgs := make([]*message.TxPointMsg, 0, len(txPoints))
+	for _, txPoint := range txPoints {
+		msgs = append(msgs, TxPoint2Msg(txPoint))
+	}
+	return msgs
+}
+
+func AddrInventory2Msg(addrInventory *services.AddrInventory) *message.AddrInventoryMsg {
+	return &message.AddrInventoryMsg{
+		Addr:      addrInventory.Addr,
+		Txid:      addrInventory.Txid,
+		Timestamp: addrInventory.Timestamp,
+		Value:     addrInventory.Value,
+	}
+}
+
+func TxInventory2Response(txInventory *services.TxInventory) *message.TxInventoryResponse {
+	return &message.TxInventoryResponse{
+		Vins:  TxPoints2Msgs(txInventory.Vins),
+		Vouts: TxPoints2Msgs(txInventory.Vouts),
+	}
+}
+
+func GetUtxosResult2Response(result *services.GetUtxosResult) *message.GetUtxosResponse {
+	return &message.GetUtxosResponse{
+		Utxos:      TxPoints2Msgs(result.Utxos),
+		NextCursor: result.NextCursor,
+	}
+}
+
+func GetBalanceRsp2Response(result *services.GetBalanceRsp) *message.GetBalanceResponse {
+	return &message.GetBalanceResponse{
+		Balance:    result.Balance,
+		UtxoCount:  result.UtxoCount,
+		LastHeight: result.LastHeight,
+	}
+}
+
+func GetAddrInventoryRsp2Response(result *services.GetAddrInventoryRsp) *message.GetAddrInventorysResponse {
+	addrInventorys := make([]*message.AddrInventoryMsg, 0, len(result.AddrInventorys))
+	for _, addrInventory := range result.AddrInventorys {
+		addrInventorys = append(addrInventorys, AddrInventory2Msg(addrInventory))
+	}
+	return &message.GetAddrInventorysResponse{
+		AddrInventorys: addrInventorys,
+		NextCursor:     result.NextCursor,
+	}
+}
+
+func (this *ApiController) SendRawTransaction(ctx context.Context, request *message.SendRawTransactionRequest) (*message.TxInventoryResponse, error) {
+	err := CheckRequired(request.Rawtx)
+	if err != nil {
+		return nil, err
+	}
+	reqid := util.RandStringBytes(8)
+	glog.Infof("ApiController SendRawTransaction %s %s", request.Rawtx, reqid)
+	txInventory, err := this.TouchstoneServer.SendRawTransaction(request.Rawtx, reqid)
+	if err != nil {
+		return nil, err
+	}
+	return TxInventory2Response(txInventory), nil
+}
+
+func (this *ApiController) GetTxInventory(ctx context.Context, request *message.GetTxInventoryRequest) (*message.TxInventoryResponse, error) {
+	err := CheckRequired(request.Txid)
+	if err != nil {
+		return nil, err
+	}
+	txInventory, err := this.TouchstoneServer.GetTransactionInventory(request.Txid)
+	if err != nil {
+		return nil, err
+	}
+	return TxInventory2Response(txInventory), nil
+}
+
+func (this *ApiController) GetAddrUtxos(ctx context.Context, request *message.AddrPageRequest) (*message.GetUtxosResponse, error) {
+	err := this.CheckAddrRequest(ctx, request.Addr, request.BadgeCode)
+	if err != nil {
+		return nil, err
+	}
+	result, err := this.TouchstoneServer.GetAddrUtxos(request.Addr, request.BadgeCode, request.Cursor, ApiPageLimit(request.Limit, API_DEFAULT_PAGE_LIMIT))
+	if err != nil {
+		return nil, err
+	}
+	return GetUtxosResult2Response(result), nil
+}
+
+func (this *ApiController) GetAddrBalance(ctx context.Context, request *message.AddrRequest) (*message.GetBalanceResponse, error) {
+	err := this.CheckAddrRequest(ctx, request.Addr, request.BadgeCode)
+	if err != nil {
+		return nil, err
+	}
+	result, err := this.TouchstoneServer.GetAddrBalance(request.Addr, request.BadgeCode)
+	if err != nil {
+		return nil, err
+	}
+	return GetBalanceRsp2Response(result), nil
+}
+
+func (this *ApiController) GetAddrInventorys(ctx context.Context, request *message.AddrPageRequest) (*message.GetAddrInventorysResponse, error) {
+	err := this.CheckAddrRequest(ctx, request.Addr, request.BadgeCode)
+	if err != nil {
+		return nil, err
+	}
+	result, err := this.TouchstoneServer.GetAddrInventorys(request.Addr, request.BadgeCode, request.Cursor, ApiPageLimit(request.Limit, API_DEFAULT_PAGE_LIMIT))
+	if err != nil {
+		return nil, err
+	}
+	return GetAddrInventoryRsp2Response(result), nil
+}
+
+func (this *ApiController) CheckAddrRequest(ctx context.Context, addr string, badgeCode string) error {
+	err := CheckRequired(addr, badgeCode)
+	if err != nil {
+		return err
+	}
+	return this.TouchstoneServer.CheckCallerAddrs(interceptor.GetCaller(ctx), []string{addr})
+}
+
+func CheckUserRequest(ctx context.Context, appid string, badgeCode string) error {
+	err := CheckRequired(appid, badgeCode)
+	if err != nil {
+		return err
+	}
+	return interceptor.CheckCallerAppid(interceptor.GetCaller(ctx), appid)
+}
+
+func (this *ApiController) GetUserUtxos(ctx context.Context, request *message.UserPageRequest) (*message.GetUtxosResponse, error) {
+	err := CheckUserRequest(ctx, request.Appid, request.BadgeCode)
+	if err != nil {
+		return nil, err
+	}
+	result, err := this.TouchstoneServer.GetUserUtxos(request.Appid, request.Userid, request.UserIndex, request.BadgeCode, request.Cursor, ApiPageLimit(request.Limit, API_DEFAULT_PAGE_LIMIT))
+	if err != nil {
+		return nil, err
+	}
+	return GetUtxosResult2Response(result), nil
+}
+
+func (this *ApiController) GetUserBalance(ctx context.Context, request *message.UserRequest) (*message.GetBalanceResponse, error) {
+	err := CheckUserRequest(ctx, request.Appid, request.BadgeCode)
+	if err != nil {
+		return nil, err
+	}
+	result, err := this.TouchstoneServer.GetUserBalance(request.Appid, request.Userid, request.UserIndex, request.BadgeCode)
+	if err != nil {
+		return nil, err
+	}
+	return GetBalanceRsp2Response(result), nil
+}
+
+func (this *ApiController) GetUserInventorys(ctx context.Context, request *message.UserPageRequest) (*message.GetAddrInventorysResponse, error) {
+	err := CheckUserRequest(ctx, request.Appid, request.BadgeCode)
+	if err != nil {
+		return nil, err
+	}
+	result, err := this.TouchstoneServer.GetUserInventorys(request.Appid, request.Userid, request.UserIndex, request.BadgeCode, request.Cursor, ApiPageLimit(request.Limit, API_DEFAULT_PAGE_LIMIT))
+	if err != nil {
+		return nil, err
+	}
+	return GetAddrInventoryRsp2Response(result), nil
+}
+
+func (this *ApiController) SendBadgeToAddress(ctx context.Context, request *message.SendBadgeToAddressRequest) (*message.SendBadgeToAddressResponse, error) {
+	err := CheckUserRequest(ctx, request.Appid, request.BadgeCode)
+	if err != nil {
+		return nil, err
+	}
+	err = CheckRequired(request.ChangeAddr)
+	if err != nil {
+		return nil, err
+	}
+	if request.Amount2Burn < 0 {
+		return nil, util.NewCodeError(util.ERR_PARAMETERS_CODE, API_AMOUNT2BURN_LESS_MSG)
+	}
+	addrAmounts := make([]*services.AddrAmount, 0, len(request.AddrAmounts))
+	for _, addrAmount := range request.AddrAmounts {
+		addrAmounts = append(addrAmounts, &services.AddrAmount{
+			Addr:   addrAmount.Addr,
+			Amount: addrAmount.Amount,
+		})
+	}
+	result, err := this.TouchstoneServer.SendBadgeToAddress(request.Appid, request.Userid, request.UserIndex, request.BadgeCode, request.ChangeAddr, addrAmounts, request.Amount2Burn)
+	if err != nil {
+		return nil, err
+	}
+	return &message.SendBadgeToAddressResponse{
+		UnfinishedTx: result.UnFinishedTx,
+		Vins:         TxPoints2Msgs(result.Vins),
+	}, nil
+}
+
+type inventoryPager func(cursor string, limit int) (*services.GetAddrInventoryRsp, error)
+
+// send pages until the last one,stop when client is gone
+func StreamInventorys(ctx context.Context, cursor string, limit int, pager inventoryPager, send func(*message.AddrInventoryMsg) error) error {
+	for {
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+		result, err := pager(cursor, limit)
+		if err != nil {
+			return err
+		}
+		for _, addrInventory := range result.AddrInventorys {
+			err = send(AddrInventory2Msg(addrInventory))
+			if err != nil {
+				return err
+			}
+		}
+		if result.NextCursor == "" {
+			return nil
+		}
+		cursor = result.NextCursor
+	}
+}
+
+func (this *ApiController) StreamAddrInventorys(request *message.AddrPageRequest, stream message.Touchstone_StreamAddrInventorysServer) error {
+	err := this.CheckAddrRequest(stream.Context(), request.Addr, request.BadgeCode)
+	if err != nil {
+		return err
+	}
+	pager := func(cursor string, limit int) (*services.GetAddrInventoryRsp, error) {
+		return this.TouchstoneServer.GetAddrInventorys(request.Addr, request.BadgeCode, cursor, limit)
+	}
+	return StreamInventorys(stream.Context(), request.Cursor, ApiPageLimit(request.Limit, API_STREAM_PAGE_LIMIT), pager, stream.Send)
+}
+
+func (this *ApiController) StreamUserInventorys(request *message.UserPageRequest, stream message.Touchstone_StreamUserInventorysServer) error {
+	err := CheckUserRequest(stream.Context(), request.Appid, request.BadgeCode)
+	if err != nil {
+		return err
+	}
+	pager := func(cursor string, limit int) (*services.GetAddrInventoryRsp, error) {
+		return this.TouchstoneServer.GetUserInventorys(request.Appid, request.Userid, request.UserIndex, request.BadgeCode, cursor, limit)
+	}
+	return StreamInventorys(stream.Context(), request.Cursor, ApiPageLimit(request.Limit, API_STREAM_PAGE_LIMIT), pager, stream.Send)
+}
@@ -0,0 +1,111 @@
+package controller
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+
+	"github.com/dotwallet/touchstone/conf"
+	"github.com/dotwallet/touchstone/interceptor"
+	"github.com/dotwallet/touchstone/services"
+)
+
+func IsAdminToken(config *conf.HttpAuthConfig, token string) bool {
+	if config == nil || config.AdminToken == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) == 1
+}
+
+// every caller is admin when auth is not enabled
+type ApiKeyAuthenticator struct {
+	TouchstoneServer *services.TouchstoneServer
+	Config           *conf.HttpAuthConfig
+}
+
+func (this *ApiKeyAuthenticator) Authenticate(req *http.Request) (*interceptor.HttpCaller, error) {
+	return this.AuthenticateToken(interceptor.BearerToken(req))
+}
+
+func (this *ApiKeyAuthenticator) AuthenticateToken(token string) (*interceptor.HttpCaller, error) {
+	if this.Config == nil || !this.Config.Enable {
+		return &interceptor.HttpCaller{Admin: true}, nil
+	}
+	if token == "" {
+		return nil, errors.New("missing bearer token")
+	}
+	if IsAdminToken(this.Config, token) {
+		return &interceptor.HttpCaller{Admin: true}, nil
+	}
+	appid, err := this.TouchstoneServer.VerifyApiKey(token)
+	if err != nil {
+		return nil, err
+	}
+	return &interceptor.HttpCaller{Appid: appid}, nil
+}
+
+// admin endpoints are closed when admin token is not set
+type AdminAuthenticator struct {
+	Config *conf.HttpAuthConfig
+}
+
+func (this *AdminAuthenticator) Authenticate(req *http.Request) (*interceptor.HttpCaller, error) {
+	if !IsAdminToken(this.Config, interceptor.BearerToken(req)) {
+		return nil, errors.New("admin token required")
+	}
+	return &interceptor.HttpCaller{Admin: true}, nil
+}
+
+type CreateApiKeyReq struct {
+	Appid *string `json:"appid"`
+}
+
+func (this *CreateApiKeyReq) NewHttpReqBody() interceptor.HttpReqBody {
+	return &CreateApiKeyReq{}
+}
+
+func (this *HttpController) CreateApiKey(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
+	request := httpReqStruct.(*CreateApiKeyReq)
+	return this.TouchstoneServer.CreateApiKey(*request.Appid)
+}
+
+type RotateApiKeyReq struct {
+	KeyId        *string `json:"key_id"`
+	GraceSeconds int64   `json:"grace_seconds"`
+}
+
+func (this *RotateApiKeyReq) NewHttpReqBody() interceptor.HttpReqBody {
+	return &RotateApiKeyReq{}
+}
+
+func (this *HttpController) RotateApiKey(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
+	request := httpReqStruct.(*RotateApiKeyReq)
+	return this.TouchstoneServer.RotateApiKey(*request.KeyId, request.GraceSeconds)
+}
+
+type RevokeApiKeyReq struct {
+	KeyId *string `json:"key_id"`
+}
+
+func (this *RevokeApiKeyReq) NewHttpReqBody() interceptor.HttpReqBody {
+	return &RevokeApiKeyReq{}
+}
+
+func (this *HttpController) RevokeApiKey(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
+	request := httpReqStruct.(*RevokeApiKeyReq)
+	err := this.TouchstoneServer.RevokeApiKey(*request.KeyId)
+	return nil, err
+}
+
+type GetApiKeysReq struct {
+	Appid *string `json:"appid"`
+}
+
+func (this *GetApiKeysReq) NewHttpReqBody() interceptor.HttpReqBody {
+	return &GetApiKeysReq{}
+}
+
+func (this *HttpController) GetApiKeys(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
+	request := httpReqStruct.(*GetApiKeysReq)
+	return this.TouchstoneServer.GetApiKeys(*request.Appid)
+}
@@ -0,0 +1,170 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dotwallet/touchstone/interceptor"
+	"github.com/dotwallet/touchstone/models"
+	"github.com/dotwallet/touchstone/services"
+	"github.com/dotwallet/touchstone/util"
+	"github.com/golang/glog"
+)
+
+const (
+	EVENT_HEARTBEAT_INTERVAL = 30 * time.Second
+)
+
+// user is userid:user_index:appid
+func ParseEventFilter(req *http.Request, caller *interceptor.HttpCaller) (*services.EventFilter, error) {
+	query := req.URL.Query()
+	users := make([]string, 0, len(query["user"]))
+	for _, user := range query["user"] {
+		fields := strings.SplitN(user, ":", 3)
+		if len(fields) != 3 {
+			return nil, util.NewCodeError(util.ERR_PARAMETERS_CODE, "user should be userid:user_index:appid")
+		}
+		userid, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, util.NewCodeError(util.ERR_PARAMETERS_CODE, err.Error())
+		}
+		userIndex, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, util.NewCodeError(util.ERR_PARAMETERS_CODE, err.Error())
+		}
+		err = interceptor.CheckCallerAppid(caller, fields[2])
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, models.UserKey(fields[2], userid, userIndex))
+	}
+	eventFilter := services.NewEventFilter(query["addr"], query["badge_code"], users)
+	if !caller.Admin {
+		eventFilter.Appid = caller.Appid
+	}
+	if eventFilter.Len() == 0 {
+		return nil, util.NewCodeError(util.ERR_PARAMETERS_CODE, "addr,badge_code or user is required")
+	}
+	if eventFilter.Len() > services.MAX_EVENT_FILTER_ITEMS {
+		errStr := fmt.Sprintf("too many addr,badge_code and user,max %d", services.MAX_EVENT_FILTER_ITEMS)
+		return nil, util.NewCodeError(util.ERR_PARAMETERS_CODE, errStr)
+	}
+	return eventFilter, nil
+}
+
+// resume from Last-Event-ID header or last_seq param
+func ParseLastSeq(req *http.Request) (int64, error) {
+	lastSeqStr := req.Header.Get("Last-Event-ID")
+	if lastSeqStr == "" {
+		lastSeqStr = req.URL.Query().Get("last_seq")
+	}
+	if lastSeqStr == "" {
+		return -1, nil
+	}
+	lastSeq, err := strconv.ParseInt(lastSeqStr, 10, 64)
+	if err != nil {
+		return 0, util.NewCodeError(util.ERR_PARAMETERS_CODE, err.Error())
+	}
+	return lastSeq, nil
+}
+
+func WriteEvent(rsp http.ResponseWriter, flusher http.Flusher, event *models.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(rsp, "id: %d\nevent: %s\ndata: %s\n\n", event.Seq, event.Type, data)
+	if err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
+
+// server-sent events,not wrapped by interceptor.Aspect because the response is a stream
+func (this *HttpController) Subscribe(rsp http.ResponseWriter, req *http.Request) {
+	reqid := util.RandStringBytes(8)
+	glog.Infof("Subscribe %s %s", req.URL.String(), reqid)
+	flusher, ok := rsp.(http.Flusher)
+	if !ok {
+		rsp.Write(interceptor.NewErrHttpJsonResponse(util.HTTP_SERVICE_ERROR_CODE, "streaming not supported"))
+		return
+	}
+	caller, err := this.Authenticator.Authenticate(req)
+	if err != nil {
+		rsp.Write(interceptor.NewErrHttpJsonResponse(util.ERR_UNAUTHORIZED_CODE, err.Error()))
+		return
+	}
+	eventFilter, err := ParseEventFilter(req, caller)
+	if err == nil {
+		err = this.TouchstoneServer.CheckCallerAddrs(caller, eventFilter.Addrs)
+	}
+	if err != nil {
+		codeErr, ok := err.(*util.CodeError)
+		if !ok {
+			rsp.Write(interceptor.NewErrHttpJsonResponse(util.ERR_PARAMETERS_CODE, err.Error()))
+			return
+		}
+		rsp.Write(interceptor.NewErrHttpJsonResponse(codeErr.Code, codeErr.Error()))
+		return
+	}
+	lastSeq, err := ParseLastSeq(req)
+	if err != nil {
+		rsp.Write(interceptor.NewErrHttpJsonResponse(util.ERR_PARAMETERS_CODE, err.Error()))
+		return
+	}
+
+	eventHub := this.TouchstoneServer.EventHub
+	subscriber := eventHub.Subscribe(eventFilter)
+	defer eventHub.Unsubscribe(subscriber)
+
+	rsp.Header().Set("Content-Type", "text/event-stream")
+	rsp.Header().Set("Cache-Control", "no-cache")
+	rsp.Header().Set("Connection", "keep-alive")
+	rsp.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	if lastSeq >= 0 {
+		lastSeq, err = eventHub.Replay(eventFilter, lastSeq, func(event *models.Event) error {
+			return WriteEvent(rsp, flusher, event)
+		})
+		if err != nil {
+			glog.Infof("HttpController.Subscribe Replay %s %s", err, reqid)
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(EVENT_HEARTBEAT_INTERVAL)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-heartbeat.C:
+			_, err := fmt.Fprint(rsp, ": heartbeat\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case event, ok := <-subscriber.Events:
+			if !ok {
+				glog.Infof("HttpController.Subscribe dropped %s", reqid)
+				return
+			}
+			if event.Seq <= lastSeq {
+				// already replayed
+				continue
+			}
+			err := WriteEvent(rsp, flusher, event)
+			if err != nil {
+				glog.Infof("HttpController.Subscribe WriteEvent %s %s", err, reqid)
+				return
+			}
+			lastSeq = event.Seq
+		}
+	}
+}
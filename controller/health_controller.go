@@ -0,0 +1,36 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+type Liveness struct {
+	Ok bool `json:"ok"`
+}
+
+func WriteJson(rsp http.ResponseWriter, status int, data interface{}) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		rsp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rsp.Header().Set("Content-Type", "application/json")
+	rsp.WriteHeader(status)
+	rsp.Write(body)
+}
+
+// the process is able to serve http,dependencies are not checked
+func (this *HttpController) Healthz(rsp http.ResponseWriter, req *http.Request) {
+	WriteJson(rsp, http.StatusOK, &Liveness{Ok: true})
+}
+
+// 503 when any check fails
+func (this *HttpController) Readyz(rsp http.ResponseWriter, req *http.Request) {
+	readiness := this.TouchstoneServer.GetReadiness()
+	status := http.StatusOK
+	if !readiness.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	WriteJson(rsp, status, readiness)
+}
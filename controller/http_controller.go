@@ -4,12 +4,22 @@ import (
 	"net/http"
 
 	"github.com/dotwallet/touchstone/interceptor"
+	"github.com/dotwallet/touchstone/models"
 	"github.com/dotwallet/touchstone/services"
 	"github.com/dotwallet/touchstone/util"
 )
 
 type HttpController struct {
 	TouchstoneServer *services.TouchstoneServer
+	Authenticator    interceptor.HttpAuthenticator
+}
+
+func AddrBadgeCodesAddrs(items []*models.AddrBadgeCode) []string {
+	addrs := make([]string, 0, len(items))
+	for _, item := range items {
+		addrs = append(addrs, item.Addr)
+	}
+	return addrs
 }
 
 type SendRawTransactionReq struct {
@@ -38,23 +48,43 @@ func (this *HttpController) GetTransactionInventory(rsp http.ResponseWriter, req
 	return this.TouchstoneServer.GetTransactionInventory(request.Txid)
 }
 
+// offset paging is replaced by cursor,a non zero offset is rejected instead of returning the first page again
+type OffsetRemoved struct {
+	Offset int `json:"offset"`
+}
+
+func (this *OffsetRemoved) CheckOffset() error {
+	if this.Offset != 0 {
+		return util.NewCodeError(util.ERR_PARAMETERS_CODE, "offset is removed,use cursor")
+	}
+	return nil
+}
+
 type GetAddrUtxosReq struct {
 	Addr      *string `json:"addr"`
 	BadgeCode *string `json:"badge_code"`
-	Offset    int     `json:"offset"`
+	Cursor    string  `json:"cursor"`
 	Limit     int     `json:"limit"`
+	OffsetRemoved
 }
 
 func (this *GetAddrUtxosReq) NewHttpReqBody() interceptor.HttpReqBody {
 	return &GetAddrUtxosReq{
-		Offset: 0,
-		Limit:  10,
+		Limit: 10,
 	}
 }
 
 func (this *HttpController) GetAddrUtxos(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
 	request := httpReqStruct.(*GetAddrUtxosReq)
-	return this.TouchstoneServer.GetAddrUtxos(*request.Addr, *request.BadgeCode, request.Offset, request.Limit)
+	err := request.CheckOffset()
+	if err != nil {
+		return nil, err
+	}
+	err = this.TouchstoneServer.CheckCallerAddrs(interceptor.GetHttpCaller(req), []string{*request.Addr})
+	if err != nil {
+		return nil, err
+	}
+	return this.TouchstoneServer.GetAddrUtxos(*request.Addr, *request.BadgeCode, request.Cursor, request.Limit)
 }
 
 type GetAddrBalanceReq struct {
@@ -68,26 +98,72 @@ func (this *GetAddrBalanceReq) NewHttpReqBody() interceptor.HttpReqBody {
 
 func (this *HttpController) GetAddrBalance(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
 	request := httpReqStruct.(*GetAddrBalanceReq)
+	err := this.TouchstoneServer.CheckCallerAddrs(interceptor.GetHttpCaller(req), []string{*request.Addr})
+	if err != nil {
+		return nil, err
+	}
 	return this.TouchstoneServer.GetAddrBalance(*request.Addr, *request.BadgeCode)
 }
 
+type GetAddrsBalanceReq struct {
+	Items []*models.AddrBadgeCode `json:"items"`
+}
+
+func (this *GetAddrsBalanceReq) NewHttpReqBody() interceptor.HttpReqBody {
+	return &GetAddrsBalanceReq{}
+}
+
+func (this *HttpController) GetAddrsBalance(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
+	request := httpReqStruct.(*GetAddrsBalanceReq)
+	err := this.TouchstoneServer.CheckCallerAddrs(interceptor.GetHttpCaller(req), AddrBadgeCodesAddrs(request.Items))
+	if err != nil {
+		return nil, err
+	}
+	return this.TouchstoneServer.GetAddrsBalance(request.Items)
+}
+
+type GetAddrsUtxosReq struct {
+	Items []*models.AddrBadgeCode `json:"items"`
+}
+
+func (this *GetAddrsUtxosReq) NewHttpReqBody() interceptor.HttpReqBody {
+	return &GetAddrsUtxosReq{}
+}
+
+func (this *HttpController) GetAddrsUtxos(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
+	request := httpReqStruct.(*GetAddrsUtxosReq)
+	err := this.TouchstoneServer.CheckCallerAddrs(interceptor.GetHttpCaller(req), AddrBadgeCodesAddrs(request.Items))
+	if err != nil {
+		return nil, err
+	}
+	return this.TouchstoneServer.GetAddrsUtxos(request.Items)
+}
+
 type GetAddrInventorysReq struct {
 	Addr      *string `json:"addr"`
 	BadgeCode *string `json:"badge_code"`
-	Offset    int     `json:"offset"`
+	Cursor    string  `json:"cursor"`
 	Limit     int     `json:"limit"`
+	OffsetRemoved
 }
 
 func (this *GetAddrInventorysReq) NewHttpReqBody() interceptor.HttpReqBody {
 	return &GetAddrInventorysReq{
-		Offset: 0,
-		Limit:  10,
+		Limit: 10,
 	}
 }
 
 func (this *HttpController) GetAddrInventorys(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
 	request := httpReqStruct.(*GetAddrInventorysReq)
-	return this.TouchstoneServer.GetAddrInventorys(*request.Addr, *request.BadgeCode, request.Offset, request.Limit)
+	err := request.CheckOffset()
+	if err != nil {
+		return nil, err
+	}
+	err = this.TouchstoneServer.CheckCallerAddrs(interceptor.GetHttpCaller(req), []string{*request.Addr})
+	if err != nil {
+		return nil, err
+	}
+	return this.TouchstoneServer.GetAddrInventorys(*request.Addr, *request.BadgeCode, request.Cursor, request.Limit)
 }
 
 type SetAddrInfoReq struct {
@@ -101,31 +177,84 @@ func (this *SetAddrInfoReq) NewHttpReqBody() interceptor.HttpReqBody {
 	return new(SetAddrInfoReq)
 }
 
+func (this *SetAddrInfoReq) GetAppid() string {
+	return *this.Appid
+}
+
 func (this *HttpController) SetAddrInfo(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
 	request := httpReqStruct.(*SetAddrInfoReq)
-	err := this.TouchstoneServer.SetAddrInfo(*request.Appid, *request.UserID, *request.UserIndex, *request.Addr)
+	caller := interceptor.GetHttpCaller(req)
+	err := this.TouchstoneServer.SetAddrInfo(*request.Appid, *request.UserID, *request.UserIndex, *request.Addr, caller.Admin)
 	return nil, err
 }
 
+type SetUserXpubReq struct {
+	Appid     *string `json:"appid"`
+	UserID    *int64  `json:"userid"`
+	UserIndex *int64  `json:"user_index"`
+	Xpub      *string `json:"xpub"`
+	GapLimit  int64   `json:"gap_limit"`
+}
+
+func (this *SetUserXpubReq) NewHttpReqBody() interceptor.HttpReqBody {
+	return new(SetUserXpubReq)
+}
+
+func (this *SetUserXpubReq) GetAppid() string {
+	return *this.Appid
+}
+
+func (this *HttpController) SetUserXpub(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
+	request := httpReqStruct.(*SetUserXpubReq)
+	return this.TouchstoneServer.SetUserXpub(*request.Appid, *request.UserID, *request.UserIndex, *request.Xpub, request.GapLimit)
+}
+
+type GetUserXpubReq struct {
+	Appid     *string `json:"appid"`
+	UserID    *int64  `json:"userid"`
+	UserIndex *int64  `json:"user_index"`
+}
+
+func (this *GetUserXpubReq) NewHttpReqBody() interceptor.HttpReqBody {
+	return new(GetUserXpubReq)
+}
+
+func (this *GetUserXpubReq) GetAppid() string {
+	return *this.Appid
+}
+
+func (this *HttpController) GetUserXpub(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
+	request := httpReqStruct.(*GetUserXpubReq)
+	return this.TouchstoneServer.GetUserXpub(*request.Appid, *request.UserID, *request.UserIndex)
+}
+
 type GetUserUtxosReq struct {
 	Appid     *string `json:"appid"`
 	UserID    *int64  `json:"userid"`
 	UserIndex *int64  `json:"user_index"`
 	BadgeCode *string `json:"badge_code"`
-	Offset    int     `json:"offset"`
+	Cursor    string  `json:"cursor"`
 	Limit     int     `json:"limit"`
+	OffsetRemoved
 }
 
 func (this *GetUserUtxosReq) NewHttpReqBody() interceptor.HttpReqBody {
 	return &GetUserUtxosReq{
-		Offset: 0,
-		Limit:  10,
+		Limit: 10,
 	}
 }
 
+func (this *GetUserUtxosReq) GetAppid() string {
+	return *this.Appid
+}
+
 func (this *HttpController) GetUserUtxos(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
 	request := httpReqStruct.(*GetUserUtxosReq)
-	return this.TouchstoneServer.GetUserUtxos(*request.Appid, *request.UserID, *request.UserIndex, *request.BadgeCode, request.Offset, request.Limit)
+	err := request.CheckOffset()
+	if err != nil {
+		return nil, err
+	}
+	return this.TouchstoneServer.GetUserUtxos(*request.Appid, *request.UserID, *request.UserIndex, *request.BadgeCode, request.Cursor, request.Limit)
 }
 
 type GetUserBalanceReq struct {
@@ -139,6 +268,10 @@ func (this *GetUserBalanceReq) NewHttpReqBody() interceptor.HttpReqBody {
 	return &GetUserBalanceReq{}
 }
 
+func (this *GetUserBalanceReq) GetAppid() string {
+	return *this.Appid
+}
+
 func (this *HttpController) GetUserBalance(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
 	request := httpReqStruct.(*GetUserBalanceReq)
 	return this.TouchstoneServer.GetUserBalance(*request.Appid, *request.UserID, *request.UserIndex, *request.BadgeCode)
@@ -149,20 +282,28 @@ type GetUserInventorysReq struct {
 	UserID    *int64  `json:"userid"`
 	UserIndex *int64  `json:"user_index"`
 	BadgeCode *string `json:"badge_code"`
-	Offset    int     `json:"offset"`
+	Cursor    string  `json:"cursor"`
 	Limit     int     `json:"limit"`
+	OffsetRemoved
 }
 
 func (this *GetUserInventorysReq) NewHttpReqBody() interceptor.HttpReqBody {
 	return &GetUserInventorysReq{
-		Offset: 0,
-		Limit:  10,
+		Limit: 10,
 	}
 }
 
+func (this *GetUserInventorysReq) GetAppid() string {
+	return *this.Appid
+}
+
 func (this *HttpController) GetUserInventorys(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
 	request := httpReqStruct.(*GetUserInventorysReq)
-	return this.TouchstoneServer.GetUserInventorys(*request.Appid, *request.UserID, *request.UserIndex, *request.BadgeCode, request.Offset, request.Limit)
+	err := request.CheckOffset()
+	if err != nil {
+		return nil, err
+	}
+	return this.TouchstoneServer.GetUserInventorys(*request.Appid, *request.UserID, *request.UserIndex, *request.BadgeCode, request.Cursor, request.Limit)
 }
 
 type SendBadgeToAddressReq struct {
@@ -179,6 +320,10 @@ func (this *SendBadgeToAddressReq) NewHttpReqBody() interceptor.HttpReqBody {
 	return &SendBadgeToAddressReq{}
 }
 
+func (this *SendBadgeToAddressReq) GetAppid() string {
+	return *this.Appid
+}
+
 func (this *HttpController) SendBadgeToAddress(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
 	request := httpReqStruct.(*SendBadgeToAddressReq)
 	if request.Amount2Burn < 0 {
@@ -186,3 +331,104 @@ func (this *HttpController) SendBadgeToAddress(rsp http.ResponseWriter, req *htt
 	}
 	return this.TouchstoneServer.SendBadgeToAddress(*request.Appid, *request.UserID, *request.UserIndex, *request.BadgeCode, *request.ChangeAddr, request.AddrAmounts, request.Amount2Burn)
 }
+
+type ConsolidateUserUtxosReq struct {
+	Appid     *string `json:"appid"`
+	UserID    *int64  `json:"userid"`
+	UserIndex *int64  `json:"user_index"`
+	BadgeCode *string `json:"badge_code"`
+	Addr      *string `json:"addr"`
+	MaxVins   int     `json:"max_vins"`
+}
+
+func (this *ConsolidateUserUtxosReq) NewHttpReqBody() interceptor.HttpReqBody {
+	return &ConsolidateUserUtxosReq{
+		MaxVins: 100,
+	}
+}
+
+func (this *ConsolidateUserUtxosReq) GetAppid() string {
+	return *this.Appid
+}
+
+func (this *HttpController) ConsolidateUserUtxos(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
+	request := httpReqStruct.(*ConsolidateUserUtxosReq)
+	return this.TouchstoneServer.ConsolidateUserUtxos(*request.Appid, *request.UserID, *request.UserIndex, *request.BadgeCode, *request.Addr, request.MaxVins)
+}
+
+type GetUserConsolidateTxsReq struct {
+	Appid     *string `json:"appid"`
+	UserID    *int64  `json:"userid"`
+	UserIndex *int64  `json:"user_index"`
+	BadgeCode *string `json:"badge_code"`
+}
+
+func (this *GetUserConsolidateTxsReq) NewHttpReqBody() interceptor.HttpReqBody {
+	return &GetUserConsolidateTxsReq{}
+}
+
+func (this *GetUserConsolidateTxsReq) GetAppid() string {
+	return *this.Appid
+}
+
+func (this *HttpController) GetUserConsolidateTxs(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
+	request := httpReqStruct.(*GetUserConsolidateTxsReq)
+	return this.TouchstoneServer.GetUserConsolidateTxs(*request.Appid, *request.UserID, *request.UserIndex, *request.BadgeCode)
+}
+
+type CreatePayoutBatchReq struct {
+	Appid          *string                `json:"appid"`
+	UserID         *int64                 `json:"userid"`
+	UserIndex      *int64                 `json:"user_index"`
+	BadgeCode      *string                `json:"badge_code"`
+	ChangeAddr     *string                `json:"change_addr"`
+	IdempotencyKey *string                `json:"idempotency_key"`
+	AddrAmounts    []*services.AddrAmount `json:"addr_amounts"`
+	OutputsPerTx   int                    `json:"outputs_per_tx"`
+}
+
+func (this *CreatePayoutBatchReq) NewHttpReqBody() interceptor.HttpReqBody {
+	return &CreatePayoutBatchReq{}
+}
+
+func (this *CreatePayoutBatchReq) GetAppid() string {
+	return *this.Appid
+}
+
+func (this *HttpController) CreatePayoutBatch(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
+	request := httpReqStruct.(*CreatePayoutBatchReq)
+	return this.TouchstoneServer.CreatePayoutBatch(*request.Appid, *request.IdempotencyKey, *request.UserID, *request.UserIndex, *request.BadgeCode, *request.ChangeAddr, request.AddrAmounts, request.OutputsPerTx, reqid)
+}
+
+type GetPayoutBatchReq struct {
+	Appid          *string `json:"appid"`
+	IdempotencyKey *string `json:"idempotency_key"`
+}
+
+func (this *GetPayoutBatchReq) NewHttpReqBody() interceptor.HttpReqBody {
+	return &GetPayoutBatchReq{}
+}
+
+func (this *GetPayoutBatchReq) GetAppid() string {
+	return *this.Appid
+}
+
+func (this *HttpController) GetPayoutBatch(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
+	request := httpReqStruct.(*GetPayoutBatchReq)
+	return this.TouchstoneServer.GetPayoutBatch(*request.Appid, *request.IdempotencyKey, reqid)
+}
+
+type IssueBadgeReq struct {
+	FundingInputs []*services.FundingInput `json:"funding_inputs"`
+	AddrAmounts   []*services.AddrAmount   `json:"addr_amounts"`
+	Metadata      string                   `json:"metadata"`
+}
+
+func (this *IssueBadgeReq) NewHttpReqBody() interceptor.HttpReqBody {
+	return &IssueBadgeReq{}
+}
+
+func (this *HttpController) IssueBadge(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
+	request := httpReqStruct.(*IssueBadgeReq)
+	return this.TouchstoneServer.IssueBadge(request.FundingInputs, request.AddrAmounts, request.Metadata)
+}
@@ -0,0 +1,307 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/dotwallet/touchstone/services"
+	"github.com/dotwallet/touchstone/util"
+)
+
+const (
+	OPENAPI_VERSION = "3.0.3"
+	API_VERSION     = "1.0.0"
+)
+
+type OpenApiSchema map[string]interface{}
+
+type OpenApiBuilder struct {
+	schemas   map[string]OpenApiSchema
+	typeNames map[reflect.Type]string
+}
+
+func NewOpenApiBuilder() *OpenApiBuilder {
+	return &OpenApiBuilder{
+		schemas:   make(map[string]OpenApiSchema),
+		typeNames: make(map[reflect.Type]string),
+	}
+}
+
+// json name of a field,empty if it is not in json
+func JsonFieldName(field reflect.StructField) string {
+	if field.PkgPath != "" {
+		return ""
+	}
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return ""
+	}
+	name := strings.Split(tag, ",")[0]
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+func (this *OpenApiBuilder) TypeName(t reflect.Type) string {
+	name, ok := this.typeNames[t]
+	if ok {
+		return name
+	}
+	name = t.Name()
+	for _, usedName := range this.typeNames {
+		if usedName == name {
+			pkgPath := strings.Split(t.PkgPath(), "/")
+			name = pkgPath[len(pkgPath)-1] + "." + name
+			break
+		}
+	}
+	this.typeNames[t] = name
+	return name
+}
+
+// request structs are inlined and their pointer fields are required,
+// response structs are refs to components
+func (this *OpenApiBuilder) Schema(t reflect.Type, request bool) OpenApiSchema {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return this.Schema(t.Elem(), request)
+	case reflect.Bool:
+		return OpenApiSchema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return OpenApiSchema{"type": "integer", "format": "int32"}
+	case reflect.Int64, reflect.Uint, reflect.Uint64:
+		return OpenApiSchema{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return OpenApiSchema{"type": "number"}
+	case reflect.String:
+		return OpenApiSchema{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return OpenApiSchema{"type": "string", "format": "byte"}
+		}
+		return OpenApiSchema{"type": "array", "items": this.Schema(t.Elem(), request)}
+	case reflect.Map:
+		return OpenApiSchema{"type": "object", "additionalProperties": this.Schema(t.Elem(), request)}
+	case reflect.Struct:
+		if request {
+			return this.StructSchema(t, request)
+		}
+		name := this.TypeName(t)
+		_, ok := this.schemas[name]
+		if !ok {
+			// placeholder for recursive types
+			this.schemas[name] = OpenApiSchema{}
+			this.schemas[name] = this.StructSchema(t, request)
+		}
+		return OpenApiSchema{"$ref": "#/components/schemas/" + name}
+	}
+	return OpenApiSchema{}
+}
+
+func (this *OpenApiBuilder) StructSchema(t reflect.Type, request bool) OpenApiSchema {
+	properties := make(map[string]interface{})
+	required := make([]string, 0, 4)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		embeddedType := field.Type
+		if embeddedType.Kind() == reflect.Ptr {
+			embeddedType = embeddedType.Elem()
+		}
+		if field.Anonymous && embeddedType.Kind() == reflect.Struct {
+			embedded := this.StructSchema(embeddedType, request)
+			for name, property := range embedded["properties"].(map[string]interface{}) {
+				properties[name] = property
+			}
+			continue
+		}
+		name := JsonFieldName(field)
+		if name == "" {
+			continue
+		}
+		properties[name] = this.Schema(field.Type, request)
+		if request && field.Type.Kind() == reflect.Ptr {
+			required = append(required, name)
+		}
+	}
+	schema := OpenApiSchema{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) != 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func ErrorCodeSchema() OpenApiSchema {
+	codes := make([]int, 0, len(util.ERROR_CODE_DESCRIBES))
+	for code := range util.ERROR_CODE_DESCRIBES {
+		codes = append(codes, code)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(codes)))
+	describes := make([]string, 0, len(codes))
+	for _, code := range codes {
+		describes = append(describes, fmt.Sprintf("%d: %s", code, util.ERROR_CODE_DESCRIBES[code]))
+	}
+	return OpenApiSchema{
+		"type":        "integer",
+		"enum":        codes,
+		"description": strings.Join(describes, "\n"),
+	}
+}
+
+func (this *OpenApiBuilder) RspSchema(rsp interface{}) OpenApiSchema {
+	data := OpenApiSchema{"nullable": true}
+	if rsp != nil {
+		data = this.Schema(reflect.TypeOf(rsp), false)
+	}
+	return OpenApiSchema{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"code": OpenApiSchema{"$ref": "#/components/schemas/ErrorCode"},
+			"msg":  OpenApiSchema{"type": "string"},
+			"data": data,
+		},
+	}
+}
+
+func (this *OpenApiBuilder) Operation(route *HttpRoute) OpenApiSchema {
+	tag := "user"
+	security := []map[string][]string{{"apiKey": {}}}
+	if route.Admin {
+		tag = "admin"
+		security = []map[string][]string{{"adminToken": {}}}
+	}
+	return OpenApiSchema{
+		"operationId": strings.Replace(strings.TrimPrefix(route.Path, HTTP_PATH_PREFIX), "/", "_", -1),
+		"tags":        []string{tag},
+		"security":    security,
+		"requestBody": OpenApiSchema{
+			"required": true,
+			"content": map[string]interface{}{
+				"application/json": OpenApiSchema{"schema": this.Schema(reflect.TypeOf(route.Req), true)},
+			},
+		},
+		"responses": map[string]interface{}{
+			"200": OpenApiSchema{
+				"description": "code is 0 on success,or one of ErrorCode with msg",
+				"content": map[string]interface{}{
+					"application/json": OpenApiSchema{"schema": this.RspSchema(route.Rsp)},
+				},
+			},
+		},
+	}
+}
+
+func SubscribeOperation() OpenApiSchema {
+	parameters := make([]OpenApiSchema, 0, 4)
+	for _, name := range []string{"addr", "badge_code", "user"} {
+		parameters = append(parameters, OpenApiSchema{
+			"name":     name,
+			"in":       "query",
+			"required": false,
+			"style":    "form",
+			"explode":  true,
+			"schema":   OpenApiSchema{"type": "array", "items": OpenApiSchema{"type": "string"}},
+		})
+	}
+	parameters = append(parameters,
+		OpenApiSchema{"name": "last_seq", "in": "query", "required": false, "schema": OpenApiSchema{"type": "integer", "format": "int64"}},
+		OpenApiSchema{"name": "Last-Event-ID", "in": "header", "required": false, "schema": OpenApiSchema{"type": "integer", "format": "int64"}},
+	)
+	return OpenApiSchema{
+		"operationId": "subscribe",
+		"tags":        []string{"user"},
+		"security":    []map[string][]string{{"apiKey": {}}},
+		"description": "server-sent events,user is userid:user_index:appid",
+		"parameters":  parameters,
+		"responses": map[string]interface{}{
+			"200": OpenApiSchema{
+				"description": "event stream",
+				"content": map[string]interface{}{
+					"text/event-stream": OpenApiSchema{"schema": OpenApiSchema{"type": "string"}},
+				},
+			},
+		},
+	}
+}
+
+// get without envelope and authentication
+func RawGetOperation(operationId string, tag string, describe string, contentType string, schema OpenApiSchema) OpenApiSchema {
+	return OpenApiSchema{
+		"operationId": operationId,
+		"tags":        []string{tag},
+		"security":    []map[string][]string{},
+		"responses": map[string]interface{}{
+			"200": OpenApiSchema{
+				"description": describe,
+				"content": map[string]interface{}{
+					contentType: OpenApiSchema{"schema": schema},
+				},
+			},
+		},
+	}
+}
+
+func BuildOpenApi(routes []*HttpRoute) OpenApiSchema {
+	builder := NewOpenApiBuilder()
+	paths := make(map[string]interface{})
+	for _, route := range routes {
+		paths[route.Path] = OpenApiSchema{
+			"post": builder.Operation(route),
+		}
+	}
+	paths[SUBSCRIBE_PATH] = OpenApiSchema{
+		"get": SubscribeOperation(),
+	}
+	paths[OPENAPI_PATH] = OpenApiSchema{
+		"get": RawGetOperation("openapi", "doc", "this document", "application/json", OpenApiSchema{"type": "object"}),
+	}
+	paths[METRICS_PATH] = OpenApiSchema{
+		"get": RawGetOperation("metrics", "ops", "prometheus text format", "text/plain", OpenApiSchema{"type": "string"}),
+	}
+	paths[HEALTHZ_PATH] = OpenApiSchema{
+		"get": RawGetOperation("healthz", "ops", "the process is alive", "application/json", builder.Schema(reflect.TypeOf(&Liveness{}), false)),
+	}
+	readyz := RawGetOperation("readyz", "ops", "every check is ok", "application/json", builder.Schema(reflect.TypeOf(&services.Readiness{}), false))
+	readyz["responses"].(map[string]interface{})["503"] = OpenApiSchema{
+		"description": "some check failed",
+		"content": map[string]interface{}{
+			"application/json": OpenApiSchema{"schema": builder.Schema(reflect.TypeOf(&services.Readiness{}), false)},
+		},
+	}
+	paths[READYZ_PATH] = OpenApiSchema{
+		"get": readyz,
+	}
+	builder.schemas["ErrorCode"] = ErrorCodeSchema()
+	return OpenApiSchema{
+		"openapi": OPENAPI_VERSION,
+		"info": OpenApiSchema{
+			"title":   "touchstone",
+			"version": API_VERSION,
+		},
+		"paths": paths,
+		"components": OpenApiSchema{
+			"schemas": builder.schemas,
+			"securitySchemes": OpenApiSchema{
+				"apiKey":     OpenApiSchema{"type": "http", "scheme": "bearer", "description": "<key_id>.<secret>,not needed when auth is disabled"},
+				"adminToken": OpenApiSchema{"type": "http", "scheme": "bearer", "description": "admin token in config"},
+			},
+		},
+	}
+}
+
+func (this *HttpController) OpenApi(rsp http.ResponseWriter, req *http.Request) {
+	spec, err := json.Marshal(BuildOpenApi(this.HttpRoutes()))
+	if err != nil {
+		rsp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rsp.Header().Set("Content-Type", "application/json")
+	rsp.Write(spec)
+}
@@ -0,0 +1,56 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/dotwallet/touchstone/conf"
+	"github.com/gorilla/mux"
+)
+
+func TestOpenApiCoversRoutes(t *testing.T) {
+	httpController := &HttpController{}
+	r := NewHttpRouter(httpController, &conf.HttpAuthConfig{})
+	rsp := httptest.NewRecorder()
+	r.ServeHTTP(rsp, httptest.NewRequest(http.MethodGet, OPENAPI_PATH, nil))
+	if rsp.Code != http.StatusOK {
+		t.Fatalf("get openapi status %d", rsp.Code)
+	}
+	spec := struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}{}
+	err := json.Unmarshal(rsp.Body.Bytes(), &spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	err = r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		count++
+		if _, ok := spec.Paths[path]; !ok {
+			t.Errorf("route %s is missing from openapi spec", path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(spec.Paths) {
+		t.Errorf("router has %d routes but spec has %d paths", count, len(spec.Paths))
+	}
+}
+
+func TestOpenApiRequestRequired(t *testing.T) {
+	builder := NewOpenApiBuilder()
+	schema := builder.Schema(reflect.TypeOf(&GetAddrUtxosReq{}), true)
+	required, _ := schema["required"].([]string)
+	if len(required) != 2 || required[0] != "addr" || required[1] != "badge_code" {
+		t.Fatalf("required %v", required)
+	}
+}
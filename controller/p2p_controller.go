@@ -48,6 +48,30 @@ func (this *P2pController) GetUnconfirmTxids(context context.Context, request *m
 	return this.TouchstoneServer.GetUnconfirmTxids(request)
 }
 
+func (this *P2pController) ExchangePeers(content context.Context, request *message.ExchangePeersRequest) (*message.ExchangePeersResponse, error) {
+	pubkey, err := GetPeerPubkey(content)
+	if err != nil {
+		return nil, err
+	}
+	return this.TouchstoneServer.ExchangePeers(pubkey, request, util.RandStringBytes(8))
+}
+
+func (this *P2pController) Hello(content context.Context, request *message.HelloRequest) (*message.HelloResponse, error) {
+	pubkey, err := GetPeerPubkey(content)
+	if err != nil {
+		return nil, err
+	}
+	return this.TouchstoneServer.Hello(pubkey, request, util.RandStringBytes(8)), nil
+}
+
+func (this *P2pController) GetSnapshotManifest(context context.Context, request *message.GetSnapshotManifestRequest) (*message.SnapshotManifest, error) {
+	return this.TouchstoneServer.GetSnapshotManifest(request)
+}
+
+func (this *P2pController) GetSnapshotChunk(context context.Context, request *message.GetSnapshotChunkRequest) (*message.SnapshotChunk, error) {
+	return this.TouchstoneServer.GetSnapshotChunk(request)
+}
+
 func (this *P2pController) GetTxidsByPartitions(context context.Context, request *message.GetTxidsByPartitionsRequest) (*message.GetTxidsResponse, error) {
 	return this.TouchstoneServer.GetPartitionsTxids(request)
 }
@@ -0,0 +1,335 @@
+package controller
+
+import (
+	"net/http"
+
+	"github.com/dotwallet/touchstone/conf"
+	"github.com/dotwallet/touchstone/interceptor"
+	"github.com/dotwallet/touchstone/models"
+	"github.com/dotwallet/touchstone/services"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	HTTP_PATH_PREFIX = "/v1/touchstone/"
+	SUBSCRIBE_PATH   = HTTP_PATH_PREFIX + "subscribe"
+	OPENAPI_PATH     = HTTP_PATH_PREFIX + "openapi.json"
+	METRICS_PATH     = "/metrics"
+	HEALTHZ_PATH     = "/healthz"
+	READYZ_PATH      = "/readyz"
+)
+
+// Rsp is a typed nil of data in rsp,nil if data is always null
+type HttpRoute struct {
+	Path       string
+	Admin      bool
+	HandleFunc func(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error)
+	Req        interceptor.HttpReqBody
+	Rsp        interface{}
+}
+
+// every json api,openapi spec is generated from them
+func (this *HttpController) HttpRoutes() []*HttpRoute {
+	return []*HttpRoute{
+		{
+			Path:       HTTP_PATH_PREFIX + "sendrawtransaction",
+			HandleFunc: this.SendRawTransaction,
+			Req:        &SendRawTransactionReq{},
+			Rsp:        (*services.TxInventory)(nil),
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "gettxinventory",
+			HandleFunc: this.GetTransactionInventory,
+			Req:        &GetTransactionInventoryReq{},
+			Rsp:        (*services.TxInventory)(nil),
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "getaddrutxos",
+			HandleFunc: this.GetAddrUtxos,
+			Req:        &GetAddrUtxosReq{},
+			Rsp:        (*services.GetUtxosResult)(nil),
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "getaddrbalance",
+			HandleFunc: this.GetAddrBalance,
+			Req:        &GetAddrBalanceReq{},
+			Rsp:        (*services.GetBalanceRsp)(nil),
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "getaddrsbalance",
+			HandleFunc: this.GetAddrsBalance,
+			Req:        &GetAddrsBalanceReq{},
+			Rsp:        []*services.AddrBalanceItem(nil),
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "getaddrsutxos",
+			HandleFunc: this.GetAddrsUtxos,
+			Req:        &GetAddrsUtxosReq{},
+			Rsp:        []*services.AddrUtxosItem(nil),
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "getaddrinventorys",
+			HandleFunc: this.GetAddrInventorys,
+			Req:        &GetAddrInventorysReq{},
+			Rsp:        (*services.GetAddrInventoryRsp)(nil),
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "setaddrinfo",
+			HandleFunc: this.SetAddrInfo,
+			Req:        &SetAddrInfoReq{},
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "setuserxpub",
+			HandleFunc: this.SetUserXpub,
+			Req:        &SetUserXpubReq{},
+			Rsp:        (*models.XpubInfo)(nil),
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "getuserxpub",
+			HandleFunc: this.GetUserXpub,
+			Req:        &GetUserXpubReq{},
+			Rsp:        (*models.XpubInfo)(nil),
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "getuserutxos",
+			HandleFunc: this.GetUserUtxos,
+			Req:        &GetUserUtxosReq{},
+			Rsp:        (*services.GetUtxosResult)(nil),
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "getuserbalance",
+			HandleFunc: this.GetUserBalance,
+			Req:        &GetUserBalanceReq{},
+			Rsp:        (*services.GetBalanceRsp)(nil),
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "getuserinventorys",
+			HandleFunc: this.GetUserInventorys,
+			Req:        &GetUserInventorysReq{},
+			Rsp:        (*services.GetAddrInventoryRsp)(nil),
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "sendbadgetoaddress",
+			HandleFunc: this.SendBadgeToAddress,
+			Req:        &SendBadgeToAddressReq{},
+			Rsp:        (*services.SendBadgeToAddressRsp)(nil),
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "consolidateuserutxos",
+			HandleFunc: this.ConsolidateUserUtxos,
+			Req:        &ConsolidateUserUtxosReq{},
+			Rsp:        (*services.ConsolidateUtxosRsp)(nil),
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "getuserconsolidatetxs",
+			HandleFunc: this.GetUserConsolidateTxs,
+			Req:        &GetUserConsolidateTxsReq{},
+			Rsp:        (*services.GetUserConsolidateTxsRsp)(nil),
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "createpayoutbatch",
+			HandleFunc: this.CreatePayoutBatch,
+			Req:        &CreatePayoutBatchReq{},
+			Rsp:        (*models.PayoutBatch)(nil),
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "getpayoutbatch",
+			HandleFunc: this.GetPayoutBatch,
+			Req:        &GetPayoutBatchReq{},
+			Rsp:        (*models.PayoutBatch)(nil),
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "issuebadge",
+			HandleFunc: this.IssueBadge,
+			Req:        &IssueBadgeReq{},
+			Rsp:        (*services.IssueBadgeRsp)(nil),
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "setwebhook",
+			HandleFunc: this.SetWebhook,
+			Req:        &SetWebhookReq{},
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "removewebhook",
+			HandleFunc: this.RemoveWebhook,
+			Req:        &RemoveWebhookReq{},
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "getwebhooks",
+			HandleFunc: this.GetWebhooks,
+			Req:        &GetWebhooksReq{},
+			Rsp:        []*models.Webhook(nil),
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "getwebhookdeliveries",
+			HandleFunc: this.GetWebhookDeliveries,
+			Req:        &GetWebhookDeliveriesReq{},
+			Rsp:        []*models.WebhookDelivery(nil),
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "replaywebhookdeliveries",
+			HandleFunc: this.ReplayWebhookDeliveries,
+			Req:        &ReplayWebhookDeliveriesReq{},
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "admin/createapikey",
+			Admin:      true,
+			HandleFunc: this.CreateApiKey,
+			Req:        &CreateApiKeyReq{},
+			Rsp:        (*services.ApiKeyRsp)(nil),
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "admin/rotateapikey",
+			Admin:      true,
+			HandleFunc: this.RotateApiKey,
+			Req:        &RotateApiKeyReq{},
+			Rsp:        (*services.ApiKeyRsp)(nil),
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "admin/revokeapikey",
+			Admin:      true,
+			HandleFunc: this.RevokeApiKey,
+			Req:        &RevokeApiKeyReq{},
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "admin/getapikeys",
+			Admin:      true,
+			HandleFunc: this.GetApiKeys,
+			Req:        &GetApiKeysReq{},
+			Rsp:        []*models.ApiKey(nil),
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "admin/syncstate",
+			Admin:      true,
+			HandleFunc: this.AdminSyncState,
+			Req:        &AdminSyncStateReq{},
+			Rsp:        (*services.Job)(nil),
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "admin/syncpartitions",
+			Admin:      true,
+			HandleFunc: this.AdminSyncPartitions,
+			Req:        &AdminSyncPartitionsReq{},
+			Rsp:        (*services.Job)(nil),
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "admin/recomputepartitionhashes",
+			Admin:      true,
+			HandleFunc: this.AdminRecomputePartitionHashes,
+			Req:        &AdminRecomputePartitionHashesReq{},
+			Rsp:        (*services.Job)(nil),
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "admin/reprocesstx",
+			Admin:      true,
+			HandleFunc: this.AdminReprocessTx,
+			Req:        &AdminReprocessTxReq{},
+			Rsp:        (*services.Job)(nil),
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "admin/cleartx",
+			Admin:      true,
+			HandleFunc: this.AdminClearTx,
+			Req:        &AdminClearTxReq{},
+			Rsp:        (*services.Job)(nil),
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "admin/setspent",
+			Admin:      true,
+			HandleFunc: this.AdminSetSpent,
+			Req:        &AdminSetSpentReq{},
+			Rsp:        (*services.Job)(nil),
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "admin/bootstrapsnapshot",
+			Admin:      true,
+			HandleFunc: this.AdminBootstrapSnapshot,
+			Req:        &AdminBootstrapSnapshotReq{},
+			Rsp:        (*services.Job)(nil),
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "admin/getjob",
+			Admin:      true,
+			HandleFunc: this.AdminGetJob,
+			Req:        &AdminGetJobReq{},
+			Rsp:        (*services.Job)(nil),
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "admin/getjobs",
+			Admin:      true,
+			HandleFunc: this.AdminGetJobs,
+			Req:        &AdminGetJobsReq{},
+			Rsp:        []*services.Job(nil),
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "admin/getpeers",
+			Admin:      true,
+			HandleFunc: this.AdminGetPeers,
+			Req:        &AdminGetPeersReq{},
+			Rsp:        []*services.PeerStatus(nil),
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "admin/reloadpeers",
+			Admin:      true,
+			HandleFunc: this.AdminReloadPeers,
+			Req:        &AdminReloadPeersReq{},
+			Rsp:        []*services.PeerStatus(nil),
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "admin/unbanpeer",
+			Admin:      true,
+			HandleFunc: this.AdminUnbanPeer,
+			Req:        &AdminUnbanPeerReq{},
+			Rsp:        []*services.PeerStatus(nil),
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "admin/getnodes",
+			Admin:      true,
+			HandleFunc: this.AdminGetNodes,
+			Req:        &AdminGetNodesReq{},
+			Rsp:        []*services.KnownNode(nil),
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "admin/pauseloop",
+			Admin:      true,
+			HandleFunc: this.AdminPauseLoop,
+			Req:        &AdminPauseLoopReq{},
+			Rsp:        []*services.LoopStatus(nil),
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "admin/resumeloop",
+			Admin:      true,
+			HandleFunc: this.AdminResumeLoop,
+			Req:        &AdminResumeLoopReq{},
+			Rsp:        []*services.LoopStatus(nil),
+		},
+		{
+			Path:       HTTP_PATH_PREFIX + "admin/getloops",
+			Admin:      true,
+			HandleFunc: this.AdminGetLoops,
+			Req:        &AdminGetLoopsReq{},
+			Rsp:        []*services.LoopStatus(nil),
+		},
+	}
+}
+
+func NewHttpRouter(httpController *HttpController, httpAuthConfig *conf.HttpAuthConfig) *mux.Router {
+	adminAuthenticator := &AdminAuthenticator{
+		Config: httpAuthConfig,
+	}
+	r := mux.NewRouter()
+	for _, route := range httpController.HttpRoutes() {
+		var authenticator interceptor.HttpAuthenticator = httpController.Authenticator
+		if route.Admin {
+			authenticator = adminAuthenticator
+		}
+		r.HandleFunc(route.Path, interceptor.Aspect(authenticator, route.HandleFunc, route.Req))
+	}
+	r.HandleFunc(SUBSCRIBE_PATH, httpController.Subscribe).Methods(http.MethodGet)
+	r.HandleFunc(OPENAPI_PATH, httpController.OpenApi).Methods(http.MethodGet)
+	r.Handle(METRICS_PATH, promhttp.Handler()).Methods(http.MethodGet)
+	r.HandleFunc(HEALTHZ_PATH, httpController.Healthz).Methods(http.MethodGet)
+	r.HandleFunc(READYZ_PATH, httpController.Readyz).Methods(http.MethodGet)
+	return r
+}
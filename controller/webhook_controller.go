@@ -0,0 +1,107 @@
+package controller
+
+import (
+	"net/http"
+
+	"github.com/dotwallet/touchstone/interceptor"
+	"github.com/dotwallet/touchstone/models"
+)
+
+type SetWebhookReq struct {
+	Appid      *string  `json:"appid"`
+	Url        *string  `json:"url"`
+	EventTypes []string `json:"event_types"`
+}
+
+func (this *SetWebhookReq) NewHttpReqBody() interceptor.HttpReqBody {
+	return &SetWebhookReq{}
+}
+
+func (this *SetWebhookReq) GetAppid() string {
+	return *this.Appid
+}
+
+func (this *HttpController) SetWebhook(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
+	request := httpReqStruct.(*SetWebhookReq)
+	err := this.TouchstoneServer.SetWebhook(*request.Appid, *request.Url, request.EventTypes)
+	return nil, err
+}
+
+type RemoveWebhookReq struct {
+	Appid *string `json:"appid"`
+	Url   *string `json:"url"`
+}
+
+func (this *RemoveWebhookReq) NewHttpReqBody() interceptor.HttpReqBody {
+	return &RemoveWebhookReq{}
+}
+
+func (this *RemoveWebhookReq) GetAppid() string {
+	return *this.Appid
+}
+
+func (this *HttpController) RemoveWebhook(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
+	request := httpReqStruct.(*RemoveWebhookReq)
+	err := this.TouchstoneServer.RemoveWebhook(*request.Appid, *request.Url)
+	return nil, err
+}
+
+type GetWebhooksReq struct {
+	Appid *string `json:"appid"`
+}
+
+func (this *GetWebhooksReq) NewHttpReqBody() interceptor.HttpReqBody {
+	return &GetWebhooksReq{}
+}
+
+func (this *GetWebhooksReq) GetAppid() string {
+	return *this.Appid
+}
+
+func (this *HttpController) GetWebhooks(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
+	request := httpReqStruct.(*GetWebhooksReq)
+	return this.TouchstoneServer.GetWebhooks(*request.Appid)
+}
+
+type GetWebhookDeliveriesReq struct {
+	Appid  *string `json:"appid"`
+	State  int     `json:"state"`
+	Offset int     `json:"offset"`
+	Limit  int     `json:"limit"`
+}
+
+func (this *GetWebhookDeliveriesReq) NewHttpReqBody() interceptor.HttpReqBody {
+	return &GetWebhookDeliveriesReq{
+		State:  models.WEBHOOK_DELIVERY_STATE_ALL,
+		Offset: 0,
+		Limit:  10,
+	}
+}
+
+func (this *GetWebhookDeliveriesReq) GetAppid() string {
+	return *this.Appid
+}
+
+func (this *HttpController) GetWebhookDeliveries(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
+	request := httpReqStruct.(*GetWebhookDeliveriesReq)
+	return this.TouchstoneServer.GetWebhookDeliveries(*request.Appid, request.State, request.Offset, request.Limit)
+}
+
+type ReplayWebhookDeliveriesReq struct {
+	Appid       *string  `json:"appid"`
+	DeliveryIds []string `json:"delivery_ids"`
+}
+
+func (this *ReplayWebhookDeliveriesReq) NewHttpReqBody() interceptor.HttpReqBody {
+	return &ReplayWebhookDeliveriesReq{}
+}
+
+func (this *ReplayWebhookDeliveriesReq) GetAppid() string {
+	return *this.Appid
+}
+
+func (this *HttpController) ReplayWebhookDeliveries(rsp http.ResponseWriter, req *http.Request, httpReqStruct interceptor.HttpReqBody, reqid string) (interface{}, error) {
+	request := httpReqStruct.(*ReplayWebhookDeliveriesReq)
+	err := this.TouchstoneServer.ReplayWebhookDeliveries(*request.Appid, request.DeliveryIds)
+	return nil, err
+}
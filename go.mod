@@ -8,6 +8,7 @@ require (
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
 	github.com/golang/protobuf v1.4.3
 	github.com/gorilla/mux v1.8.0
+	github.com/prometheus/client_golang v1.9.0
 	github.com/tyler-smith/go-bip39 v1.1.0
 	google.golang.org/grpc v1.27.0
 	google.golang.org/protobuf v1.25.0
@@ -0,0 +1,118 @@
+package interceptor
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dotwallet/touchstone/metrics"
+	"github.com/dotwallet/touchstone/util"
+	"github.com/golang/glog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	KEY_AUTHORIZATION   = "authorization"
+	KEY_TOUCHSTONE_CODE = "touchstone-code"
+)
+
+// for grpc api,token is the same as the bearer token of http api
+type TokenAuthenticator interface {
+	AuthenticateToken(token string) (*HttpCaller, error)
+}
+
+// authorization: Bearer <token>
+func MetadataBearerToken(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	authorizations := md.Get(KEY_AUTHORIZATION)
+	if len(authorizations) == 0 || !strings.HasPrefix(authorizations[0], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(authorizations[0][len("Bearer "):])
+}
+
+var grpcCodes = map[int]codes.Code{
+	util.HTTP_WRONG_FORMAT_ERROR_CODE: codes.InvalidArgument,
+	util.ERR_UNKNOW_UTXO_CODE:         codes.NotFound,
+	util.ERR_UNKNOW_TX_CODE:           codes.NotFound,
+	util.ERR_ILLEGAL_VIN_CODE:         codes.InvalidArgument,
+	util.ERR_PARAMETERS_CODE:          codes.InvalidArgument,
+	util.ERR_NOT_ENOUGH_BADGE_CODE:    codes.FailedPrecondition,
+	util.ERR_NOT_USER_ADDR_CODE:       codes.InvalidArgument,
+	util.ERR_UNAUTHORIZED_CODE:        codes.Unauthenticated,
+	util.ERR_FORBIDDEN_CODE:           codes.PermissionDenied,
+}
+
+// code of util.CodeError is also sent in trailer
+func GrpcError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	code := util.HTTP_SERVICE_ERROR_CODE
+	codeErr, ok := err.(*util.CodeError)
+	if ok {
+		code = codeErr.Code
+	}
+	grpc.SetTrailer(ctx, metadata.Pairs(KEY_TOUCHSTONE_CODE, strconv.Itoa(code)))
+	grpcCode, ok := grpcCodes[code]
+	if !ok {
+		grpcCode = codes.Internal
+	}
+	return status.Error(grpcCode, err.Error())
+}
+
+type ApiAuthInterceptor struct {
+	Authenticator TokenAuthenticator
+}
+
+func (this *ApiAuthInterceptor) Authenticate(ctx context.Context, method string) (context.Context, error) {
+	caller, err := this.Authenticator.AuthenticateToken(MetadataBearerToken(ctx))
+	if err != nil {
+		glog.Infof("ApiAuthInterceptor %s Authenticate %s", method, err)
+		return nil, GrpcError(ctx, util.NewCodeError(util.ERR_UNAUTHORIZED_CODE, err.Error()))
+	}
+	return WithCaller(ctx, caller), nil
+}
+
+func (this *ApiAuthInterceptor) Intercept(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := this.Authenticate(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	rsp, err := handler(ctx, req)
+	err = GrpcError(ctx, err)
+	metrics.ObserveGrpcApi(info.FullMethod, err, start)
+	return rsp, err
+}
+
+type callerServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (this *callerServerStream) Context() context.Context {
+	return this.ctx
+}
+
+func (this *ApiAuthInterceptor) StreamIntercept(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := this.Authenticate(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = handler(srv, &callerServerStream{ServerStream: ss, ctx: ctx})
+	err = GrpcError(ctx, err)
+	metrics.ObserveGrpcApi(info.FullMethod, err, start)
+	return err
+}
@@ -0,0 +1,68 @@
+package interceptor
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/dotwallet/touchstone/util"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type testTokenAuthenticator struct{}
+
+func (this *testTokenAuthenticator) AuthenticateToken(token string) (*HttpCaller, error) {
+	if token == "app1" {
+		return &HttpCaller{Appid: "app1"}, nil
+	}
+	return nil, errors.New("wrong token")
+}
+
+func testApiCall(token string, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx := context.Background()
+	if token != "" {
+		ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(KEY_AUTHORIZATION, "Bearer "+token))
+	}
+	authInterceptor := &ApiAuthInterceptor{Authenticator: &testTokenAuthenticator{}}
+	return authInterceptor.Intercept(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/Touchstone/Test"}, handler)
+}
+
+func TestApiAuthInterceptor(t *testing.T) {
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return GetCaller(ctx).Appid, CheckCallerAppid(GetCaller(ctx), "app2")
+	}
+	_, err := testApiCall("", handler)
+	if status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("no token %v", err)
+	}
+	_, err = testApiCall("app1", handler)
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("other appid %v", err)
+	}
+	rsp, err := testApiCall("app1", func(ctx context.Context, req interface{}) (interface{}, error) {
+		return GetCaller(ctx).Appid, nil
+	})
+	if err != nil || rsp != "app1" {
+		t.Fatalf("rsp %v err %v", rsp, err)
+	}
+}
+
+func TestGrpcError(t *testing.T) {
+	ctx := context.Background()
+	cases := map[error]codes.Code{
+		util.NewCodeError(util.ERR_PARAMETERS_CODE, "bad"):    codes.InvalidArgument,
+		util.NewCodeError(util.ERR_UNKNOW_TX_CODE, "unknown"): codes.NotFound,
+		errors.New("db down"):                                 codes.Internal,
+	}
+	for err, code := range cases {
+		if status.Code(GrpcError(ctx, err)) != code {
+			t.Errorf("%v should be %s", err, code)
+		}
+	}
+	if GrpcError(ctx, nil) != nil {
+		t.Errorf("nil error")
+	}
+}
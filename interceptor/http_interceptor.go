@@ -1,11 +1,15 @@
 package interceptor
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"reflect"
+	"strings"
+	"time"
 
+	"github.com/dotwallet/touchstone/metrics"
 	"github.com/dotwallet/touchstone/util"
 	"github.com/golang/glog"
 )
@@ -14,6 +18,54 @@ type HttpReqBody interface {
 	NewHttpReqBody() HttpReqBody
 }
 
+// request bodies of user level endpoints,caller can only touch its own appid
+type AppidHttpReqBody interface {
+	GetAppid() string
+}
+
+type HttpCaller struct {
+	Appid string
+	Admin bool
+}
+
+type HttpAuthenticator interface {
+	Authenticate(req *http.Request) (*HttpCaller, error)
+}
+
+// Authorization: Bearer <token>
+func BearerToken(req *http.Request) string {
+	authorization := req.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(authorization[len("Bearer "):])
+}
+
+type httpCallerKey struct{}
+
+func WithCaller(ctx context.Context, caller *HttpCaller) context.Context {
+	return context.WithValue(ctx, httpCallerKey{}, caller)
+}
+
+func GetCaller(ctx context.Context) *HttpCaller {
+	caller, ok := ctx.Value(httpCallerKey{}).(*HttpCaller)
+	if !ok {
+		return &HttpCaller{}
+	}
+	return caller
+}
+
+func GetHttpCaller(req *http.Request) *HttpCaller {
+	return GetCaller(req.Context())
+}
+
+func CheckCallerAppid(caller *HttpCaller, appid string) error {
+	if caller.Admin || caller.Appid == appid {
+		return nil
+	}
+	return util.NewCodeError(util.ERR_FORBIDDEN_CODE, "appid not allowed by the credential")
+}
+
 type HttpJsonResponse struct {
 	Code int         `json:"code"`
 	Msg  string      `json:"msg"`
@@ -74,14 +126,29 @@ func CheckNil(inter interface{}) error {
 }
 
 func Aspect(
+	authenticator HttpAuthenticator,
 	handleFunc func(rsp http.ResponseWriter, req *http.Request, httpReqStruct HttpReqBody, reqid string) (interface{}, error),
 	httpReqBody HttpReqBody,
 ) func(rsp http.ResponseWriter, req *http.Request) {
 	return func(rsp http.ResponseWriter, req *http.Request) {
 		reqid := util.RandStringBytes(8)
+		start := time.Now()
+		code := util.HTTP_OK_RESPONSE_CODE
+		defer func() {
+			metrics.ObserveHttp(req.URL.Path, code, start)
+		}()
+		caller, err := authenticator.Authenticate(req)
+		if err != nil {
+			glog.Infof("Aspect %s Authenticate %s %s", req.URL.String(), err, reqid)
+			code = util.ERR_UNAUTHORIZED_CODE
+			rsp.Write(NewErrHttpJsonResponse(code, err.Error()))
+			return
+		}
+		req = req.WithContext(WithCaller(req.Context(), caller))
 		bodyBytes, err := ioutil.ReadAll(req.Body)
 		if err != nil {
-			rsp.Write(NewErrHttpJsonResponse(util.HTTP_READ_BODY_ERROR_CODE, err.Error()))
+			code = util.HTTP_READ_BODY_ERROR_CODE
+			rsp.Write(NewErrHttpJsonResponse(code, err.Error()))
 			return
 		}
 		glog.Infof("Aspect %s %s %s", req.URL.String(), string(bodyBytes), reqid)
@@ -89,23 +156,36 @@ func Aspect(
 		if reqBody != nil {
 			err = json.Unmarshal(bodyBytes, reqBody)
 			if err != nil {
-				rsp.Write(NewErrHttpJsonResponse(util.HTTP_WRONG_FORMAT_ERROR_CODE, err.Error()))
+				code = util.HTTP_WRONG_FORMAT_ERROR_CODE
+				rsp.Write(NewErrHttpJsonResponse(code, err.Error()))
 				return
 			}
 			err = CheckNil(reqBody)
 			if err != nil {
-				rsp.Write(NewErrHttpJsonResponse(util.HTTP_WRONG_FORMAT_ERROR_CODE, err.Error()))
+				code = util.HTTP_WRONG_FORMAT_ERROR_CODE
+				rsp.Write(NewErrHttpJsonResponse(code, err.Error()))
 				return
 			}
+			appidReqBody, ok := reqBody.(AppidHttpReqBody)
+			if ok {
+				err := CheckCallerAppid(caller, appidReqBody.GetAppid())
+				if err != nil {
+					code = util.ERR_FORBIDDEN_CODE
+					rsp.Write(NewErrHttpJsonResponse(code, err.Error()))
+					return
+				}
+			}
 		}
 		result, err := handleFunc(rsp, req, reqBody, reqid)
 		if err != nil {
 			codeErr, ok := err.(*util.CodeError)
 			if !ok {
-				rsp.Write(NewErrHttpJsonResponse(util.HTTP_SERVICE_ERROR_CODE, err.Error()))
+				code = util.HTTP_SERVICE_ERROR_CODE
+				rsp.Write(NewErrHttpJsonResponse(code, err.Error()))
 				return
 			}
-			rsp.Write(NewErrHttpJsonResponse(codeErr.Code, codeErr.Error()))
+			code = codeErr.Code
+			rsp.Write(NewErrHttpJsonResponse(code, codeErr.Error()))
 			return
 		}
 		rsp.Write(NewOkHttpJsonResponse(result))
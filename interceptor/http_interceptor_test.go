@@ -1 +1,78 @@
 package interceptor
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/dotwallet/touchstone/metrics"
+	"github.com/dotwallet/touchstone/util"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type testAuthenticator struct{}
+
+func (this *testAuthenticator) Authenticate(req *http.Request) (*HttpCaller, error) {
+	switch BearerToken(req) {
+	case "admin":
+		return &HttpCaller{Admin: true}, nil
+	case "app1":
+		return &HttpCaller{Appid: "app1"}, nil
+	}
+	return nil, errors.New("wrong token")
+}
+
+type testAppidReq struct {
+	Appid *string `json:"appid"`
+}
+
+func (this *testAppidReq) NewHttpReqBody() HttpReqBody {
+	return &testAppidReq{}
+}
+
+func (this *testAppidReq) GetAppid() string {
+	return *this.Appid
+}
+
+func testHandle(rsp http.ResponseWriter, req *http.Request, httpReqStruct HttpReqBody, reqid string) (interface{}, error) {
+	return GetHttpCaller(req).Appid, nil
+}
+
+func TestAspectAuthenticate(t *testing.T) {
+	handle := Aspect(&testAuthenticator{}, testHandle, &testAppidReq{})
+	cases := []struct {
+		token string
+		appid string
+		code  int
+	}{
+		{"", "app1", util.ERR_UNAUTHORIZED_CODE},
+		{"app1", "app1", util.HTTP_OK_RESPONSE_CODE},
+		{"app1", "app2", util.ERR_FORBIDDEN_CODE},
+		{"admin", "app2", util.HTTP_OK_RESPONSE_CODE},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"appid":"`+c.appid+`"}`))
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		requests := metrics.HttpRequests.WithLabelValues("/", strconv.Itoa(c.code))
+		before := testutil.ToFloat64(requests)
+		rsp := httptest.NewRecorder()
+		handle(rsp, req)
+		if testutil.ToFloat64(requests) != before+1 {
+			t.Fatalf("token:%s appid:%s http_requests_total not counted", c.token, c.appid)
+		}
+		httpJsonResponse := &HttpJsonResponse{}
+		err := json.Unmarshal(rsp.Body.Bytes(), httpJsonResponse)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if httpJsonResponse.Code != c.code {
+			t.Fatalf("token:%s appid:%s code:%d want:%d", c.token, c.appid, httpJsonResponse.Code, c.code)
+		}
+	}
+}
@@ -8,14 +8,18 @@ import (
 	"errors"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/btcsuite/btcd/btcec"
 	"github.com/dotwallet/touchstone/conf"
 	"github.com/dotwallet/touchstone/message"
+	"github.com/dotwallet/touchstone/metrics"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -24,6 +28,9 @@ const (
 	KEY_TIMESTAMP  = "timestamp"
 	KEY_SIGNATURE  = "signature"
 	AUTH_HEAD_LONG = 4
+
+	// a refused peer may still say hello,so it learns why and may be negotiated again
+	P2P_METHOD_HELLO = "/P2p/Hello"
 )
 
 func AllowPubkeyFromConfigs() {
@@ -94,18 +101,49 @@ func (this AuthPerRPCCredential) RequireTransportSecurity() bool {
 	return false
 }
 
-type AuthInterceptor struct {
-	allowPubkeys map[string]bool
+// shared by AuthInterceptor and AuthCredential,replaced as a whole when peers are reloaded
+type PeerAllowList struct {
+	lock    sync.RWMutex
+	pubkeys map[string]bool
 }
 
-func NewAuthInterceptor(PeerConfigs []*conf.PeerConfig) *AuthInterceptor {
-	authInterceptor := &AuthInterceptor{
-		allowPubkeys: make(map[string]bool),
-	}
+func NewPeerAllowList(PeerConfigs []*conf.PeerConfig) *PeerAllowList {
+	allowList := &PeerAllowList{}
+	allowList.Set(PeerConfigs)
+	return allowList
+}
+
+func (this *PeerAllowList) Set(PeerConfigs []*conf.PeerConfig) {
+	pubkeys := make(map[string]bool)
 	for _, PeerConfig := range PeerConfigs {
-		authInterceptor.allowPubkeys[PeerConfig.Pubkey] = true
+		pubkeys[PeerConfig.Pubkey] = true
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.pubkeys = pubkeys
+}
+
+func (this *PeerAllowList) Allowed(pubkeyHex string) bool {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return this.pubkeys[pubkeyHex]
+}
+
+// tells why a peer is refused,empty when it is not
+type PeerRefuser interface {
+	RefusedReason(pubkey string) string
+}
+
+type AuthInterceptor struct {
+	allowList *PeerAllowList
+	refuser   PeerRefuser
+}
+
+func NewAuthInterceptor(allowList *PeerAllowList, refuser PeerRefuser) *AuthInterceptor {
+	return &AuthInterceptor{
+		allowList: allowList,
+		refuser:   refuser,
 	}
-	return authInterceptor
 }
 
 func (this *AuthInterceptor) Intercept(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
@@ -117,8 +155,7 @@ func (this *AuthInterceptor) Intercept(ctx context.Context, req interface{}, inf
 	if !ok {
 		return nil, errors.New("no pubkey")
 	}
-	_, ok = this.allowPubkeys[pubkeyHex[0]]
-	if !ok {
+	if !this.allowList.Allowed(pubkeyHex[0]) {
 		return nil, errors.New("not support pubkey")
 	}
 	pubkeyByte, err := hex.DecodeString(pubkeyHex[0])
@@ -145,7 +182,16 @@ func (this *AuthInterceptor) Intercept(ctx context.Context, req interface{}, inf
 	if err != nil {
 		return nil, err
 	}
-	return handler(ctx, req)
+	if info.FullMethod != P2P_METHOD_HELLO && this.refuser != nil {
+		reason := this.refuser.RefusedReason(pubkeyHex[0])
+		if reason != "" {
+			return nil, status.Errorf(codes.FailedPrecondition, "peer refused:%s", reason)
+		}
+	}
+	start := time.Now()
+	rsp, err := handler(ctx, req)
+	metrics.ObserveP2pRpc(pubkeyHex[0], metrics.P2P_DIRECTION_IN, info.FullMethod, err, start)
+	return rsp, err
 }
 
 type AuthInfo struct {
@@ -157,8 +203,8 @@ func (this *AuthInfo) AuthType() string {
 }
 
 type AuthCredential struct {
-	privateKey   *btcec.PrivateKey
-	allowPubkeys map[string]bool
+	privateKey *btcec.PrivateKey
+	allowList  *PeerAllowList
 }
 
 func NewClientAuthCredential(privateKey *btcec.PrivateKey) *AuthCredential {
@@ -167,13 +213,9 @@ func NewClientAuthCredential(privateKey *btcec.PrivateKey) *AuthCredential {
 	}
 }
 
-func NewServerAuthCredential(PeerConfigs []*conf.PeerConfig) *AuthCredential {
-	allowPubkeys := make(map[string]bool)
-	for _, PeerConfig := range PeerConfigs {
-		allowPubkeys[PeerConfig.Pubkey] = true
-	}
+func NewServerAuthCredential(allowList *PeerAllowList) *AuthCredential {
 	return &AuthCredential{
-		allowPubkeys: allowPubkeys,
+		allowList: allowList,
 	}
 }
 
@@ -326,6 +368,10 @@ func (this *AuthCredential) ServerHandshake(conn net.Conn) (net.Conn, credential
 		conn.Close()
 		return conn, nil, err
 	}
+	if !this.allowList.Allowed(hex.EncodeToString(request.Pubkey)) {
+		conn.Close()
+		return conn, nil, errors.New("not support pubkey")
+	}
 	err = VerifyTimestampSig(request.Pubkey, request.Signature, request.Timestamp)
 	if err != nil {
 		conn.Close()
@@ -343,8 +389,8 @@ func (this *AuthCredential) ServerHandshake(conn net.Conn) (net.Conn, credential
 
 func (this *AuthCredential) Clone() credentials.TransportCredentials {
 	return &AuthCredential{
-		privateKey:   this.privateKey,
-		allowPubkeys: this.allowPubkeys,
+		privateKey: this.privateKey,
+		allowList:  this.allowList,
 	}
 }
 
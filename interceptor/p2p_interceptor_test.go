@@ -0,0 +1,69 @@
+package interceptor
+
+import (
+	"context"
+	"encoding/hex"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/dotwallet/touchstone/conf"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestPeerAllowList(t *testing.T) {
+	allowList := NewPeerAllowList([]*conf.PeerConfig{
+		{Host: "127.0.0.1:7788", Pubkey: "036af584f4f274e3b6831f9c8cfb8cce56d441887a9349cc93b180eb9a913d06cd"},
+	})
+	if !allowList.Allowed("036af584f4f274e3b6831f9c8cfb8cce56d441887a9349cc93b180eb9a913d06cd") {
+		t.Fatal("configured peer should be allowed")
+	}
+	allowList.Set([]*conf.PeerConfig{
+		{Host: "127.0.0.1:7788", Pubkey: "026e85c3255ad46183ee3e425247e4a326be03c4ea5f2be5f8d6280610e0376492"},
+	})
+	if allowList.Allowed("036af584f4f274e3b6831f9c8cfb8cce56d441887a9349cc93b180eb9a913d06cd") {
+		t.Fatal("removed peer should not be allowed")
+	}
+	if !allowList.Allowed("026e85c3255ad46183ee3e425247e4a326be03c4ea5f2be5f8d6280610e0376492") {
+		t.Fatal("added peer should be allowed")
+	}
+}
+
+type refuser map[string]string
+
+func (this refuser) RefusedReason(pubkey string) string {
+	return this[pubkey]
+}
+
+func TestAuthInterceptorRefused(t *testing.T) {
+	privateKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubkey := hex.EncodeToString(privateKey.PubKey().SerializeCompressed())
+	allowList := NewPeerAllowList([]*conf.PeerConfig{{Host: "127.0.0.1:7788", Pubkey: pubkey}})
+	authInterceptor := NewAuthInterceptor(allowList, refuser{pubkey: "network regtest,ours mainnet"})
+	headers, err := NewAuthPerRPCCredential(privateKey).GetRequestMetadata(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.New(headers))
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "ok", nil
+	}
+	_, err = authInterceptor.Intercept(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/P2p/GetTxs"}, handler)
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("refused peer got %v", err)
+	}
+	rsp, err := authInterceptor.Intercept(ctx, nil, &grpc.UnaryServerInfo{FullMethod: P2P_METHOD_HELLO}, handler)
+	if err != nil || rsp != "ok" {
+		t.Fatalf("hello of refused peer %v %v", rsp, err)
+	}
+	authInterceptor = NewAuthInterceptor(allowList, refuser{})
+	rsp, err = authInterceptor.Intercept(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/P2p/GetTxs"}, handler)
+	if err != nil || rsp != "ok" {
+		t.Fatalf("peer %v %v", rsp, err)
+	}
+}
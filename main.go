@@ -1,11 +1,13 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"flag"
-	"io/ioutil"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/dotwallet/touchstone/conf"
@@ -16,75 +18,161 @@ import (
 	"github.com/dotwallet/touchstone/models"
 	"github.com/dotwallet/touchstone/services"
 	"github.com/golang/glog"
-	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/reflection"
 )
 
-func StartP2pServer(p2pController *controller.P2pController, host string, allowPeers []*conf.PeerConfig) {
-	p2pListener, err := net.Listen("tcp", host)
-	if err != nil {
-		glog.Infof("StartP2pServer Listen %s", err)
-		glog.Flush()
-		panic(err)
-	}
+const SHUTDOWN_TIMEOUT = time.Second * 30
 
+func NewP2pServer(p2pController *controller.P2pController, allowList *interceptor.PeerAllowList) *grpc.Server {
 	var opts []grpc.ServerOption
 
-	authCredential := interceptor.NewServerAuthCredential(allowPeers)
+	authCredential := interceptor.NewServerAuthCredential(allowList)
 
 	opts = append(opts, grpc.Creds(authCredential))
-	authInterceptor := interceptor.NewAuthInterceptor(allowPeers)
+	authInterceptor := interceptor.NewAuthInterceptor(allowList, p2pController.TouchstoneServer)
 	opts = append(opts, grpc.UnaryInterceptor(authInterceptor.Intercept))
 
 	//need opt
 	s := grpc.NewServer(opts...)
 	message.RegisterP2PServer(s, p2pController)
 	reflection.Register(s)
-	err = s.Serve(p2pListener)
+	return s
+}
+
+// client-facing api,authenticated by the same api keys as http
+func NewGrpcApiServer(apiController *controller.ApiController, authenticator interceptor.TokenAuthenticator) *grpc.Server {
+	authInterceptor := &interceptor.ApiAuthInterceptor{
+		Authenticator: authenticator,
+	}
+	s := grpc.NewServer(
+		grpc.UnaryInterceptor(authInterceptor.Intercept),
+		grpc.StreamInterceptor(authInterceptor.StreamIntercept),
+	)
+	message.RegisterTouchstoneServer(s, apiController)
+	reflection.Register(s)
+	return s
+}
+
+// subscribe streams end when shutdown starts
+func NewHttpServer(httpController *controller.HttpController, host string, httpAuthConfig *conf.HttpAuthConfig) *http.Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &http.Server{
+		Addr:    host,
+		Handler: controller.NewHttpRouter(httpController, httpAuthConfig),
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+	s.RegisterOnShutdown(cancel)
+	return s
+}
+
+func ServeGrpc(name string, s *grpc.Server, host string, serveErrs chan<- error) {
+	listener, err := net.Listen("tcp", host)
 	if err != nil {
-		glog.Infof("StartHttpServer Serve %s", err)
-		glog.Flush()
-		panic(err)
+		glog.Infof("ServeGrpc %s Listen %s", name, err)
+		serveErrs <- err
+		return
+	}
+	err = s.Serve(listener)
+	if err != nil {
+		glog.Infof("ServeGrpc %s Serve %s", name, err)
+		serveErrs <- err
 	}
 }
 
-func StartHttpServer(httpController *controller.HttpController, host string) {
-	r := mux.NewRouter()
-	r.HandleFunc("/v1/touchstone/sendrawtransaction", interceptor.Aspect(httpController.SendRawTransaction, &controller.SendRawTransactionReq{}))
-	r.HandleFunc("/v1/touchstone/gettxinventory", interceptor.Aspect(httpController.GetTransactionInventory, &controller.GetTransactionInventoryReq{}))
-	r.HandleFunc("/v1/touchstone/getaddrutxos", interceptor.Aspect(httpController.GetAddrUtxos, &controller.GetAddrUtxosReq{}))
-	r.HandleFunc("/v1/touchstone/getaddrbalance", interceptor.Aspect(httpController.GetAddrBalance, &controller.GetAddrBalanceReq{}))
-	r.HandleFunc("/v1/touchstone/getaddrinventorys", interceptor.Aspect(httpController.GetAddrInventorys, &controller.GetAddrInventorysReq{}))
-	r.HandleFunc("/v1/touchstone/setaddrinfo", interceptor.Aspect(httpController.SetAddrInfo, &controller.SetAddrInfoReq{}))
-	r.HandleFunc("/v1/touchstone/getuserutxos", interceptor.Aspect(httpController.GetUserUtxos, &controller.GetUserUtxosReq{}))
-	r.HandleFunc("/v1/touchstone/getuserbalance", interceptor.Aspect(httpController.GetUserBalance, &controller.GetUserBalanceReq{}))
-	r.HandleFunc("/v1/touchstone/getuserinventorys", interceptor.Aspect(httpController.GetUserInventorys, &controller.GetUserInventorysReq{}))
-	r.HandleFunc("/v1/touchstone/sendbadgetoaddress", interceptor.Aspect(httpController.SendBadgeToAddress, &controller.SendBadgeToAddressReq{}))
-	err := http.ListenAndServe(host, r)
+func ServeHttp(s *http.Server, serveErrs chan<- error) {
+	err := s.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		glog.Infof("ServeHttp ListenAndServe %s", err)
+		serveErrs <- err
+	}
+}
+
+// in-flight rpcs are waited until ctx is done
+func StopGrpcServer(ctx context.Context, s *grpc.Server) error {
+	done := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.Stop()
+		return ctx.Err()
+	}
+}
+
+// 0 on signal,1 when a server failed
+func WaitForStop(sigs <-chan os.Signal, serveErrs <-chan error) int {
+	for {
+		glog.Infof("main %s", time.Now().String())
+		select {
+		case sig := <-sigs:
+			glog.Infof("main got signal %s", sig)
+			return 0
+		case err := <-serveErrs:
+			glog.Infof("main serve %s", err)
+			return 1
+		case <-time.After(time.Hour):
+		}
+	}
+}
+
+// stop accepting requests first,then drain SyncTxs and stop loops
+func Shutdown(touchstoneServer *services.TouchstoneServer, httpServer *http.Server, grpcServers []*grpc.Server) error {
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	var shutdownErr error
+	err := httpServer.Shutdown(ctx)
 	if err != nil {
-		glog.Infof("StartHttpServer ListenAndServe %s", err)
-		glog.Flush()
-		panic(err)
+		glog.Infof("Shutdown http server %s", err)
+		shutdownErr = err
+	}
+	for _, s := range grpcServers {
+		err := StopGrpcServer(ctx, s)
+		if err != nil {
+			glog.Infof("Shutdown grpc server %s", err)
+			shutdownErr = err
+		}
+	}
+	err = touchstoneServer.Shutdown(ctx)
+	if err != nil {
+		glog.Infof("Shutdown touchstoneServer %s", err)
+		shutdownErr = err
+	}
+	return shutdownErr
+}
+
+// PeersConfigs is read again from the same file,environment and flags
+func ReloadPeersOnHup(touchstoneServer *services.TouchstoneServer, hups chan os.Signal) {
+	for range hups {
+		glog.Infof("main SIGHUP reload peers")
+		_, err := touchstoneServer.ReloadPeers()
+		if err != nil {
+			glog.Infof("main ReloadPeers %s", err)
+		}
 	}
 }
 
 func main() {
-	configFilePath := flag.String("config", "conf/config.json", "Path of config file")
+	configFilePath := flag.String("config", "conf/config.json", "Path of config file,empty to use defaults and environment only")
+	configSets := conf.ConfigSets{}
+	flag.Var(&configSets, "set", "Override a config key,like -set Tunables.SpentDepth=30,repeatable")
+	migrateDryRun := flag.Bool("migrate_dry_run", false, "Print pending schema migrations and exit")
+	rebuildAddrBalance := flag.Bool("rebuild_addr_balance", false, "Rebuild addr_balance from closed txs and exit")
 	flag.Parse()
-	configJSON, err := ioutil.ReadFile(*configFilePath)
-	if err != nil {
-		glog.Infof("main 1 ReadFile %s", err)
-		glog.Flush()
-		panic(err)
-	}
-	config := &conf.Config{}
-	err = json.Unmarshal(configJSON, config)
+	config, err := conf.LoadConfig(*configFilePath, os.Environ(), configSets)
 	if err != nil {
-		glog.Infof("main 2 Unmarshal %s", err)
+		glog.Infof("main 1 LoadConfig %s", err)
 		glog.Flush()
 		panic(err)
 	}
+	conf.GTunables = config.Tunables
 	err = conf.InitGConfig(config.Env)
 	if err != nil {
 		glog.Infof("main 3 InitGConfig %s", err)
@@ -97,6 +185,36 @@ func main() {
 		glog.Flush()
 		panic(err)
 	}
+	migrationRepository := &models.MigrationRepository{
+		Db: db,
+	}
+	err = migrationRepository.Migrate(models.MIGRATIONS, *migrateDryRun)
+	if err != nil {
+		glog.Infof("main 4 Migrate %s", err)
+		glog.Flush()
+		panic(err)
+	}
+	if *migrateDryRun {
+		glog.Flush()
+		return
+	}
+	err = migrationRepository.CheckPartitionParams(config.Tunables.PartitionBlockCount, *conf.GStartHeight)
+	if err != nil {
+		glog.Infof("main 4 CheckPartitionParams %s", err)
+		glog.Flush()
+		panic(err)
+	}
+	if *rebuildAddrBalance {
+		err := models.RebuildAddrBalances(db)
+		if err != nil {
+			glog.Infof("main 4 RebuildAddrBalances %s", err)
+			glog.Flush()
+			panic(err)
+		}
+		glog.Flush()
+		return
+	}
+
 	txInfoRepository := &models.TxInfoRepository{
 		Db: db,
 	}
@@ -116,6 +234,13 @@ func main() {
 		glog.Flush()
 		panic(err)
 	}
+	// txn of closing txs addresses points by txid_index_type,legacy _id must be migrated first
+	legacyTxPoints, err := txPointRepository.CountLegacyTxPoints()
+	if err != nil || legacyTxPoints > 0 {
+		glog.Infof("main 5 txPointRepository CountLegacyTxPoints %d %v", legacyTxPoints, err)
+		glog.Flush()
+		panic("tx_point has legacy _id,run schema migrations first")
+	}
 
 	partitionInfoRepository := &models.PartitionInfoRepository{
 		Db: db,
@@ -137,6 +262,102 @@ func main() {
 		panic(err)
 	}
 
+	consolidateInfoRepository := &models.ConsolidateInfoRepository{
+		Db: db,
+	}
+	err = consolidateInfoRepository.CreateIndex()
+	if err != nil {
+		glog.Infof("main 5 consolidateInfoRepository CreateIndex %s", err)
+		glog.Flush()
+		panic(err)
+	}
+
+	payoutBatchRepository := &models.PayoutBatchRepository{
+		Db: db,
+	}
+	err = payoutBatchRepository.CreateIndex()
+	if err != nil {
+		glog.Infof("main 5 payoutBatchRepository CreateIndex %s", err)
+		glog.Flush()
+		panic(err)
+	}
+
+	addrBalanceRepository := &models.AddrBalanceRepository{
+		Db: db,
+	}
+	err = addrBalanceRepository.CreateIndex()
+	if err != nil {
+		glog.Infof("main 5 addrBalanceRepository CreateIndex %s", err)
+		glog.Flush()
+		panic(err)
+	}
+
+	eventRepository := &models.EventRepository{
+		Db: db,
+	}
+	err = eventRepository.CreateIndex()
+	if err != nil {
+		glog.Infof("main 5 eventRepository CreateIndex %s", err)
+		glog.Flush()
+		panic(err)
+	}
+	eventHub, err := services.NewEventHub(eventRepository, addrInfoRepository)
+	if err != nil {
+		glog.Infof("main 5 NewEventHub %s", err)
+		glog.Flush()
+		panic(err)
+	}
+
+	webhookRepository := &models.WebhookRepository{
+		Db: db,
+	}
+	err = webhookRepository.CreateIndex()
+	if err != nil {
+		glog.Infof("main 5 webhookRepository CreateIndex %s", err)
+		glog.Flush()
+		panic(err)
+	}
+
+	webhookDeliveryRepository := &models.WebhookDeliveryRepository{
+		Db: db,
+	}
+	err = webhookDeliveryRepository.CreateIndex()
+	if err != nil {
+		glog.Infof("main 5 webhookDeliveryRepository CreateIndex %s", err)
+		glog.Flush()
+		panic(err)
+	}
+
+	apiKeyRepository := &models.ApiKeyRepository{
+		Db: db,
+	}
+	err = apiKeyRepository.CreateIndex()
+	if err != nil {
+		glog.Infof("main 5 apiKeyRepository CreateIndex %s", err)
+		glog.Flush()
+		panic(err)
+	}
+
+	xpubInfoRepository := &models.XpubInfoRepository{
+		Db: db,
+	}
+	err = xpubInfoRepository.CreateIndex()
+	if err != nil {
+		glog.Infof("main 5 xpubInfoRepository CreateIndex %s", err)
+		glog.Flush()
+		panic(err)
+	}
+
+	nodeRepository := &models.NodeRepository{
+		Db: db,
+	}
+	err = nodeRepository.CreateIndex()
+	if err != nil {
+		glog.Infof("main 5 nodeRepository CreateIndex %s", err)
+		glog.Flush()
+		panic(err)
+	}
+
 	mapiClient, err := mapi.NewMempoolMapiClient(config.MempoolHost, config.MempoolPkiMnemonic, config.MempoolPkiMnemonicPassword)
 	if err != nil {
 		glog.Infof("main 6 NewMempoolMapiClient CreateIndex %s", err)
@@ -144,25 +365,71 @@ func main() {
 		panic(err)
 	}
 
+	peerAllowList := interceptor.NewPeerAllowList(config.PeersConfigs)
+	configLoader := func() (*conf.Config, error) {
+		return conf.LoadConfig(*configFilePath, os.Environ(), configSets)
+	}
 	touchstoneServer := &services.TouchstoneServer{
 		TxInfoRepository:                 txInfoRepository,
 		TxPointRepository:                txPointRepository,
 		PartitionInfoRepository:          partitionInfoRepository,
 		MapiClient:                       mapiClient,
 		AddrInfoRepository:               addrInfoRepository,
+		ConsolidateInfoRepository:        consolidateInfoRepository,
+		ConsolidateConfig:                config.ConsolidateConfig,
+		PayoutBatchRepository:            payoutBatchRepository,
+		PayoutConfig:                     config.PayoutConfig,
+		AddrBalanceRepository:            addrBalanceRepository,
+		EventHub:                         eventHub,
+		WebhookRepository:                webhookRepository,
+		WebhookDeliveryRepository:        webhookDeliveryRepository,
+		ApiKeyRepository:                 apiKeyRepository,
+		XpubInfoRepository:               xpubInfoRepository,
 		NeedRecomputehashPartitionsCache: make(map[int64]bool),
+		PeerAllowList:                    peerAllowList,
+		ConfigLoader:                     configLoader,
+		NodeRepository:                   nodeRepository,
+		DiscoveryConfig:                  config.DiscoveryConfig,
 	}
 
+	prometheus.MustRegister(&services.TxStateCollector{
+		TxInfoRepository: txInfoRepository,
+	})
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	serveErrs := make(chan error, 3)
+
 	p2pController := &controller.P2pController{
 		TouchstoneServer: touchstoneServer,
 	}
-	go StartP2pServer(p2pController, config.P2pHost, config.PeersConfigs)
+	p2pServer := NewP2pServer(p2pController, peerAllowList)
+	grpcServers := []*grpc.Server{p2pServer}
+	go ServeGrpc("p2p", p2pServer, config.P2pHost, serveErrs)
 
+	apiKeyAuthenticator := &controller.ApiKeyAuthenticator{
+		TouchstoneServer: touchstoneServer,
+		Config:           config.HttpAuthConfig,
+	}
 	httpController := &controller.HttpController{
 		TouchstoneServer: touchstoneServer,
+		Authenticator:    apiKeyAuthenticator,
 	}
 
-	go StartHttpServer(httpController, config.HttpHost)
+	if config.HttpAuthConfig == nil || !config.HttpAuthConfig.Enable {
+		glog.Infof("main INSECURE http auth is disabled by HttpAuthConfig.Insecure,every caller is admin")
+	}
+	httpServer := NewHttpServer(httpController, config.HttpHost, config.HttpAuthConfig)
+	go ServeHttp(httpServer, serveErrs)
+
+	if config.GrpcApiHost != "" {
+		apiController := &controller.ApiController{
+			TouchstoneServer: touchstoneServer,
+		}
+		grpcApiServer := NewGrpcApiServer(apiController, apiKeyAuthenticator)
+		grpcServers = append(grpcServers, grpcApiServer)
+		go ServeGrpc("api", grpcApiServer, config.GrpcApiHost, serveErrs)
+	}
 
 	err = touchstoneServer.Init(config.PeersConfigs, config.ServerPrivatekey)
 	if err != nil {
@@ -171,9 +438,16 @@ func main() {
 		panic(err)
 	}
 
-	for {
-		glog.Infof("main %s", time.Now().String())
-		time.Sleep(time.Hour)
-	}
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	go ReloadPeersOnHup(touchstoneServer, hups)
 
+	exitCode := WaitForStop(sigs, serveErrs)
+	err = Shutdown(touchstoneServer, httpServer, grpcServers)
+	if err != nil {
+		exitCode = 1
+	}
+	glog.Infof("main exit %d", exitCode)
+	glog.Flush()
+	os.Exit(exitCode)
 }
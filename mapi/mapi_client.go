@@ -1,7 +1,12 @@
 package mapi
 
 import (
+	"context"
 	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/dotwallet/touchstone/metrics"
 )
 
 const (
@@ -17,9 +22,9 @@ type MapiCertInfo struct {
 }
 
 type MapiClientAdaptor interface {
-	GetFeeQuote() (*MapiResponse, error)
-	GetTxState(txid string) (*MapiResponse, error)
-	SendTx(sendTxRequest *SendTxRequest) (*MapiResponse, error)
+	GetFeeQuote(ctx context.Context) (*MapiResponse, error)
+	GetTxState(ctx context.Context, txid string) (*MapiResponse, error)
+	SendTx(ctx context.Context, sendTxRequest *SendTxRequest) (*MapiResponse, error)
 }
 
 type MapiResponse struct {
@@ -29,6 +34,24 @@ type MapiResponse struct {
 
 type MapiClient struct {
 	MapiClientAdaptor
+	lastSuccTime int64
+	lastHeight   int64
+}
+
+func (this *MapiClient) setResult(err error) {
+	if err == nil {
+		atomic.StoreInt64(&this.lastSuccTime, time.Now().Unix())
+	}
+}
+
+// unix time of the last successful call,0 if never
+func (this *MapiClient) LastSuccTime() int64 {
+	return atomic.LoadInt64(&this.lastSuccTime)
+}
+
+// chain height of the last fee quote,0 if never
+func (this *MapiClient) LastHeight() int64 {
+	return atomic.LoadInt64(&this.lastHeight)
 }
 
 type Fee struct {
@@ -58,8 +81,11 @@ type FeeQuote struct {
 	MapiCertInfo
 }
 
-func (this *MapiClient) GetFeeQuote() (*FeeQuote, error) {
-	mapiFeeQuote, err := this.MapiClientAdaptor.GetFeeQuote()
+func (this *MapiClient) GetFeeQuote(ctx context.Context) (*FeeQuote, error) {
+	start := time.Now()
+	mapiFeeQuote, err := this.MapiClientAdaptor.GetFeeQuote(ctx)
+	metrics.ObserveMapi(metrics.MAPI_METHOD_GET_FEE_QUOTE, err, start)
+	this.setResult(err)
 	if err != nil {
 		return nil, err
 	}
@@ -69,6 +95,7 @@ func (this *MapiClient) GetFeeQuote() (*FeeQuote, error) {
 	if err != nil {
 		return nil, err
 	}
+	atomic.StoreInt64(&this.lastHeight, feeQuote.Payload.CurrentHighestBlockHeight)
 	return feeQuote, nil
 }
 
@@ -89,8 +116,11 @@ type TxState struct {
 	MapiCertInfo
 }
 
-func (this *MapiClient) GetTxState(txid string) (*TxState, error) {
-	mapiTxState, err := this.MapiClientAdaptor.GetTxState(txid)
+func (this *MapiClient) GetTxState(ctx context.Context, txid string) (*TxState, error) {
+	start := time.Now()
+	mapiTxState, err := this.MapiClientAdaptor.GetTxState(ctx, txid)
+	metrics.ObserveMapi(metrics.MAPI_METHOD_GET_TX_STATE, err, start)
+	this.setResult(err)
 	if err != nil {
 		return nil, err
 	}
@@ -124,11 +154,14 @@ type SendTxRequest struct {
 	RawTx string `json:"rawtx"`
 }
 
-func (this *MapiClient) SendTx(rawTx string) (*SendTxResult, error) {
+func (this *MapiClient) SendTx(ctx context.Context, rawTx string) (*SendTxResult, error) {
 	sendTxRequest := &SendTxRequest{
 		RawTx: rawTx,
 	}
-	mapiSendTxResult, err := this.MapiClientAdaptor.SendTx(sendTxRequest)
+	start := time.Now()
+	mapiSendTxResult, err := this.MapiClientAdaptor.SendTx(ctx, sendTxRequest)
+	metrics.ObserveMapi(metrics.MAPI_METHOD_SEND_TX, err, start)
+	this.setResult(err)
 	if err != nil {
 		return nil, err
 	}
@@ -1,6 +1,7 @@
 package mapi
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
@@ -47,7 +48,7 @@ type MempoolMapiAdaptor struct {
 	sendRawTxUrl   string
 }
 
-func (this *MempoolMapiAdaptor) doRequest(method string, url string, headers map[string]string, param interface{}) (*MapiResponse, error) {
+func (this *MempoolMapiAdaptor) doRequest(ctx context.Context, method string, url string, headers map[string]string, param interface{}) (*MapiResponse, error) {
 	paramByte, err := json.Marshal(param)
 	if err != nil {
 		return nil, err
@@ -70,7 +71,7 @@ func (this *MempoolMapiAdaptor) doRequest(method string, url string, headers map
 	}
 	newHeader[util.HTTP_CONTENT_TYPE] = "application/json"
 
-	httpResult, err := util.HttpRequest(method, url, newHeader, request)
+	httpResult, err := util.HttpRequestContext(ctx, method, url, newHeader, request)
 	if err != nil {
 		return nil, err
 	}
@@ -79,16 +80,16 @@ func (this *MempoolMapiAdaptor) doRequest(method string, url string, headers map
 	return result, err
 }
 
-func (this *MempoolMapiAdaptor) GetFeeQuote() (*MapiResponse, error) {
-	return this.doRequest(util.HTTP_METHOD_GET, this.getFeeQuoteUrl, nil, nil)
+func (this *MempoolMapiAdaptor) GetFeeQuote(ctx context.Context) (*MapiResponse, error) {
+	return this.doRequest(ctx, util.HTTP_METHOD_GET, this.getFeeQuoteUrl, nil, nil)
 }
-func (this *MempoolMapiAdaptor) GetTxState(txid string) (*MapiResponse, error) {
+func (this *MempoolMapiAdaptor) GetTxState(ctx context.Context, txid string) (*MapiResponse, error) {
 	url := this.getTxStateUrl + txid
-	return this.doRequest(util.HTTP_METHOD_GET, url, nil, nil)
+	return this.doRequest(ctx, util.HTTP_METHOD_GET, url, nil, nil)
 
 }
-func (this *MempoolMapiAdaptor) SendTx(sendTxRequest *SendTxRequest) (*MapiResponse, error) {
-	return this.doRequest(util.HTTP_METHOD_POST, this.sendRawTxUrl, nil, sendTxRequest)
+func (this *MempoolMapiAdaptor) SendTx(ctx context.Context, sendTxRequest *SendTxRequest) (*MapiResponse, error) {
+	return this.doRequest(ctx, util.HTTP_METHOD_POST, this.sendRawTxUrl, nil, sendTxRequest)
 }
 
 func NewMempoolMapiClient(host string, mnemonicWords string, password string) (*MapiClient, error) {
@@ -1,9 +1,13 @@
 package mapi
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 var gMempoolMapiClient *MapiClient
@@ -26,9 +30,31 @@ func ToJson(data interface{}) string {
 }
 
 func TestGetTxState(t *testing.T) {
-	result, err := gMempoolMapiClient.GetTxState("e624fd69683d27c48982e3e62e1e73b276e7b4c7763c514c00091cbcff19f700")
+	result, err := gMempoolMapiClient.GetTxState(context.Background(), "e624fd69683d27c48982e3e62e1e73b276e7b4c7763c514c00091cbcff19f700")
 	if err != nil {
 		t.Fatal(err)
 	}
 	fmt.Println(ToJson(result))
 }
+
+func TestGetFeeQuoteCancelled(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	mapiClient, err := NewMempoolMapiClient(server.URL, "border napkin domain blush hammer what avocado venue delay network tell art", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = mapiClient.GetFeeQuote(ctx)
+	if err == nil {
+		t.Fatal("GetFeeQuote should fail with ctx")
+	}
+	if mapiClient.LastSuccTime() != 0 {
+		t.Fatal("a cancelled call is not a success")
+	}
+}
@@ -0,0 +1,155 @@
+package metrics
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	NAMESPACE = "touchstone"
+
+	P2P_DIRECTION_IN  = "in"
+	P2P_DIRECTION_OUT = "out"
+
+	SYNC_TXS_RESULT_CLOSED         = "closed"
+	SYNC_TXS_RESULT_OPEN           = "open"
+	SYNC_TXS_RESULT_ERROR          = "error"
+	SYNC_TXS_RESULT_ALREADY_CLOSED = "already_closed"
+
+	MAPI_METHOD_GET_FEE_QUOTE = "get_fee_quote"
+	MAPI_METHOD_GET_TX_STATE  = "get_tx_state"
+	MAPI_METHOD_SEND_TX       = "send_tx"
+)
+
+var (
+	HttpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "http_requests_total",
+		Help:      "Http requests by path and response code,0 is success.",
+	}, []string{"path", "code"})
+	HttpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "http_request_duration_seconds",
+		Help:      "Http request latency by path.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"path"})
+	GrpcApiRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "grpc_api_requests_total",
+		Help:      "Client grpc api requests by method and grpc code.",
+	}, []string{"method", "code"})
+	GrpcApiRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "grpc_api_request_duration_seconds",
+		Help:      "Client grpc api latency by method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+	P2pRpcs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "p2p_rpcs_total",
+		Help:      "P2p rpcs by peer pubkey,direction,method and grpc code.",
+	}, []string{"peer", "direction", "method", "code"})
+	P2pRpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "p2p_rpc_duration_seconds",
+		Help:      "P2p rpc latency by peer pubkey,direction and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"peer", "direction", "method"})
+	SyncTxs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "sync_txs_total",
+		Help:      "Txs synced from peers by result.",
+	}, []string{"result"})
+	PartitionHashMismatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "partition_hash_mismatches_total",
+		Help:      "Partitions whose hash differs from the peer's.",
+	}, []string{"peer"})
+	MapiRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "mapi_requests_total",
+		Help:      "Mapi calls by method.",
+	}, []string{"method"})
+	MapiFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "mapi_failures_total",
+		Help:      "Mapi calls failed by method.",
+	}, []string{"method"})
+	MapiRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "mapi_request_duration_seconds",
+		Help:      "Mapi latency by method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+	PeerScore = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "peer_score",
+		Help:      "Health score of a peer from 0 to 100 by pubkey.",
+	}, []string{"peer"})
+	LoopDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "loop_iteration_duration_seconds",
+		Help:      "Duration of one iteration of the background loops.",
+		Buckets:   []float64{0.1, 1, 5, 15, 60, 300, 900, 3600},
+	}, []string{"loop"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		HttpRequests,
+		HttpRequestDuration,
+		GrpcApiRequests,
+		GrpcApiRequestDuration,
+		P2pRpcs,
+		P2pRpcDuration,
+		SyncTxs,
+		PartitionHashMismatches,
+		MapiRequests,
+		MapiFailures,
+		MapiRequestDuration,
+		PeerScore,
+		LoopDuration,
+	)
+}
+
+func ObserveHttp(path string, code int, start time.Time) {
+	HttpRequests.WithLabelValues(path, strconv.Itoa(code)).Inc()
+	HttpRequestDuration.WithLabelValues(path).Observe(time.Since(start).Seconds())
+}
+
+func ObserveGrpcApi(method string, err error, start time.Time) {
+	GrpcApiRequests.WithLabelValues(method, status.Code(err).String()).Inc()
+	GrpcApiRequestDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
+
+func ObserveP2pRpc(peer string, direction string, method string, err error, start time.Time) {
+	P2pRpcs.WithLabelValues(peer, direction, method, status.Code(err).String()).Inc()
+	P2pRpcDuration.WithLabelValues(peer, direction, method).Observe(time.Since(start).Seconds())
+}
+
+func ObserveMapi(method string, err error, start time.Time) {
+	MapiRequests.WithLabelValues(method).Inc()
+	if err != nil {
+		MapiFailures.WithLabelValues(method).Inc()
+	}
+	MapiRequestDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
+
+func ObserveLoop(loop string, start time.Time) {
+	LoopDuration.WithLabelValues(loop).Observe(time.Since(start).Seconds())
+}
+
+// for rpcs sent to a peer
+func PeerClientInterceptor(peer string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		start := time.Now()
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		ObserveP2pRpc(peer, P2P_DIRECTION_OUT, method, err, start)
+		return err
+	}
+}
@@ -0,0 +1,239 @@
+package models
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/txn"
+)
+
+const (
+	TBL_ADDR_BALANCE = "addr_balance"
+
+	BALANCE     = "balance"
+	UTXO_COUNT  = "utxo_count"
+	LAST_HEIGHT = "last_height"
+
+	REBUILD_ADDR_BALANCE_BATCH_TXS = 10000
+
+	MONGO_OPERATOR_INC = "$inc"
+	MONGO_OPERATOR_MAX = "$max"
+)
+
+type AddrBalance struct {
+	Id         string `json:"-" bson:"_id"`
+	Addr       string `json:"addr" bson:"addr"`
+	BadgeCode  string `json:"badge_code" bson:"badge_code"`
+	Balance    int64  `json:"balance" bson:"balance"`
+	UtxoCount  int64  `json:"utxo_count" bson:"utxo_count"`
+	LastHeight int64  `json:"last_height" bson:"last_height"`
+}
+
+func AddrBalanceDocId(addr string, badgeCode string) string {
+	return fmt.Sprintf("%s_%s", addr, badgeCode)
+}
+
+func NewAddrBalance(addr string, badgeCode string) *AddrBalance {
+	return &AddrBalance{
+		Id:         AddrBalanceDocId(addr, badgeCode),
+		Addr:       addr,
+		BadgeCode:  badgeCode,
+		LastHeight: UNCONFIRM_TX_HEIGHT,
+	}
+}
+
+// vout adds a utxo,vin removes the utxo it spends
+func SumTxPointsByAddr(txPoints []*TxPoint, addrBalances map[string]*AddrBalance, height int64) {
+	for _, txPoint := range txPoints {
+		id := AddrBalanceDocId(txPoint.Addr, txPoint.BadgeCode)
+		addrBalance, ok := addrBalances[id]
+		if !ok {
+			addrBalance = NewAddrBalance(txPoint.Addr, txPoint.BadgeCode)
+			addrBalances[id] = addrBalance
+		}
+		addrBalance.Balance += txPoint.Value
+		if txPoint.Type == TX_POINT_TYPE_VOUT {
+			addrBalance.UtxoCount++
+		} else {
+			addrBalance.UtxoCount--
+		}
+		if height > addrBalance.LastHeight {
+			addrBalance.LastHeight = height
+		}
+	}
+}
+
+type AddrBalanceRepository struct {
+	Db *MongoDb
+}
+
+func (this *AddrBalanceRepository) TableName() string {
+	return TBL_ADDR_BALANCE
+}
+
+func (this *AddrBalanceRepository) CreateIndex() error {
+	return this.Db.CreateIndex(
+		this.TableName(),
+		[]*mgo.Index{
+			{
+				Key:    []string{ADDR, BADGE_CODE},
+				Unique: true,
+			},
+		},
+	)
+}
+
+// revert is true when the tx points are removed
+func (this *AddrBalanceRepository) ChangeBalanceOps(txPoints []*TxPoint, height int64, revert bool) []txn.Op {
+	addrBalances := make(map[string]*AddrBalance)
+	SumTxPointsByAddr(txPoints, addrBalances, height)
+	ops := make([]txn.Op, 0, 2*len(addrBalances))
+	for id, addrBalance := range addrBalances {
+		updator := bson.M{
+			MONGO_OPERATOR_INC: bson.M{BALANCE: addrBalance.Balance, UTXO_COUNT: addrBalance.UtxoCount},
+			MONGO_OPERATOR_MAX: bson.M{LAST_HEIGHT: addrBalance.LastHeight},
+		}
+		if revert {
+			updator = bson.M{
+				MONGO_OPERATOR_INC: bson.M{BALANCE: -addrBalance.Balance, UTXO_COUNT: -addrBalance.UtxoCount},
+			}
+		}
+		ops = append(ops,
+			txn.Op{
+				C:      this.TableName(),
+				Id:     id,
+				Insert: NewAddrBalance(addrBalance.Addr, addrBalance.BadgeCode),
+			},
+			txn.Op{
+				C:      this.TableName(),
+				Id:     id,
+				Update: updator,
+			},
+		)
+	}
+	return ops
+}
+
+func (this *AddrBalanceRepository) SetLastHeight(txPoints []*TxPoint, height int64) error {
+	addrBalances := make(map[string]*AddrBalance)
+	SumTxPointsByAddr(txPoints, addrBalances, height)
+	ops := make([]txn.Op, 0, len(addrBalances))
+	for id := range addrBalances {
+		ops = append(ops, txn.Op{
+			C:      this.TableName(),
+			Id:     id,
+			Update: bson.M{MONGO_OPERATOR_MAX: bson.M{LAST_HEIGHT: height}},
+		})
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+	return this.Db.RunTxn(ops)
+}
+
+func (this *AddrBalanceRepository) GetAddrBalance(addr string, badgeCode string) (*AddrBalance, error) {
+	condition := bson.M{
+		MONGO_ID: AddrBalanceDocId(addr, badgeCode),
+	}
+	addrBalance := &AddrBalance{}
+	err := this.Db.GetOne(this.TableName(), condition, nil, addrBalance)
+	return addrBalance, err
+}
+
+func (this *AddrBalanceRepository) GetAddrBalances(addrBadgeCodes []*AddrBadgeCode) ([]*AddrBalance, error) {
+	ids := make([]string, 0, len(addrBadgeCodes))
+	for _, addrBadgeCode := range addrBadgeCodes {
+		ids = append(ids, AddrBalanceDocId(addrBadgeCode.Addr, addrBadgeCode.BadgeCode))
+	}
+	condition := bson.M{
+		MONGO_ID: bson.M{MONGO_OPERATOR_IN: ids},
+	}
+	addrBalances := make([]*AddrBalance, 0, len(ids))
+	err := this.Db.GetAll(this.TableName(), condition, nil, MONGO_ID, &addrBalances)
+	return addrBalances, err
+}
+
+func (this *AddrBalanceRepository) GetUsedAddrs(addrs []string) ([]string, error) {
+	condition := bson.M{
+		ADDR: bson.M{MONGO_OPERATOR_IN: addrs},
+	}
+	usedAddrs := make([]string, 0, 8)
+	err := this.Db.Distinct(this.TableName(), condition, ADDR, &usedAddrs)
+	return usedAddrs, err
+}
+
+// selector and updator of each balance for BulkUpsert,the sums are added to the stored ones
+func AddrBalanceUpsertPairs(addrBalances map[string]*AddrBalance) []interface{} {
+	pairs := make([]interface{}, 0, 2*len(addrBalances))
+	for id, addrBalance := range addrBalances {
+		pairs = append(pairs,
+			bson.M{MONGO_ID: id},
+			bson.M{
+				MONGO_OPERATOR_SET_ON_INSERT: bson.M{ADDR: addrBalance.Addr, BADGE_CODE: addrBalance.BadgeCode},
+				MONGO_OPERATOR_INC:           bson.M{BALANCE: addrBalance.Balance, UTXO_COUNT: addrBalance.UtxoCount},
+				MONGO_OPERATOR_MAX:           bson.M{LAST_HEIGHT: addrBalance.LastHeight},
+			},
+		)
+	}
+	return pairs
+}
+
+// only for a stopped node, txs closed during rebuild are lost.
+// interrupted txns are resumed first,a txn resumed after the rebuild would change balances twice
+func RebuildAddrBalances(db *MongoDb) error {
+	err := db.ResumeTxns()
+	if err != nil {
+		return err
+	}
+	pending, err := db.CountPendingTxns()
+	if err != nil {
+		return err
+	}
+	if pending > 0 {
+		return fmt.Errorf("RebuildAddrBalances %d txns pending", pending)
+	}
+	err = db.DeleteAll(TBL_ADDR_BALANCE, nil)
+	if err != nil {
+		return err
+	}
+	txPointRepository := &TxPointRepository{
+		Db: db,
+	}
+	// sums of a batch of txs are added to the table,so only one batch is kept in memory
+	addrBalances := make(map[string]*AddrBalance)
+	msgTxBriefInfo := &MsgTxBriefInfo{}
+	condition := bson.M{
+		INDEX: TX_INFO_INDEX,
+		STATE: TX_STATE_CLOSED,
+	}
+	count := 0
+	f := func() error {
+		txPoints, err := txPointRepository.GetTxPoints(msgTxBriefInfo.Txid)
+		if err != nil {
+			return err
+		}
+		SumTxPointsByAddr(txPoints, addrBalances, msgTxBriefInfo.Height)
+		count++
+		if count%REBUILD_ADDR_BALANCE_BATCH_TXS == 0 {
+			err := db.BulkUpsert(TBL_ADDR_BALANCE, AddrBalanceUpsertPairs(addrBalances))
+			if err != nil {
+				return err
+			}
+			addrBalances = make(map[string]*AddrBalance)
+			glog.Infof("RebuildAddrBalances txs:%d", count)
+		}
+		return nil
+	}
+	err = db.Foreach(TBL_RAW_TX_INFO, condition, msgTxBriefInfo, f)
+	if err != nil {
+		return err
+	}
+	err = db.BulkUpsert(TBL_ADDR_BALANCE, AddrBalanceUpsertPairs(addrBalances))
+	if err != nil {
+		return err
+	}
+	glog.Infof("RebuildAddrBalances done txs:%d", count)
+	return nil
+}
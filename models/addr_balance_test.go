@@ -0,0 +1,46 @@
+package models
+
+import (
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestSumTxPointsByAddr(t *testing.T) {
+	txPoints := []*TxPoint{
+		{Addr: "a", BadgeCode: "b", Type: TX_POINT_TYPE_VOUT, Value: 100},
+		{Addr: "a", BadgeCode: "b", Type: TX_POINT_TYPE_VOUT, Value: 50},
+		{Addr: "a", BadgeCode: "b", Type: TX_POINT_TYPE_VIN, Value: -100},
+		{Addr: "c", BadgeCode: "b", Type: TX_POINT_TYPE_VOUT, Value: 100},
+	}
+	addrBalances := make(map[string]*AddrBalance)
+	SumTxPointsByAddr(txPoints, addrBalances, 10)
+	addrBalance := addrBalances[AddrBalanceDocId("a", "b")]
+	if addrBalance.Balance != 50 || addrBalance.UtxoCount != 1 || addrBalance.LastHeight != 10 {
+		t.Fatal("wrong balance", addrBalance)
+	}
+	addrBalance = addrBalances[AddrBalanceDocId("c", "b")]
+	if addrBalance.Balance != 100 || addrBalance.UtxoCount != 1 {
+		t.Fatal("wrong balance", addrBalance)
+	}
+}
+
+func TestAddrBalanceUpsertPairs(t *testing.T) {
+	addrBalances := make(map[string]*AddrBalance)
+	SumTxPointsByAddr([]*TxPoint{{Addr: "a", BadgeCode: "b", Type: TX_POINT_TYPE_VOUT, Value: 100}}, addrBalances, 10)
+	pairs := AddrBalanceUpsertPairs(addrBalances)
+	if len(pairs) != 2 {
+		t.Fatal("wrong pairs", pairs)
+	}
+	if pairs[0].(bson.M)[MONGO_ID] != AddrBalanceDocId("a", "b") {
+		t.Fatal("wrong selector", pairs[0])
+	}
+	// sums of a batch are added,not set
+	inc := pairs[1].(bson.M)[MONGO_OPERATOR_INC].(bson.M)
+	if inc[BALANCE] != int64(100) || inc[UTXO_COUNT] != int64(1) {
+		t.Fatal("wrong updator", pairs[1])
+	}
+	if len(AddrBalanceUpsertPairs(nil)) != 0 {
+		t.Fatal("pairs of no balance")
+	}
+}
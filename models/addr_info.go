@@ -17,6 +17,10 @@ type AddrInfo struct {
 	UserIndex int64  `json:"user_index" bson:"user_index"`
 	Addr      string `json:"addr" bson:"addr"`
 	Timestamp int64  `json:"timestamp" bson:"timestamp"`
+	// empty if not derived from a xpub
+	Xpub      string `json:"xpub" bson:"xpub"`
+	XpubChain int    `json:"xpub_chain" bson:"xpub_chain"`
+	XpubIndex int64  `json:"xpub_index" bson:"xpub_index"`
 }
 
 type AddrInfoRepository struct {
@@ -57,12 +61,27 @@ func (this *AddrInfoRepository) AddOrUpdateAddrInfo(addrInfo *AddrInfo) error {
 			USERID:     addrInfo.UserID,
 			USER_INDEX: addrInfo.UserIndex,
 			TIMESTAMP:  addrInfo.Timestamp,
+			XPUB:       addrInfo.Xpub,
+			XPUB_CHAIN: addrInfo.XpubChain,
+			XPUB_INDEX: addrInfo.XpubIndex,
 		}
 		return this.Db.UpdateAll(this.TableName(), condition, updator)
 	}
 	return nil
 }
 
+// never takes an addr already set
+func (this *AddrInfoRepository) AddAddrInfoIfAbsent(addrInfo *AddrInfo) (bool, error) {
+	err := this.Db.Insert(this.TableName(), addrInfo)
+	if err != nil {
+		if !strings.Contains(err.Error(), MONGO_ERROR_DUPLICATE) {
+			return false, err
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
 func (this *AddrInfoRepository) GetAddrInfo(addr string) (*AddrInfo, error) {
 	condition := bson.M{
 		ADDR: addr,
@@ -157,3 +176,47 @@ func (this *AddrInfoRepository) GetUserTxPoints(appid string, userid int64, user
 	return result, err
 
 }
+
+func (this *AddrInfoRepository) GetUserAddrBalances(appid string, userid int64, userIndex int64, badgeCode string) ([]*AddrBalance, error) {
+	conditions := []bson.M{
+		{
+			MONGO_OPERATOR_MATCH: bson.M{APPID: appid, USERID: userid, USER_INDEX: userIndex},
+		},
+		{
+			MONGO_OPERATOR_LOOKUP: bson.M{
+				MONGO_OPERATOR_FROM:          TBL_ADDR_BALANCE,
+				MONGO_OPERATOR_LOACL_FIELD:   ADDR,
+				MONGO_OPERATOR_FOREIGN_FIELD: ADDR,
+				MONGO_OPERATOR_AS:            "addr_balance",
+			},
+		},
+		{
+			MONGO_OPERATOR_UNWIND: "$addr_balance",
+		},
+		{
+			MONGO_OPERATOR_MATCH: bson.M{"addr_balance.badge_code": badgeCode},
+		},
+		{
+			MONGO_OPERATOR_PROJECT: bson.M{
+				MONGO_ID:    "$addr_balance._id",
+				ADDR:        "$addr_balance.addr",
+				BADGE_CODE:  "$addr_balance.badge_code",
+				BALANCE:     "$addr_balance.balance",
+				UTXO_COUNT:  "$addr_balance.utxo_count",
+				LAST_HEIGHT: "$addr_balance.last_height",
+			},
+		},
+	}
+	result := make([]*AddrBalance, 0, 8)
+	err := this.Db.AggregateAll(this.TableName(), conditions, &result)
+	return result, err
+}
+
+func (this *AddrInfoRepository) GetAddrInfos(addrs []string) ([]*AddrInfo, error) {
+	condition := bson.M{
+		ADDR: bson.M{MONGO_OPERATOR_IN: addrs},
+	}
+	addrInfos := make([]*AddrInfo, 0, len(addrs))
+	err := this.Db.GetAll(this.TableName(), condition, nil, MONGO_ID, &addrInfos)
+	return addrInfos, err
+}
@@ -0,0 +1,98 @@
+package models
+
+import (
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	TBL_API_KEY = "api_key"
+
+	KEY_ID           = "key_id"
+	SECRET_HASH      = "secret_hash"
+	PREV_SECRET_HASH = "prev_secret_hash"
+	PREV_EXPIRE      = "prev_expire"
+
+	API_KEY_STATE_ACTIVE  = 1
+	API_KEY_STATE_REVOKED = 2
+)
+
+// only sha256 of the secret is stored,the previous secret is still valid until prev_expire after rotated
+type ApiKey struct {
+	KeyId          string `json:"key_id" bson:"key_id"`
+	Appid          string `json:"appid" bson:"appid"`
+	SecretHash     string `json:"-" bson:"secret_hash"`
+	PrevSecretHash string `json:"-" bson:"prev_secret_hash"`
+	PrevExpire     int64  `json:"prev_expire" bson:"prev_expire"`
+	State          int    `json:"state" bson:"state"`
+	Timestamp      int64  `json:"timestamp" bson:"timestamp"`
+}
+
+type ApiKeyRepository struct {
+	Db *MongoDb
+}
+
+func (this *ApiKeyRepository) TableName() string {
+	return TBL_API_KEY
+}
+
+func (this *ApiKeyRepository) CreateIndex() error {
+	return this.Db.CreateIndex(
+		this.TableName(),
+		[]*mgo.Index{
+			{
+				Key:    []string{KEY_ID},
+				Unique: true,
+			},
+			{
+				Key:    []string{APPID},
+				Unique: false,
+			},
+		},
+	)
+}
+
+func (this *ApiKeyRepository) AddApiKey(apiKey *ApiKey) error {
+	return this.Db.Insert(this.TableName(), apiKey)
+}
+
+func (this *ApiKeyRepository) GetApiKey(keyId string) (*ApiKey, error) {
+	condition := bson.M{
+		KEY_ID: keyId,
+	}
+	apiKey := &ApiKey{}
+	err := this.Db.GetOne(this.TableName(), condition, nil, apiKey)
+	return apiKey, err
+}
+
+func (this *ApiKeyRepository) GetApiKeys(appid string) ([]*ApiKey, error) {
+	condition := bson.M{
+		APPID: appid,
+	}
+	apiKeys := make([]*ApiKey, 0, 4)
+	err := this.Db.GetAll(this.TableName(), condition, nil, MONGO_ID, &apiKeys)
+	return apiKeys, err
+}
+
+func (this *ApiKeyRepository) RotateApiKey(keyId string, secretHash string, prevSecretHash string, prevExpire int64) error {
+	condition := bson.M{
+		KEY_ID: keyId,
+		STATE:  API_KEY_STATE_ACTIVE,
+	}
+	updator := bson.M{
+		SECRET_HASH:      secretHash,
+		PREV_SECRET_HASH: prevSecretHash,
+		PREV_EXPIRE:      prevExpire,
+	}
+	return this.Db.UpdateOne(this.TableName(), condition, updator)
+}
+
+func (this *ApiKeyRepository) RevokeApiKey(keyId string) error {
+	condition := bson.M{
+		KEY_ID: keyId,
+	}
+	updator := bson.M{
+		STATE: API_KEY_STATE_REVOKED,
+	}
+	return this.Db.UpdateOne(this.TableName(), condition, updator)
+}
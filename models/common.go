@@ -23,6 +23,7 @@ const (
 	TIMESTAMP  = "timestamp"
 	BADGE_CODE = "badge_code"
 	VALUE      = "value"
+	COUNT      = "count"
 )
 
 func NewDb(host string, dbname string) (*MongoDb, error) {
@@ -0,0 +1,73 @@
+package models
+
+import (
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	TBL_CONSOLIDATE_INFO = "consolidate_info"
+)
+
+type ConsolidateInfo struct {
+	Appid        string     `json:"appid" bson:"appid"`
+	UserID       int64      `json:"userid" bson:"userid"`
+	UserIndex    int64      `json:"user_index" bson:"user_index"`
+	BadgeCode    string     `json:"badge_code" bson:"badge_code"`
+	Addr         string     `json:"addr" bson:"addr"`
+	UnFinishedTx string     `json:"unfinished_tx" bson:"unfinished_tx"`
+	Vins         []*TxPoint `json:"vins" bson:"vins"`
+	Timestamp    int64      `json:"timestamp" bson:"timestamp"`
+}
+
+type ConsolidateInfoRepository struct {
+	Db *MongoDb
+}
+
+func (this *ConsolidateInfoRepository) TableName() string {
+	return TBL_CONSOLIDATE_INFO
+}
+
+func (this *ConsolidateInfoRepository) CreateIndex() error {
+	return this.Db.CreateIndex(
+		this.TableName(),
+		[]*mgo.Index{
+			{
+				Key:    []string{APPID, USERID, USER_INDEX, BADGE_CODE},
+				Unique: false,
+			},
+		},
+	)
+}
+
+func (this *ConsolidateInfoRepository) SetUserConsolidateInfos(appid string, userid int64, userIndex int64, badgeCode string, consolidateInfos []*ConsolidateInfo) error {
+	condition := bson.M{
+		APPID:      appid,
+		USERID:     userid,
+		USER_INDEX: userIndex,
+		BADGE_CODE: badgeCode,
+	}
+	err := this.Db.DeleteAll(this.TableName(), condition)
+	if err != nil {
+		return err
+	}
+	for _, consolidateInfo := range consolidateInfos {
+		err := this.Db.Insert(this.TableName(), consolidateInfo)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *ConsolidateInfoRepository) GetUserConsolidateInfos(appid string, userid int64, userIndex int64, badgeCode string) ([]*ConsolidateInfo, error) {
+	condition := bson.M{
+		APPID:      appid,
+		USERID:     userid,
+		USER_INDEX: userIndex,
+		BADGE_CODE: badgeCode,
+	}
+	consolidateInfos := make([]*ConsolidateInfo, 0, 8)
+	err := this.Db.GetAll(this.TableName(), condition, nil, MONGO_ID, &consolidateInfos)
+	return consolidateInfos, err
+}
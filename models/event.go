@@ -0,0 +1,185 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	TBL_EVENT = "event"
+	// the seq counter,not in the event table as events expire
+	TBL_EVENT_SEQ = "event_seq"
+	EVENT_SEQ_ID  = "event"
+
+	SEQ         = "seq"
+	ADDRS       = "addrs"
+	BADGE_CODES = "badge_codes"
+	USERS       = "users"
+	CREATED_AT  = "created_at"
+
+	EVENT_RETENTION = 7 * 24 * time.Hour
+)
+
+type Event struct {
+	Seq        int64      `json:"seq" bson:"seq"`
+	Type       string     `json:"type" bson:"type"`
+	Txid       string     `json:"txid" bson:"txid"`
+	Height     int64      `json:"height" bson:"height"`
+	TxPoints   []*TxPoint `json:"tx_points" bson:"tx_points"`
+	Addrs      []string   `json:"addrs" bson:"addrs"`
+	BadgeCodes []string   `json:"badge_codes" bson:"badge_codes"`
+	Users      []string   `json:"-" bson:"users"`
+	Timestamp  int64      `json:"timestamp" bson:"timestamp"`
+	CreatedAt  time.Time  `json:"-" bson:"created_at"`
+}
+
+func UserKey(appid string, userid int64, userIndex int64) string {
+	return fmt.Sprintf("%d_%d_%s", userid, userIndex, appid)
+}
+
+func UserKeyAppid(user string) string {
+	fields := strings.SplitN(user, "_", 3)
+	if len(fields) != 3 {
+		return ""
+	}
+	return fields[2]
+}
+
+type EventRepository struct {
+	Db *MongoDb
+}
+
+func (this *EventRepository) TableName() string {
+	return TBL_EVENT
+}
+
+func (this *EventRepository) CreateIndex() error {
+	return this.Db.CreateIndex(
+		this.TableName(),
+		[]*mgo.Index{
+			{
+				Key:    []string{SEQ},
+				Unique: true,
+			},
+			{
+				Key:    []string{ADDRS},
+				Unique: false,
+			},
+			{
+				Key:    []string{BADGE_CODES},
+				Unique: false,
+			},
+			{
+				Key:    []string{USERS},
+				Unique: false,
+			},
+			{
+				Key:         []string{CREATED_AT},
+				Unique:      false,
+				ExpireAfter: EVENT_RETENTION,
+			},
+		},
+	)
+}
+
+func (this *EventRepository) AddEvent(event *Event) error {
+	return this.Db.Insert(this.TableName(), event)
+}
+
+func (this *EventRepository) GetLastSeq() (int64, error) {
+	events := make([]*Event, 0, 1)
+	err := this.Db.GetMany(this.TableName(), bson.M{}, nil, "-"+SEQ, 0, 1, &events)
+	if err != nil {
+		return 0, err
+	}
+	if len(events) == 0 {
+		return 0, nil
+	}
+	return events[0].Seq, nil
+}
+
+type EventSeq struct {
+	Id  string `bson:"_id"`
+	Seq int64  `bson:"seq"`
+}
+
+// the counter starts from the last stored event,for databases before the counter
+func (this *EventRepository) InitSeq() error {
+	lastSeq, err := this.GetLastSeq()
+	if err != nil {
+		return err
+	}
+	return this.RaiseSeq(lastSeq)
+}
+
+// the counter is never lowered
+func (this *EventRepository) RaiseSeq(seq int64) error {
+	change := mgo.Change{
+		Update:    bson.M{MONGO_OPERATOR_MAX: bson.M{SEQ: seq}},
+		Upsert:    true,
+		ReturnNew: true,
+	}
+	return this.Db.Apply(TBL_EVENT_SEQ, bson.M{MONGO_ID: EVENT_SEQ_ID}, change, &EventSeq{})
+}
+
+// the counter doc never expires,so seq never goes back even when every event expired
+func (this *EventRepository) NextSeq() (int64, error) {
+	change := mgo.Change{
+		Update:    bson.M{MONGO_OPERATOR_INC: bson.M{SEQ: 1}},
+		Upsert:    true,
+		ReturnNew: true,
+	}
+	eventSeq := &EventSeq{}
+	err := this.Db.Apply(TBL_EVENT_SEQ, bson.M{MONGO_ID: EVENT_SEQ_ID}, change, eventSeq)
+	return eventSeq.Seq, err
+}
+
+// seq of the last published event,0 if none
+func (this *EventRepository) GetSeq() (int64, error) {
+	eventSeq := &EventSeq{}
+	err := this.Db.GetOne(TBL_EVENT_SEQ, bson.M{MONGO_ID: EVENT_SEQ_ID}, nil, eventSeq)
+	if err != nil {
+		if !strings.Contains(err.Error(), MONGO_NOT_FOUND) {
+			return 0, err
+		}
+		return 0, nil
+	}
+	return eventSeq.Seq, nil
+}
+
+func (this *EventRepository) GetAllEventsAfter(seq int64, limit int) ([]*Event, error) {
+	condition := bson.M{
+		SEQ: bson.M{MONGO_OPERATOR_GT: seq},
+	}
+	events := make([]*Event, 0, limit)
+	err := this.Db.GetMany(this.TableName(), condition, nil, SEQ, 0, limit, &events)
+	return events, err
+}
+
+// events after seq touching any of addrs,badgeCodes or users
+func (this *EventRepository) GetEventsAfter(seq int64, addrs []string, badgeCodes []string, users []string, limit int) ([]*Event, error) {
+	conditions := make([]bson.M, 0, 3)
+	if len(addrs) > 0 {
+		conditions = append(conditions, bson.M{ADDRS: bson.M{MONGO_OPERATOR_IN: addrs}})
+	}
+	if len(badgeCodes) > 0 {
+		conditions = append(conditions, bson.M{BADGE_CODES: bson.M{MONGO_OPERATOR_IN: badgeCodes}})
+	}
+	if len(users) > 0 {
+		conditions = append(conditions, bson.M{USERS: bson.M{MONGO_OPERATOR_IN: users}})
+	}
+	events := make([]*Event, 0, limit)
+	if len(conditions) == 0 {
+		return events, nil
+	}
+	condition := bson.M{
+		SEQ:               bson.M{MONGO_OPERATOR_GT: seq},
+		MONGO_OPERATOR_OR: conditions,
+	}
+	err := this.Db.GetMany(this.TableName(), condition, nil, SEQ, 0, limit, &events)
+	return events, err
+}
@@ -0,0 +1,213 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/txn"
+)
+
+const (
+	TBL_SCHEMA_INFO = "schema_info"
+	SCHEMA_INFO_ID  = "schema"
+	VERSION         = "version"
+
+	PARTITION_PARAMS_ID   = "partition_params"
+	PARTITION_BLOCK_COUNT = "partition_block_count"
+	START_HEIGHT          = "start_height"
+
+	MONGO_OPERATOR_EXISTS = "$exists"
+)
+
+type Migration struct {
+	Version  int
+	Describe string
+	Migrate  func(db *MongoDb) error
+}
+
+// append only,never change a released migration
+var MIGRATIONS = []*Migration{
+	{
+		Version:  1,
+		Describe: "baseline,raw_tx_info header row has index -1 and raw tx is split by MAX_SEGMENT_SIZE",
+		Migrate: func(db *MongoDb) error {
+			return nil
+		},
+	},
+	{
+		Version:  2,
+		Describe: "tx_point _id becomes txid_index_type for txn",
+		Migrate:  MigrateTxPointDocId,
+	},
+	{
+		Version:  3,
+		Describe: "build addr_balance from closed txs",
+		Migrate:  RebuildAddrBalances,
+	},
+}
+
+type SchemaInfo struct {
+	Id        string `bson:"_id"`
+	Version   int    `bson:"version"`
+	Timestamp int64  `bson:"timestamp"`
+}
+
+// params the stored partition hashes depend on
+type PartitionParams struct {
+	Id                  string `bson:"_id"`
+	PartitionBlockCount int64  `bson:"partition_block_count"`
+	StartHeight         int64  `bson:"start_height"`
+	Timestamp           int64  `bson:"timestamp"`
+}
+
+func ComparePartitionParams(stored *PartitionParams, current *PartitionParams) error {
+	if stored.PartitionBlockCount != current.PartitionBlockCount {
+		errStr := fmt.Sprintf("Tunables.PartitionBlockCount %d differs from %d the database was built with", current.PartitionBlockCount, stored.PartitionBlockCount)
+		return errors.New(errStr)
+	}
+	if stored.StartHeight != current.StartHeight {
+		errStr := fmt.Sprintf("start height %d differs from %d the database was built with", current.StartHeight, stored.StartHeight)
+		return errors.New(errStr)
+	}
+	return nil
+}
+
+type MigrationRepository struct {
+	Db *MongoDb
+}
+
+func (this *MigrationRepository) TableName() string {
+	return TBL_SCHEMA_INFO
+}
+
+func (this *MigrationRepository) GetSchemaVersion() (int, error) {
+	condition := bson.M{
+		MONGO_ID: SCHEMA_INFO_ID,
+	}
+	schemaInfo := &SchemaInfo{}
+	err := this.Db.GetOne(this.TableName(), condition, nil, schemaInfo)
+	if err != nil {
+		if !strings.Contains(err.Error(), MONGO_NOT_FOUND) {
+			return 0, err
+		}
+		return 0, nil
+	}
+	return schemaInfo.Version, nil
+}
+
+func (this *MigrationRepository) SetSchemaVersion(version int) error {
+	condition := bson.M{
+		MONGO_ID: SCHEMA_INFO_ID,
+	}
+	updator := bson.M{
+		VERSION:   version,
+		TIMESTAMP: time.Now().Unix(),
+	}
+	return this.Db.Upsert(this.TableName(), condition, updator)
+}
+
+// the params of the first run are kept,a run with other ones is refused
+func (this *MigrationRepository) CheckPartitionParams(partitionBlockCount int64, startHeight int64) error {
+	current := &PartitionParams{
+		Id:                  PARTITION_PARAMS_ID,
+		PartitionBlockCount: partitionBlockCount,
+		StartHeight:         startHeight,
+		Timestamp:           time.Now().Unix(),
+	}
+	// params kept without a start height were of the start height of the network
+	err := this.Db.UpdateAll(this.TableName(), bson.M{MONGO_ID: PARTITION_PARAMS_ID, START_HEIGHT: bson.M{MONGO_OPERATOR_EXISTS: false}}, bson.M{START_HEIGHT: startHeight})
+	if err != nil {
+		return err
+	}
+	condition := bson.M{
+		MONGO_ID: PARTITION_PARAMS_ID,
+	}
+	stored := &PartitionParams{}
+	err = this.Db.GetOne(this.TableName(), condition, nil, stored)
+	if err == nil {
+		return ComparePartitionParams(stored, current)
+	}
+	if !strings.Contains(err.Error(), MONGO_NOT_FOUND) {
+		return err
+	}
+	glog.Infof("MigrationRepository.CheckPartitionParams keep %d %d", partitionBlockCount, startHeight)
+	return this.Db.Insert(this.TableName(), current)
+}
+
+func CheckMigrations(migrations []*Migration) error {
+	for index, migration := range migrations {
+		if migration.Version != index+1 {
+			errStr := fmt.Sprintf("migration %d has version %d", index, migration.Version)
+			return errors.New(errStr)
+		}
+	}
+	return nil
+}
+
+// refuse to run on a database migrated by a newer binary
+func (this *MigrationRepository) Migrate(migrations []*Migration, dryRun bool) error {
+	err := CheckMigrations(migrations)
+	if err != nil {
+		return err
+	}
+	version, err := this.GetSchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		errStr := fmt.Sprintf("database schema version %d is newer than binary %d", version, len(migrations))
+		return errors.New(errStr)
+	}
+	glog.Infof("Migrate schema version %d binary %d dryRun:%t", version, len(migrations), dryRun)
+	for _, migration := range migrations[version:] {
+		if dryRun {
+			glog.Infof("Migrate pending %d %s", migration.Version, migration.Describe)
+			continue
+		}
+		glog.Infof("Migrate start %d %s", migration.Version, migration.Describe)
+		err := migration.Migrate(this.Db)
+		if err != nil {
+			glog.Infof("Migrate %d err:%s", migration.Version, err)
+			return err
+		}
+		err = this.SetSchemaVersion(migration.Version)
+		if err != nil {
+			return err
+		}
+		glog.Infof("Migrate done %d", migration.Version)
+	}
+	return nil
+}
+
+type legacyTxPointDoc struct {
+	Id      bson.ObjectId `bson:"_id"`
+	TxPoint `bson:",inline"`
+}
+
+func MigrateTxPointDocId(db *MongoDb) error {
+	condition := bson.M{
+		MONGO_ID: bson.M{MONGO_OPERATOR_TYPE: "objectId"},
+	}
+	doc := &legacyTxPointDoc{}
+	f := func() error {
+		id := TxPointDocId(doc.Txid, doc.Index, doc.Type)
+		ops := []txn.Op{
+			{
+				C:      TBL_TX_POINT,
+				Id:     doc.Id,
+				Remove: true,
+			},
+			{
+				C:      TBL_TX_POINT,
+				Id:     id,
+				Insert: &TxPointDoc{Id: id, TxPoint: doc.TxPoint},
+			},
+		}
+		return db.RunTxn(ops)
+	}
+	return db.Foreach(TBL_TX_POINT, condition, doc, f)
+}
@@ -0,0 +1,31 @@
+package models
+
+import "testing"
+
+func TestCheckMigrations(t *testing.T) {
+	err := CheckMigrations(MIGRATIONS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrations := []*Migration{MIGRATIONS[1]}
+	err = CheckMigrations(migrations)
+	if err == nil {
+		t.Fatal("migrations out of order not rejected")
+	}
+}
+
+func TestComparePartitionParams(t *testing.T) {
+	stored := &PartitionParams{PartitionBlockCount: 10, StartHeight: 650000}
+	err := ComparePartitionParams(stored, &PartitionParams{PartitionBlockCount: 10, StartHeight: 650000, Timestamp: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ComparePartitionParams(stored, &PartitionParams{PartitionBlockCount: 20, StartHeight: 650000})
+	if err == nil {
+		t.Fatal("other PartitionBlockCount not refused")
+	}
+	err = ComparePartitionParams(stored, &PartitionParams{PartitionBlockCount: 10, StartHeight: 0})
+	if err == nil {
+		t.Fatal("other start height not refused")
+	}
+}
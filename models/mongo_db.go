@@ -3,9 +3,11 @@ package models
 import (
 	"errors"
 	"fmt"
+	"time"
 
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/txn"
 )
 
 const (
@@ -14,15 +16,30 @@ const (
 	MONGO_ERROR_DUPLICATE = "E11000"
 	MONGO_NOT_FOUND       = "not found"
 
+	TBL_TXN = "txn"
+	// mgo/txn states of txns that are done
+	TXN_STATE_ABORTED = 5
+	TXN_STATE_APPLIED = 6
+	TXN_QUEUE         = "txn-queue"
+	TXN_STATE         = "s"
+
+	MONGO_OPERATOR_PULL_ALL = "$pullAll"
+
 	MONGO_ID                     = "_id"
 	MONGO_OPERATOR_SET           = "$set"
 	MONGO_OPERATOR_GTE           = "$gte"
 	MONGO_OPERATOR_LT            = "$lt"
+	MONGO_OPERATOR_GT            = "$gt"
+	MONGO_OPERATOR_NE            = "$ne"
+	MONGO_OPERATOR_IN            = "$in"
+	MONGO_OPERATOR_TYPE          = "$type"
 	MONGO_OPERATOR_OR            = "$or"
 	MONGO_OPERATOR_MATCH         = "$match"
 	MONGO_OPERATOR_PROJECT       = "$project"
 	MONGO_OPERATOR_UNWIND        = "$unwind"
 	MONGO_OPERATOR_LOOKUP        = "$lookup"
+	MONGO_OPERATOR_GROUP         = "$group"
+	MONGO_OPERATOR_SUM           = "$sum"
 	MONGO_OPERATOR_FROM          = "from"
 	MONGO_OPERATOR_LOACL_FIELD   = "localField"
 	MONGO_OPERATOR_FOREIGN_FIELD = "foreignField"
@@ -64,6 +81,15 @@ func (this *MongoDb) NewSession() (*mgo.Session, error) {
 	return nil, errors.New(errStr)
 }
 
+// one ping of a clone without reconnecting,so a check of a down mongo fails within timeout
+func (this *MongoDb) Ping(timeout time.Duration) error {
+	sess := this.sess.Clone()
+	defer sess.Close()
+	sess.SetSyncTimeout(timeout)
+	sess.SetSocketTimeout(timeout)
+	return sess.Ping()
+}
+
 func (this *MongoDb) Exec(colName string, opreation func(*mgo.Collection) error) error {
 	sess, err := this.NewSession()
 	if err != nil {
@@ -101,6 +127,16 @@ func (this *MongoDb) GetMany(colName string, condition bson.M, selector bson.M,
 	return this.Exec(colName, operation)
 }
 
+func (this *MongoDb) GetPage(colName string, condition bson.M, selector bson.M, sorts []string, limit int, result interface{}) error {
+	operation := func(col *mgo.Collection) error {
+		if selector != nil {
+			return col.Find(condition).Select(selector).Sort(sorts...).Limit(limit).All(result)
+		}
+		return col.Find(condition).Sort(sorts...).Limit(limit).All(result)
+	}
+	return this.Exec(colName, operation)
+}
+
 func (this *MongoDb) GetAll(colName string, condition bson.M, selector bson.M, sort string, result interface{}) error {
 	operation := func(col *mgo.Collection) error {
 		if selector != nil {
@@ -154,6 +190,26 @@ func (this *MongoDb) UpdateOne(colName string, condition bson.M, updator bson.M)
 	return this.Exec(colName, operation)
 }
 
+func (this *MongoDb) Upsert(colName string, condition bson.M, updator bson.M) error {
+	operation := func(col *mgo.Collection) error {
+		setUpdator := bson.M{
+			MONGO_OPERATOR_SET: updator,
+		}
+		_, err := col.Upsert(condition, setUpdator)
+		return err
+	}
+	return this.Exec(colName, operation)
+}
+
+// find and modify one doc,result is the doc before or after change by change.ReturnNew
+func (this *MongoDb) Apply(colName string, condition bson.M, change mgo.Change, result interface{}) error {
+	operation := func(col *mgo.Collection) error {
+		_, err := col.Find(condition).Apply(change, result)
+		return err
+	}
+	return this.Exec(colName, operation)
+}
+
 func (this *MongoDb) CreateIndex(colName string, Indexs []*mgo.Index) error {
 	opreation := func(col *mgo.Collection) error {
 		for _, index := range Indexs {
@@ -204,3 +260,97 @@ func (this *MongoDb) Foreach(colName string, conditions bson.M, result interface
 	}
 	return this.Exec(colName, operation)
 }
+
+// ops are applied all or none, a txn interrupted by crash is finished by ResumeTxns
+func (this *MongoDb) RunTxn(ops []txn.Op) error {
+	operation := func(col *mgo.Collection) error {
+		runner := txn.NewRunner(col)
+		return runner.Run(ops, "", nil)
+	}
+	return this.Exec(TBL_TXN, operation)
+}
+
+func (this *MongoDb) ResumeTxns() error {
+	operation := func(col *mgo.Collection) error {
+		runner := txn.NewRunner(col)
+		return runner.ResumeAll()
+	}
+	return this.Exec(TBL_TXN, operation)
+}
+
+// txns neither applied nor aborted,ResumeTxns leaves them only when they fail again
+func (this *MongoDb) CountPendingTxns() (int64, error) {
+	condition := bson.M{
+		TXN_STATE: bson.M{MONGO_OPERATOR_NIN: []int{TXN_STATE_ABORTED, TXN_STATE_APPLIED}},
+	}
+	return this.Count(TBL_TXN, condition)
+}
+
+// pairs are selector and updator of each doc
+func (this *MongoDb) BulkUpsert(colName string, pairs []interface{}) error {
+	if len(pairs) == 0 {
+		return nil
+	}
+	operation := func(col *mgo.Collection) error {
+		bulk := col.Bulk()
+		bulk.Unordered()
+		bulk.Upsert(pairs...)
+		_, err := bulk.Run()
+		return err
+	}
+	return this.Exec(colName, operation)
+}
+
+// collections changed by txns,stash keeps docs being inserted or removed
+var TXN_COLLECTIONS = []string{TBL_RAW_TX_INFO, TBL_TX_POINT, TBL_ADDR_BALANCE, TBL_TXN + ".stash"}
+
+type FinishedTxn struct {
+	Id    bson.ObjectId `bson:"_id"`
+	Nonce string        `bson:"n"`
+}
+
+// same as the tokens mgo/txn keeps in txn-queue
+func TxnTokens(txns []*FinishedTxn) []string {
+	tokens := make([]string, 0, len(txns))
+	for _, finishedTxn := range txns {
+		tokens = append(tokens, finishedTxn.Id.Hex()+"_"+finishedTxn.Nonce)
+	}
+	return tokens
+}
+
+// up to limit txns done before are removed.their tokens are pulled from the queues first,
+// as mgo/txn does itself for done txns,so no runner meets a token of a removed txn
+func (this *MongoDb) PurgeTxns(before time.Time, limit int) (int, error) {
+	condition := bson.M{
+		TXN_STATE: bson.M{MONGO_OPERATOR_IN: []int{TXN_STATE_ABORTED, TXN_STATE_APPLIED}},
+		MONGO_ID:  bson.M{MONGO_OPERATOR_LT: bson.NewObjectIdWithTime(before)},
+	}
+	txns := make([]*FinishedTxn, 0, limit)
+	err := this.GetMany(TBL_TXN, condition, bson.M{MONGO_ID: 1, "n": 1}, MONGO_ID, 0, limit, &txns)
+	if err != nil {
+		return 0, err
+	}
+	if len(txns) == 0 {
+		return 0, nil
+	}
+	tokens := TxnTokens(txns)
+	for _, colName := range TXN_COLLECTIONS {
+		operation := func(col *mgo.Collection) error {
+			_, err := col.UpdateAll(bson.M{TXN_QUEUE: bson.M{MONGO_OPERATOR_IN: tokens}}, bson.M{MONGO_OPERATOR_PULL_ALL: bson.M{TXN_QUEUE: tokens}})
+			return err
+		}
+		err = this.Exec(colName, operation)
+		if err != nil {
+			return 0, err
+		}
+	}
+	ids := make([]bson.ObjectId, 0, len(txns))
+	for _, finishedTxn := range txns {
+		ids = append(ids, finishedTxn.Id)
+	}
+	err = this.DeleteAll(TBL_TXN, bson.M{MONGO_ID: bson.M{MONGO_OPERATOR_IN: ids}})
+	if err != nil {
+		return 0, err
+	}
+	return len(txns), nil
+}
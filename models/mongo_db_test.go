@@ -0,0 +1,16 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestTxnTokens(t *testing.T) {
+	id := bson.ObjectIdHex("5f8d0d55b54764421b7156c5")
+	tokens := TxnTokens([]*FinishedTxn{{Id: id, Nonce: "a1b2c3d4"}})
+	if !reflect.DeepEqual(tokens, []string{"5f8d0d55b54764421b7156c5_a1b2c3d4"}) {
+		t.Fatalf("tokens %v", tokens)
+	}
+}
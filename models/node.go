@@ -1,27 +1,117 @@
 package models
 
+import (
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
 const (
 	TABLE_NODE = "node"
+
+	PUBKEY       = "pubkey"
+	HOST         = "host"
+	CAPABILITIES = "capabilities"
+	SIGNATURE    = "signature"
+	INTRODUCERS  = "introducers"
+
+	MONGO_OPERATOR_ADD_TO_SET    = "$addToSet"
+	MONGO_OPERATOR_SET_ON_INSERT = "$setOnInsert"
+	MONGO_OPERATOR_NIN           = "$nin"
 )
 
+// a peer announced by itself,introducers are the peers we heard it from
 type Node struct {
-	Host   string `bson:"host"`
-	Pubkey string `bson:"pubkey"`
+	Pubkey       string   `json:"pubkey" bson:"pubkey"`
+	Host         string   `json:"host" bson:"host"`
+	Capabilities []string `json:"capabilities" bson:"capabilities"`
+	Timestamp    int64    `json:"timestamp" bson:"timestamp"`
+	Signature    string   `json:"signature" bson:"signature"`
+	Introducers  []string `json:"introducers" bson:"introducers"`
 }
 
 type NodeRepository struct {
-	db *MongoDb
+	Db *MongoDb
+}
+
+func (this *NodeRepository) TableName() string {
+	return TABLE_NODE
+}
+
+func (this *NodeRepository) CreateIndex() error {
+	return this.Db.CreateIndex(
+		this.TableName(),
+		[]*mgo.Index{
+			{
+				Key:    []string{PUBKEY},
+				Unique: true,
+			},
+		},
+	)
 }
 
 func (this *NodeRepository) GetNodes(offset int, limit int) ([]*Node, error) {
 	nodes := make([]*Node, 0, 8)
-	err := this.db.GetMany(TABLE_NODE, nil, nil, MONGO_ID, offset, limit, nodes)
+	err := this.Db.GetMany(this.TableName(), nil, nil, MONGO_ID, offset, limit, &nodes)
 	return nodes, err
 }
 
-func (this *NodeRepository) AddNode(Host string) error {
-	node := &Node{
-		Host: Host,
+func (this *NodeRepository) GetAllNodes() ([]*Node, error) {
+	nodes := make([]*Node, 0, 8)
+	err := this.Db.GetAll(this.TableName(), nil, nil, MONGO_ID, &nodes)
+	return nodes, err
+}
+
+// nodes none of the introducers vouches for
+func (this *NodeRepository) CountNodesNotIntroducedBy(introducers []string) (int64, error) {
+	condition := bson.M{
+		INTRODUCERS: bson.M{MONGO_OPERATOR_NIN: introducers},
+	}
+	return this.Db.Count(this.TableName(), condition)
+}
+
+// the introducer is always added,the announcement only replaces an older one.
+// a node not stored yet is inserted only when insert is true,changed is false when nothing was written
+func (this *NodeRepository) SaveNode(node *Node, introducer string, insert bool) (bool, error) {
+	changed := false
+	updator := bson.M{
+		MONGO_OPERATOR_ADD_TO_SET:    bson.M{INTRODUCERS: introducer},
+		MONGO_OPERATOR_SET_ON_INSERT: bson.M{TIMESTAMP: int64(0)},
+	}
+	err := this.Db.Exec(this.TableName(), func(col *mgo.Collection) error {
+		if !insert {
+			delete(updator, MONGO_OPERATOR_SET_ON_INSERT)
+			info, err := col.UpdateAll(bson.M{PUBKEY: node.Pubkey}, updator)
+			if err != nil {
+				return err
+			}
+			changed = info.Updated > 0
+			return nil
+		}
+		info, err := col.Upsert(bson.M{PUBKEY: node.Pubkey}, updator)
+		if err != nil {
+			return err
+		}
+		changed = info.UpsertedId != nil || info.Updated > 0
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	condition := bson.M{
+		PUBKEY:    node.Pubkey,
+		TIMESTAMP: bson.M{MONGO_OPERATOR_LT: node.Timestamp},
+	}
+	err = this.Db.UpdateOne(this.TableName(), condition, bson.M{
+		HOST:         node.Host,
+		CAPABILITIES: node.Capabilities,
+		TIMESTAMP:    node.Timestamp,
+		SIGNATURE:    node.Signature,
+	})
+	if err == mgo.ErrNotFound {
+		return changed, nil
+	}
+	if err != nil {
+		return false, err
 	}
-	return this.db.Insert(TABLE_NODE, node)
+	return true, nil
 }
@@ -0,0 +1,111 @@
+package models
+
+import (
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	TBL_PAYOUT_BATCH = "payout_batch"
+
+	IDEMPOTENCY_KEY = "idempotency_key"
+	TXS             = "txs"
+	RECIPIENTS      = "recipients"
+
+	PAYOUT_TX_STATE_WAIT      = 1
+	PAYOUT_TX_STATE_BUILT     = 2
+	PAYOUT_TX_STATE_SENT      = 3
+	PAYOUT_TX_STATE_CONFIRMED = 4
+
+	PAYOUT_BATCH_STATE_PROCESSING = 1
+	PAYOUT_BATCH_STATE_DONE       = 2
+)
+
+type PayoutRecipient struct {
+	Addr    string `json:"addr" bson:"addr"`
+	Amount  int64  `json:"amount" bson:"amount"`
+	TxIndex int    `json:"tx_index" bson:"tx_index"`
+	Vout    int    `json:"vout" bson:"vout"`
+	State   int    `json:"state" bson:"state"`
+}
+
+type PayoutTx struct {
+	Index        int        `json:"index" bson:"index"`
+	State        int        `json:"state" bson:"state"`
+	UnFinishedTx string     `json:"unfinished_tx" bson:"unfinished_tx"`
+	Vins         []*TxPoint `json:"vins" bson:"vins"`
+	Txid         string     `json:"txid" bson:"txid"`
+}
+
+type PayoutBatch struct {
+	Appid          string             `json:"appid" bson:"appid"`
+	IdempotencyKey string             `json:"idempotency_key" bson:"idempotency_key"`
+	UserID         int64              `json:"userid" bson:"userid"`
+	UserIndex      int64              `json:"user_index" bson:"user_index"`
+	BadgeCode      string             `json:"badge_code" bson:"badge_code"`
+	ChangeAddr     string             `json:"change_addr" bson:"change_addr"`
+	State          int                `json:"state" bson:"state"`
+	Txs            []*PayoutTx        `json:"txs" bson:"txs"`
+	Recipients     []*PayoutRecipient `json:"recipients" bson:"recipients"`
+	Timestamp      int64              `json:"timestamp" bson:"timestamp"`
+}
+
+type PayoutBatchRepository struct {
+	Db *MongoDb
+}
+
+func (this *PayoutBatchRepository) TableName() string {
+	return TBL_PAYOUT_BATCH
+}
+
+func (this *PayoutBatchRepository) CreateIndex() error {
+	return this.Db.CreateIndex(
+		this.TableName(),
+		[]*mgo.Index{
+			{
+				Key:    []string{APPID, IDEMPOTENCY_KEY},
+				Unique: true,
+			},
+			{
+				Key:    []string{STATE},
+				Unique: false,
+			},
+		},
+	)
+}
+
+func (this *PayoutBatchRepository) AddPayoutBatch(payoutBatch *PayoutBatch) error {
+	return this.Db.Insert(this.TableName(), payoutBatch)
+}
+
+func (this *PayoutBatchRepository) GetPayoutBatch(appid string, idempotencyKey string) (*PayoutBatch, error) {
+	condition := bson.M{
+		APPID:           appid,
+		IDEMPOTENCY_KEY: idempotencyKey,
+	}
+	payoutBatch := &PayoutBatch{}
+	err := this.Db.GetOne(this.TableName(), condition, nil, payoutBatch)
+	return payoutBatch, err
+}
+
+func (this *PayoutBatchRepository) GetPayoutBatchsByState(state int) ([]*PayoutBatch, error) {
+	condition := bson.M{
+		STATE: state,
+	}
+	payoutBatchs := make([]*PayoutBatch, 0, 8)
+	err := this.Db.GetAll(this.TableName(), condition, nil, MONGO_ID, &payoutBatchs)
+	return payoutBatchs, err
+}
+
+func (this *PayoutBatchRepository) UpdatePayoutBatchProgress(payoutBatch *PayoutBatch) error {
+	condition := bson.M{
+		APPID:           payoutBatch.Appid,
+		IDEMPOTENCY_KEY: payoutBatch.IdempotencyKey,
+	}
+	updator := bson.M{
+		STATE:      payoutBatch.State,
+		TXS:        payoutBatch.Txs,
+		RECIPIENTS: payoutBatch.Recipients,
+	}
+	return this.Db.UpdateOne(this.TableName(), condition, updator)
+}
@@ -10,6 +10,7 @@ import (
 
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/txn"
 )
 
 const (
@@ -60,6 +61,10 @@ func (this *TxInfoRepository) CreateIndex() error {
 				Key:    []string{HEIGHT},
 				Unique: false,
 			},
+			{
+				Key:    []string{STATE},
+				Unique: false,
+			},
 		},
 	)
 }
@@ -78,39 +83,106 @@ func (this *TxInfoRepository) IsMsgTxClosed(txid string) (bool, error) {
 }
 
 type MsgTxBriefInfo struct {
-	Txid      string `bson:"txid"`
-	Height    int64  `bson:"height"`
-	BlockHash string `bson:"blockhash"`
-	Timestamp int64  `bson:"timestamp"`
-	State     int    `bson:"state"`
+	Id        bson.ObjectId `bson:"_id"`
+	Txid      string        `bson:"txid"`
+	Height    int64         `bson:"height"`
+	BlockHash string        `bson:"blockhash"`
+	Timestamp int64         `bson:"timestamp"`
+	State     int           `bson:"state"`
 }
 
+// the header is changed by txn as CloseMsgTx does,mgo txn can not be mixed with plain writes of the same doc
+func (this *TxInfoRepository) updateMsgTxHeader(txid string, assert interface{}, updator bson.M) error {
+	msgTxBriefInfo, err := this.GetMsgTxBriefInfo(txid)
+	if err != nil {
+		return err
+	}
+	ops := []txn.Op{
+		{
+			C:      this.TableName(),
+			Id:     msgTxBriefInfo.Id,
+			Assert: assert,
+			Update: bson.M{MONGO_OPERATOR_SET: updator},
+		},
+	}
+	return this.Db.RunTxn(ops)
+}
+
+// a closed tx is never set back to new or open
 func (this *TxInfoRepository) SetMsgTxState(txid string, state int) error {
 	switch state {
-	case TX_STATE_NEW, TX_STATE_OPEN, TX_STATE_CLOSED:
-		condition := bson.M{
-			TXID:  txid,
-			INDEX: TX_INFO_INDEX,
+	case TX_STATE_NEW, TX_STATE_OPEN:
+		err := this.updateMsgTxHeader(txid, bson.M{STATE: bson.M{MONGO_OPERATOR_NE: TX_STATE_CLOSED}}, bson.M{STATE: state})
+		if err == txn.ErrAborted {
+			// closed by others
+			return nil
 		}
-		updator := bson.M{
-			STATE: state,
-		}
-		return this.Db.UpdateOne(this.TableName(), condition, updator)
+		return err
+	case TX_STATE_CLOSED:
+		return this.updateMsgTxHeader(txid, txn.DocExists, bson.M{STATE: state})
 	}
 	errStr := fmt.Sprintf("not support state %d", state)
 	return errors.New(errStr)
 }
 
-func (this *TxInfoRepository) SetMsgTxHeightHash(txid string, height int64, hash string) error {
+// vins and vouts of the tx are inserted by ops together with the closed state
+func (this *TxInfoRepository) CloseMsgTx(msgTxBriefInfo *MsgTxBriefInfo, ops []txn.Op) error {
+	if msgTxBriefInfo.State == TX_STATE_CLOSED {
+		return nil
+	}
+	ops = append(ops, txn.Op{
+		C:      this.TableName(),
+		Id:     msgTxBriefInfo.Id,
+		Assert: bson.M{STATE: bson.M{MONGO_OPERATOR_NE: TX_STATE_CLOSED}},
+		Update: bson.M{MONGO_OPERATOR_SET: bson.M{STATE: TX_STATE_CLOSED}},
+	})
+	err := this.Db.RunTxn(ops)
+	if err == txn.ErrAborted {
+		// closed by others
+		return nil
+	}
+	return err
+}
+
+// header is removed by ops in the same txn,raw tx parts are removed after it
+func (this *TxInfoRepository) RemoveMsgTx(msgTxBriefInfo *MsgTxBriefInfo, ops []txn.Op) error {
+	ops = append(ops, txn.Op{
+		C:      this.TableName(),
+		Id:     msgTxBriefInfo.Id,
+		Assert: bson.M{STATE: msgTxBriefInfo.State},
+		Remove: true,
+	})
+	err := this.Db.RunTxn(ops)
+	if err != nil {
+		return err
+	}
+	return this.DeleteMsgTx(msgTxBriefInfo.Txid)
+}
+
+func (this *TxInfoRepository) GetMsgTxBriefInfosByStates(states []int) ([]*MsgTxBriefInfo, error) {
+	result := make([]*MsgTxBriefInfo, 0, 128)
+	condition := bson.M{
+		INDEX: TX_INFO_INDEX,
+		STATE: bson.M{MONGO_OPERATOR_IN: states},
+	}
+	err := this.Db.GetAll(this.TableName(), condition, nil, MONGO_ID, &result)
+	return result, err
+}
+
+func (this *TxInfoRepository) CountMsgTxsByState(state int) (int64, error) {
 	condition := bson.M{
-		TXID:  txid,
 		INDEX: TX_INFO_INDEX,
+		STATE: state,
 	}
+	return this.Db.Count(this.TableName(), condition)
+}
+
+func (this *TxInfoRepository) SetMsgTxHeightHash(txid string, height int64, hash string) error {
 	updator := bson.M{
 		HASH:   hash,
 		HEIGHT: height,
 	}
-	return this.Db.UpdateOne(this.TableName(), condition, updator)
+	return this.updateMsgTxHeader(txid, txn.DocExists, updator)
 }
 
 func (this *TxInfoRepository) GetMsgTxBriefInfo(txid string) (*MsgTxBriefInfo, error) {
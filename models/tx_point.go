@@ -1,10 +1,15 @@
 package models
 
 import (
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/txn"
 )
 
 const (
@@ -32,6 +37,15 @@ type TxPoint struct {
 	State     int    `json:"-" bson:"state"`
 }
 
+type TxPointDoc struct {
+	Id      string `bson:"_id"`
+	TxPoint `bson:",inline"`
+}
+
+func TxPointDocId(txid string, index int, Type int) string {
+	return fmt.Sprintf("%s_%d_%d", txid, index, Type)
+}
+
 type TxPointRepository struct {
 	Db *MongoDb
 }
@@ -60,6 +74,14 @@ func (this *TxPointRepository) CreateIndex() error {
 				Key:    []string{TIMESTAMP},
 				Unique: false,
 			},
+			{
+				Key:    []string{PRETXID, PREINDEX},
+				Unique: false,
+			},
+			{
+				Key:    []string{ADDR, BADGE_CODE, TIMESTAMP, TXID, INDEX, TYPE},
+				Unique: false,
+			},
 		},
 	)
 }
@@ -79,6 +101,44 @@ func (this *TxPointRepository) AddTxPoint(txPoint *TxPoint) error {
 	return this.Db.Insert(this.TableName(), txPoint)
 }
 
+// points already written before are skipped, so closing a tx twice is harmless
+func (this *TxPointRepository) InsertTxPointOps(txid string, txPoints []*TxPoint) ([]txn.Op, error) {
+	oldTxPoints, err := this.GetTxPoints(txid)
+	if err != nil {
+		return nil, err
+	}
+	existIds := make(map[string]bool)
+	for _, oldTxPoint := range oldTxPoints {
+		existIds[TxPointDocId(oldTxPoint.Txid, oldTxPoint.Index, oldTxPoint.Type)] = true
+	}
+	ops := make([]txn.Op, 0, len(txPoints))
+	for _, txPoint := range txPoints {
+		id := TxPointDocId(txPoint.Txid, txPoint.Index, txPoint.Type)
+		_, ok := existIds[id]
+		if ok {
+			continue
+		}
+		ops = append(ops, txn.Op{
+			C:      this.TableName(),
+			Id:     id,
+			Insert: &TxPointDoc{Id: id, TxPoint: *txPoint},
+		})
+	}
+	return ops, nil
+}
+
+func (this *TxPointRepository) RemoveTxPointOps(txPoints []*TxPoint) []txn.Op {
+	ops := make([]txn.Op, 0, len(txPoints))
+	for _, txPoint := range txPoints {
+		ops = append(ops, txn.Op{
+			C:      this.TableName(),
+			Id:     TxPointDocId(txPoint.Txid, txPoint.Index, txPoint.Type),
+			Remove: true,
+		})
+	}
+	return ops
+}
+
 func (this *TxPointRepository) GetTxPoint(txid string, index int, Type int) (*TxPoint, error) {
 	if Type == TX_POINT_TYPE_ALL {
 		return nil, errors.New("only support in or out,not all")
@@ -93,6 +153,17 @@ func (this *TxPointRepository) GetTxPoint(txid string, index int, Type int) (*Tx
 	return txPoint, err
 }
 
+func (this *TxPointRepository) GetVinTxPointByPreOutPoint(preTxid string, preIndex int) (*TxPoint, error) {
+	condition := bson.M{
+		PRETXID:  preTxid,
+		PREINDEX: preIndex,
+		TYPE:     TX_POINT_TYPE_VIN,
+	}
+	txPoint := &TxPoint{}
+	err := this.Db.GetOne(this.TableName(), condition, nil, txPoint)
+	return txPoint, err
+}
+
 func (this *TxPointRepository) GetTxPoints(txid string) ([]*TxPoint, error) {
 	condition := bson.M{
 		TXID: txid,
@@ -115,24 +186,217 @@ func (this *TxPointRepository) GetTxPointsByAddr(addr string, badgeCode string,
 	return txPoints, err
 }
 
-func (this *TxPointRepository) DeleteTxPoints(txid string) error {
+// position of a page,next page starts after (timestamp,txid,index,type)
+type TxPointCursor struct {
+	Timestamp int64
+	Txid      string
+	Index     int
+	Type      int
+}
+
+func (this *TxPointCursor) Encode() string {
+	cursor := fmt.Sprintf("%d_%s_%d_%d", this.Timestamp, this.Txid, this.Index, this.Type)
+	return base64.RawURLEncoding.EncodeToString([]byte(cursor))
+}
+
+func DecodeTxPointCursor(cursor string) (*TxPointCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Split(string(data), "_")
+	if len(fields) != 4 {
+		return nil, errors.New("illegal cursor")
+	}
+	timestamp, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	index, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return nil, err
+	}
+	Type, err := strconv.Atoi(fields[3])
+	if err != nil {
+		return nil, err
+	}
+	return &TxPointCursor{
+		Timestamp: timestamp,
+		Txid:      fields[1],
+		Index:     index,
+		Type:      Type,
+	}, nil
+}
+
+// conditions to be joined by $or
+func (this *TxPointCursor) Conditions(desc bool) []bson.M {
+	operator := MONGO_OPERATOR_GT
+	if desc {
+		operator = MONGO_OPERATOR_LT
+	}
+	return []bson.M{
+		{TIMESTAMP: bson.M{operator: this.Timestamp}},
+		{TIMESTAMP: this.Timestamp, TXID: bson.M{operator: this.Txid}},
+		{TIMESTAMP: this.Timestamp, TXID: this.Txid, INDEX: bson.M{operator: this.Index}},
+		{TIMESTAMP: this.Timestamp, TXID: this.Txid, INDEX: this.Index, TYPE: bson.M{operator: this.Type}},
+	}
+}
+
+func (this *TxPointRepository) GetTxPointsPage(addrs []string, badgeCode string, Type int, state int, cursor *TxPointCursor, desc bool, limit int) ([]*TxPoint, error) {
 	condition := bson.M{
-		TXID: txid,
+		ADDR:       bson.M{MONGO_OPERATOR_IN: addrs},
+		BADGE_CODE: badgeCode,
+	}
+	if Type != TX_POINT_TYPE_ALL {
+		condition[TYPE] = Type
+	}
+	if state != TX_POINT_STATE_ALL {
+		condition[STATE] = state
+	}
+	if cursor != nil {
+		condition[MONGO_OPERATOR_OR] = cursor.Conditions(desc)
 	}
-	return this.Db.DeleteAll(this.TableName(), condition)
+	sorts := []string{TIMESTAMP, TXID, INDEX, TYPE}
+	if desc {
+		sorts = []string{"-" + TIMESTAMP, "-" + TXID, "-" + INDEX, "-" + TYPE}
+	}
+	txPoints := make([]*TxPoint, 0, limit)
+	err := this.Db.GetPage(this.TableName(), condition, nil, sorts, limit, &txPoints)
+	return txPoints, err
 }
 
-func (this *TxPointRepository) SetTxPointState(txid string, index int, Type int, state int) error {
+// vins spending the given vouts
+func (this *TxPointRepository) GetVinTxPointsByPreOutPoints(txPoints []*TxPoint, state int) ([]*TxPoint, error) {
+	vins := make([]*TxPoint, 0, 8)
+	if len(txPoints) == 0 {
+		return vins, nil
+	}
+	preOutPoints := make([]bson.M, 0, len(txPoints))
+	for _, txPoint := range txPoints {
+		preOutPoints = append(preOutPoints, bson.M{PRETXID: txPoint.Txid, PREINDEX: txPoint.Index})
+	}
+	condition := bson.M{
+		TYPE:              TX_POINT_TYPE_VIN,
+		MONGO_OPERATOR_OR: preOutPoints,
+	}
+	if state != TX_POINT_STATE_ALL {
+		condition[STATE] = state
+	}
+	err := this.Db.GetAll(this.TableName(), condition, nil, MONGO_ID, &vins)
+	return vins, err
+}
+
+// removed by txn,the points may be inserted by a txn not finished yet
+func (this *TxPointRepository) DeleteTxPoints(txid string) error {
+	txPoints, err := this.GetTxPoints(txid)
+	if err != nil {
+		return err
+	}
+	if len(txPoints) == 0 {
+		return nil
+	}
+	return this.Db.RunTxn(this.RemoveTxPointOps(txPoints))
+}
+
+func (this *TxPointRepository) SetTxPointStateOp(txid string, index int, Type int, state int) (txn.Op, error) {
 	if Type == TX_POINT_TYPE_ALL {
-		return errors.New("only support in or out,not all")
+		return txn.Op{}, errors.New("only support in or out,not all")
 	}
-	conditions := bson.M{
-		TXID:  txid,
-		INDEX: index,
-		TYPE:  Type,
+	return txn.Op{
+		C:      this.TableName(),
+		Id:     TxPointDocId(txid, index, Type),
+		Assert: txn.DocExists,
+		Update: bson.M{MONGO_OPERATOR_SET: bson.M{STATE: state}},
+	}, nil
+}
+
+// points are written by txn as CloseMsgTx does,a missing point is not found
+func (this *TxPointRepository) SetTxPointState(txid string, index int, Type int, state int) error {
+	op, err := this.SetTxPointStateOp(txid, index, Type, state)
+	if err != nil {
+		return err
+	}
+	err = this.Db.RunTxn([]txn.Op{op})
+	if err == txn.ErrAborted {
+		return mgo.ErrNotFound
 	}
-	updator := bson.M{
-		STATE: state,
+	return err
+}
+
+// the vin and the vout it spends are set together
+func (this *TxPointRepository) SetVinAndPreVoutState(vin *TxPoint, state int) error {
+	voutOp, err := this.SetTxPointStateOp(vin.PreTxid, vin.PreIndex, TX_POINT_TYPE_VOUT, state)
+	if err != nil {
+		return err
+	}
+	vinOp, err := this.SetTxPointStateOp(vin.Txid, vin.Index, TX_POINT_TYPE_VIN, state)
+	if err != nil {
+		return err
+	}
+	err = this.Db.RunTxn([]txn.Op{voutOp, vinOp})
+	if err == txn.ErrAborted {
+		return mgo.ErrNotFound
+	}
+	return err
+}
+
+// docs of the _id before txn,they are moved by the migration of schema version 2
+func (this *TxPointRepository) CountLegacyTxPoints() (int64, error) {
+	condition := bson.M{
+		MONGO_ID: bson.M{MONGO_OPERATOR_TYPE: "objectId"},
+	}
+	return this.Db.Count(this.TableName(), condition)
+}
+
+type AddrBadgeCode struct {
+	Addr      string `json:"addr" bson:"addr"`
+	BadgeCode string `json:"badge_code" bson:"badge_code"`
+}
+
+type AddrBadgeCount struct {
+	Addr      string `bson:"addr"`
+	BadgeCode string `bson:"badge_code"`
+	Count     int    `bson:"count"`
+}
+
+// this code will do something like this
+// db.tx_point.aggregate([
+//     {
+//         "$match":{"type":2,"state":1}
+//     },
+//     {
+//         "$group":{"_id":{"addr":"$addr","badge_code":"$badge_code"},"count":{"$sum":1}}
+//     },
+//     {
+//         "$match":{"count":{"$gte":100}}
+//     },
+//     {
+//         "$project":{"addr":"$_id.addr","badge_code":"$_id.badge_code","count":1}
+//     }
+// ])
+func (this *TxPointRepository) GetAddrBadgeCounts(minCount int) ([]*AddrBadgeCount, error) {
+	conditions := []bson.M{
+		{
+			MONGO_OPERATOR_MATCH: bson.M{TYPE: TX_POINT_TYPE_VOUT, STATE: TX_POINT_STATE_MAY_BE_UNSPENT},
+		},
+		{
+			MONGO_OPERATOR_GROUP: bson.M{
+				MONGO_ID: bson.M{ADDR: "$" + ADDR, BADGE_CODE: "$" + BADGE_CODE},
+				COUNT:    bson.M{MONGO_OPERATOR_SUM: 1},
+			},
+		},
+		{
+			MONGO_OPERATOR_MATCH: bson.M{COUNT: bson.M{MONGO_OPERATOR_GTE: minCount}},
+		},
+		{
+			MONGO_OPERATOR_PROJECT: bson.M{
+				ADDR:       "$" + MONGO_ID + "." + ADDR,
+				BADGE_CODE: "$" + MONGO_ID + "." + BADGE_CODE,
+				COUNT:      1,
+			},
+		},
 	}
-	return this.Db.UpdateOne(this.TableName(), conditions, updator)
+	result := make([]*AddrBadgeCount, 0, 8)
+	err := this.Db.AggregateAll(this.TableName(), conditions, &result)
+	return result, err
 }
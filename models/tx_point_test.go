@@ -1 +1,23 @@
 package models
+
+import "testing"
+
+func TestTxPointCursor(t *testing.T) {
+	cursor := &TxPointCursor{
+		Timestamp: 1609430400,
+		Txid:      "e624fd69683d27c48982e3e62e1e73b276e7b4c7763c514c00091cbcff19f700",
+		Index:     -1,
+		Type:      TX_POINT_TYPE_VOUT,
+	}
+	decoded, err := DecodeTxPointCursor(cursor.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *decoded != *cursor {
+		t.Fatal("cursor changed", decoded)
+	}
+	_, err = DecodeTxPointCursor("bm90IGEgY3Vyc29y")
+	if err == nil {
+		t.Fatal("illegal cursor not rejected")
+	}
+}
@@ -0,0 +1,289 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	TBL_WEBHOOK          = "webhook"
+	TBL_WEBHOOK_DELIVERY = "webhook_delivery"
+	TBL_WEBHOOK_INFO     = "webhook_info"
+
+	URL          = "url"
+	EVENT_TYPES  = "event_types"
+	EVENT_SEQ    = "event_seq"
+	START_SEQ    = "start_seq"
+	WEBHOOK_TYPE = "webhook_type"
+	ATTEMPTS     = "attempts"
+	NEXT_RETRY   = "next_retry"
+	LAST_ERROR   = "last_error"
+	EVENT        = "event"
+
+	ENQUEUED_SEQ_ID = "enqueued_seq"
+
+	WEBHOOK_TYPE_DEPOSIT      = "deposit"
+	WEBHOOK_TYPE_CONFIRMATION = "confirmation"
+	WEBHOOK_TYPE_SPEND        = "spend"
+	WEBHOOK_TYPE_REORG        = "reorg"
+
+	WEBHOOK_DELIVERY_STATE_ALL       = 0
+	WEBHOOK_DELIVERY_STATE_PENDING   = 1
+	WEBHOOK_DELIVERY_STATE_DELIVERED = 2
+	WEBHOOK_DELIVERY_STATE_DEAD      = 3
+)
+
+var WEBHOOK_TYPES = []string{WEBHOOK_TYPE_DEPOSIT, WEBHOOK_TYPE_CONFIRMATION, WEBHOOK_TYPE_SPEND, WEBHOOK_TYPE_REORG}
+
+type Webhook struct {
+	Appid      string   `json:"appid" bson:"appid"`
+	Url        string   `json:"url" bson:"url"`
+	EventTypes []string `json:"event_types" bson:"event_types"`
+	// events up to this seq were published before the webhook was added
+	StartSeq  int64 `json:"start_seq" bson:"start_seq"`
+	Timestamp int64 `json:"timestamp" bson:"timestamp"`
+}
+
+type WebhookDelivery struct {
+	Id          bson.ObjectId `json:"id" bson:"_id"`
+	Appid       string        `json:"appid" bson:"appid"`
+	Url         string        `json:"url" bson:"url"`
+	WebhookType string        `json:"webhook_type" bson:"webhook_type"`
+	EventSeq    int64         `json:"event_seq" bson:"event_seq"`
+	Event       *Event        `json:"event" bson:"event"`
+	State       int           `json:"state" bson:"state"`
+	Attempts    int           `json:"attempts" bson:"attempts"`
+	NextRetry   int64         `json:"next_retry" bson:"next_retry"`
+	LastError   string        `json:"last_error" bson:"last_error"`
+	Timestamp   int64         `json:"timestamp" bson:"timestamp"`
+}
+
+// the same event enqueued to the same url gets the same id,the time part is the event timestamp
+// so ids still sort by time
+func WebhookDeliveryId(appid string, url string, eventSeq int64, webhookType string, timestamp int64) bson.ObjectId {
+	key, _ := json.Marshal([]interface{}{appid, url, eventSeq, webhookType})
+	hash := sha256.Sum256(key)
+	id := make([]byte, 12)
+	binary.BigEndian.PutUint32(id, uint32(timestamp))
+	copy(id[4:], hash[:8])
+	return bson.ObjectId(id)
+}
+
+type WebhookRepository struct {
+	Db *MongoDb
+}
+
+func (this *WebhookRepository) TableName() string {
+	return TBL_WEBHOOK
+}
+
+func (this *WebhookRepository) CreateIndex() error {
+	return this.Db.CreateIndex(
+		this.TableName(),
+		[]*mgo.Index{
+			{
+				Key:    []string{APPID, URL},
+				Unique: true,
+			},
+		},
+	)
+}
+
+func (this *WebhookRepository) SetWebhook(webhook *Webhook) error {
+	condition := bson.M{
+		APPID: webhook.Appid,
+		URL:   webhook.Url,
+	}
+	// start_seq is kept when a webhook is updated
+	change := mgo.Change{
+		Update: bson.M{
+			MONGO_OPERATOR_SET: bson.M{
+				EVENT_TYPES: webhook.EventTypes,
+				TIMESTAMP:   webhook.Timestamp,
+			},
+			MONGO_OPERATOR_SET_ON_INSERT: bson.M{
+				START_SEQ: webhook.StartSeq,
+			},
+		},
+		Upsert: true,
+	}
+	return this.Db.Apply(this.TableName(), condition, change, &Webhook{})
+}
+
+func (this *WebhookRepository) RemoveWebhook(appid string, url string) error {
+	condition := bson.M{
+		APPID: appid,
+		URL:   url,
+	}
+	return this.Db.DeleteAll(this.TableName(), condition)
+}
+
+func (this *WebhookRepository) GetWebhooks(appid string) ([]*Webhook, error) {
+	condition := bson.M{
+		APPID: appid,
+	}
+	webhooks := make([]*Webhook, 0, 4)
+	err := this.Db.GetAll(this.TableName(), condition, nil, MONGO_ID, &webhooks)
+	return webhooks, err
+}
+
+func (this *WebhookRepository) GetWebhooksByAppids(appids []string) ([]*Webhook, error) {
+	condition := bson.M{
+		APPID: bson.M{MONGO_OPERATOR_IN: appids},
+	}
+	webhooks := make([]*Webhook, 0, 4)
+	err := this.Db.GetAll(this.TableName(), condition, nil, MONGO_ID, &webhooks)
+	return webhooks, err
+}
+
+type WebhookDeliveryRepository struct {
+	Db *MongoDb
+}
+
+func (this *WebhookDeliveryRepository) TableName() string {
+	return TBL_WEBHOOK_DELIVERY
+}
+
+func (this *WebhookDeliveryRepository) CreateIndex() error {
+	return this.Db.CreateIndex(
+		this.TableName(),
+		[]*mgo.Index{
+			{
+				Key:    []string{APPID, URL, EVENT_SEQ, WEBHOOK_TYPE},
+				Unique: true,
+			},
+			{
+				Key:    []string{STATE, NEXT_RETRY},
+				Unique: false,
+			},
+			{
+				Key:    []string{APPID, STATE},
+				Unique: false,
+			},
+		},
+	)
+}
+
+// the same event is enqueued to a url only once,a delivery enqueued again is left as it is
+func (this *WebhookDeliveryRepository) AddWebhookDelivery(webhookDelivery *WebhookDelivery) error {
+	condition := bson.M{
+		MONGO_ID: webhookDelivery.Id,
+	}
+	change := mgo.Change{
+		Update: bson.M{
+			MONGO_OPERATOR_SET_ON_INSERT: bson.M{
+				APPID:        webhookDelivery.Appid,
+				URL:          webhookDelivery.Url,
+				WEBHOOK_TYPE: webhookDelivery.WebhookType,
+				EVENT_SEQ:    webhookDelivery.EventSeq,
+				EVENT:        webhookDelivery.Event,
+				STATE:        webhookDelivery.State,
+				ATTEMPTS:     webhookDelivery.Attempts,
+				NEXT_RETRY:   webhookDelivery.NextRetry,
+				LAST_ERROR:   webhookDelivery.LastError,
+				TIMESTAMP:    webhookDelivery.Timestamp,
+			},
+		},
+		Upsert: true,
+	}
+	err := this.Db.Apply(this.TableName(), condition, change, &WebhookDelivery{})
+	if err != nil {
+		// enqueued before ids were derived from the event
+		if !strings.Contains(err.Error(), MONGO_ERROR_DUPLICATE) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *WebhookDeliveryRepository) GetDueWebhookDeliveries(now int64, limit int) ([]*WebhookDelivery, error) {
+	condition := bson.M{
+		STATE:      WEBHOOK_DELIVERY_STATE_PENDING,
+		NEXT_RETRY: bson.M{MONGO_OPERATOR_LT: now + 1},
+	}
+	webhookDeliveries := make([]*WebhookDelivery, 0, limit)
+	err := this.Db.GetMany(this.TableName(), condition, nil, NEXT_RETRY, 0, limit, &webhookDeliveries)
+	return webhookDeliveries, err
+}
+
+func (this *WebhookDeliveryRepository) GetWebhookDeliveries(appid string, state int, offset int, limit int) ([]*WebhookDelivery, error) {
+	condition := bson.M{
+		APPID: appid,
+	}
+	if state != WEBHOOK_DELIVERY_STATE_ALL {
+		condition[STATE] = state
+	}
+	webhookDeliveries := make([]*WebhookDelivery, 0, limit)
+	err := this.Db.GetMany(this.TableName(), condition, nil, "-"+MONGO_ID, offset, limit, &webhookDeliveries)
+	return webhookDeliveries, err
+}
+
+func (this *WebhookDeliveryRepository) UpdateWebhookDelivery(webhookDelivery *WebhookDelivery) error {
+	condition := bson.M{
+		MONGO_ID: webhookDelivery.Id,
+	}
+	updator := bson.M{
+		STATE:      webhookDelivery.State,
+		ATTEMPTS:   webhookDelivery.Attempts,
+		NEXT_RETRY: webhookDelivery.NextRetry,
+		LAST_ERROR: webhookDelivery.LastError,
+	}
+	return this.Db.UpdateOne(this.TableName(), condition, updator)
+}
+
+// ids empty means all dead deliveries of appid
+func (this *WebhookDeliveryRepository) ReplayWebhookDeliveries(appid string, ids []bson.ObjectId) error {
+	condition := bson.M{
+		APPID: appid,
+		STATE: WEBHOOK_DELIVERY_STATE_DEAD,
+	}
+	if len(ids) > 0 {
+		condition = bson.M{
+			APPID:    appid,
+			MONGO_ID: bson.M{MONGO_OPERATOR_IN: ids},
+		}
+	}
+	updator := bson.M{
+		STATE:      WEBHOOK_DELIVERY_STATE_PENDING,
+		ATTEMPTS:   0,
+		NEXT_RETRY: time.Now().Unix(),
+	}
+	return this.Db.UpdateAll(this.TableName(), condition, updator)
+}
+
+type EnqueuedSeq struct {
+	Id  string `bson:"_id"`
+	Seq int64  `bson:"seq"`
+}
+
+// seq of the last event turned into deliveries,not found before the first enqueue
+func (this *WebhookDeliveryRepository) GetEnqueuedSeq() (int64, bool, error) {
+	condition := bson.M{
+		MONGO_ID: ENQUEUED_SEQ_ID,
+	}
+	enqueuedSeq := &EnqueuedSeq{}
+	err := this.Db.GetOne(TBL_WEBHOOK_INFO, condition, nil, enqueuedSeq)
+	if err != nil {
+		if !strings.Contains(err.Error(), MONGO_NOT_FOUND) {
+			return 0, false, err
+		}
+		return 0, false, nil
+	}
+	return enqueuedSeq.Seq, true, nil
+}
+
+func (this *WebhookDeliveryRepository) SetEnqueuedSeq(seq int64) error {
+	condition := bson.M{
+		MONGO_ID: ENQUEUED_SEQ_ID,
+	}
+	updator := bson.M{
+		SEQ: seq,
+	}
+	return this.Db.Upsert(TBL_WEBHOOK_INFO, condition, updator)
+}
@@ -0,0 +1,18 @@
+package models
+
+import "testing"
+
+func TestWebhookDeliveryId(t *testing.T) {
+	id := WebhookDeliveryId("app", "https://8.8.8.8/hook", 7, WEBHOOK_TYPE_DEPOSIT, 1615196949)
+	if id != WebhookDeliveryId("app", "https://8.8.8.8/hook", 7, WEBHOOK_TYPE_DEPOSIT, 1615196949) {
+		t.Fatal("ids of the same delivery differ")
+	}
+	if !id.Valid() || id.Time().Unix() != 1615196949 {
+		t.Fatal("wrong id", id.Hex())
+	}
+	if id == WebhookDeliveryId("app", "https://8.8.8.8/hook", 8, WEBHOOK_TYPE_DEPOSIT, 1615196949) ||
+		id == WebhookDeliveryId("app", "https://8.8.8.8/hook", 7, WEBHOOK_TYPE_SPEND, 1615196949) ||
+		id == WebhookDeliveryId("other", "https://8.8.8.8/hook", 7, WEBHOOK_TYPE_DEPOSIT, 1615196949) {
+		t.Fatal("ids of other deliveries equal")
+	}
+}
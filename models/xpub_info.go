@@ -0,0 +1,178 @@
+package models
+
+import (
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	TBL_XPUB_INFO = "xpub_info"
+
+	XPUB               = "xpub"
+	GAP_LIMIT          = "gap_limit"
+	RECEIVE_COUNT      = "receive_count"
+	RECEIVE_USED       = "receive_used"
+	CHANGE_COUNT       = "change_count"
+	CHANGE_USED        = "change_used"
+	RECEIVE_SKIPPED    = "receive_skipped"
+	CHANGE_SKIPPED     = "change_skipped"
+	XPUB_CHAIN         = "xpub_chain"
+	XPUB_INDEX         = "xpub_index"
+	XPUB_CHAIN_RECEIVE = 0
+	XPUB_CHAIN_CHANGE  = 1
+)
+
+// addrs of chain are derived by xpub/chain/index,
+// count is the number derived,used is the max used index + 1,
+// skipped are indexes from used whose addrs were already set by another user
+type XpubInfo struct {
+	Appid        string `json:"appid" bson:"appid"`
+	UserID       int64  `json:"userid" bson:"userid"`
+	UserIndex    int64  `json:"user_index" bson:"user_index"`
+	Xpub         string `json:"xpub" bson:"xpub"`
+	GapLimit     int64  `json:"gap_limit" bson:"gap_limit"`
+	ReceiveCount int64  `json:"receive_count" bson:"receive_count"`
+	ReceiveUsed  int64  `json:"receive_used" bson:"receive_used"`
+	ChangeCount  int64  `json:"change_count" bson:"change_count"`
+	ChangeUsed   int64  `json:"change_used" bson:"change_used"`
+	// not counted by the gap window
+	ReceiveSkipped []int64 `json:"receive_skipped" bson:"receive_skipped"`
+	ChangeSkipped  []int64 `json:"change_skipped" bson:"change_skipped"`
+	Timestamp      int64   `json:"timestamp" bson:"timestamp"`
+}
+
+func (this *XpubInfo) GetCount(chain int) int64 {
+	if chain == XPUB_CHAIN_CHANGE {
+		return this.ChangeCount
+	}
+	return this.ReceiveCount
+}
+
+func (this *XpubInfo) GetUsed(chain int) int64 {
+	if chain == XPUB_CHAIN_CHANGE {
+		return this.ChangeUsed
+	}
+	return this.ReceiveUsed
+}
+
+func (this *XpubInfo) SetCount(chain int, count int64) {
+	if chain == XPUB_CHAIN_CHANGE {
+		this.ChangeCount = count
+		return
+	}
+	this.ReceiveCount = count
+}
+
+func (this *XpubInfo) GetSkipped(chain int) []int64 {
+	if chain == XPUB_CHAIN_CHANGE {
+		return this.ChangeSkipped
+	}
+	return this.ReceiveSkipped
+}
+
+func (this *XpubInfo) setSkipped(chain int, skipped []int64) {
+	if chain == XPUB_CHAIN_CHANGE {
+		this.ChangeSkipped = skipped
+		return
+	}
+	this.ReceiveSkipped = skipped
+}
+
+func (this *XpubInfo) AddSkipped(chain int, index int64) {
+	this.setSkipped(chain, append(this.GetSkipped(chain), index))
+}
+
+// skipped indexes before used are dropped
+func (this *XpubInfo) SetUsed(chain int, used int64) {
+	if chain == XPUB_CHAIN_CHANGE {
+		this.ChangeUsed = used
+	} else {
+		this.ReceiveUsed = used
+	}
+	skipped := make([]int64, 0, len(this.GetSkipped(chain)))
+	for _, index := range this.GetSkipped(chain) {
+		if index >= used {
+			skipped = append(skipped, index)
+		}
+	}
+	this.setSkipped(chain, skipped)
+}
+
+// addrs are derived up to it,gap limit addrs of the user after the used one
+func (this *XpubInfo) WindowEnd(chain int) int64 {
+	end := this.GetUsed(chain) + this.GapLimit
+	for _, index := range this.GetSkipped(chain) {
+		if index >= this.GetUsed(chain) {
+			end++
+		}
+	}
+	return end
+}
+
+type XpubInfoRepository struct {
+	Db *MongoDb
+}
+
+func (this *XpubInfoRepository) TableName() string {
+	return TBL_XPUB_INFO
+}
+
+func (this *XpubInfoRepository) CreateIndex() error {
+	return this.Db.CreateIndex(
+		this.TableName(),
+		[]*mgo.Index{
+			{
+				Key:    []string{APPID, USERID, USER_INDEX},
+				Unique: true,
+			},
+			{
+				Key:    []string{XPUB},
+				Unique: true,
+			},
+		},
+	)
+}
+
+func (this *XpubInfoRepository) AddXpubInfo(xpubInfo *XpubInfo) error {
+	return this.Db.Insert(this.TableName(), xpubInfo)
+}
+
+func (this *XpubInfoRepository) GetXpubInfo(xpub string) (*XpubInfo, error) {
+	condition := bson.M{
+		XPUB: xpub,
+	}
+	xpubInfo := &XpubInfo{}
+	err := this.Db.GetOne(this.TableName(), condition, nil, xpubInfo)
+	return xpubInfo, err
+}
+
+func (this *XpubInfoRepository) GetUserXpubInfo(appid string, userid int64, userIndex int64) (*XpubInfo, error) {
+	condition := bson.M{
+		APPID:      appid,
+		USERID:     userid,
+		USER_INDEX: userIndex,
+	}
+	xpubInfo := &XpubInfo{}
+	err := this.Db.GetOne(this.TableName(), condition, nil, xpubInfo)
+	return xpubInfo, err
+}
+
+func (this *XpubInfoRepository) UpdateXpubInfoProgress(xpubInfo *XpubInfo) error {
+	condition := bson.M{
+		XPUB: xpubInfo.Xpub,
+	}
+	updator := bson.M{
+		GAP_LIMIT:       xpubInfo.GapLimit,
+		RECEIVE_COUNT:   xpubInfo.ReceiveCount,
+		RECEIVE_USED:    xpubInfo.ReceiveUsed,
+		CHANGE_COUNT:    xpubInfo.ChangeCount,
+		CHANGE_USED:     xpubInfo.ChangeUsed,
+		RECEIVE_SKIPPED: xpubInfo.ReceiveSkipped,
+		CHANGE_SKIPPED:  xpubInfo.ChangeSkipped,
+	}
+	return this.Db.UpdateOne(this.TableName(), condition, updator)
+}
+
+func (this *XpubInfoRepository) CountXpubInfos() (int64, error) {
+	return this.Db.Count(this.TableName(), bson.M{})
+}
@@ -0,0 +1,519 @@
+package services
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dotwallet/touchstone/models"
+	"github.com/dotwallet/touchstone/util"
+	"github.com/golang/glog"
+)
+
+const (
+	LOOP_SYNC_STATE     = "sync_state"
+	LOOP_CHECK_TX_STATE = "check_tx_state"
+	LOOP_SET_SPENT      = "set_spent"
+	LOOP_PAYOUT         = "payout"
+	LOOP_WEBHOOK        = "webhook"
+	LOOP_CONSOLIDATE    = "consolidate"
+	LOOP_PURGE_TXNS     = "purge_txns"
+
+	JOB_TYPE_SYNC_STATE                 = "sync_state"
+	JOB_TYPE_SYNC_PARTITIONS            = "sync_partitions"
+	JOB_TYPE_RECOMPUTE_PARTITION_HASHES = "recompute_partition_hashes"
+	JOB_TYPE_REPROCESS_TX               = "reprocess_tx"
+	JOB_TYPE_CLEAR_TX                   = "clear_tx"
+	JOB_TYPE_SET_SPENT                  = "set_spent"
+	JOB_TYPE_BOOTSTRAP_SNAPSHOT         = "bootstrap_snapshot"
+
+	JOB_STATE_RUNNING = "running"
+	JOB_STATE_DONE    = "done"
+	JOB_STATE_FAILED  = "failed"
+
+	MAX_KEEP_JOBS = 100
+
+	PEER_SYNC_TYPE_PARTITIONS = "partitions"
+	PEER_SYNC_TYPE_UNCONFIRM  = "unconfirm"
+	PEER_SYNC_TYPE_NOTIFIED   = "notified"
+)
+
+var LOOPS = []string{LOOP_SYNC_STATE, LOOP_CHECK_TX_STATE, LOOP_SET_SPENT, LOOP_PAYOUT, LOOP_WEBHOOK, LOOP_CONSOLIDATE, LOOP_DISCOVERY, LOOP_PURGE_TXNS}
+
+// total is 0 when it is unknown,a nil job ignores progress
+type Job struct {
+	JobId     string      `json:"job_id"`
+	Type      string      `json:"type"`
+	Params    interface{} `json:"params"`
+	State     string      `json:"state"`
+	Done      int64       `json:"done"`
+	Total     int64       `json:"total"`
+	Error     string      `json:"error"`
+	StartTime int64       `json:"start_time"`
+	EndTime   int64       `json:"end_time"`
+	lock      sync.Mutex
+}
+
+func (this *Job) SetTotal(total int64) {
+	if this == nil {
+		return
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.Total = total
+}
+
+func (this *Job) AddDone(done int64) {
+	if this == nil {
+		return
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.Done += done
+}
+
+func (this *Job) Finish(err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.State = JOB_STATE_DONE
+	if err != nil {
+		this.State = JOB_STATE_FAILED
+		this.Error = err.Error()
+	}
+	this.EndTime = time.Now().Unix()
+}
+
+func (this *Job) Snapshot() *Job {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return &Job{
+		JobId:     this.JobId,
+		Type:      this.Type,
+		Params:    this.Params,
+		State:     this.State,
+		Done:      this.Done,
+		Total:     this.Total,
+		Error:     this.Error,
+		StartTime: this.StartTime,
+		EndTime:   this.EndTime,
+	}
+}
+
+type PeerSyncResult struct {
+	Pubkey       string `json:"pubkey"`
+	SyncType     string `json:"sync_type"`
+	SyncTime     int64  `json:"sync_time"`
+	ClosedTxs    int    `json:"closed_txs"`
+	ErrTxs       int    `json:"error_txs"`
+	Error        string `json:"error"`
+	LastSuccTime int64  `json:"last_succ_time"`
+}
+
+type PeerStatus struct {
+	Pubkey         string          `json:"pubkey"`
+	Host           string          `json:"host"`
+	Connected      bool            `json:"connected"`
+	LastSyncResult *PeerSyncResult `json:"last_sync_result"`
+	Health         *PeerHealth     `json:"health"`
+	Protocol       *PeerProtocol   `json:"protocol"`
+}
+
+type LoopStatus struct {
+	Loop   string `json:"loop"`
+	Paused bool   `json:"paused"`
+}
+
+// zero value is ready to use,nothing here survives a restart
+type AdminState struct {
+	lock            sync.Mutex
+	jobs            map[string]*Job
+	jobIds          []string
+	pausedLoops     map[string]bool
+	peerSyncResults map[string]*PeerSyncResult
+	// unix time of the last SyncState without error
+	lastSyncStateTime int64
+}
+
+func (this *TouchstoneServer) LoopPaused(loop string) bool {
+	this.adminState.lock.Lock()
+	defer this.adminState.lock.Unlock()
+	return this.adminState.pausedLoops[loop]
+}
+
+// a paused loop finishes the running round and skips the next ones
+func (this *TouchstoneServer) SetLoopPaused(loop string, paused bool) ([]*LoopStatus, error) {
+	found := false
+	for _, name := range LOOPS {
+		if name == loop {
+			found = true
+			break
+		}
+	}
+	if !found {
+		errStr := fmt.Sprintf("loop should be one of %s", strings.Join(LOOPS, ","))
+		return nil, util.NewCodeError(util.ERR_PARAMETERS_CODE, errStr)
+	}
+	this.adminState.lock.Lock()
+	if this.adminState.pausedLoops == nil {
+		this.adminState.pausedLoops = make(map[string]bool)
+	}
+	this.adminState.pausedLoops[loop] = paused
+	this.adminState.lock.Unlock()
+	glog.Infof("TouchstoneServer.SetLoopPaused %s %t", loop, paused)
+	return this.GetLoops(), nil
+}
+
+func (this *TouchstoneServer) GetLoops() []*LoopStatus {
+	loopStatuses := make([]*LoopStatus, 0, len(LOOPS))
+	for _, loop := range LOOPS {
+		loopStatuses = append(loopStatuses, &LoopStatus{
+			Loop:   loop,
+			Paused: this.LoopPaused(loop),
+		})
+	}
+	return loopStatuses
+}
+
+func (this *TouchstoneServer) SetPeerSyncResult(pubkey string, syncType string, syncTxsResult *SyncTxsResult, err error) {
+	if syncTxsResult != nil {
+		this.ObservePeerSyncTxs(pubkey, syncTxsResult)
+	}
+	this.adminState.lock.Lock()
+	defer this.adminState.lock.Unlock()
+	if this.adminState.peerSyncResults == nil {
+		this.adminState.peerSyncResults = make(map[string]*PeerSyncResult)
+	}
+	peerSyncResult := &PeerSyncResult{
+		Pubkey:   pubkey,
+		SyncType: syncType,
+		SyncTime: time.Now().Unix(),
+	}
+	oldPeerSyncResult, ok := this.adminState.peerSyncResults[pubkey]
+	if ok {
+		peerSyncResult.LastSuccTime = oldPeerSyncResult.LastSuccTime
+	}
+	if err != nil {
+		peerSyncResult.Error = err.Error()
+	} else {
+		peerSyncResult.LastSuccTime = peerSyncResult.SyncTime
+	}
+	if syncTxsResult != nil {
+		peerSyncResult.ClosedTxs = len(syncTxsResult.TxInventorys)
+		peerSyncResult.ErrTxs = len(syncTxsResult.ErrTxs)
+	}
+	this.adminState.peerSyncResults[pubkey] = peerSyncResult
+}
+
+func (this *TouchstoneServer) SetLastSyncStateTime(timestamp int64) {
+	this.adminState.lock.Lock()
+	defer this.adminState.lock.Unlock()
+	this.adminState.lastSyncStateTime = timestamp
+}
+
+func (this *TouchstoneServer) GetLastSyncStateTime() int64 {
+	this.adminState.lock.Lock()
+	defer this.adminState.lock.Unlock()
+	return this.adminState.lastSyncStateTime
+}
+
+// adminState.lock is never held with peersLock or the locks of peers
+func (this *TouchstoneServer) GetPeers() []*PeerStatus {
+	peers := this.Peers()
+	peerStatuses := make([]*PeerStatus, 0, len(peers))
+	for pubkey, peer := range peers {
+		peerStatuses = append(peerStatuses, &PeerStatus{
+			Pubkey:    pubkey,
+			Host:      peer.host,
+			Connected: peer.Connected(),
+			Health:    this.peerHealth.Snapshot(pubkey),
+			Protocol:  peer.Protocol(),
+		})
+	}
+	this.adminState.lock.Lock()
+	defer this.adminState.lock.Unlock()
+	for _, peerStatus := range peerStatuses {
+		peerSyncResult, ok := this.adminState.peerSyncResults[peerStatus.Pubkey]
+		if ok {
+			copyResult := *peerSyncResult
+			peerStatus.LastSyncResult = &copyResult
+		}
+	}
+	return peerStatuses
+}
+
+// PeersConfigs and trusted introducers are reloaded,enabling discovery needs a restart
+func (this *TouchstoneServer) ReloadPeers() ([]*PeerStatus, error) {
+	if this.ConfigLoader == nil {
+		return nil, errors.New("peers reload is not supported")
+	}
+	config, err := this.ConfigLoader()
+	if err != nil {
+		glog.Infof("TouchstoneServer.ReloadPeers ConfigLoader %s", err)
+		return nil, err
+	}
+	this.peersLock.Lock()
+	this.staticPeerConfigs = config.PeersConfigs
+	if this.DiscoveryConfig != nil && this.DiscoveryConfig.Enable && config.DiscoveryConfig != nil {
+		discoveryConfig := *config.DiscoveryConfig
+		discoveryConfig.Enable = true
+		this.DiscoveryConfig = &discoveryConfig
+	}
+	this.peersLock.Unlock()
+	err = this.ApplyPeers()
+	if err != nil {
+		glog.Infof("TouchstoneServer.ReloadPeers ApplyPeers %s,retried by %s", err, LOOP_CONNECT_PEER)
+	}
+	glog.Infof("TouchstoneServer.ReloadPeers %d peers", len(this.PeerConfigs()))
+	return this.GetPeers(), nil
+}
+
+// only one job of a type runs at the same time
+func (this *TouchstoneServer) StartJob(jobType string, params interface{}, run func(ctx context.Context, job *Job, processId string) error) (*Job, error) {
+	jobId, err := RandHex(8)
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{
+		JobId:     jobId,
+		Type:      jobType,
+		Params:    params,
+		State:     JOB_STATE_RUNNING,
+		StartTime: time.Now().Unix(),
+	}
+	this.adminState.lock.Lock()
+	if this.adminState.jobs == nil {
+		this.adminState.jobs = make(map[string]*Job)
+	}
+	for _, oldJob := range this.adminState.jobs {
+		if oldJob.Type == jobType && oldJob.Snapshot().State == JOB_STATE_RUNNING {
+			this.adminState.lock.Unlock()
+			errStr := fmt.Sprintf("job %s of %s is running", oldJob.JobId, jobType)
+			return nil, util.NewCodeError(util.ERR_PARAMETERS_CODE, errStr)
+		}
+	}
+	this.adminState.jobs[jobId] = job
+	this.adminState.jobIds = append(this.adminState.jobIds, jobId)
+	// forget the oldest finished jobs
+	for len(this.adminState.jobIds) > MAX_KEEP_JOBS {
+		oldJob := this.adminState.jobs[this.adminState.jobIds[0]]
+		if oldJob.Snapshot().State == JOB_STATE_RUNNING {
+			break
+		}
+		delete(this.adminState.jobs, oldJob.JobId)
+		this.adminState.jobIds = this.adminState.jobIds[1:]
+	}
+	this.adminState.lock.Unlock()
+	err = this.lifecycle.Go("job "+jobId, func(ctx context.Context) {
+		processId := util.RandStringBytes(8)
+		glog.Infof("TouchstoneServer job %s %s start %s", jobType, jobId, processId)
+		err := run(ctx, job, processId)
+		if err != nil {
+			glog.Infof("TouchstoneServer job %s %s err:%s %s", jobType, jobId, err, processId)
+		}
+		job.Finish(err)
+		glog.Infof("TouchstoneServer job %s %s done %s", jobType, jobId, processId)
+	})
+	if err != nil {
+		job.Finish(err)
+		return nil, err
+	}
+	return job.Snapshot(), nil
+}
+
+func (this *TouchstoneServer) GetJob(jobId string) (*Job, error) {
+	this.adminState.lock.Lock()
+	defer this.adminState.lock.Unlock()
+	job, ok := this.adminState.jobs[jobId]
+	if !ok {
+		return nil, util.NewCodeError(util.ERR_PARAMETERS_CODE, "job not found")
+	}
+	return job.Snapshot(), nil
+}
+
+// newest first
+func (this *TouchstoneServer) GetJobs() []*Job {
+	this.adminState.lock.Lock()
+	defer this.adminState.lock.Unlock()
+	jobs := make([]*Job, 0, len(this.adminState.jobIds))
+	for i := len(this.adminState.jobIds) - 1; i >= 0; i-- {
+		jobs = append(jobs, this.adminState.jobs[this.adminState.jobIds[i]].Snapshot())
+	}
+	return jobs
+}
+
+func (this *TouchstoneServer) StartSyncStateJob() (*Job, error) {
+	return this.StartJob(JOB_TYPE_SYNC_STATE, nil, func(ctx context.Context, job *Job, processId string) error {
+		return this.SyncState(ctx, true, job, processId)
+	})
+}
+
+type PartitionRange struct {
+	Start int64  `json:"start"`
+	End   int64  `json:"end"`
+	Peer  string `json:"peer,omitempty"`
+}
+
+func CheckPartitionRange(start int64, end int64) error {
+	if start < 0 || start > end {
+		return util.NewCodeError(util.ERR_PARAMETERS_CODE, "should be 0 <= start <= end")
+	}
+	return nil
+}
+
+func (this *TouchstoneServer) StartSyncPartitionsJob(start int64, end int64, pubkey string) (*Job, error) {
+	err := CheckPartitionRange(start, end)
+	if err != nil {
+		return nil, err
+	}
+	peers := this.Peers()
+	if pubkey != "" {
+		peer, ok := peers[pubkey]
+		if !ok {
+			return nil, util.NewCodeError(util.ERR_PARAMETERS_CODE, "peer not found")
+		}
+		peers = map[string]*Node{pubkey: peer}
+	}
+	params := &PartitionRange{
+		Start: start,
+		End:   end,
+		Peer:  pubkey,
+	}
+	return this.StartJob(JOB_TYPE_SYNC_PARTITIONS, params, func(ctx context.Context, job *Job, processId string) error {
+		for i := start; i <= end; i++ {
+			this.AddNeedRecomputehashPartition(i)
+		}
+		compared, err := this.SyncPatitionsFromPeers(ctx, start, end, peers, job, processId)
+		if err != nil {
+			return err
+		}
+		if compared == 0 {
+			return errors.New("no peer compared partitions")
+		}
+		return nil
+	})
+}
+
+func (this *TouchstoneServer) StartRecomputePartitionHashesJob(start int64, end int64) (*Job, error) {
+	err := CheckPartitionRange(start, end)
+	if err != nil {
+		return nil, err
+	}
+	params := &PartitionRange{
+		Start: start,
+		End:   end,
+	}
+	return this.StartJob(JOB_TYPE_RECOMPUTE_PARTITION_HASHES, params, func(ctx context.Context, job *Job, processId string) error {
+		job.SetTotal(end - start + 1)
+		for id := start; id <= end; id++ {
+			err := this.ComputeAndSetPartitionHash(id)
+			if err != nil {
+				return err
+			}
+			job.AddDone(1)
+		}
+		return nil
+	})
+}
+
+type TxidParams struct {
+	Txid string `json:"txid"`
+}
+
+func CheckTxid(txid string) error {
+	txidBytes, err := hex.DecodeString(txid)
+	if err != nil || len(txidBytes) != 32 {
+		return util.NewCodeError(util.ERR_PARAMETERS_CODE, "illegal txid")
+	}
+	return nil
+}
+
+// a new or open tx is processed again,an unknown tx is fetched from peers
+func (this *TouchstoneServer) StartReprocessTxJob(txid string) (*Job, error) {
+	err := CheckTxid(txid)
+	if err != nil {
+		return nil, err
+	}
+	params := &TxidParams{
+		Txid: txid,
+	}
+	return this.StartJob(JOB_TYPE_REPROCESS_TX, params, func(ctx context.Context, job *Job, processId string) error {
+		job.SetTotal(1)
+		msgTxBriefInfo, err := this.TxInfoRepository.GetMsgTxBriefInfo(txid)
+		if err == nil {
+			if msgTxBriefInfo.State == models.TX_STATE_CLOSED {
+				job.AddDone(1)
+				return nil
+			}
+			msgTxInfo, err := this.TxInfoRepository.GetMsgTxInfo(txid)
+			if err != nil {
+				return err
+			}
+			this.AddNeedRecomputehashPartitionByHeight(msgTxBriefInfo.Height)
+			this.syncTxLock.RLock()
+			_, err = this.ProcessMsgTx(msgTxInfo.MsgTx, time.Now().Unix(), processId)
+			this.syncTxLock.RUnlock()
+			if err != nil {
+				return err
+			}
+			job.AddDone(1)
+			return nil
+		}
+		if !strings.Contains(err.Error(), models.MONGO_NOT_FOUND) {
+			return err
+		}
+		txidBytes, err := hex.DecodeString(txid)
+		if err != nil {
+			return err
+		}
+		peers := this.Peers()
+		for _, pubkey := range this.RankPeers(peers) {
+			syncTxsResult, err := this.SyncTxs(ctx, [][]byte{txidBytes}, peers[pubkey], processId)
+			if err != nil {
+				glog.Infof("TouchstoneServer.StartReprocessTxJob SyncTxs %s err:%s %s", pubkey, err, processId)
+				continue
+			}
+			if len(syncTxsResult.TxInventorys) != 0 || len(syncTxsResult.AlreadyClosedTxs) != 0 {
+				job.AddDone(1)
+				return nil
+			}
+		}
+		return fmt.Errorf("tx %s is not closed", txid)
+	})
+}
+
+func (this *TouchstoneServer) StartClearTxJob(txid string) (*Job, error) {
+	err := CheckTxid(txid)
+	if err != nil {
+		return nil, err
+	}
+	params := &TxidParams{
+		Txid: txid,
+	}
+	return this.StartJob(JOB_TYPE_CLEAR_TX, params, func(ctx context.Context, job *Job, processId string) error {
+		job.SetTotal(1)
+		msgTxBriefInfo, err := this.TxInfoRepository.GetMsgTxBriefInfo(txid)
+		if err != nil {
+			if !strings.Contains(err.Error(), models.MONGO_NOT_FOUND) {
+				return err
+			}
+		} else {
+			this.AddNeedRecomputehashPartitionByHeight(msgTxBriefInfo.Height)
+		}
+		err = this.ClearMsgTx(txid)
+		if err != nil {
+			return err
+		}
+		job.AddDone(1)
+		return nil
+	})
+}
+
+func (this *TouchstoneServer) StartSetSpentJob() (*Job, error) {
+	return this.StartJob(JOB_TYPE_SET_SPENT, nil, func(ctx context.Context, job *Job, processId string) error {
+		return this.SetSpent(ctx, job)
+	})
+}
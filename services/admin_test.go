@@ -0,0 +1,117 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGetPeersWithPeersLockHeld(t *testing.T) {
+	server := &TouchstoneServer{
+		peers: map[string]*Node{"02aa": {host: "127.0.0.1:7788"}},
+	}
+	server.SetPeerSyncResult("02aa", PEER_SYNC_TYPE_PARTITIONS, nil, nil)
+	// a writer of peers may report sync results before it unlocks
+	server.peersLock.Lock()
+	done := make(chan []*PeerStatus)
+	go func() {
+		done <- server.GetPeers()
+	}()
+	time.Sleep(20 * time.Millisecond)
+	server.SetPeerSyncResult("02aa", PEER_SYNC_TYPE_PARTITIONS, nil, errors.New("timeout"))
+	server.peersLock.Unlock()
+	select {
+	case peerStatuses := <-done:
+		if len(peerStatuses) != 1 || peerStatuses[0].LastSyncResult == nil {
+			t.Fatalf("peers %+v", peerStatuses)
+		}
+		if peerStatuses[0].LastSyncResult.Error != "timeout" || peerStatuses[0].LastSyncResult.LastSuccTime == 0 {
+			t.Fatalf("last sync result %+v", peerStatuses[0].LastSyncResult)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("GetPeers is blocked")
+	}
+}
+
+func TestStartJobOnePerType(t *testing.T) {
+	server := &TouchstoneServer{}
+	release := make(chan struct{})
+	job, err := server.StartJob(JOB_TYPE_SET_SPENT, nil, func(ctx context.Context, job *Job, processId string) error {
+		<-release
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = server.StartJob(JOB_TYPE_SET_SPENT, nil, func(ctx context.Context, job *Job, processId string) error {
+		return nil
+	})
+	if err == nil {
+		t.Fatal("a second job of the type should be refused")
+	}
+	close(release)
+	for i := 0; i < 100; i++ {
+		snapshot, err := server.GetJob(job.JobId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if snapshot.State == JOB_STATE_DONE {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("job is not done")
+}
+
+func TestSyncPartitionsJobWaitsForSyncState(t *testing.T) {
+	server := &TouchstoneServer{
+		NeedRecomputehashPartitionsCache: make(map[int64]bool),
+	}
+	// held by a running SyncState
+	server.syncPartitionsLock.Lock()
+	job, err := server.StartSyncPartitionsJob(0, 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	snapshot, err := server.GetJob(job.JobId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.State != JOB_STATE_RUNNING || snapshot.Total != 0 {
+		t.Fatalf("job should wait for the lock %+v", snapshot)
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		server.syncPartitionsLock.Unlock()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = server.Shutdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err = server.GetJob(job.JobId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.State != JOB_STATE_FAILED {
+		t.Fatalf("job should stop with the context %+v", snapshot)
+	}
+}
+
+func TestSetLoopPaused(t *testing.T) {
+	server := &TouchstoneServer{}
+	_, err := server.SetLoopPaused("unknown", true)
+	if err == nil {
+		t.Fatal("unknown loop should be refused")
+	}
+	_, err = server.SetLoopPaused(LOOP_WEBHOOK, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !server.LoopPaused(LOOP_WEBHOOK) || server.LoopPaused(LOOP_PAYOUT) {
+		t.Fatal("only webhook should be paused")
+	}
+}
@@ -0,0 +1,138 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/dotwallet/touchstone/models"
+	"github.com/dotwallet/touchstone/util"
+)
+
+const (
+	API_KEY_ID_BYTES     = 8
+	API_KEY_SECRET_BYTES = 32
+	MAX_API_KEY_GRACE    = 7 * 24 * 60 * 60
+)
+
+type ApiKeyRsp struct {
+	KeyId string `json:"key_id"`
+	Appid string `json:"appid"`
+	// <key_id>.<secret>,only returned once
+	Token string `json:"token"`
+}
+
+func RandHex(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func HashApiKeySecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+func ParseApiKeyToken(token string) (string, string, error) {
+	fields := strings.SplitN(token, ".", 2)
+	if len(fields) != 2 || fields[0] == "" || fields[1] == "" {
+		return "", "", util.NewCodeError(util.ERR_UNAUTHORIZED_CODE, "illegal api key")
+	}
+	return fields[0], fields[1], nil
+}
+
+func (this *TouchstoneServer) CreateApiKey(appid string) (*ApiKeyRsp, error) {
+	if appid == "" {
+		return nil, util.NewCodeError(util.ERR_PARAMETERS_CODE, "appid is empty")
+	}
+	keyId, err := RandHex(API_KEY_ID_BYTES)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := RandHex(API_KEY_SECRET_BYTES)
+	if err != nil {
+		return nil, err
+	}
+	err = this.ApiKeyRepository.AddApiKey(&models.ApiKey{
+		KeyId:      keyId,
+		Appid:      appid,
+		SecretHash: HashApiKeySecret(secret),
+		State:      models.API_KEY_STATE_ACTIVE,
+		Timestamp:  time.Now().Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ApiKeyRsp{
+		KeyId: keyId,
+		Appid: appid,
+		Token: keyId + "." + secret,
+	}, nil
+}
+
+// the old secret keeps working for graceSeconds
+func (this *TouchstoneServer) RotateApiKey(keyId string, graceSeconds int64) (*ApiKeyRsp, error) {
+	if graceSeconds < 0 || graceSeconds > MAX_API_KEY_GRACE {
+		return nil, util.NewCodeError(util.ERR_PARAMETERS_CODE, "grace_seconds should be in [0,604800]")
+	}
+	apiKey, err := this.ApiKeyRepository.GetApiKey(keyId)
+	if err != nil {
+		return nil, err
+	}
+	if apiKey.State != models.API_KEY_STATE_ACTIVE {
+		return nil, util.NewCodeError(util.ERR_PARAMETERS_CODE, "api key is revoked")
+	}
+	secret, err := RandHex(API_KEY_SECRET_BYTES)
+	if err != nil {
+		return nil, err
+	}
+	err = this.ApiKeyRepository.RotateApiKey(keyId, HashApiKeySecret(secret), apiKey.SecretHash, time.Now().Unix()+graceSeconds)
+	if err != nil {
+		return nil, err
+	}
+	return &ApiKeyRsp{
+		KeyId: keyId,
+		Appid: apiKey.Appid,
+		Token: keyId + "." + secret,
+	}, nil
+}
+
+func (this *TouchstoneServer) RevokeApiKey(keyId string) error {
+	return this.ApiKeyRepository.RevokeApiKey(keyId)
+}
+
+func (this *TouchstoneServer) GetApiKeys(appid string) ([]*models.ApiKey, error) {
+	return this.ApiKeyRepository.GetApiKeys(appid)
+}
+
+// returns appid of the key
+func (this *TouchstoneServer) VerifyApiKey(token string) (string, error) {
+	keyId, secret, err := ParseApiKeyToken(token)
+	if err != nil {
+		return "", err
+	}
+	apiKey, err := this.ApiKeyRepository.GetApiKey(keyId)
+	if err != nil {
+		if strings.Contains(err.Error(), models.MONGO_NOT_FOUND) {
+			return "", util.NewCodeError(util.ERR_UNAUTHORIZED_CODE, "unknow api key")
+		}
+		return "", err
+	}
+	if apiKey.State != models.API_KEY_STATE_ACTIVE {
+		return "", util.NewCodeError(util.ERR_UNAUTHORIZED_CODE, "api key is revoked")
+	}
+	secretHash := HashApiKeySecret(secret)
+	if subtle.ConstantTimeCompare([]byte(secretHash), []byte(apiKey.SecretHash)) == 1 {
+		return apiKey.Appid, nil
+	}
+	if time.Now().Unix() < apiKey.PrevExpire && subtle.ConstantTimeCompare([]byte(secretHash), []byte(apiKey.PrevSecretHash)) == 1 {
+		return apiKey.Appid, nil
+	}
+	return "", util.NewCodeError(util.ERR_UNAUTHORIZED_CODE, "wrong api key")
+}
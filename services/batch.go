@@ -0,0 +1,145 @@
+package services
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/dotwallet/touchstone/conf"
+	"github.com/dotwallet/touchstone/models"
+	"github.com/dotwallet/touchstone/util"
+)
+
+const (
+	MAX_BATCH_BALANCE_ITEMS = 1000
+	MAX_BATCH_UTXOS_ITEMS   = 100
+	MAX_BATCH_ITEM_UTXOS    = 1000
+)
+
+type AddrBalanceItem struct {
+	Addr       string `json:"addr"`
+	BadgeCode  string `json:"badge_code"`
+	Balance    int64  `json:"balance"`
+	UtxoCount  int64  `json:"utxo_count"`
+	LastHeight int64  `json:"last_height"`
+	Code       int    `json:"code"`
+	Msg        string `json:"msg"`
+}
+
+type AddrUtxosItem struct {
+	Addr      string            `json:"addr"`
+	BadgeCode string            `json:"badge_code"`
+	Utxos     []*models.TxPoint `json:"utxos"`
+	// use getaddrutxos to page the rest
+	Truncated bool   `json:"truncated"`
+	Code      int    `json:"code"`
+	Msg       string `json:"msg"`
+}
+
+func CheckBatchSize(addrBadgeCodes []*models.AddrBadgeCode, max int) error {
+	if len(addrBadgeCodes) == 0 || len(addrBadgeCodes) > max {
+		errStr := fmt.Sprintf("items should be in (0,%d]", max)
+		return util.NewCodeError(util.ERR_PARAMETERS_CODE, errStr)
+	}
+	for _, addrBadgeCode := range addrBadgeCodes {
+		if addrBadgeCode == nil {
+			return util.NewCodeError(util.ERR_PARAMETERS_CODE, "items contains null")
+		}
+	}
+	return nil
+}
+
+func CheckAddrBadgeCode(addrBadgeCode *models.AddrBadgeCode) error {
+	_, err := btcutil.DecodeAddress(addrBadgeCode.Addr, conf.GNetParam)
+	if err != nil {
+		return util.NewCodeError(util.ERR_PARAMETERS_CODE, err.Error())
+	}
+	badgeCode, err := hex.DecodeString(addrBadgeCode.BadgeCode)
+	if err != nil || len(badgeCode) != 32 {
+		return util.NewCodeError(util.ERR_PARAMETERS_CODE, "badge_code should be a txid")
+	}
+	return nil
+}
+
+// returns the legal items,illegal ones are reported by setErr
+func FilterAddrBadgeCodes(addrBadgeCodes []*models.AddrBadgeCode, setErr func(index int, err error)) []*models.AddrBadgeCode {
+	legalAddrBadgeCodes := make([]*models.AddrBadgeCode, 0, len(addrBadgeCodes))
+	for index, addrBadgeCode := range addrBadgeCodes {
+		err := CheckAddrBadgeCode(addrBadgeCode)
+		if err != nil {
+			setErr(index, err)
+			continue
+		}
+		legalAddrBadgeCodes = append(legalAddrBadgeCodes, addrBadgeCode)
+	}
+	return legalAddrBadgeCodes
+}
+
+func (this *TouchstoneServer) GetAddrsBalance(addrBadgeCodes []*models.AddrBadgeCode) ([]*AddrBalanceItem, error) {
+	err := CheckBatchSize(addrBadgeCodes, MAX_BATCH_BALANCE_ITEMS)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]*AddrBalanceItem, 0, len(addrBadgeCodes))
+	for _, addrBadgeCode := range addrBadgeCodes {
+		items = append(items, &AddrBalanceItem{
+			Addr:       addrBadgeCode.Addr,
+			BadgeCode:  addrBadgeCode.BadgeCode,
+			LastHeight: models.UNCONFIRM_TX_HEIGHT,
+		})
+	}
+	legalAddrBadgeCodes := FilterAddrBadgeCodes(addrBadgeCodes, func(index int, err error) {
+		items[index].Code = util.ERR_PARAMETERS_CODE
+		items[index].Msg = err.Error()
+	})
+	addrBalances, err := this.AddrBalanceRepository.GetAddrBalances(legalAddrBadgeCodes)
+	if err != nil {
+		return nil, err
+	}
+	addrBalanceMap := make(map[string]*models.AddrBalance)
+	for _, addrBalance := range addrBalances {
+		addrBalanceMap[addrBalance.Id] = addrBalance
+	}
+	for _, item := range items {
+		addrBalance, ok := addrBalanceMap[models.AddrBalanceDocId(item.Addr, item.BadgeCode)]
+		if !ok || item.Code != util.HTTP_OK_RESPONSE_CODE {
+			continue
+		}
+		item.Balance = addrBalance.Balance
+		item.UtxoCount = addrBalance.UtxoCount
+		item.LastHeight = addrBalance.LastHeight
+	}
+	return items, nil
+}
+
+func (this *TouchstoneServer) GetAddrsUtxos(addrBadgeCodes []*models.AddrBadgeCode) ([]*AddrUtxosItem, error) {
+	err := CheckBatchSize(addrBadgeCodes, MAX_BATCH_UTXOS_ITEMS)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]*AddrUtxosItem, 0, len(addrBadgeCodes))
+	for _, addrBadgeCode := range addrBadgeCodes {
+		items = append(items, &AddrUtxosItem{
+			Addr:      addrBadgeCode.Addr,
+			BadgeCode: addrBadgeCode.BadgeCode,
+			Utxos:     make([]*models.TxPoint, 0),
+		})
+	}
+	FilterAddrBadgeCodes(addrBadgeCodes, func(index int, err error) {
+		items[index].Code = util.ERR_PARAMETERS_CODE
+		items[index].Msg = err.Error()
+	})
+	// a page for each item,every query of a busy addr reads at most MAX_BATCH_ITEM_UTXOS vouts
+	for _, item := range items {
+		if item.Code != util.HTTP_OK_RESPONSE_CODE {
+			continue
+		}
+		result, err := this.PageUtxos([]string{item.Addr}, item.BadgeCode, "", MAX_BATCH_ITEM_UTXOS)
+		if err != nil {
+			return nil, err
+		}
+		item.Utxos = result.Utxos
+		item.Truncated = result.NextCursor != ""
+	}
+	return items, nil
+}
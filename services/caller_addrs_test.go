@@ -0,0 +1,35 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/dotwallet/touchstone/interceptor"
+	"github.com/dotwallet/touchstone/models"
+	"github.com/dotwallet/touchstone/util"
+)
+
+func TestCheckAddrInfosAppid(t *testing.T) {
+	addrInfos := map[string]*models.AddrInfo{
+		"a": {Appid: "app", Addr: "a"},
+		"b": {Appid: "other", Addr: "b"},
+	}
+	if err := CheckAddrInfosAppid("app", []string{"a"}, addrInfos); err != nil {
+		t.Fatal(err)
+	}
+	// a key for another appid,and addrs never set
+	for _, addrs := range [][]string{{"a", "b"}, {"c"}} {
+		err := CheckAddrInfosAppid("app", addrs, addrInfos)
+		codeErr, ok := err.(*util.CodeError)
+		if !ok || codeErr.Code != util.ERR_FORBIDDEN_CODE {
+			t.Fatalf("%v not refused %v", addrs, err)
+		}
+	}
+}
+
+func TestCheckCallerAddrsAdmin(t *testing.T) {
+	// admin reads any addr without a lookup
+	server := &TouchstoneServer{}
+	if err := server.CheckCallerAddrs(&interceptor.HttpCaller{Admin: true}, []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,280 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/dotwallet/touchstone/conf"
+	"github.com/dotwallet/touchstone/metrics"
+	"github.com/dotwallet/touchstone/models"
+	"github.com/dotwallet/touchstone/util"
+	"github.com/golang/glog"
+)
+
+const (
+	MIN_CONSOLIDATE_VINS = 2
+	// as many utxos as a batch item returns
+	MAX_CONSOLIDATE_VINS = MAX_BATCH_ITEM_UTXOS
+)
+
+type ConsolidateUtxosRsp struct {
+	Txs []*SendBadgeToAddressRsp `json:"txs"`
+}
+
+func BuildConsolidateTxs(utxos []*models.TxPoint, addr btcutil.Address, maxVins int) ([]*SendBadgeToAddressRsp, error) {
+	sort.Sort(TxPointsSorter(utxos))
+	result := make([]*SendBadgeToAddressRsp, 0, len(utxos)/maxVins+1)
+	for start := 0; start < len(utxos); start += maxVins {
+		end := start + maxVins
+		if end > len(utxos) {
+			end = len(utxos)
+		}
+		usedVins := utxos[start:end]
+		if len(usedVins) < MIN_CONSOLIDATE_VINS {
+			break
+		}
+		msgTx := wire.NewMsgTx(TX_VERSION)
+		vinValue := int64(0)
+		for _, txPoint := range usedVins {
+			hash, err := chainhash.NewHashFromStr(txPoint.Txid)
+			if err != nil {
+				return nil, err
+			}
+			outPoint := wire.NewOutPoint(hash, uint32(txPoint.Index))
+			msgTx.AddTxIn(wire.NewTxIn(outPoint, nil, nil))
+			vinValue += txPoint.Value
+		}
+		script, err := util.CreateBadgeLockScript(addr, vinValue)
+		if err != nil {
+			return nil, err
+		}
+		msgTx.AddTxOut(wire.NewTxOut(conf.GTunables.BadgeDustLimit, script))
+		result = append(result, &SendBadgeToAddressRsp{
+			UnFinishedTx: util.SeserializeMsgTxStr(msgTx),
+			Vins:         usedVins,
+		})
+	}
+	return result, nil
+}
+
+func (this *TouchstoneServer) CheckUserAddr(appid string, userid int64, userIndex int64, addrStr string) error {
+	addrInfo, err := this.AddrInfoRepository.GetAddrInfo(addrStr)
+	if err != nil {
+		if !strings.Contains(err.Error(), models.MONGO_NOT_FOUND) {
+			return err
+		}
+		return util.NewCodeError(util.ERR_NOT_USER_ADDR_CODE, "addr not belong to user")
+	}
+	if addrInfo.Appid != appid || addrInfo.UserID != userid || addrInfo.UserIndex != userIndex {
+		return util.NewCodeError(util.ERR_NOT_USER_ADDR_CODE, "addr not belong to user")
+	}
+	return nil
+}
+
+func (this *TouchstoneServer) ConsolidateUserUtxos(appid string, userid int64, userIndex int64, badgeCode string, addrStr string, maxVins int) (*ConsolidateUtxosRsp, error) {
+	if maxVins < MIN_CONSOLIDATE_VINS {
+		errStr := fmt.Sprintf("max_vins < %d", MIN_CONSOLIDATE_VINS)
+		return nil, util.NewCodeError(util.ERR_PARAMETERS_CODE, errStr)
+	}
+	if maxVins > MAX_CONSOLIDATE_VINS {
+		errStr := fmt.Sprintf("max_vins > %d", MAX_CONSOLIDATE_VINS)
+		return nil, util.NewCodeError(util.ERR_PARAMETERS_CODE, errStr)
+	}
+	err := this.CheckUserAddr(appid, userid, userIndex, addrStr)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := btcutil.DecodeAddress(addrStr, conf.GNetParam)
+	if err != nil {
+		return nil, err
+	}
+	utxos, err := this.GetAllUserUtxos(appid, userid, userIndex, badgeCode)
+	if err != nil {
+		return nil, err
+	}
+	txs, err := BuildConsolidateTxs(utxos, addr, maxVins)
+	if err != nil {
+		return nil, err
+	}
+	return &ConsolidateUtxosRsp{
+		Txs: txs,
+	}, nil
+}
+
+type GetUserConsolidateTxsRsp struct {
+	Txs []*models.ConsolidateInfo `json:"txs"`
+}
+
+func (this *TouchstoneServer) GetUserConsolidateTxs(appid string, userid int64, userIndex int64, badgeCode string) (*GetUserConsolidateTxsRsp, error) {
+	consolidateInfos, err := this.ConsolidateInfoRepository.GetUserConsolidateInfos(appid, userid, userIndex, badgeCode)
+	if err != nil {
+		return nil, err
+	}
+	return &GetUserConsolidateTxsRsp{
+		Txs: consolidateInfos,
+	}, nil
+}
+
+// the utxo count of a badge of a user,addr is the one with the most utxos and receives the consolidation
+type UserBadgeCount struct {
+	Appid     string
+	UserID    int64
+	UserIndex int64
+	BadgeCode string
+	Addr      string
+	AddrCount int
+	Count     int
+}
+
+func (this *UserBadgeCount) Key() string {
+	return fmt.Sprintf("%s_%d_%d_%s", this.Appid, this.UserID, this.UserIndex, this.BadgeCode)
+}
+
+// sums the counts of the addrs of a user by badge code,addrs not of any user are skipped
+func GroupUserBadgeCounts(addrBadgeCounts []*models.AddrBadgeCount, addrInfos map[string]*models.AddrInfo, minCount int) []*UserBadgeCount {
+	userBadgeCounts := make(map[string]*UserBadgeCount)
+	for _, addrBadgeCount := range addrBadgeCounts {
+		addrInfo, ok := addrInfos[addrBadgeCount.Addr]
+		if !ok {
+			continue
+		}
+		userBadgeCount := &UserBadgeCount{
+			Appid:     addrInfo.Appid,
+			UserID:    addrInfo.UserID,
+			UserIndex: addrInfo.UserIndex,
+			BadgeCode: addrBadgeCount.BadgeCode,
+		}
+		key := userBadgeCount.Key()
+		if old, ok := userBadgeCounts[key]; ok {
+			userBadgeCount = old
+		} else {
+			userBadgeCounts[key] = userBadgeCount
+		}
+		userBadgeCount.Count += addrBadgeCount.Count
+		if addrBadgeCount.Count > userBadgeCount.AddrCount || (addrBadgeCount.Count == userBadgeCount.AddrCount && addrBadgeCount.Addr < userBadgeCount.Addr) {
+			userBadgeCount.Addr = addrBadgeCount.Addr
+			userBadgeCount.AddrCount = addrBadgeCount.Count
+		}
+	}
+	result := make([]*UserBadgeCount, 0, len(userBadgeCounts))
+	for _, userBadgeCount := range userBadgeCounts {
+		if userBadgeCount.Count >= minCount {
+			result = append(result, userBadgeCount)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key() < result[j].Key()
+	})
+	return result
+}
+
+func (this *TouchstoneServer) GetAddrInfosMap(addrs []string) (map[string]*models.AddrInfo, error) {
+	addrInfos := make(map[string]*models.AddrInfo, len(addrs))
+	for start := 0; start < len(addrs); start += MAX_BATCH_BALANCE_ITEMS {
+		end := start + MAX_BATCH_BALANCE_ITEMS
+		if end > len(addrs) {
+			end = len(addrs)
+		}
+		batch, err := this.AddrInfoRepository.GetAddrInfos(addrs[start:end])
+		if err != nil {
+			return nil, err
+		}
+		for _, addrInfo := range batch {
+			addrInfos[addrInfo.Addr] = addrInfo
+		}
+	}
+	return addrInfos, nil
+}
+
+// users are consolidated by badge code across all their addrs
+func (this *TouchstoneServer) Consolidate(processId string) error {
+	addrBadgeCounts, err := this.TxPointRepository.GetAddrBadgeCounts(1)
+	if err != nil {
+		glog.Infof("TouchstoneServer.Consolidate GetAddrBadgeCounts %s %s", err, processId)
+		return err
+	}
+	addrs := make([]string, 0, len(addrBadgeCounts))
+	seenAddrs := make(map[string]bool)
+	for _, addrBadgeCount := range addrBadgeCounts {
+		if seenAddrs[addrBadgeCount.Addr] {
+			continue
+		}
+		seenAddrs[addrBadgeCount.Addr] = true
+		addrs = append(addrs, addrBadgeCount.Addr)
+	}
+	addrInfos, err := this.GetAddrInfosMap(addrs)
+	if err != nil {
+		glog.Infof("TouchstoneServer.Consolidate GetAddrInfosMap %s %s", err, processId)
+		return err
+	}
+	for _, userBadgeCount := range GroupUserBadgeCounts(addrBadgeCounts, addrInfos, this.ConsolidateConfig.MinUtxos) {
+		userKey := userBadgeCount.Key()
+		addr, err := btcutil.DecodeAddress(userBadgeCount.Addr, conf.GNetParam)
+		if err != nil {
+			glog.Infof("TouchstoneServer.Consolidate DecodeAddress %s %s %s", userBadgeCount.Addr, err, processId)
+			continue
+		}
+		utxos, err := this.GetAllUserUtxos(userBadgeCount.Appid, userBadgeCount.UserID, userBadgeCount.UserIndex, userBadgeCount.BadgeCode)
+		if err != nil {
+			glog.Infof("TouchstoneServer.Consolidate GetAllUserUtxos %s %s", err, processId)
+			return err
+		}
+		consolidateInfos := make([]*models.ConsolidateInfo, 0, 8)
+		if len(utxos) >= this.ConsolidateConfig.MinUtxos {
+			txs, err := BuildConsolidateTxs(utxos, addr, this.ConsolidateConfig.MaxVins)
+			if err != nil {
+				glog.Infof("TouchstoneServer.Consolidate BuildConsolidateTxs %s %s", err, processId)
+				return err
+			}
+			now := time.Now().Unix()
+			for _, tx := range txs {
+				consolidateInfos = append(consolidateInfos, &models.ConsolidateInfo{
+					Appid:        userBadgeCount.Appid,
+					UserID:       userBadgeCount.UserID,
+					UserIndex:    userBadgeCount.UserIndex,
+					BadgeCode:    userBadgeCount.BadgeCode,
+					Addr:         userBadgeCount.Addr,
+					UnFinishedTx: tx.UnFinishedTx,
+					Vins:         tx.Vins,
+					Timestamp:    now,
+				})
+			}
+		}
+		err = this.ConsolidateInfoRepository.SetUserConsolidateInfos(userBadgeCount.Appid, userBadgeCount.UserID, userBadgeCount.UserIndex, userBadgeCount.BadgeCode, consolidateInfos)
+		if err != nil {
+			glog.Infof("TouchstoneServer.Consolidate SetUserConsolidateInfos %s %s", err, processId)
+			return err
+		}
+		glog.Infof("Consolidate %s %s txs:%d %s", userKey, userBadgeCount.Addr, len(consolidateInfos), processId)
+	}
+	return nil
+}
+
+func (this *TouchstoneServer) ConsolidateLoop(ctx context.Context) {
+	for {
+		if this.LoopPaused(LOOP_CONSOLIDATE) {
+			if !SleepContext(ctx, conf.Seconds(conf.GTunables.LoopPausedIntervalSeconds)) {
+				return
+			}
+			continue
+		}
+		processId := util.RandStringBytes(8)
+		start := time.Now()
+		glog.Infof("TouchstoneServer ConsolidateLoop start %s", processId)
+		err := this.Consolidate(processId)
+		if err != nil {
+			glog.Infof("TouchstoneServer.ConsolidateLoop Consolidate %s %s", err, processId)
+		}
+		glog.Infof("TouchstoneServer ConsolidateLoop done %s", processId)
+		metrics.ObserveLoop(LOOP_CONSOLIDATE, start)
+		if !SleepContext(ctx, conf.Seconds(conf.GTunables.ConsolidateIntervalSeconds)) {
+			return
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/dotwallet/touchstone/models"
+	"github.com/dotwallet/touchstone/util"
+)
+
+func TestGroupUserBadgeCounts(t *testing.T) {
+	addrInfos := map[string]*models.AddrInfo{
+		"a1": {Appid: "app", UserID: 1, Addr: "a1"},
+		"a2": {Appid: "app", UserID: 1, Addr: "a2"},
+		"b1": {Appid: "app", UserID: 2, Addr: "b1"},
+	}
+	addrBadgeCounts := []*models.AddrBadgeCount{
+		{Addr: "a1", BadgeCode: "x", Count: 3},
+		{Addr: "a2", BadgeCode: "x", Count: 4},
+		{Addr: "a2", BadgeCode: "y", Count: 1},
+		{Addr: "b1", BadgeCode: "x", Count: 6},
+		{Addr: "unknown", BadgeCode: "x", Count: 100},
+	}
+	result := GroupUserBadgeCounts(addrBadgeCounts, addrInfos, 5)
+	if len(result) != 2 {
+		t.Fatalf("got %d groups", len(result))
+	}
+	if result[0].UserID != 1 || result[0].BadgeCode != "x" || result[0].Count != 7 || result[0].Addr != "a2" {
+		t.Fatalf("user 1 %+v", result[0])
+	}
+	if result[1].UserID != 2 || result[1].Count != 6 || result[1].Addr != "b1" {
+		t.Fatalf("user 2 %+v", result[1])
+	}
+}
+
+func TestConsolidateUserUtxosMaxVins(t *testing.T) {
+	server := &TouchstoneServer{}
+	for _, maxVins := range []int{MIN_CONSOLIDATE_VINS - 1, MAX_CONSOLIDATE_VINS + 1} {
+		_, err := server.ConsolidateUserUtxos("app", 1, 0, "code", "addr", maxVins)
+		codeErr, ok := err.(*util.CodeError)
+		if !ok || codeErr.Code != util.ERR_PARAMETERS_CODE {
+			t.Fatalf("max_vins %d got %v", maxVins, err)
+		}
+	}
+}
@@ -0,0 +1,383 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/dotwallet/touchstone/conf"
+	"github.com/dotwallet/touchstone/message"
+	"github.com/dotwallet/touchstone/metrics"
+	"github.com/dotwallet/touchstone/models"
+	"github.com/dotwallet/touchstone/util"
+	"github.com/golang/glog"
+)
+
+const (
+	LOOP_DISCOVERY = "discovery"
+
+	CAPABILITY_P2P       = "p2p"
+	CAPABILITY_DISCOVERY = "discovery"
+	CAPABILITY_PUSH_TXS  = "push_txs"
+	CAPABILITY_SNAPSHOT  = "snapshot"
+
+	MAX_ANNOUNCEMENT_AGE        = time.Hour * 24
+	MAX_ANNOUNCEMENT_CLOCK_SKEW = time.Minute
+	MAX_ANNOUNCEMENTS           = 100
+	// nodes no trusted introducer vouches for are only kept up to this count
+	MAX_UNVOUCHED_NODES = 1000
+)
+
+var OWN_CAPABILITIES = []string{CAPABILITY_P2P, CAPABILITY_DISCOVERY, CAPABILITY_PUSH_TXS, CAPABILITY_SNAPSHOT}
+
+// a known node and whether a trusted introducer vouches for it
+type KnownNode struct {
+	*models.Node
+	Admitted bool `json:"admitted"`
+}
+
+func writeVarBytes(byteBuf *bytes.Buffer, data []byte) {
+	binary.Write(byteBuf, binary.LittleEndian, uint32(len(data)))
+	byteBuf.Write(data)
+}
+
+// the pubkey is signed compressed,so an announcement still verifies after its pubkey is normalised
+func AnnouncementDigest(pubkey *btcec.PublicKey, announcement *message.PeerAnnouncement) []byte {
+	byteBuf := bytes.NewBuffer(make([]byte, 0, 128))
+	writeVarBytes(byteBuf, pubkey.SerializeCompressed())
+	writeVarBytes(byteBuf, []byte(announcement.Host))
+	binary.Write(byteBuf, binary.LittleEndian, uint32(len(announcement.Capabilities)))
+	for _, capability := range announcement.Capabilities {
+		writeVarBytes(byteBuf, []byte(capability))
+	}
+	binary.Write(byteBuf, binary.LittleEndian, announcement.Timestamp)
+	digest := sha256.Sum256(byteBuf.Bytes())
+	return digest[:]
+}
+
+func SignAnnouncement(privateKey *btcec.PrivateKey, host string, capabilities []string, timestamp int64) (*message.PeerAnnouncement, error) {
+	announcement := &message.PeerAnnouncement{
+		Pubkey:       privateKey.PubKey().SerializeCompressed(),
+		Host:         host,
+		Capabilities: capabilities,
+		Timestamp:    timestamp,
+	}
+	sig, err := privateKey.Sign(AnnouncementDigest(privateKey.PubKey(), announcement))
+	if err != nil {
+		return nil, err
+	}
+	announcement.Signature = sig.Serialize()
+	return announcement, nil
+}
+
+// returns the pubkey as compressed hex,the form peers are configured and stored with
+func VerifyAnnouncement(announcement *message.PeerAnnouncement, now time.Time) (string, error) {
+	timestamp := time.Unix(announcement.Timestamp, 0)
+	if timestamp.After(now.Add(MAX_ANNOUNCEMENT_CLOCK_SKEW)) {
+		return "", errors.New("announcement from future")
+	}
+	if now.Sub(timestamp) > MAX_ANNOUNCEMENT_AGE {
+		return "", errors.New("announcement expired")
+	}
+	_, _, err := net.SplitHostPort(announcement.Host)
+	if err != nil {
+		return "", err
+	}
+	pubkey, err := btcec.ParsePubKey(announcement.Pubkey, btcec.S256())
+	if err != nil {
+		return "", err
+	}
+	sig, err := btcec.ParseSignature(announcement.Signature, btcec.S256())
+	if err != nil {
+		return "", err
+	}
+	if !sig.Verify(AnnouncementDigest(pubkey, announcement), pubkey) {
+		return "", errors.New("verify fail")
+	}
+	return hex.EncodeToString(pubkey.SerializeCompressed()), nil
+}
+
+func Node2Announcement(node *models.Node) (*message.PeerAnnouncement, error) {
+	pubkey, err := hex.DecodeString(node.Pubkey)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := hex.DecodeString(node.Signature)
+	if err != nil {
+		return nil, err
+	}
+	return &message.PeerAnnouncement{
+		Pubkey:       pubkey,
+		Host:         node.Host,
+		Capabilities: node.Capabilities,
+		Timestamp:    node.Timestamp,
+		Signature:    signature,
+	}, nil
+}
+
+func HasCapability(capabilities []string, capability string) bool {
+	for _, item := range capabilities {
+		if item == capability {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *TouchstoneServer) OwnPubkey() string {
+	return hex.EncodeToString(this.privateKey.PubKey().SerializeCompressed())
+}
+
+func (this *TouchstoneServer) GetDiscoveryConfig() *conf.DiscoveryConfig {
+	this.peersLock.RLock()
+	defer this.peersLock.RUnlock()
+	return this.DiscoveryConfig
+}
+
+func (this *TouchstoneServer) DiscoveryEnabled() bool {
+	discoveryConfig := this.GetDiscoveryConfig()
+	return discoveryConfig != nil && discoveryConfig.Enable
+}
+
+func (this *TouchstoneServer) TrustedIntroducer(pubkey string) bool {
+	discoveryConfig := this.GetDiscoveryConfig()
+	if discoveryConfig == nil {
+		return false
+	}
+	for _, introducer := range discoveryConfig.TrustedIntroducers {
+		if introducer == pubkey {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *TouchstoneServer) Admitted(node *models.Node) bool {
+	if node.Timestamp == 0 || !HasCapability(node.Capabilities, CAPABILITY_P2P) {
+		return false
+	}
+	for _, introducer := range node.Introducers {
+		if this.TrustedIntroducer(introducer) {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *TouchstoneServer) GetKnownNodes() ([]*KnownNode, error) {
+	nodes, err := this.NodeRepository.GetAllNodes()
+	if err != nil {
+		return nil, err
+	}
+	knownNodes := make([]*KnownNode, 0, len(nodes))
+	for _, node := range nodes {
+		knownNodes = append(knownNodes, &KnownNode{
+			Node:     node,
+			Admitted: this.Admitted(node),
+		})
+	}
+	return knownNodes, nil
+}
+
+// configured peers come first and keep their host
+func (this *TouchstoneServer) MergePeerConfigs() ([]*conf.PeerConfig, error) {
+	this.peersLock.RLock()
+	peerConfigs := append([]*conf.PeerConfig{}, this.staticPeerConfigs...)
+	this.peersLock.RUnlock()
+	if !this.DiscoveryEnabled() {
+		return peerConfigs, nil
+	}
+	nodes, err := this.NodeRepository.GetAllNodes()
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool)
+	known[this.OwnPubkey()] = true
+	for _, peerConfig := range peerConfigs {
+		known[peerConfig.Pubkey] = true
+	}
+	for _, node := range nodes {
+		if known[node.Pubkey] || !this.Admitted(node) {
+			continue
+		}
+		known[node.Pubkey] = true
+		peerConfigs = append(peerConfigs, &conf.PeerConfig{
+			Host:   node.Host,
+			Pubkey: node.Pubkey,
+		})
+	}
+	return peerConfigs, nil
+}
+
+// allow-list is updated before dialing,so new peers are accepted as soon as they connect
+func (this *TouchstoneServer) ApplyPeers() error {
+	this.applyLock.Lock()
+	defer this.applyLock.Unlock()
+	peerConfigs, err := this.MergePeerConfigs()
+	if err != nil {
+		return err
+	}
+	if this.PeerAllowList != nil {
+		this.PeerAllowList.Set(peerConfigs)
+	}
+	return this.ConnectPeer(peerConfigs)
+}
+
+// ours and the ones of current peers
+func (this *TouchstoneServer) GetAnnouncements() ([]*message.PeerAnnouncement, error) {
+	discoveryConfig := this.GetDiscoveryConfig()
+	own, err := SignAnnouncement(this.privateKey, discoveryConfig.AnnounceHost, OWN_CAPABILITIES, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	announcements := []*message.PeerAnnouncement{own}
+	nodes, err := this.NodeRepository.GetAllNodes()
+	if err != nil {
+		return nil, err
+	}
+	peers := this.Peers()
+	for _, node := range nodes {
+		if len(announcements) >= MAX_ANNOUNCEMENTS {
+			break
+		}
+		_, ok := peers[node.Pubkey]
+		if !ok || node.Timestamp == 0 {
+			continue
+		}
+		announcement, err := Node2Announcement(node)
+		if err != nil {
+			glog.Infof("TouchstoneServer.GetAnnouncements Node2Announcement %s %s", node.Pubkey, err)
+			continue
+		}
+		announcements = append(announcements, announcement)
+	}
+	return announcements, nil
+}
+
+// nodes are stored when a trusted introducer vouches for them,or while there is room for unvouched ones.
+// only the ones vouched by a trusted introducer are admitted
+func (this *TouchstoneServer) ReceiveAnnouncements(from string, announcements []*message.PeerAnnouncement, processid string) error {
+	now := time.Now()
+	ownPubkey := this.OwnPubkey()
+	insert := this.TrustedIntroducer(from)
+	if !insert {
+		// counted once per exchange,so the limit is passed by MAX_ANNOUNCEMENTS at most
+		trustedIntroducers := []string{}
+		discoveryConfig := this.GetDiscoveryConfig()
+		if discoveryConfig != nil {
+			trustedIntroducers = append(trustedIntroducers, discoveryConfig.TrustedIntroducers...)
+		}
+		unvouched, err := this.NodeRepository.CountNodesNotIntroducedBy(trustedIntroducers)
+		if err != nil {
+			glog.Infof("TouchstoneServer.ReceiveAnnouncements CountNodesNotIntroducedBy %s %s", err, processid)
+			return err
+		}
+		insert = unvouched < MAX_UNVOUCHED_NODES
+	}
+	changed := 0
+	for i, announcement := range announcements {
+		if i >= MAX_ANNOUNCEMENTS {
+			break
+		}
+		pubkey, err := VerifyAnnouncement(announcement, now)
+		if err != nil {
+			glog.Infof("TouchstoneServer.ReceiveAnnouncements VerifyAnnouncement %s from %s %s %s", hex.EncodeToString(announcement.Pubkey), from, err, processid)
+			continue
+		}
+		if pubkey == ownPubkey {
+			continue
+		}
+		node := &models.Node{
+			Pubkey:       pubkey,
+			Host:         announcement.Host,
+			Capabilities: announcement.Capabilities,
+			Timestamp:    announcement.Timestamp,
+			Signature:    hex.EncodeToString(announcement.Signature),
+		}
+		saved, err := this.NodeRepository.SaveNode(node, from, insert)
+		if err != nil {
+			glog.Infof("TouchstoneServer.ReceiveAnnouncements SaveNode %s %s %s", pubkey, err, processid)
+			return err
+		}
+		if saved {
+			changed++
+		}
+	}
+	if changed == 0 {
+		return nil
+	}
+	glog.Infof("TouchstoneServer.ReceiveAnnouncements %d nodes changed from %s %s", changed, from, processid)
+	return this.ApplyPeers()
+}
+
+func (this *TouchstoneServer) ExchangePeers(from string, request *message.ExchangePeersRequest, processid string) (*message.ExchangePeersResponse, error) {
+	if !this.DiscoveryEnabled() {
+		return &message.ExchangePeersResponse{}, nil
+	}
+	err := this.ReceiveAnnouncements(from, request.Announcements, processid)
+	if err != nil {
+		return nil, err
+	}
+	announcements, err := this.GetAnnouncements()
+	if err != nil {
+		return nil, err
+	}
+	return &message.ExchangePeersResponse{
+		Announcements: announcements,
+	}, nil
+}
+
+func (this *TouchstoneServer) DiscoverPeers(ctx context.Context, processid string) {
+	announcements, err := this.GetAnnouncements()
+	if err != nil {
+		glog.Infof("TouchstoneServer.DiscoverPeers GetAnnouncements %s %s", err, processid)
+		return
+	}
+	request := &message.ExchangePeersRequest{
+		Announcements: announcements,
+	}
+	peers := this.Peers()
+	for _, pubkey := range this.RankPeers(peers) {
+		peer := peers[pubkey]
+		if !peer.Connected() || !peer.Protocol().HasCapability(CAPABILITY_DISCOVERY) {
+			continue
+		}
+		rpcCtx, cancel := context.WithTimeout(ctx, PEER_RPC_TIMEOUT)
+		response, err := peer.ExchangePeers(rpcCtx, request)
+		cancel()
+		if err != nil {
+			glog.Infof("TouchstoneServer.DiscoverPeers ExchangePeers %s %s %s", pubkey, err, processid)
+			continue
+		}
+		err = this.ReceiveAnnouncements(pubkey, response.Announcements, processid)
+		if err != nil {
+			glog.Infof("TouchstoneServer.DiscoverPeers ReceiveAnnouncements %s %s %s", pubkey, err, processid)
+		}
+	}
+}
+
+func (this *TouchstoneServer) DiscoveryLoop(ctx context.Context) {
+	for {
+		if this.LoopPaused(LOOP_DISCOVERY) {
+			if !SleepContext(ctx, conf.Seconds(conf.GTunables.LoopPausedIntervalSeconds)) {
+				return
+			}
+			continue
+		}
+		processId := util.RandStringBytes(8)
+		start := time.Now()
+		glog.Infof("TouchstoneServer DiscoveryLoop start %s", processId)
+		this.DiscoverPeers(ctx, processId)
+		glog.Infof("TouchstoneServer DiscoveryLoop done %s", processId)
+		metrics.ObserveLoop(LOOP_DISCOVERY, start)
+		if !SleepContext(ctx, conf.Seconds(conf.GTunables.DiscoveryIntervalSeconds)) {
+			return
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package services
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/dotwallet/touchstone/conf"
+	"github.com/dotwallet/touchstone/models"
+)
+
+func TestVerifyAnnouncement(t *testing.T) {
+	privateKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubkey := hex.EncodeToString(privateKey.PubKey().SerializeCompressed())
+	now := time.Now()
+	announcement, err := SignAnnouncement(privateKey, "203.0.113.7:7788", OWN_CAPABILITIES, now.Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	verified, err := VerifyAnnouncement(announcement, now)
+	if err != nil || verified != pubkey {
+		t.Fatalf("verify %s %v", verified, err)
+	}
+	// an uncompressed pubkey is normalised
+	announcement.Pubkey = privateKey.PubKey().SerializeUncompressed()
+	verified, err = VerifyAnnouncement(announcement, now)
+	if err != nil || verified != pubkey {
+		t.Fatalf("uncompressed %s %v", verified, err)
+	}
+	if _, err := VerifyAnnouncement(announcement, now.Add(-MAX_ANNOUNCEMENT_CLOCK_SKEW-time.Second)); err == nil {
+		t.Fatal("announcement from future verified")
+	}
+	if _, err := VerifyAnnouncement(announcement, now.Add(MAX_ANNOUNCEMENT_AGE+time.Second)); err == nil {
+		t.Fatal("expired announcement verified")
+	}
+	announcement.Host = "203.0.113.8:7788"
+	if _, err := VerifyAnnouncement(announcement, now); err == nil {
+		t.Fatal("tampered announcement verified")
+	}
+	announcement.Host = "203.0.113.7"
+	if _, err := VerifyAnnouncement(announcement, now); err == nil {
+		t.Fatal("host without port verified")
+	}
+}
+
+func TestAdmitted(t *testing.T) {
+	server := &TouchstoneServer{
+		DiscoveryConfig: &conf.DiscoveryConfig{
+			Enable:             true,
+			TrustedIntroducers: []string{"02aa"},
+		},
+	}
+	cases := []struct {
+		node   *models.Node
+		expect bool
+	}{
+		{&models.Node{Timestamp: 1, Capabilities: []string{CAPABILITY_P2P}, Introducers: []string{"02bb", "02aa"}}, true},
+		{&models.Node{Timestamp: 1, Capabilities: []string{CAPABILITY_P2P}, Introducers: []string{"02bb"}}, false},
+		// heard of before its own announcement
+		{&models.Node{Timestamp: 0, Capabilities: []string{CAPABILITY_P2P}, Introducers: []string{"02aa"}}, false},
+		{&models.Node{Timestamp: 1, Capabilities: []string{CAPABILITY_DISCOVERY}, Introducers: []string{"02aa"}}, false},
+	}
+	for i, c := range cases {
+		if server.Admitted(c.node) != c.expect {
+			t.Fatalf("case %d expect %t", i, c.expect)
+		}
+	}
+}
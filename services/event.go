@@ -0,0 +1,226 @@
+package services
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dotwallet/touchstone/models"
+	"github.com/golang/glog"
+)
+
+const (
+	EVENT_TYPE_TX_CLOSED    = "tx_closed"
+	EVENT_TYPE_TX_CONFIRMED = "tx_confirmed"
+	EVENT_TYPE_TX_REORGED   = "tx_reorged"
+	EVENT_TYPE_TX_REMOVED   = "tx_removed"
+	EVENT_TYPE_UTXO_SPENT   = "utxo_spent"
+
+	EVENT_SUBSCRIBER_BUFFER = 256
+	EVENT_REPLAY_BATCH      = 500
+	MAX_EVENT_FILTER_ITEMS  = 1000
+)
+
+// Appid not empty limits events to those touching a user of the appid
+type EventFilter struct {
+	Addrs        []string
+	BadgeCodes   []string
+	Users        []string
+	Appid        string
+	addrSet      map[string]bool
+	badgeCodeSet map[string]bool
+	userSet      map[string]bool
+}
+
+func NewEventFilter(addrs []string, badgeCodes []string, users []string) *EventFilter {
+	eventFilter := &EventFilter{
+		Addrs:        addrs,
+		BadgeCodes:   badgeCodes,
+		Users:        users,
+		addrSet:      make(map[string]bool),
+		badgeCodeSet: make(map[string]bool),
+		userSet:      make(map[string]bool),
+	}
+	for _, addr := range addrs {
+		eventFilter.addrSet[addr] = true
+	}
+	for _, badgeCode := range badgeCodes {
+		eventFilter.badgeCodeSet[badgeCode] = true
+	}
+	for _, user := range users {
+		eventFilter.userSet[user] = true
+	}
+	return eventFilter
+}
+
+func (this *EventFilter) Len() int {
+	return len(this.Addrs) + len(this.BadgeCodes) + len(this.Users)
+}
+
+func (this *EventFilter) Allowed(event *models.Event) bool {
+	if this.Appid == "" {
+		return true
+	}
+	for _, user := range event.Users {
+		if models.UserKeyAppid(user) == this.Appid {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *EventFilter) Match(event *models.Event) bool {
+	if !this.Allowed(event) {
+		return false
+	}
+	for _, addr := range event.Addrs {
+		if this.addrSet[addr] {
+			return true
+		}
+	}
+	for _, badgeCode := range event.BadgeCodes {
+		if this.badgeCodeSet[badgeCode] {
+			return true
+		}
+	}
+	for _, user := range event.Users {
+		if this.userSet[user] {
+			return true
+		}
+	}
+	return false
+}
+
+type Subscriber struct {
+	Filter *EventFilter
+	// closed when the subscriber is too slow,it should resume from the last seq
+	Events chan *models.Event
+}
+
+type EventHub struct {
+	EventRepository    *models.EventRepository
+	AddrInfoRepository *models.AddrInfoRepository
+	lock               sync.Mutex
+	subscribers        map[*Subscriber]bool
+}
+
+func NewEventHub(eventRepository *models.EventRepository, addrInfoRepository *models.AddrInfoRepository) (*EventHub, error) {
+	err := eventRepository.InitSeq()
+	if err != nil {
+		return nil, err
+	}
+	return &EventHub{
+		EventRepository:    eventRepository,
+		AddrInfoRepository: addrInfoRepository,
+		subscribers:        make(map[*Subscriber]bool),
+	}, nil
+}
+
+// events are stored and pushed in seq order
+func (this *EventHub) Publish(eventType string, txid string, height int64, txPoints []*models.TxPoint) error {
+	addrSet := make(map[string]bool)
+	badgeCodeSet := make(map[string]bool)
+	for _, txPoint := range txPoints {
+		addrSet[txPoint.Addr] = true
+		badgeCodeSet[txPoint.BadgeCode] = true
+	}
+	event := &models.Event{
+		Type:       eventType,
+		Txid:       txid,
+		Height:     height,
+		TxPoints:   txPoints,
+		Addrs:      make([]string, 0, len(addrSet)),
+		BadgeCodes: make([]string, 0, len(badgeCodeSet)),
+		Users:      make([]string, 0, 1),
+		Timestamp:  time.Now().Unix(),
+		CreatedAt:  time.Now(),
+	}
+	for addr := range addrSet {
+		event.Addrs = append(event.Addrs, addr)
+	}
+	for badgeCode := range badgeCodeSet {
+		event.BadgeCodes = append(event.BadgeCodes, badgeCode)
+	}
+	addrInfos, err := this.AddrInfoRepository.GetAddrInfos(event.Addrs)
+	if err != nil {
+		return err
+	}
+	for _, addrInfo := range addrInfos {
+		event.Users = append(event.Users, models.UserKey(addrInfo.Appid, addrInfo.UserID, addrInfo.UserIndex))
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	// a seq lost by a failed insert is only a gap,resuming is by seq greater than the last one
+	event.Seq, err = this.EventRepository.NextSeq()
+	if err != nil {
+		return err
+	}
+	err = this.EventRepository.AddEvent(event)
+	if err != nil {
+		return err
+	}
+	for subscriber := range this.subscribers {
+		if !subscriber.Filter.Match(event) {
+			continue
+		}
+		select {
+		case subscriber.Events <- event:
+		default:
+			glog.Infof("EventHub.Publish subscriber too slow,drop it seq:%d", event.Seq)
+			delete(this.subscribers, subscriber)
+			close(subscriber.Events)
+		}
+	}
+	return nil
+}
+
+func (this *EventHub) Subscribe(eventFilter *EventFilter) *Subscriber {
+	subscriber := &Subscriber{
+		Filter: eventFilter,
+		Events: make(chan *models.Event, EVENT_SUBSCRIBER_BUFFER),
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.subscribers[subscriber] = true
+	return subscriber
+}
+
+func (this *EventHub) Unsubscribe(subscriber *Subscriber) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	_, ok := this.subscribers[subscriber]
+	if !ok {
+		return
+	}
+	delete(this.subscribers, subscriber)
+	close(subscriber.Events)
+}
+
+// handle stored events after seq,returns seq of the last handled event
+func (this *EventHub) Replay(eventFilter *EventFilter, seq int64, handle func(event *models.Event) error) (int64, error) {
+	for {
+		events, err := this.EventRepository.GetEventsAfter(seq, eventFilter.Addrs, eventFilter.BadgeCodes, eventFilter.Users, EVENT_REPLAY_BATCH)
+		if err != nil {
+			return seq, err
+		}
+		for _, event := range events {
+			if eventFilter.Allowed(event) {
+				err := handle(event)
+				if err != nil {
+					return seq, err
+				}
+			}
+			seq = event.Seq
+		}
+		if len(events) < EVENT_REPLAY_BATCH {
+			return seq, nil
+		}
+	}
+}
+
+func (this *TouchstoneServer) PublishEvent(eventType string, txid string, height int64, txPoints []*models.TxPoint) {
+	err := this.EventHub.Publish(eventType, txid, height, txPoints)
+	if err != nil {
+		glog.Infof("TouchstoneServer.PublishEvent %s %s err:%s", eventType, txid, err)
+	}
+}
@@ -0,0 +1,31 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/dotwallet/touchstone/models"
+)
+
+func TestEventFilterAppid(t *testing.T) {
+	event := &models.Event{
+		Addrs:      []string{"a1", "b1"},
+		BadgeCodes: []string{"x"},
+		Users:      []string{models.UserKey("app_1", 1, 0)},
+	}
+	eventFilter := NewEventFilter(nil, []string{"x"}, nil)
+	if !eventFilter.Match(event) {
+		t.Fatal("admin filter should match")
+	}
+	eventFilter.Appid = "1"
+	if eventFilter.Match(event) {
+		t.Fatal("event of another appid should not match")
+	}
+	eventFilter.Appid = "app_1"
+	if !eventFilter.Match(event) {
+		t.Fatal("event of the appid should match")
+	}
+	event.Users = nil
+	if eventFilter.Match(event) {
+		t.Fatal("event without users should not match an appid filter")
+	}
+}
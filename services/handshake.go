@@ -0,0 +1,204 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dotwallet/touchstone/conf"
+	"github.com/dotwallet/touchstone/message"
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	PROTOCOL_VERSION     = 1
+	MIN_PROTOCOL_VERSION = 1
+	// sha256 of the closed txids of a partition ordered by txid
+	PARTITION_HASH_ALGORITHM = "sha256-txids"
+
+	// full peers are synced by partitions and txs,downgraded ones only by txs,refused ones not at all
+	PEER_PROTOCOL_FULL       = "full"
+	PEER_PROTOCOL_DOWNGRADED = "downgraded"
+	PEER_PROTOCOL_REFUSED    = "refused"
+
+	PEER_HELLO_INTERVAL = time.Minute * 10
+)
+
+// the parameters agreed with a peer,capabilities are the ones both sides have
+type PeerProtocol struct {
+	Status                 string   `json:"status"`
+	Reason                 string   `json:"reason"`
+	ProtocolVersion        int64    `json:"protocol_version"`
+	Network                string   `json:"network"`
+	StartHeight            int64    `json:"start_height"`
+	PartitionBlockCount    int64    `json:"partition_block_count"`
+	PartitionHashAlgorithm string   `json:"partition_hash_algorithm"`
+	Capabilities           []string `json:"capabilities"`
+	Time                   int64    `json:"time"`
+}
+
+// nil is a peer not negotiated yet
+func (this *PeerProtocol) PartitionSync() bool {
+	return this != nil && this.Status == PEER_PROTOCOL_FULL
+}
+
+func (this *PeerProtocol) Refused() bool {
+	return this != nil && this.Status == PEER_PROTOCOL_REFUSED
+}
+
+// peers not negotiated yet are assumed to have every capability
+func (this *PeerProtocol) HasCapability(capability string) bool {
+	return this == nil || HasCapability(this.Capabilities, capability)
+}
+
+func (this *Node) Protocol() *PeerProtocol {
+	this.protocolLock.Lock()
+	defer this.protocolLock.Unlock()
+	return this.protocol
+}
+
+func (this *Node) SetProtocol(protocol *PeerProtocol) {
+	this.protocolLock.Lock()
+	defer this.protocolLock.Unlock()
+	this.protocol = protocol
+}
+
+func OwnHello() *message.HelloRequest {
+	return &message.HelloRequest{
+		ProtocolVersion:        PROTOCOL_VERSION,
+		Network:                conf.GEnv,
+		StartHeight:            *conf.GStartHeight,
+		PartitionBlockCount:    conf.GTunables.PartitionBlockCount,
+		PartitionHashAlgorithm: PARTITION_HASH_ALGORITHM,
+		Capabilities:           OWN_CAPABILITIES,
+	}
+}
+
+// another network or a too old protocol is refused,other partition parameters are downgraded
+func NegotiateProtocol(hello *message.HelloRequest, now time.Time) *PeerProtocol {
+	own := OwnHello()
+	protocol := &PeerProtocol{
+		Status:                 PEER_PROTOCOL_FULL,
+		ProtocolVersion:        hello.ProtocolVersion,
+		Network:                hello.Network,
+		StartHeight:            hello.StartHeight,
+		PartitionBlockCount:    hello.PartitionBlockCount,
+		PartitionHashAlgorithm: hello.PartitionHashAlgorithm,
+		Capabilities:           make([]string, 0, len(own.Capabilities)),
+		Time:                   now.Unix(),
+	}
+	if protocol.ProtocolVersion > own.ProtocolVersion {
+		protocol.ProtocolVersion = own.ProtocolVersion
+	}
+	for _, capability := range own.Capabilities {
+		if HasCapability(hello.Capabilities, capability) {
+			protocol.Capabilities = append(protocol.Capabilities, capability)
+		}
+	}
+	switch {
+	case hello.Network != own.Network:
+		protocol.Status = PEER_PROTOCOL_REFUSED
+		protocol.Reason = fmt.Sprintf("network %s,ours %s", hello.Network, own.Network)
+	case hello.ProtocolVersion < MIN_PROTOCOL_VERSION:
+		protocol.Status = PEER_PROTOCOL_REFUSED
+		protocol.Reason = fmt.Sprintf("protocol version %d,min %d", hello.ProtocolVersion, MIN_PROTOCOL_VERSION)
+	case hello.StartHeight != own.StartHeight:
+		protocol.Status = PEER_PROTOCOL_DOWNGRADED
+		protocol.Reason = fmt.Sprintf("start height %d,ours %d", hello.StartHeight, own.StartHeight)
+	case hello.PartitionBlockCount != own.PartitionBlockCount:
+		protocol.Status = PEER_PROTOCOL_DOWNGRADED
+		protocol.Reason = fmt.Sprintf("partition block count %d,ours %d", hello.PartitionBlockCount, own.PartitionBlockCount)
+	case hello.PartitionHashAlgorithm != own.PartitionHashAlgorithm:
+		protocol.Status = PEER_PROTOCOL_DOWNGRADED
+		protocol.Reason = fmt.Sprintf("partition hash algorithm %s,ours %s", hello.PartitionHashAlgorithm, own.PartitionHashAlgorithm)
+	}
+	return protocol
+}
+
+// peers older than Hello can not tell their parameters,their partitions are not trusted
+func LegacyProtocol(now time.Time) *PeerProtocol {
+	return &PeerProtocol{
+		Status:       PEER_PROTOCOL_DOWNGRADED,
+		Reason:       "hello not supported",
+		Capabilities: []string{CAPABILITY_P2P},
+		Time:         now.Unix(),
+	}
+}
+
+// the result is kept on the connection,a redialed peer is negotiated again
+func (this *TouchstoneServer) HandshakePeer(ctx context.Context, pubkey string, peer *Node, processid string) *PeerProtocol {
+	rpcCtx, cancel := context.WithTimeout(ctx, PEER_RPC_TIMEOUT)
+	response, err := peer.Hello(rpcCtx, OwnHello())
+	cancel()
+	now := time.Now()
+	var protocol *PeerProtocol
+	switch {
+	case err == nil && response.Hello != nil:
+		protocol = NegotiateProtocol(response.Hello, now)
+	case status.Code(err) == codes.Unimplemented:
+		protocol = LegacyProtocol(now)
+	default:
+		glog.Infof("TouchstoneServer.HandshakePeer Hello %s %v %s", pubkey, err, processid)
+		return peer.Protocol()
+	}
+	this.setPeerProtocol(pubkey, peer, protocol, processid)
+	return protocol
+}
+
+func (this *TouchstoneServer) setPeerProtocol(pubkey string, peer *Node, protocol *PeerProtocol, processid string) {
+	old := peer.Protocol()
+	peer.SetProtocol(protocol)
+	if old == nil || old.Status != protocol.Status || old.Reason != protocol.Reason {
+		glog.Infof("TouchstoneServer peer protocol %s %s %s %s", pubkey, protocol.Status, protocol.Reason, processid)
+	}
+}
+
+// negotiates a peer not negotiated yet
+func (this *TouchstoneServer) EnsurePeerProtocol(ctx context.Context, pubkey string, peer *Node, processid string) *PeerProtocol {
+	protocol := peer.Protocol()
+	if protocol != nil {
+		return protocol
+	}
+	return this.HandshakePeer(ctx, pubkey, peer, processid)
+}
+
+// connected peers are negotiated again every PEER_HELLO_INTERVAL,they may have restarted with other parameters
+func (this *TouchstoneServer) HandshakePeers(ctx context.Context, processid string) {
+	now := time.Now()
+	for pubkey, peer := range this.Peers() {
+		if !peer.Connected() {
+			continue
+		}
+		protocol := peer.Protocol()
+		if protocol != nil && now.Sub(time.Unix(protocol.Time, 0)) < PEER_HELLO_INTERVAL {
+			continue
+		}
+		this.HandshakePeer(ctx, pubkey, peer, processid)
+	}
+}
+
+// refused peers get FailedPrecondition on every p2p rpc but Hello
+func (this *TouchstoneServer) RefusedReason(pubkey string) string {
+	peer, ok := this.Peers()[pubkey]
+	if !ok {
+		return ""
+	}
+	protocol := peer.Protocol()
+	if !protocol.Refused() {
+		return ""
+	}
+	return protocol.Reason
+}
+
+// the caller is negotiated by its hello too,our answer lets it do the same
+func (this *TouchstoneServer) Hello(from string, request *message.HelloRequest, processid string) *message.HelloResponse {
+	peer, ok := this.Peers()[from]
+	if ok {
+		this.setPeerProtocol(from, peer, NegotiateProtocol(request, time.Now()), processid)
+	}
+	return &message.HelloResponse{
+		Hello: OwnHello(),
+	}
+}
@@ -0,0 +1,71 @@
+package services
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dotwallet/touchstone/message"
+)
+
+func TestNegotiateProtocol(t *testing.T) {
+	now := time.Now()
+	hello := func(update func(hello *message.HelloRequest)) *message.HelloRequest {
+		hello := OwnHello()
+		update(hello)
+		return hello
+	}
+	cases := []struct {
+		name         string
+		hello        *message.HelloRequest
+		status       string
+		version      int64
+		capabilities []string
+	}{
+		{"same", OwnHello(), PEER_PROTOCOL_FULL, PROTOCOL_VERSION, OWN_CAPABILITIES},
+		{"newer version", hello(func(hello *message.HelloRequest) { hello.ProtocolVersion = PROTOCOL_VERSION + 1 }), PEER_PROTOCOL_FULL, PROTOCOL_VERSION, OWN_CAPABILITIES},
+		{"fewer capabilities", hello(func(hello *message.HelloRequest) {
+			hello.Capabilities = []string{CAPABILITY_SNAPSHOT, "unknown", CAPABILITY_P2P}
+		}), PEER_PROTOCOL_FULL, PROTOCOL_VERSION, []string{CAPABILITY_P2P, CAPABILITY_SNAPSHOT}},
+		{"other network", hello(func(hello *message.HelloRequest) { hello.Network = "other" }), PEER_PROTOCOL_REFUSED, PROTOCOL_VERSION, OWN_CAPABILITIES},
+		{"old version", hello(func(hello *message.HelloRequest) { hello.ProtocolVersion = MIN_PROTOCOL_VERSION - 1 }), PEER_PROTOCOL_REFUSED, MIN_PROTOCOL_VERSION - 1, OWN_CAPABILITIES},
+		{"start height", hello(func(hello *message.HelloRequest) { hello.StartHeight++ }), PEER_PROTOCOL_DOWNGRADED, PROTOCOL_VERSION, OWN_CAPABILITIES},
+		{"partition block count", hello(func(hello *message.HelloRequest) { hello.PartitionBlockCount++ }), PEER_PROTOCOL_DOWNGRADED, PROTOCOL_VERSION, OWN_CAPABILITIES},
+		{"partition hash algorithm", hello(func(hello *message.HelloRequest) { hello.PartitionHashAlgorithm = "other" }), PEER_PROTOCOL_DOWNGRADED, PROTOCOL_VERSION, OWN_CAPABILITIES},
+		// refusing wins over downgrading
+		{"other network and start height", hello(func(hello *message.HelloRequest) {
+			hello.Network = "other"
+			hello.StartHeight++
+		}), PEER_PROTOCOL_REFUSED, PROTOCOL_VERSION, OWN_CAPABILITIES},
+	}
+	for _, c := range cases {
+		protocol := NegotiateProtocol(c.hello, now)
+		if protocol.Status != c.status || protocol.ProtocolVersion != c.version || !reflect.DeepEqual(protocol.Capabilities, c.capabilities) {
+			t.Fatalf("%s %+v", c.name, protocol)
+		}
+		if (protocol.Status == PEER_PROTOCOL_FULL) != (protocol.Reason == "") {
+			t.Fatalf("%s reason %s", c.name, protocol.Reason)
+		}
+		if protocol.Time != now.Unix() {
+			t.Fatalf("%s time %d", c.name, protocol.Time)
+		}
+	}
+}
+
+func TestRefusedReason(t *testing.T) {
+	server := &TouchstoneServer{
+		peers: map[string]*Node{
+			"02aa": {protocol: &PeerProtocol{Status: PEER_PROTOCOL_REFUSED, Reason: "network regtest,ours mainnet"}},
+			"02bb": {protocol: &PeerProtocol{Status: PEER_PROTOCOL_DOWNGRADED, Reason: "hello not supported"}},
+			"02cc": {},
+		},
+	}
+	if server.RefusedReason("02aa") != "network regtest,ours mainnet" {
+		t.Fatal("refused peer")
+	}
+	for _, pubkey := range []string{"02bb", "02cc", "02dd"} {
+		if server.RefusedReason(pubkey) != "" {
+			t.Fatalf("%s refused", pubkey)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package services
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dotwallet/touchstone/conf"
+)
+
+const (
+	HEALTH_CHECK_SHUTDOWN   = "shutdown"
+	HEALTH_CHECK_MONGO      = "mongo"
+	HEALTH_CHECK_MAPI       = "mapi"
+	HEALTH_CHECK_PEERS      = "peers"
+	HEALTH_CHECK_SYNC_STATE = "sync_state"
+	HEALTH_CHECK_PARTITIONS = "partitions"
+
+	// readiness probes of orchestrators time out in seconds
+	MONGO_PING_TIMEOUT = time.Second * 2
+	// mapi is called by CheckTxStateLoop every minute
+	MAX_MAPI_SUCC_AGE = time.Minute * 10
+	// SyncStateLoop runs every 5 minutes
+	MAX_SYNC_STATE_AGE = time.Minute * 30
+	// partitions up to the chain height are added by SyncState
+	MAX_PARTITIONS_BEHIND = 1
+)
+
+type HealthCheck struct {
+	Name string `json:"name"`
+	Ok   bool   `json:"ok"`
+	Msg  string `json:"msg"`
+}
+
+type Readiness struct {
+	Ready  bool           `json:"ready"`
+	Checks []*HealthCheck `json:"checks"`
+}
+
+func AgeMsg(timestamp int64, now int64) string {
+	if timestamp == 0 {
+		return "never"
+	}
+	return fmt.Sprintf("%ds ago", now-timestamp)
+}
+
+func (this *TouchstoneServer) CheckMongo() *HealthCheck {
+	check := &HealthCheck{Name: HEALTH_CHECK_MONGO}
+	err := this.TxInfoRepository.Db.Ping(MONGO_PING_TIMEOUT)
+	if err != nil {
+		check.Msg = err.Error()
+		return check
+	}
+	check.Ok = true
+	return check
+}
+
+func (this *TouchstoneServer) CheckMapi(now int64) *HealthCheck {
+	lastSuccTime := this.MapiClient.LastSuccTime()
+	return &HealthCheck{
+		Name: HEALTH_CHECK_MAPI,
+		Ok:   lastSuccTime != 0 && now-lastSuccTime <= int64(MAX_MAPI_SUCC_AGE/time.Second),
+		Msg:  "last success " + AgeMsg(lastSuccTime, now),
+	}
+}
+
+// ready with at least one connected peer,unless no peer is configured
+func (this *TouchstoneServer) CheckPeers() *HealthCheck {
+	connected := 0
+	peerConfigs := this.PeerConfigs()
+	for _, peer := range this.Peers() {
+		if peer.Connected() {
+			connected++
+		}
+	}
+	return &HealthCheck{
+		Name: HEALTH_CHECK_PEERS,
+		Ok:   connected > 0 || len(peerConfigs) == 0,
+		Msg:  fmt.Sprintf("%d of %d peers connected", connected, len(peerConfigs)),
+	}
+}
+
+func (this *TouchstoneServer) CheckSyncState(now int64) *HealthCheck {
+	lastSyncStateTime := this.GetLastSyncStateTime()
+	return &HealthCheck{
+		Name: HEALTH_CHECK_SYNC_STATE,
+		Ok:   lastSyncStateTime != 0 && now-lastSyncStateTime <= int64(MAX_SYNC_STATE_AGE/time.Second),
+		Msg:  "last success " + AgeMsg(lastSyncStateTime, now),
+	}
+}
+
+// chain height is from the last fee quote of mapi
+func (this *TouchstoneServer) CheckPartitions() *HealthCheck {
+	check := &HealthCheck{Name: HEALTH_CHECK_PARTITIONS}
+	height := this.MapiClient.LastHeight()
+	if height == 0 {
+		check.Msg = "chain height unknown"
+		return check
+	}
+	count, err := this.PartitionInfoRepository.GetPartitionsCount()
+	if err != nil {
+		check.Msg = err.Error()
+		return check
+	}
+	expectPartitionsCount := (height-*conf.GStartHeight)/conf.GTunables.PartitionBlockCount + 1
+	check.Ok = expectPartitionsCount-count <= MAX_PARTITIONS_BEHIND
+	check.Msg = fmt.Sprintf("%d of %d partitions at height %d", count, expectPartitionsCount, height)
+	return check
+}
+
+func (this *TouchstoneServer) GetReadiness() *Readiness {
+	now := time.Now().Unix()
+	shutdownCheck := &HealthCheck{
+		Name: HEALTH_CHECK_SHUTDOWN,
+		Ok:   !this.lifecycle.Stopping(),
+	}
+	if !shutdownCheck.Ok {
+		shutdownCheck.Msg = ErrShuttingDown.Error()
+	}
+	readiness := &Readiness{
+		Ready: true,
+		Checks: []*HealthCheck{
+			shutdownCheck,
+			this.CheckMongo(),
+			this.CheckMapi(now),
+			this.CheckPeers(),
+			this.CheckSyncState(now),
+			this.CheckPartitions(),
+		},
+	}
+	for _, check := range readiness.Checks {
+		if !check.Ok {
+			readiness.Ready = false
+		}
+	}
+	return readiness
+}
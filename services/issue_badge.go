@@ -0,0 +1,108 @@
+package services
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/dotwallet/touchstone/conf"
+	"github.com/dotwallet/touchstone/models"
+	"github.com/dotwallet/touchstone/util"
+)
+
+type FundingInput struct {
+	Txid  string `json:"txid"`
+	Index int    `json:"index"`
+}
+
+type IssueBadgeRsp struct {
+	UnFinishedTx string `json:"unfinished_tx"`
+	Total        int64  `json:"total"`
+}
+
+// txids should be 64 hex chars,chainhash pads shorter ones with zeros
+func CheckFundingInputs(fundingInputs []*FundingInput) error {
+	for _, fundingInput := range fundingInputs {
+		if fundingInput == nil {
+			return util.NewCodeError(util.ERR_PARAMETERS_CODE, "funding input is null")
+		}
+		_, err := hex.DecodeString(fundingInput.Txid)
+		if err != nil || len(fundingInput.Txid) != chainhash.MaxHashStringSize {
+			errStr := fmt.Sprintf("funding input txid %s is illegal", fundingInput.Txid)
+			return util.NewCodeError(util.ERR_PARAMETERS_CODE, errStr)
+		}
+		if fundingInput.Index < 0 || int64(fundingInput.Index) > math.MaxUint32 {
+			errStr := fmt.Sprintf("funding input index %d is illegal", fundingInput.Index)
+			return util.NewCodeError(util.ERR_PARAMETERS_CODE, errStr)
+		}
+	}
+	return nil
+}
+
+func (this *TouchstoneServer) IssueBadge(fundingInputs []*FundingInput, addrAmounts []*AddrAmount, metadata string) (*IssueBadgeRsp, error) {
+	if len(fundingInputs) == 0 {
+		return nil, util.NewCodeError(util.ERR_PARAMETERS_CODE, "funding_inputs is empty")
+	}
+	err := CheckFundingInputs(fundingInputs)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrAmounts) == 0 {
+		return nil, util.NewCodeError(util.ERR_PARAMETERS_CODE, "addr_amounts is empty")
+	}
+	values := make([]int64, 0, len(addrAmounts))
+	for _, addrAmount := range addrAmounts {
+		values = append(values, addrAmount.Amount)
+	}
+	total, err := util.SumBadgeValues(values)
+	if err != nil {
+		return nil, util.NewCodeError(util.ERR_PARAMETERS_CODE, err.Error())
+	}
+	msgTx := wire.NewMsgTx(TX_VERSION)
+	for _, fundingInput := range fundingInputs {
+		_, err := this.TxPointRepository.GetTxPoint(fundingInput.Txid, fundingInput.Index, models.TX_POINT_TYPE_VOUT)
+		if err == nil {
+			errStr := fmt.Sprintf("funding input %s:%d is a badge utxo", fundingInput.Txid, fundingInput.Index)
+			return nil, util.NewCodeError(util.ERR_ILLEGAL_VIN_CODE, errStr)
+		}
+		if !strings.Contains(err.Error(), models.MONGO_NOT_FOUND) {
+			return nil, err
+		}
+		hash, err := chainhash.NewHashFromStr(fundingInput.Txid)
+		if err != nil {
+			return nil, util.NewCodeError(util.ERR_PARAMETERS_CODE, err.Error())
+		}
+		outPoint := wire.NewOutPoint(hash, uint32(fundingInput.Index))
+		msgTx.AddTxIn(wire.NewTxIn(outPoint, nil, nil))
+	}
+	for _, addrAmount := range addrAmounts {
+		addr, err := btcutil.DecodeAddress(addrAmount.Addr, conf.GNetParam)
+		if err != nil {
+			return nil, util.NewCodeError(util.ERR_PARAMETERS_CODE, err.Error())
+		}
+		script, err := util.CreateBadgeLockScript(addr, addrAmount.Amount)
+		if err != nil {
+			return nil, err
+		}
+		msgTx.AddTxOut(wire.NewTxOut(conf.GTunables.BadgeDustLimit, script))
+	}
+	if metadata != "" {
+		data, err := hex.DecodeString(metadata)
+		if err != nil {
+			return nil, util.NewCodeError(util.ERR_PARAMETERS_CODE, err.Error())
+		}
+		script, err := util.CreateOpReturnScript(data)
+		if err != nil {
+			return nil, err
+		}
+		msgTx.AddTxOut(wire.NewTxOut(0, script))
+	}
+	return &IssueBadgeRsp{
+		UnFinishedTx: util.SeserializeMsgTxStr(msgTx),
+		Total:        total,
+	}, nil
+}
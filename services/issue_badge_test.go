@@ -0,0 +1,29 @@
+package services
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dotwallet/touchstone/util"
+)
+
+func TestCheckFundingInputs(t *testing.T) {
+	txid := strings.Repeat("ab", 32)
+	if err := CheckFundingInputs([]*FundingInput{{Txid: txid, Index: 0}, {Txid: txid, Index: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	cases := [][]*FundingInput{
+		{{Txid: txid, Index: -1}},
+		{{Txid: "ab", Index: 0}},
+		{{Txid: strings.Repeat("zz", 32), Index: 0}},
+		{{Txid: txid + "ab", Index: 0}},
+		{nil},
+	}
+	for i, fundingInputs := range cases {
+		err := CheckFundingInputs(fundingInputs)
+		codeErr, ok := err.(*util.CodeError)
+		if !ok || codeErr.Code != util.ERR_PARAMETERS_CODE {
+			t.Fatalf("case %d got %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	PEER_RPC_TIMEOUT    = time.Minute
+	PEER_NOTIFY_TIMEOUT = time.Second * 10
+	// default max message size grpc receives,p2p messages we build stay well under it
+	GRPC_MAX_MESSAGE_BYTES = 4 * 1024 * 1024
+	// not pausable
+	LOOP_CONNECT_PEER = "connect_peer"
+)
+
+var ErrShuttingDown = errors.New("touchstone is shutting down")
+
+// zero value is usable,ctx is cancelled when loops should stop
+type Lifecycle struct {
+	lock     sync.Mutex
+	ctx      context.Context
+	cancel   context.CancelFunc
+	stopping bool
+	loops    sync.WaitGroup
+	inflight sync.WaitGroup
+}
+
+func (this *Lifecycle) context() context.Context {
+	if this.ctx == nil {
+		this.ctx, this.cancel = context.WithCancel(context.Background())
+	}
+	return this.ctx
+}
+
+func (this *Lifecycle) Context() context.Context {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.context()
+}
+
+// run a loop or a job until ctx is cancelled
+func (this *Lifecycle) Go(name string, run func(ctx context.Context)) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.stopping {
+		return ErrShuttingDown
+	}
+	ctx := this.context()
+	this.loops.Add(1)
+	go func() {
+		defer this.loops.Done()
+		run(ctx)
+		glog.Infof("Lifecycle %s stopped", name)
+	}()
+	return nil
+}
+
+func (this *Lifecycle) Stopping() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.stopping
+}
+
+// work that should finish before shutdown,Leave must be called when Enter succeeds
+func (this *Lifecycle) Enter() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.stopping {
+		return ErrShuttingDown
+	}
+	this.inflight.Add(1)
+	return nil
+}
+
+func (this *Lifecycle) Leave() {
+	this.inflight.Done()
+}
+
+func WaitContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// drain inflight work first,then cancel loops and wait for them
+func (this *Lifecycle) Stop(ctx context.Context) error {
+	this.lock.Lock()
+	this.stopping = true
+	this.context()
+	this.lock.Unlock()
+	drainErr := WaitContext(ctx, &this.inflight)
+	if drainErr != nil {
+		glog.Infof("Lifecycle.Stop drain inflight %s", drainErr)
+	}
+	this.cancel()
+	err := WaitContext(ctx, &this.loops)
+	if err != nil {
+		glog.Infof("Lifecycle.Stop wait loops %s", err)
+		return err
+	}
+	return drainErr
+}
+
+// false when ctx is cancelled
+func SleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (this *TouchstoneServer) Context() context.Context {
+	return this.lifecycle.Context()
+}
+
+// refuse new SyncTxs and jobs,drain running SyncTxs,then stop loops and jobs
+func (this *TouchstoneServer) Shutdown(ctx context.Context) error {
+	return this.lifecycle.Stop(ctx)
+}
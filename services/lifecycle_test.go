@@ -0,0 +1,83 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLifecycleStopDrainsInflightFirst(t *testing.T) {
+	lifecycle := &Lifecycle{}
+	loopStopped := make(chan struct{})
+	err := lifecycle.Go("loop", func(ctx context.Context) {
+		<-ctx.Done()
+		close(loopStopped)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lifecycle.Enter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		stopped <- lifecycle.Stop(ctx)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if !lifecycle.Stopping() {
+		t.Fatal("lifecycle should be stopping")
+	}
+	if lifecycle.Enter() != ErrShuttingDown {
+		t.Fatal("Enter should be refused while stopping")
+	}
+	select {
+	case <-loopStopped:
+		t.Fatal("loops should run until inflight work leaves")
+	default:
+	}
+	lifecycle.Leave()
+	err = <-stopped
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-loopStopped
+	if lifecycle.Go("late", func(ctx context.Context) {}) != ErrShuttingDown {
+		t.Fatal("Go should be refused after Stop")
+	}
+}
+
+func TestLifecycleStopTimeout(t *testing.T) {
+	lifecycle := &Lifecycle{}
+	release := make(chan struct{})
+	defer close(release)
+	err := lifecycle.Go("stuck", func(ctx context.Context) {
+		<-release
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = lifecycle.Stop(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Stop should give up with ctx,got %v", err)
+	}
+}
+
+func TestSleepContext(t *testing.T) {
+	if !SleepContext(context.Background(), time.Millisecond) {
+		t.Fatal("SleepContext should be true when the time is up")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	if SleepContext(ctx, time.Minute) {
+		t.Fatal("SleepContext should be false when ctx is cancelled")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("SleepContext should return at once")
+	}
+}
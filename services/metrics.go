@@ -0,0 +1,38 @@
+package services
+
+import (
+	"strconv"
+
+	"github.com/dotwallet/touchstone/metrics"
+	"github.com/dotwallet/touchstone/models"
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var txsDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(metrics.NAMESPACE, "", "txs"),
+	"Txs by state,1 is new,2 is open,3 is closed.",
+	[]string{"state"},
+	nil,
+)
+
+// counts txs on each scrape,state is indexed
+type TxStateCollector struct {
+	TxInfoRepository *models.TxInfoRepository
+}
+
+func (this *TxStateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- txsDesc
+}
+
+func (this *TxStateCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, state := range []int{models.TX_STATE_NEW, models.TX_STATE_OPEN, models.TX_STATE_CLOSED} {
+		count, err := this.TxInfoRepository.CountMsgTxsByState(state)
+		if err != nil {
+			glog.Infof("TxStateCollector.Collect CountMsgTxsByState %d %s", state, err)
+			ch <- prometheus.NewInvalidMetric(txsDesc, err)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(txsDesc, prometheus.GaugeValue, float64(count), strconv.Itoa(state))
+	}
+}
@@ -0,0 +1,37 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/dotwallet/touchstone/models"
+	"github.com/dotwallet/touchstone/util"
+)
+
+func TestParseMsgTxByIllegalVin(t *testing.T) {
+	illegalHash := chainhash.Hash{1}
+	legalHash := chainhash.Hash{2}
+	msgTx := wire.NewMsgTx(1)
+	msgTx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&illegalHash, 0), []byte(util.BADGE_FLAG), nil))
+	msgTx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&legalHash, 1), []byte(util.BADGE_FLAG), nil))
+	getTxPoint := func(txid string, index int, processId string) (*models.TxPoint, error) {
+		if txid == illegalHash.String() {
+			return nil, util.NewCodeError(util.ERR_ILLEGAL_VIN_CODE, "illegal vin")
+		}
+		return &models.TxPoint{Addr: "addr", Txid: txid, Index: index, Type: models.TX_POINT_TYPE_VOUT, Value: 10, BadgeCode: "code"}, nil
+	}
+	server := &TouchstoneServer{}
+	// an illegal vin has no tx point,the next vins are still parsed
+	txInventory, err := server.ParseMsgTxBy(msgTx, 1, getTxPoint, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txInventory.Vins) != 1 || txInventory.Vins[0].PreTxid != legalHash.String() || txInventory.Vins[0].Index != 1 {
+		t.Fatalf("vins %+v", txInventory.Vins)
+	}
+	// a tx with an illegal vin creates no badge
+	if len(txInventory.Vouts) != 0 {
+		t.Fatalf("vouts %+v", txInventory.Vouts)
+	}
+}
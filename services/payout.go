@@ -0,0 +1,353 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/dotwallet/touchstone/conf"
+	"github.com/dotwallet/touchstone/metrics"
+	"github.com/dotwallet/touchstone/models"
+	"github.com/dotwallet/touchstone/util"
+	"github.com/golang/glog"
+)
+
+const (
+	DEFAULT_PAYOUT_OUTPUTS_PER_TX = 100
+)
+
+func (this *TouchstoneServer) MaxPayoutOutputsPerTx() int {
+	if this.PayoutConfig == nil || this.PayoutConfig.MaxOutputsPerTx <= 0 {
+		return DEFAULT_PAYOUT_OUTPUTS_PER_TX
+	}
+	return this.PayoutConfig.MaxOutputsPerTx
+}
+
+func NewPayoutBatch(appid string, idempotencyKey string, userid int64, userIndex int64, badgeCode string, changeAddr string, addrAmounts []*AddrAmount, outputsPerTx int) *models.PayoutBatch {
+	payoutBatch := &models.PayoutBatch{
+		Appid:          appid,
+		IdempotencyKey: idempotencyKey,
+		UserID:         userid,
+		UserIndex:      userIndex,
+		BadgeCode:      badgeCode,
+		ChangeAddr:     changeAddr,
+		State:          models.PAYOUT_BATCH_STATE_PROCESSING,
+		Txs:            make([]*models.PayoutTx, 0, len(addrAmounts)/outputsPerTx+1),
+		Recipients:     make([]*models.PayoutRecipient, 0, len(addrAmounts)),
+		Timestamp:      time.Now().Unix(),
+	}
+	for index, addrAmount := range addrAmounts {
+		txIndex := index / outputsPerTx
+		if txIndex == len(payoutBatch.Txs) {
+			payoutBatch.Txs = append(payoutBatch.Txs, &models.PayoutTx{
+				Index: txIndex,
+				State: models.PAYOUT_TX_STATE_WAIT,
+			})
+		}
+		payoutBatch.Recipients = append(payoutBatch.Recipients, &models.PayoutRecipient{
+			Addr:    addrAmount.Addr,
+			Amount:  addrAmount.Amount,
+			TxIndex: txIndex,
+			Vout:    index % outputsPerTx,
+			State:   models.PAYOUT_TX_STATE_WAIT,
+		})
+	}
+	return payoutBatch
+}
+
+// outputs_per_tx is not compared,it may be limited by the config of the time
+func SamePayoutParams(payoutBatch *models.PayoutBatch, userid int64, userIndex int64, badgeCode string, changeAddr string, addrAmounts []*AddrAmount) bool {
+	if payoutBatch.UserID != userid || payoutBatch.UserIndex != userIndex || payoutBatch.BadgeCode != badgeCode || payoutBatch.ChangeAddr != changeAddr {
+		return false
+	}
+	if len(payoutBatch.Recipients) != len(addrAmounts) {
+		return false
+	}
+	for i, recipient := range payoutBatch.Recipients {
+		if recipient.Addr != addrAmounts[i].Addr || recipient.Amount != addrAmounts[i].Amount {
+			return false
+		}
+	}
+	return true
+}
+
+func CheckPayoutIdempotency(payoutBatch *models.PayoutBatch, userid int64, userIndex int64, badgeCode string, changeAddr string, addrAmounts []*AddrAmount) (*models.PayoutBatch, error) {
+	if !SamePayoutParams(payoutBatch, userid, userIndex, badgeCode, changeAddr, addrAmounts) {
+		return nil, util.NewCodeError(util.ERR_PARAMETERS_CODE, "idempotency_key used by a batch of other parameters")
+	}
+	return payoutBatch, nil
+}
+
+func (this *TouchstoneServer) CreatePayoutBatch(appid string, idempotencyKey string, userid int64, userIndex int64, badgeCode string, changeAddr string, addrAmounts []*AddrAmount, outputsPerTx int, processId string) (*models.PayoutBatch, error) {
+	payoutBatch, err := this.PayoutBatchRepository.GetPayoutBatch(appid, idempotencyKey)
+	if err == nil {
+		return CheckPayoutIdempotency(payoutBatch, userid, userIndex, badgeCode, changeAddr, addrAmounts)
+	}
+	if !strings.Contains(err.Error(), models.MONGO_NOT_FOUND) {
+		return nil, err
+	}
+	if outputsPerTx <= 0 || outputsPerTx > this.MaxPayoutOutputsPerTx() {
+		outputsPerTx = this.MaxPayoutOutputsPerTx()
+	}
+	if len(addrAmounts) == 0 {
+		return nil, util.NewCodeError(util.ERR_PARAMETERS_CODE, "addr_amounts is empty")
+	}
+	for _, addrAmount := range addrAmounts {
+		if addrAmount.Amount <= 0 {
+			errStr := fmt.Sprintf("amount of %s <= 0", addrAmount.Addr)
+			return nil, util.NewCodeError(util.ERR_PARAMETERS_CODE, errStr)
+		}
+		_, err := btcutil.DecodeAddress(addrAmount.Addr, conf.GNetParam)
+		if err != nil {
+			return nil, util.NewCodeError(util.ERR_PARAMETERS_CODE, err.Error())
+		}
+	}
+	err = this.CheckUserAddr(appid, userid, userIndex, changeAddr)
+	if err != nil {
+		return nil, err
+	}
+	payoutBatch = NewPayoutBatch(appid, idempotencyKey, userid, userIndex, badgeCode, changeAddr, addrAmounts, outputsPerTx)
+	err = this.PayoutBatchRepository.AddPayoutBatch(payoutBatch)
+	if err != nil {
+		if !strings.Contains(err.Error(), models.MONGO_ERROR_DUPLICATE) {
+			return nil, err
+		}
+		payoutBatch, err = this.PayoutBatchRepository.GetPayoutBatch(appid, idempotencyKey)
+		if err != nil {
+			return nil, err
+		}
+		return CheckPayoutIdempotency(payoutBatch, userid, userIndex, badgeCode, changeAddr, addrAmounts)
+	}
+	glog.Infof("CreatePayoutBatch %s %s recipients:%d txs:%d %s", appid, idempotencyKey, len(payoutBatch.Recipients), len(payoutBatch.Txs), processId)
+	err = this.RefreshPayoutBatch(payoutBatch, processId)
+	if err != nil {
+		return nil, err
+	}
+	return payoutBatch, nil
+}
+
+func (this *TouchstoneServer) GetPayoutBatch(appid string, idempotencyKey string, processId string) (*models.PayoutBatch, error) {
+	payoutBatch, err := this.PayoutBatchRepository.GetPayoutBatch(appid, idempotencyKey)
+	if err != nil {
+		if !strings.Contains(err.Error(), models.MONGO_NOT_FOUND) {
+			return nil, err
+		}
+		return nil, util.NewCodeError(util.ERR_PARAMETERS_CODE, "payout batch not found")
+	}
+	if payoutBatch.State == models.PAYOUT_BATCH_STATE_DONE {
+		return payoutBatch, nil
+	}
+	err = this.RefreshPayoutBatch(payoutBatch, processId)
+	if err != nil {
+		return nil, err
+	}
+	return payoutBatch, nil
+}
+
+func PayoutTxRecipients(payoutBatch *models.PayoutBatch, txIndex int) []*models.PayoutRecipient {
+	result := make([]*models.PayoutRecipient, 0, 8)
+	for _, recipient := range payoutBatch.Recipients {
+		if recipient.TxIndex == txIndex {
+			result = append(result, recipient)
+		}
+	}
+	return result
+}
+
+// a built tx is sent once any of its vins is spent, and every spender must pay the recipients
+func (this *TouchstoneServer) GetPayoutTxSpender(payoutBatch *models.PayoutBatch, payoutTx *models.PayoutTx) (string, bool, error) {
+	spenderTxid := ""
+	for _, vin := range payoutTx.Vins {
+		vinTxPoint, err := this.TxPointRepository.GetVinTxPointByPreOutPoint(vin.Txid, vin.Index)
+		if err != nil {
+			if !strings.Contains(err.Error(), models.MONGO_NOT_FOUND) {
+				return "", false, err
+			}
+			continue
+		}
+		if vinTxPoint.Txid == spenderTxid {
+			continue
+		}
+		txPoints, err := this.TxPointRepository.GetTxPoints(vinTxPoint.Txid)
+		if err != nil {
+			return "", false, err
+		}
+		if !PayoutTxPaid(payoutBatch, payoutTx, TxPoints2TxInventory(txPoints).Vouts) {
+			return vinTxPoint.Txid, false, nil
+		}
+		spenderTxid = vinTxPoint.Txid
+	}
+	return spenderTxid, spenderTxid != "", nil
+}
+
+func PayoutTxPaid(payoutBatch *models.PayoutBatch, payoutTx *models.PayoutTx, vouts []*models.TxPoint) bool {
+	for _, recipient := range PayoutTxRecipients(payoutBatch, payoutTx.Index) {
+		matched := false
+		for _, vout := range vouts {
+			if vout.Index == recipient.Vout && vout.Addr == recipient.Addr && vout.Value == recipient.Amount {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func (this *TouchstoneServer) BuildPayoutTx(payoutBatch *models.PayoutBatch, payoutTx *models.PayoutTx, reserved map[string]bool) (bool, error) {
+	utxos, err := this.GetAllUserUtxos(payoutBatch.Appid, payoutBatch.UserID, payoutBatch.UserIndex, payoutBatch.BadgeCode)
+	if err != nil {
+		return false, err
+	}
+	freeUtxos := make([]*models.TxPoint, 0, len(utxos))
+	for _, utxo := range utxos {
+		_, ok := reserved[util.GenerateStrFromStrInt(utxo.Txid, utxo.Index)]
+		if ok {
+			continue
+		}
+		freeUtxos = append(freeUtxos, utxo)
+	}
+	changeAddr, err := btcutil.DecodeAddress(payoutBatch.ChangeAddr, conf.GNetParam)
+	if err != nil {
+		return false, err
+	}
+	recipients := PayoutTxRecipients(payoutBatch, payoutTx.Index)
+	addrAmounts := make([]*AddrAmount, 0, len(recipients))
+	for _, recipient := range recipients {
+		addrAmounts = append(addrAmounts, &AddrAmount{
+			Addr:   recipient.Addr,
+			Amount: recipient.Amount,
+		})
+	}
+	sendBadgeToAddressRsp, err := BuildSendBadgeTx(freeUtxos, changeAddr, addrAmounts, 0)
+	if err != nil {
+		codeErr, ok := err.(*util.CodeError)
+		if ok && codeErr.Code == util.ERR_NOT_ENOUGH_BADGE_CODE {
+			return false, nil
+		}
+		return false, err
+	}
+	payoutTx.State = models.PAYOUT_TX_STATE_BUILT
+	payoutTx.UnFinishedTx = sendBadgeToAddressRsp.UnFinishedTx
+	payoutTx.Vins = sendBadgeToAddressRsp.Vins
+	for _, vin := range payoutTx.Vins {
+		reserved[util.GenerateStrFromStrInt(vin.Txid, vin.Index)] = true
+	}
+	return true, nil
+}
+
+func (this *TouchstoneServer) RefreshPayoutBatch(payoutBatch *models.PayoutBatch, processId string) error {
+	this.payoutLock.Lock()
+	defer this.payoutLock.Unlock()
+	reserved := make(map[string]bool)
+	for _, payoutTx := range payoutBatch.Txs {
+		switch payoutTx.State {
+		case models.PAYOUT_TX_STATE_BUILT:
+			txid, ok, err := this.GetPayoutTxSpender(payoutBatch, payoutTx)
+			if err != nil {
+				glog.Infof("TouchstoneServer.RefreshPayoutBatch GetPayoutTxSpender %s %s", err, processId)
+				return err
+			}
+			if txid == "" {
+				for _, vin := range payoutTx.Vins {
+					reserved[util.GenerateStrFromStrInt(vin.Txid, vin.Index)] = true
+				}
+				continue
+			}
+			if !ok {
+				glog.Infof("RefreshPayoutBatch vin spent by other tx %s %s %d %s", txid, payoutBatch.IdempotencyKey, payoutTx.Index, processId)
+				payoutTx.State = models.PAYOUT_TX_STATE_WAIT
+				payoutTx.UnFinishedTx = ""
+				payoutTx.Vins = nil
+				continue
+			}
+			payoutTx.State = models.PAYOUT_TX_STATE_SENT
+			payoutTx.Txid = txid
+		case models.PAYOUT_TX_STATE_SENT, models.PAYOUT_TX_STATE_CONFIRMED:
+			msgTxBriefInfo, err := this.TxInfoRepository.GetMsgTxBriefInfo(payoutTx.Txid)
+			if err != nil {
+				if !strings.Contains(err.Error(), models.MONGO_NOT_FOUND) {
+					glog.Infof("TouchstoneServer.RefreshPayoutBatch GetMsgTxBriefInfo %s %s", err, processId)
+					return err
+				}
+				payoutTx.State = models.PAYOUT_TX_STATE_BUILT
+				payoutTx.Txid = ""
+				for _, vin := range payoutTx.Vins {
+					reserved[util.GenerateStrFromStrInt(vin.Txid, vin.Index)] = true
+				}
+				continue
+			}
+			payoutTx.State = models.PAYOUT_TX_STATE_SENT
+			if msgTxBriefInfo.Height > 0 {
+				payoutTx.State = models.PAYOUT_TX_STATE_CONFIRMED
+			}
+		}
+	}
+	for _, payoutTx := range payoutBatch.Txs {
+		if payoutTx.State != models.PAYOUT_TX_STATE_WAIT {
+			continue
+		}
+		built, err := this.BuildPayoutTx(payoutBatch, payoutTx, reserved)
+		if err != nil {
+			glog.Infof("TouchstoneServer.RefreshPayoutBatch BuildPayoutTx %s %s", err, processId)
+			return err
+		}
+		if !built {
+			// wait for change of sent txs
+			break
+		}
+	}
+	payoutBatch.State = models.PAYOUT_BATCH_STATE_DONE
+	for _, payoutTx := range payoutBatch.Txs {
+		if payoutTx.State != models.PAYOUT_TX_STATE_CONFIRMED {
+			payoutBatch.State = models.PAYOUT_BATCH_STATE_PROCESSING
+		}
+	}
+	for _, recipient := range payoutBatch.Recipients {
+		recipient.State = payoutBatch.Txs[recipient.TxIndex].State
+	}
+	return this.PayoutBatchRepository.UpdatePayoutBatchProgress(payoutBatch)
+}
+
+func (this *TouchstoneServer) RefreshPayoutBatchs(processId string) error {
+	payoutBatchs, err := this.PayoutBatchRepository.GetPayoutBatchsByState(models.PAYOUT_BATCH_STATE_PROCESSING)
+	if err != nil {
+		glog.Infof("TouchstoneServer.RefreshPayoutBatchs GetPayoutBatchsByState %s %s", err, processId)
+		return err
+	}
+	for _, payoutBatch := range payoutBatchs {
+		err := this.RefreshPayoutBatch(payoutBatch, processId)
+		if err != nil {
+			glog.Infof("TouchstoneServer.RefreshPayoutBatchs RefreshPayoutBatch %s %s %s", payoutBatch.IdempotencyKey, err, processId)
+			continue
+		}
+	}
+	return nil
+}
+
+func (this *TouchstoneServer) PayoutLoop(ctx context.Context) {
+	for {
+		if this.LoopPaused(LOOP_PAYOUT) {
+			if !SleepContext(ctx, conf.Seconds(conf.GTunables.LoopPausedIntervalSeconds)) {
+				return
+			}
+			continue
+		}
+		processId := util.RandStringBytes(8)
+		start := time.Now()
+		glog.Infof("TouchstoneServer PayoutLoop start %s", processId)
+		err := this.RefreshPayoutBatchs(processId)
+		if err != nil {
+			glog.Infof("TouchstoneServer.PayoutLoop RefreshPayoutBatchs %s %s", err, processId)
+		}
+		glog.Infof("TouchstoneServer PayoutLoop done %s", processId)
+		metrics.ObserveLoop(LOOP_PAYOUT, start)
+		if !SleepContext(ctx, conf.Seconds(conf.GTunables.PayoutIntervalSeconds)) {
+			return
+		}
+	}
+}
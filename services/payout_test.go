@@ -0,0 +1,22 @@
+package services
+
+import (
+	"testing"
+)
+
+func TestSamePayoutParams(t *testing.T) {
+	addrAmounts := []*AddrAmount{{Addr: "a", Amount: 1}, {Addr: "b", Amount: 2}}
+	payoutBatch := NewPayoutBatch("app", "key", 1, 0, "code", "change", addrAmounts, 1)
+	if !SamePayoutParams(payoutBatch, 1, 0, "code", "change", addrAmounts) {
+		t.Fatal("same params not matched")
+	}
+	if SamePayoutParams(payoutBatch, 1, 0, "code", "change", []*AddrAmount{{Addr: "a", Amount: 1}, {Addr: "b", Amount: 3}}) {
+		t.Fatal("other amount matched")
+	}
+	if SamePayoutParams(payoutBatch, 1, 0, "code", "change", addrAmounts[:1]) {
+		t.Fatal("other recipients matched")
+	}
+	if SamePayoutParams(payoutBatch, 1, 0, "code", "other", addrAmounts) {
+		t.Fatal("other change addr matched")
+	}
+}
@@ -0,0 +1,303 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dotwallet/touchstone/metrics"
+	"github.com/dotwallet/touchstone/util"
+	"github.com/golang/glog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	PEER_CHECK_INTERVAL      = time.Second * 10
+	PEER_REDIAL_MIN_BACKOFF  = time.Second * 30
+	PEER_REDIAL_MAX_BACKOFF  = time.Minute * 10
+	PEER_BAN_MIN_DURATION    = time.Minute * 10
+	PEER_BAN_MAX_DURATION    = time.Hour * 24
+	PEER_RPC_EWMA_ALPHA      = 0.1
+	PEER_SYNC_EWMA_ALPHA     = 0.3
+	PEER_MAX_LATENCY_PENALTY = 20
+	// a peer is banned when this part of the txs it served can not be verified
+	PEER_BAN_INVALID_RATE = 0.5
+	PEER_BAN_MIN_TXS      = 10
+)
+
+// rates are moving averages,so a peer recovers once it behaves again
+type PeerHealth struct {
+	Pubkey              string  `json:"pubkey"`
+	Score               float64 `json:"score"`
+	Rpcs                int64   `json:"rpcs"`
+	RpcErrors           int64   `json:"rpc_errors"`
+	ErrorRate           float64 `json:"error_rate"`
+	LatencyMs           float64 `json:"latency_ms"`
+	PartitionMismatches int64   `json:"partition_mismatches"`
+	// mismatches still there after the txs of the peer are synced
+	UnresolvedMismatches int64   `json:"unresolved_mismatches"`
+	MismatchRate         float64 `json:"mismatch_rate"`
+	VerifiedTxs          int64   `json:"verified_txs"`
+	InvalidTxs           int64   `json:"invalid_txs"`
+	InvalidRate          float64 `json:"invalid_rate"`
+	Bans                 int     `json:"bans"`
+	BannedUntil          int64   `json:"banned_until"`
+	Redials              int     `json:"redials"`
+	NextRedialTime       int64   `json:"next_redial_time"`
+}
+
+// each 100ms of latency costs a point
+func (this *PeerHealth) computeScore() {
+	latencyPenalty := math.Min(this.LatencyMs/100, PEER_MAX_LATENCY_PENALTY)
+	this.Score = math.Max(100*(1-this.ErrorRate)*(1-this.InvalidRate)*(1-this.MismatchRate)-latencyPenalty, 0)
+	metrics.PeerScore.WithLabelValues(this.Pubkey).Set(this.Score)
+}
+
+func (this *PeerHealth) Banned(now int64) bool {
+	return this.BannedUntil > now
+}
+
+func (this *PeerHealth) ban(now time.Time) {
+	duration := Backoff(PEER_BAN_MIN_DURATION, PEER_BAN_MAX_DURATION, this.Bans)
+	this.Bans++
+	this.BannedUntil = now.Add(duration).Unix()
+}
+
+func Backoff(min time.Duration, max time.Duration, attempts int) time.Duration {
+	d := min
+	for i := 0; i < attempts && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		return max
+	}
+	return d
+}
+
+// zero value is usable
+type PeerHealthBook struct {
+	lock    sync.Mutex
+	healths map[string]*PeerHealth
+}
+
+func (this *PeerHealthBook) get(pubkey string) *PeerHealth {
+	if this.healths == nil {
+		this.healths = make(map[string]*PeerHealth)
+	}
+	health, ok := this.healths[pubkey]
+	if !ok {
+		health = &PeerHealth{
+			Pubkey: pubkey,
+			Score:  100,
+		}
+		this.healths[pubkey] = health
+	}
+	return health
+}
+
+func (this *PeerHealthBook) Snapshot(pubkey string) *PeerHealth {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	health := *this.get(pubkey)
+	return &health
+}
+
+func (this *PeerHealthBook) ObserveRpc(pubkey string, err error, latency time.Duration) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	health := this.get(pubkey)
+	health.Rpcs++
+	failed := 0.0
+	if err != nil {
+		health.RpcErrors++
+		failed = 1
+	}
+	health.ErrorRate += PEER_RPC_EWMA_ALPHA * (failed - health.ErrorRate)
+	latencyMs := float64(latency) / float64(time.Millisecond)
+	if health.Rpcs == 1 {
+		health.LatencyMs = latencyMs
+	} else {
+		health.LatencyMs += PEER_RPC_EWMA_ALPHA * (latencyMs - health.LatencyMs)
+	}
+	health.computeScore()
+}
+
+// a mismatch resolved by syncing the txs of the peer was ours,an unresolved one is the peer's
+func (this *PeerHealthBook) ObservePartitionMismatches(pubkey string, mismatches int, unresolved int) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	health := this.get(pubkey)
+	health.PartitionMismatches += int64(mismatches)
+	health.UnresolvedMismatches += int64(unresolved)
+	rate := 0.0
+	if mismatches > 0 {
+		rate = float64(unresolved) / float64(mismatches)
+	}
+	health.MismatchRate += PEER_SYNC_EWMA_ALPHA * (rate - health.MismatchRate)
+	health.computeScore()
+}
+
+// true when the peer is banned by this sync
+func (this *PeerHealthBook) ObserveSyncTxs(pubkey string, verified int, invalid int) bool {
+	if verified+invalid == 0 {
+		return false
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	health := this.get(pubkey)
+	health.VerifiedTxs += int64(verified)
+	health.InvalidTxs += int64(invalid)
+	rate := float64(invalid) / float64(verified+invalid)
+	health.InvalidRate += PEER_SYNC_EWMA_ALPHA * (rate - health.InvalidRate)
+	health.computeScore()
+	now := time.Now()
+	if health.Banned(now.Unix()) || health.InvalidRate < PEER_BAN_INVALID_RATE || health.VerifiedTxs+health.InvalidTxs < PEER_BAN_MIN_TXS {
+		return false
+	}
+	health.ban(now)
+	return true
+}
+
+// for a peer serving data that contradicts what it signed,a banned peer stays banned until its ban ends
+func (this *PeerHealthBook) Ban(pubkey string, now time.Time) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	health := this.get(pubkey)
+	if health.Banned(now.Unix()) {
+		return
+	}
+	health.ban(now)
+}
+
+// rates are reset,a peer banned again is banned longer
+func (this *PeerHealthBook) Unban(pubkey string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	health := this.get(pubkey)
+	health.BannedUntil = 0
+	health.ErrorRate = 0
+	health.InvalidRate = 0
+	health.MismatchRate = 0
+	health.computeScore()
+}
+
+func (this *PeerHealthBook) Banned(pubkey string, now int64) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	health := this.get(pubkey)
+	if health.BannedUntil != 0 && !health.Banned(now) {
+		glog.Infof("PeerHealthBook ban expired %s", pubkey)
+		health.BannedUntil = 0
+		health.ErrorRate = 0
+		health.InvalidRate = 0
+		health.MismatchRate = 0
+		health.computeScore()
+	}
+	return health.Banned(now)
+}
+
+// the first check only schedules a redial,grpc reconnects by itself in between
+func (this *PeerHealthBook) ShouldRedial(pubkey string, connected bool, now time.Time) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	health := this.get(pubkey)
+	if connected {
+		health.Redials = 0
+		health.NextRedialTime = 0
+		return false
+	}
+	if health.NextRedialTime == 0 {
+		health.NextRedialTime = now.Add(Backoff(PEER_REDIAL_MIN_BACKOFF, PEER_REDIAL_MAX_BACKOFF, health.Redials)).Unix()
+		return false
+	}
+	if now.Unix() < health.NextRedialTime {
+		return false
+	}
+	health.Redials++
+	health.NextRedialTime = now.Add(Backoff(PEER_REDIAL_MIN_BACKOFF, PEER_REDIAL_MAX_BACKOFF, health.Redials)).Unix()
+	return true
+}
+
+// for rpcs sent to a peer,cancelled rpcs are ours and rpcs unknown to older peers are not counted
+func (this *TouchstoneServer) PeerHealthInterceptor(pubkey string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		start := time.Now()
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		code := status.Code(err)
+		if code != codes.Canceled && code != codes.Unimplemented {
+			this.peerHealth.ObserveRpc(pubkey, err, time.Since(start))
+		}
+		return err
+	}
+}
+
+// txs rejected for missing utxos may be closed later and are not counted
+func (this *TouchstoneServer) ObservePeerSyncTxs(pubkey string, syncTxsResult *SyncTxsResult) {
+	openCount := CountOpenErrTxs(syncTxsResult)
+	verified := len(syncTxsResult.TxInventorys) + len(syncTxsResult.AlreadyClosedTxs)
+	banned := this.peerHealth.ObserveSyncTxs(pubkey, verified, len(syncTxsResult.ErrTxs)-openCount)
+	if banned {
+		glog.Infof("TouchstoneServer.ObservePeerSyncTxs ban %s", pubkey)
+	}
+}
+
+// by score,banned and refused peers are left out
+func (this *TouchstoneServer) RankPeers(peers map[string]*Node) []string {
+	now := time.Now().Unix()
+	pubkeys := make([]string, 0, len(peers))
+	scores := make(map[string]float64)
+	for pubkey, peer := range peers {
+		if this.peerHealth.Banned(pubkey, now) || peer.Protocol().Refused() {
+			continue
+		}
+		pubkeys = append(pubkeys, pubkey)
+		scores[pubkey] = this.peerHealth.Snapshot(pubkey).Score
+	}
+	sort.SliceStable(pubkeys, func(i, j int) bool {
+		if scores[pubkeys[i]] != scores[pubkeys[j]] {
+			return scores[pubkeys[i]] > scores[pubkeys[j]]
+		}
+		return pubkeys[i] < pubkeys[j]
+	})
+	return pubkeys
+}
+
+func (this *TouchstoneServer) UnbanPeer(pubkey string) ([]*PeerStatus, error) {
+	_, ok := this.Peers()[pubkey]
+	if !ok {
+		return nil, util.NewCodeError(util.ERR_PARAMETERS_CODE, "peer not found")
+	}
+	this.peerHealth.Unban(pubkey)
+	glog.Infof("TouchstoneServer.UnbanPeer %s", pubkey)
+	return this.GetPeers(), nil
+}
+
+// the old connection is closed after the new one is in place
+func (this *TouchstoneServer) RedialPeer(pubkey string) error {
+	this.connectLock.Lock()
+	defer this.connectLock.Unlock()
+	oldPeers := this.Peers()
+	oldPeer, ok := oldPeers[pubkey]
+	if !ok {
+		return errors.New("peer not found")
+	}
+	peer, err := this.DialPeer(pubkey, oldPeer.host)
+	if err != nil {
+		return err
+	}
+	peers := make(map[string]*Node)
+	for key, node := range oldPeers {
+		peers[key] = node
+	}
+	peers[pubkey] = peer
+	this.peersLock.Lock()
+	this.peers = peers
+	this.peersLock.Unlock()
+	oldPeer.conn.Close()
+	return nil
+}
@@ -0,0 +1,166 @@
+package services
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dotwallet/touchstone/models"
+)
+
+func TestBackoff(t *testing.T) {
+	min := time.Second * 30
+	max := time.Minute * 10
+	cases := []struct {
+		attempts int
+		expect   time.Duration
+	}{
+		{0, min},
+		{1, time.Minute},
+		{3, time.Minute * 4},
+		{5, max},
+		{100, max},
+	}
+	for _, c := range cases {
+		d := Backoff(min, max, c.attempts)
+		if d != c.expect {
+			t.Fatalf("attempts %d got %s expect %s", c.attempts, d, c.expect)
+		}
+	}
+}
+
+func TestObserveSyncTxsBan(t *testing.T) {
+	book := &PeerHealthBook{}
+	if book.ObserveSyncTxs("02aa", 0, 0) {
+		t.Fatal("banned without txs")
+	}
+	// every tx is invalid but too few txs were served
+	if book.ObserveSyncTxs("02aa", 0, PEER_BAN_MIN_TXS-1) {
+		t.Fatal("banned under min txs")
+	}
+	// rate is still under the threshold
+	book = &PeerHealthBook{}
+	if book.ObserveSyncTxs("02aa", 90, 10) {
+		t.Fatal("banned under invalid rate")
+	}
+	if book.Banned("02aa", time.Now().Unix()) {
+		t.Fatal("banned")
+	}
+	banned := false
+	for i := 0; i < 10 && !banned; i++ {
+		banned = book.ObserveSyncTxs("02aa", 0, 10)
+	}
+	if !banned {
+		t.Fatalf("not banned %+v", book.Snapshot("02aa"))
+	}
+	health := book.Snapshot("02aa")
+	if health.Bans != 1 || !book.Banned("02aa", time.Now().Unix()) {
+		t.Fatalf("health %+v", health)
+	}
+	if book.ObserveSyncTxs("02aa", 0, 10) {
+		t.Fatal("banned twice")
+	}
+	// an expired ban resets rates
+	if book.Banned("02aa", health.BannedUntil) || book.Snapshot("02aa").InvalidRate != 0 {
+		t.Fatalf("ban not expired %+v", book.Snapshot("02aa"))
+	}
+}
+
+func TestShouldRedial(t *testing.T) {
+	book := &PeerHealthBook{}
+	now := time.Now()
+	if book.ShouldRedial("02aa", false, now) {
+		t.Fatal("redial on first check")
+	}
+	if book.ShouldRedial("02aa", false, now.Add(PEER_REDIAL_MIN_BACKOFF-time.Second)) {
+		t.Fatal("redial before backoff")
+	}
+	if !book.ShouldRedial("02aa", false, now.Add(PEER_REDIAL_MIN_BACKOFF)) {
+		t.Fatal("no redial after backoff")
+	}
+	health := book.Snapshot("02aa")
+	if health.Redials != 1 || health.NextRedialTime != now.Add(PEER_REDIAL_MIN_BACKOFF*3).Unix() {
+		t.Fatalf("health %+v", health)
+	}
+	if book.ShouldRedial("02aa", true, now) {
+		t.Fatal("redial when connected")
+	}
+	health = book.Snapshot("02aa")
+	if health.Redials != 0 || health.NextRedialTime != 0 {
+		t.Fatalf("not reset %+v", health)
+	}
+}
+
+func TestObservePartitionMismatches(t *testing.T) {
+	book := &PeerHealthBook{}
+	// mismatches resolved by syncing were ours
+	book.ObservePartitionMismatches("02aa", 5, 0)
+	health := book.Snapshot("02aa")
+	if health.Score != 100 || health.PartitionMismatches != 5 {
+		t.Fatalf("health %+v", health)
+	}
+	book.ObservePartitionMismatches("02aa", 4, 4)
+	health = book.Snapshot("02aa")
+	if health.UnresolvedMismatches != 4 || health.MismatchRate != PEER_SYNC_EWMA_ALPHA || health.Score >= 100 {
+		t.Fatalf("health %+v", health)
+	}
+	book.Unban("02aa")
+	if health = book.Snapshot("02aa"); health.MismatchRate != 0 || health.Score != 100 {
+		t.Fatalf("not reset %+v", health)
+	}
+}
+
+func TestMismatchedPartitions(t *testing.T) {
+	partitionInfos := []*models.PartitionInfo{
+		{Id: 1, Hash: "aa"},
+		{Id: 2, Hash: "bb"},
+		{Id: 3, Hash: "cc"},
+	}
+	ids := MismatchedPartitions(partitionInfos, [][]byte{{0xaa}, {0xcc}})
+	if !reflect.DeepEqual(ids, []int64{2}) {
+		t.Fatalf("ids %v", ids)
+	}
+	if unresolved := CountUnresolvedPartitions([]int64{2, 3, 5}, []int64{3, 4}); unresolved != 1 {
+		t.Fatalf("unresolved %d", unresolved)
+	}
+}
+
+func TestRankPeers(t *testing.T) {
+	server := &TouchstoneServer{}
+	peers := map[string]*Node{
+		"02aa": {},
+		"02bb": {},
+		"02cc": {},
+		"02dd": {protocol: &PeerProtocol{Status: PEER_PROTOCOL_REFUSED}},
+		"02ee": {},
+	}
+	server.peerHealth.ObserveRpc("02aa", errors.New("down"), 0)
+	for i := 0; i < PEER_BAN_MIN_TXS; i++ {
+		server.peerHealth.ObserveSyncTxs("02ee", 0, 10)
+	}
+	pubkeys := server.RankPeers(peers)
+	if !reflect.DeepEqual(pubkeys, []string{"02bb", "02cc", "02aa"}) {
+		t.Fatalf("pubkeys %v", pubkeys)
+	}
+}
+
+func TestBan(t *testing.T) {
+	book := &PeerHealthBook{}
+	now := time.Now()
+	book.Ban("02aa", now)
+	health := book.Snapshot("02aa")
+	if health.Bans != 1 || health.BannedUntil != now.Add(PEER_BAN_MIN_DURATION).Unix() {
+		t.Fatalf("health %+v", health)
+	}
+	// a banned peer is not banned longer
+	book.Ban("02aa", now)
+	if health = book.Snapshot("02aa"); health.Bans != 1 {
+		t.Fatalf("banned twice %+v", health)
+	}
+	expired := time.Unix(health.BannedUntil, 0)
+	book.Ban("02aa", expired)
+	if health = book.Snapshot("02aa"); health.Bans != 2 || health.BannedUntil != expired.Add(PEER_BAN_MIN_DURATION*2).Unix() {
+		t.Fatalf("second ban %+v", health)
+	}
+}
@@ -0,0 +1,593 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/dotwallet/touchstone/conf"
+	"github.com/dotwallet/touchstone/mapi"
+	"github.com/dotwallet/touchstone/message"
+	"github.com/dotwallet/touchstone/models"
+	"github.com/dotwallet/touchstone/util"
+	"github.com/golang/glog"
+)
+
+const (
+	MAX_SNAPSHOT_CHUNK_BYTES   = GRPC_MAX_MESSAGE_BYTES / 2
+	MAX_SNAPSHOT_PARTITION_TXS = 100000
+	SNAPSHOT_TX_POINT_BYTES    = 160
+	// one of this many txs is checked by mapi,at least one of each partition
+	SNAPSHOT_SAMPLE_RATE = 100
+)
+
+// a vin spending a tx of the snapshot not verified yet
+var errSnapshotTxPending = errors.New("spent tx of snapshot not verified yet")
+
+type BootstrapParams struct {
+	Peer   string `json:"peer,omitempty"`
+	Height int64  `json:"height,omitempty"`
+}
+
+// a tx of a snapshot with its points
+type SnapshotTxEntry struct {
+	Txid     string
+	MsgTx    *wire.MsgTx
+	Tx       *message.SnapshotTx
+	TxPoints []*models.TxPoint
+}
+
+func TxPoint2Snapshot(txPoint *models.TxPoint) *message.SnapshotTxPoint {
+	return &message.SnapshotTxPoint{
+		Addr:      txPoint.Addr,
+		Index:     int64(txPoint.Index),
+		Type:      int64(txPoint.Type),
+		Value:     txPoint.Value,
+		Pretxid:   txPoint.PreTxid,
+		Preindex:  int64(txPoint.PreIndex),
+		BadgeCode: txPoint.BadgeCode,
+		State:     int64(txPoint.State),
+	}
+}
+
+func Snapshot2TxPoint(txid string, timestamp int64, point *message.SnapshotTxPoint) *models.TxPoint {
+	return &models.TxPoint{
+		Addr:      point.Addr,
+		Txid:      txid,
+		Index:     int(point.Index),
+		Type:      int(point.Type),
+		Value:     point.Value,
+		PreTxid:   point.Pretxid,
+		PreIndex:  int(point.Preindex),
+		BadgeCode: point.BadgeCode,
+		Timestamp: timestamp,
+		State:     int(point.State),
+	}
+}
+
+// sha256 of txids ordered by txid,ComputePartitionHash uses it too
+func PartitionHash(txids []string) ([]byte, error) {
+	sorted := append([]string{}, txids...)
+	sort.Strings(sorted)
+	hashComputer := sha256.New()
+	for _, txid := range sorted {
+		txidBytes, err := hex.DecodeString(txid)
+		if err != nil {
+			return nil, err
+		}
+		hashComputer.Write(txidBytes)
+	}
+	return hashComputer.Sum(nil), nil
+}
+
+func SnapshotManifestDigest(manifest *message.SnapshotManifest) []byte {
+	params := manifest.Params
+	if params == nil {
+		params = &message.HelloRequest{}
+	}
+	byteBuf := bytes.NewBuffer(make([]byte, 0, 128+len(manifest.PartitionHashes)*36))
+	binary.Write(byteBuf, binary.LittleEndian, params.ProtocolVersion)
+	writeVarBytes(byteBuf, []byte(params.Network))
+	binary.Write(byteBuf, binary.LittleEndian, params.StartHeight)
+	binary.Write(byteBuf, binary.LittleEndian, params.PartitionBlockCount)
+	writeVarBytes(byteBuf, []byte(params.PartitionHashAlgorithm))
+	binary.Write(byteBuf, binary.LittleEndian, uint32(len(params.Capabilities)))
+	for _, capability := range params.Capabilities {
+		writeVarBytes(byteBuf, []byte(capability))
+	}
+	binary.Write(byteBuf, binary.LittleEndian, uint32(len(manifest.PartitionHashes)))
+	for _, hash := range manifest.PartitionHashes {
+		writeVarBytes(byteBuf, hash)
+	}
+	binary.Write(byteBuf, binary.LittleEndian, manifest.Timestamp)
+	writeVarBytes(byteBuf, manifest.Pubkey)
+	digest := sha256.Sum256(byteBuf.Bytes())
+	return digest[:]
+}
+
+func SignSnapshotManifest(privateKey *btcec.PrivateKey, manifest *message.SnapshotManifest) error {
+	manifest.Pubkey = privateKey.PubKey().SerializeCompressed()
+	sig, err := privateKey.Sign(SnapshotManifestDigest(manifest))
+	if err != nil {
+		return err
+	}
+	manifest.Signature = sig.Serialize()
+	return nil
+}
+
+// signed by the peer and of the same partition parameters as ours
+func VerifySnapshotManifest(manifest *message.SnapshotManifest, pubkeyHex string, now time.Time) error {
+	if hex.EncodeToString(manifest.Pubkey) != pubkeyHex {
+		return errors.New("manifest not of the peer")
+	}
+	pubkey, err := btcec.ParsePubKey(manifest.Pubkey, btcec.S256())
+	if err != nil {
+		return err
+	}
+	sig, err := btcec.ParseSignature(manifest.Signature, btcec.S256())
+	if err != nil {
+		return err
+	}
+	if !sig.Verify(SnapshotManifestDigest(manifest), pubkey) {
+		return errors.New("verify fail")
+	}
+	if manifest.Params == nil {
+		return errors.New("manifest without params")
+	}
+	protocol := NegotiateProtocol(manifest.Params, now)
+	if !protocol.PartitionSync() {
+		return errors.New("manifest " + protocol.Reason)
+	}
+	return nil
+}
+
+// the partitions of height,the latest RecomputePartitionCount partitions are left out as they still change
+func (this *TouchstoneServer) GetSnapshotManifest(request *message.GetSnapshotManifestRequest) (*message.SnapshotManifest, error) {
+	count, err := this.PartitionInfoRepository.GetPartitionsCount()
+	if err != nil {
+		glog.Infof("TouchstoneServer.GetSnapshotManifest GetPartitionsCount %s", err)
+		return nil, err
+	}
+	count -= conf.GTunables.RecomputePartitionCount
+	if request.Height > 0 {
+		heightCount := (request.Height - *conf.GStartHeight) / conf.GTunables.PartitionBlockCount
+		if heightCount < count {
+			count = heightCount
+		}
+	}
+	if count <= 0 {
+		return nil, errors.New("no settled partition")
+	}
+	partitionInfos, err := this.PartitionInfoRepository.GetPartitionInfos(0, int(count))
+	if err != nil {
+		glog.Infof("TouchstoneServer.GetSnapshotManifest GetPartitionInfos %s", err)
+		return nil, err
+	}
+	manifest := &message.SnapshotManifest{
+		Params:          OwnHello(),
+		PartitionHashes: make([][]byte, 0, len(partitionInfos)),
+		Timestamp:       time.Now().Unix(),
+	}
+	for i, partitionInfo := range partitionInfos {
+		if partitionInfo.Id != int64(i) {
+			return nil, fmt.Errorf("partition %d missing", i)
+		}
+		hash, err := hex.DecodeString(partitionInfo.Hash)
+		if err != nil {
+			return nil, err
+		}
+		manifest.PartitionHashes = append(manifest.PartitionHashes, hash)
+	}
+	err = SignSnapshotManifest(this.privateKey, manifest)
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// at least one tx,then as many as fit in MAX_SNAPSHOT_CHUNK_BYTES
+func (this *TouchstoneServer) GetSnapshotChunk(request *message.GetSnapshotChunkRequest) (*message.SnapshotChunk, error) {
+	if request.Partition < 0 {
+		return nil, errors.New("illegal partition")
+	}
+	startHeight := *conf.GStartHeight + request.Partition*conf.GTunables.PartitionBlockCount
+	txidBsons, err := this.TxInfoRepository.GetTxidsByHeightRangeOrderByTxid(startHeight, startHeight+conf.GTunables.PartitionBlockCount, models.TX_STATE_CLOSED, false)
+	if err != nil {
+		glog.Infof("TouchstoneServer.GetSnapshotChunk GetTxidsByHeightRangeOrderByTxid %d %s", request.Partition, err)
+		return nil, err
+	}
+	afterTxid := hex.EncodeToString(request.AfterTxid)
+	chunk := &message.SnapshotChunk{
+		Txs:  make([]*message.SnapshotTx, 0, 64),
+		Last: true,
+	}
+	size := 0
+	for _, txidBson := range txidBsons {
+		if txidBson.Txid <= afterTxid {
+			continue
+		}
+		msgTxInfo, err := this.TxInfoRepository.GetMsgTxInfo(txidBson.Txid)
+		if err != nil {
+			glog.Infof("TouchstoneServer.GetSnapshotChunk GetMsgTxInfo %s %s", txidBson.Txid, err)
+			return nil, err
+		}
+		txPoints, err := this.TxPointRepository.GetTxPoints(txidBson.Txid)
+		if err != nil {
+			glog.Infof("TouchstoneServer.GetSnapshotChunk GetTxPoints %s %s", txidBson.Txid, err)
+			return nil, err
+		}
+		snapshotTx := &message.SnapshotTx{
+			Rawtx:     util.SeserializeMsgTxBytes(msgTxInfo.MsgTx),
+			Height:    msgTxInfo.Height,
+			Blockhash: msgTxInfo.BlockHash,
+			Timestamp: msgTxInfo.Timestamp,
+			Points:    make([]*message.SnapshotTxPoint, 0, len(txPoints)),
+		}
+		for _, txPoint := range txPoints {
+			snapshotTx.Points = append(snapshotTx.Points, TxPoint2Snapshot(txPoint))
+		}
+		txSize := len(snapshotTx.Rawtx) + len(txPoints)*SNAPSHOT_TX_POINT_BYTES
+		if len(chunk.Txs) > 0 && size+txSize > MAX_SNAPSHOT_CHUNK_BYTES {
+			chunk.Last = false
+			break
+		}
+		chunk.Txs = append(chunk.Txs, snapshotTx)
+		size += txSize
+	}
+	return chunk, nil
+}
+
+func (this *TouchstoneServer) FetchSnapshotPartition(ctx context.Context, peer *Node, id int64) ([]*message.SnapshotTx, error) {
+	request := &message.GetSnapshotChunkRequest{
+		Partition: id,
+	}
+	snapshotTxs := make([]*message.SnapshotTx, 0, 64)
+	for {
+		rpcCtx, cancel := context.WithTimeout(ctx, PEER_RPC_TIMEOUT)
+		chunk, err := peer.GetSnapshotChunk(rpcCtx, request)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		snapshotTxs = append(snapshotTxs, chunk.Txs...)
+		if chunk.Last || len(chunk.Txs) == 0 {
+			return snapshotTxs, nil
+		}
+		if len(snapshotTxs) > MAX_SNAPSHOT_PARTITION_TXS {
+			return nil, fmt.Errorf("partition %d has more than %d txs", id, MAX_SNAPSHOT_PARTITION_TXS)
+		}
+		msgTx, err := util.DeserializeTxBytes(chunk.Txs[len(chunk.Txs)-1].Rawtx)
+		if err != nil {
+			return nil, err
+		}
+		afterTxid := util.GetHashByte(msgTx.TxHash())
+		if bytes.Compare(afterTxid, request.AfterTxid) <= 0 {
+			return nil, fmt.Errorf("partition %d chunk is not after %s", id, hex.EncodeToString(request.AfterTxid))
+		}
+		request = &message.GetSnapshotChunkRequest{
+			Partition: id,
+			AfterTxid: afterTxid,
+		}
+	}
+}
+
+func txPointKeys(txPoints []*models.TxPoint) []string {
+	keys := make([]string, 0, len(txPoints))
+	for _, txPoint := range txPoints {
+		keys = append(keys, fmt.Sprintf("%s_%d_%d_%s_%d_%s_%d_%s", txPoint.Txid, txPoint.Index, txPoint.Type, txPoint.Addr, txPoint.Value, txPoint.PreTxid, txPoint.PreIndex, txPoint.BadgeCode))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// timestamps and states are not compared,they differ from node to node
+func SameTxPoints(txInventory *TxInventory, txPoints []*models.TxPoint) bool {
+	expect := make([]*models.TxPoint, 0, len(txInventory.Vins)+len(txInventory.Vouts))
+	expect = append(expect, txInventory.Vins...)
+	expect = append(expect, txInventory.Vouts...)
+	expectKeys := txPointKeys(expect)
+	keys := txPointKeys(txPoints)
+	if len(expectKeys) != len(keys) {
+		return false
+	}
+	for i := range keys {
+		if keys[i] != expectKeys[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// every tx is parsed again,spent txs of the snapshot first.txs spending unknown utxos are skipped.
+// tx points of a verified entry are replaced by ours,only the timestamp of the peer is kept
+func (this *TouchstoneServer) VerifySnapshotTxs(entries []*SnapshotTxEntry, processId string) ([]*SnapshotTxEntry, error) {
+	pendingTxids := make(map[string]bool)
+	for _, entry := range entries {
+		pendingTxids[entry.Txid] = true
+	}
+	verifiedTxids := make(map[string]bool)
+	verifiedVouts := make(map[string]*models.TxPoint)
+	getTxPoint := func(txid string, index int, processId string) (*models.TxPoint, error) {
+		if verifiedTxids[txid] {
+			txPoint, ok := verifiedVouts[models.TxPointDocId(txid, index, models.TX_POINT_TYPE_VOUT)]
+			if !ok {
+				return nil, util.NewCodeError(util.ERR_ILLEGAL_VIN_CODE, "illegal vin")
+			}
+			return txPoint, nil
+		}
+		if pendingTxids[txid] {
+			return nil, errSnapshotTxPending
+		}
+		return this.GetTxPoint(txid, index, processId)
+	}
+	verified := make([]*SnapshotTxEntry, 0, len(entries))
+	pending := entries
+	for len(pending) > 0 {
+		next := make([]*SnapshotTxEntry, 0, 8)
+		for _, entry := range pending {
+			txInventory, err := this.ParseMsgTxBy(entry.MsgTx, entry.Tx.Timestamp, getTxPoint, processId)
+			if err == errSnapshotTxPending {
+				next = append(next, entry)
+				continue
+			}
+			if err != nil {
+				codeErr, ok := err.(*util.CodeError)
+				if !ok || codeErr.Code != util.ERR_UNKNOW_UTXO_CODE {
+					return nil, err
+				}
+				glog.Infof("TouchstoneServer.VerifySnapshotTxs skip %s %s %s", entry.Txid, err, processId)
+				delete(pendingTxids, entry.Txid)
+				continue
+			}
+			if !SameTxPoints(txInventory, entry.TxPoints) {
+				return nil, fmt.Errorf("tx points of %s differ from ours", entry.Txid)
+			}
+			entry.TxPoints = make([]*models.TxPoint, 0, len(txInventory.Vins)+len(txInventory.Vouts))
+			entry.TxPoints = append(entry.TxPoints, txInventory.Vins...)
+			entry.TxPoints = append(entry.TxPoints, txInventory.Vouts...)
+			delete(pendingTxids, entry.Txid)
+			verifiedTxids[entry.Txid] = true
+			for _, vout := range txInventory.Vouts {
+				verifiedVouts[models.TxPointDocId(vout.Txid, vout.Index, vout.Type)] = vout
+			}
+			verified = append(verified, entry)
+		}
+		if len(next) == len(pending) {
+			glog.Infof("TouchstoneServer.VerifySnapshotTxs skip %d txs spending each other %s", len(next), processId)
+			break
+		}
+		pending = next
+	}
+	return verified, nil
+}
+
+// mapi should know the tx in the same block
+func (this *TouchstoneServer) CheckSnapshotSample(ctx context.Context, entries []*SnapshotTxEntry, processId string) error {
+	for i, entry := range entries {
+		if i != 0 && rand.Intn(SNAPSHOT_SAMPLE_RATE) != 0 {
+			continue
+		}
+		txState, err := this.MapiClient.GetTxState(ctx, entry.Txid)
+		if err != nil {
+			glog.Infof("TouchstoneServer.CheckSnapshotSample GetTxState %s %s %s", entry.Txid, err, processId)
+			return err
+		}
+		if txState.Payload.ReturnResult == mapi.RETURN_RESULT_FAILURE {
+			return fmt.Errorf("sample tx %s %s", entry.Txid, txState.Payload.ResultDescription)
+		}
+		if txState.Payload.BlockHash != entry.Tx.Blockhash {
+			return fmt.Errorf("sample tx %s in block %s,mapi %s", entry.Txid, entry.Tx.Blockhash, txState.Payload.BlockHash)
+		}
+	}
+	return nil
+}
+
+// no event is published for imported txs
+func (this *TouchstoneServer) ImportSnapshotTx(entry *SnapshotTxEntry) error {
+	msgTxBriefInfo, err := this.TxInfoRepository.GetMsgTxBriefInfo(entry.Txid)
+	if err == nil && msgTxBriefInfo.State == models.TX_STATE_CLOSED {
+		return nil
+	}
+	if err != nil && !strings.Contains(err.Error(), models.MONGO_NOT_FOUND) {
+		return err
+	}
+	err = this.TxInfoRepository.AddMsgTxInfo(entry.MsgTx, entry.Tx.Height, entry.Tx.Blockhash, entry.Tx.Timestamp)
+	if err != nil {
+		return err
+	}
+	msgTxBriefInfo, err = this.TxInfoRepository.GetMsgTxBriefInfo(entry.Txid)
+	if err != nil {
+		return err
+	}
+	ops, err := this.TxPointRepository.InsertTxPointOps(entry.Txid, entry.TxPoints)
+	if err != nil {
+		return err
+	}
+	ops = append(ops, this.AddrBalanceRepository.ChangeBalanceOps(entry.TxPoints, msgTxBriefInfo.Height, false)...)
+	err = this.TxInfoRepository.CloseMsgTx(msgTxBriefInfo, ops)
+	if err != nil {
+		return err
+	}
+	err = this.CheckXpubAddrsUsed(entry.TxPoints)
+	if err != nil {
+		glog.Infof("TouchstoneServer.ImportSnapshotTx CheckXpubAddrsUsed txid:%s err:%s", entry.Txid, err)
+	}
+	return nil
+}
+
+// false when some txs can not be verified yet,partition info is set anyway.
+// txs not matching the hash the peer signed ban the peer
+func (this *TouchstoneServer) ImportSnapshotPartition(ctx context.Context, pubkey string, peer *Node, id int64, hash []byte, processId string) (bool, error) {
+	snapshotTxs, err := this.FetchSnapshotPartition(ctx, peer, id)
+	if err != nil {
+		glog.Infof("TouchstoneServer.ImportSnapshotPartition FetchSnapshotPartition %s %d %s %s", pubkey, id, err, processId)
+		return false, err
+	}
+	startHeight := *conf.GStartHeight + id*conf.GTunables.PartitionBlockCount
+	entries := make([]*SnapshotTxEntry, 0, len(snapshotTxs))
+	txids := make([]string, 0, len(snapshotTxs))
+	seen := make(map[string]bool)
+	for _, snapshotTx := range snapshotTxs {
+		msgTx, err := util.DeserializeTxBytes(snapshotTx.Rawtx)
+		if err != nil {
+			return false, err
+		}
+		txid := msgTx.TxHash().String()
+		if seen[txid] {
+			return false, fmt.Errorf("tx %s served twice", txid)
+		}
+		seen[txid] = true
+		if snapshotTx.Height < startHeight || snapshotTx.Height >= startHeight+conf.GTunables.PartitionBlockCount {
+			return false, fmt.Errorf("tx %s of height %d not in partition %d", txid, snapshotTx.Height, id)
+		}
+		entry := &SnapshotTxEntry{
+			Txid:     txid,
+			MsgTx:    msgTx,
+			Tx:       snapshotTx,
+			TxPoints: make([]*models.TxPoint, 0, len(snapshotTx.Points)),
+		}
+		for _, point := range snapshotTx.Points {
+			entry.TxPoints = append(entry.TxPoints, Snapshot2TxPoint(txid, snapshotTx.Timestamp, point))
+		}
+		entries = append(entries, entry)
+		txids = append(txids, txid)
+	}
+	partitionHash, err := PartitionHash(txids)
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(partitionHash, hash) {
+		glog.Infof("TouchstoneServer.ImportSnapshotPartition ban %s,hash of partition %d differs from its manifest %s", pubkey, id, processId)
+		this.peerHealth.Ban(pubkey, time.Now())
+		return false, errors.New("txids differ from the signed manifest")
+	}
+	verified, err := this.VerifySnapshotTxs(entries, processId)
+	if err != nil {
+		return false, err
+	}
+	if len(verified) > 0 {
+		err = this.CheckSnapshotSample(ctx, verified, processId)
+		if err != nil {
+			return false, err
+		}
+	}
+	this.syncTxLock.RLock()
+	for _, entry := range verified {
+		err = this.ImportSnapshotTx(entry)
+		if err != nil {
+			this.syncTxLock.RUnlock()
+			glog.Infof("TouchstoneServer.ImportSnapshotPartition ImportSnapshotTx %s %s %s", entry.Txid, err, processId)
+			return false, err
+		}
+	}
+	this.syncTxLock.RUnlock()
+	err = this.ComputeAndSetPartitionHash(id)
+	if err != nil {
+		return false, err
+	}
+	return len(verified) == len(entries), nil
+}
+
+// the best ranked peer of our partition parameters serving snapshots
+func (this *TouchstoneServer) SnapshotPeer(ctx context.Context, pubkey string, processId string) (string, *Node, error) {
+	peers := this.Peers()
+	pubkeys := this.RankPeers(peers)
+	if pubkey != "" {
+		pubkeys = []string{pubkey}
+	}
+	for _, key := range pubkeys {
+		peer, ok := peers[key]
+		if !ok {
+			continue
+		}
+		protocol := this.EnsurePeerProtocol(ctx, key, peer, processId)
+		if protocol.PartitionSync() && protocol.HasCapability(CAPABILITY_SNAPSHOT) {
+			return key, peer, nil
+		}
+	}
+	return "", nil, errors.New("no peer serves snapshots of our partition parameters")
+}
+
+// partitions with the hash of the manifest already are skipped,so a failed bootstrap can be started again.
+// incomplete partitions are synced from every peer as sync state does
+func (this *TouchstoneServer) BootstrapSnapshot(ctx context.Context, pubkey string, height int64, job *Job, processId string) error {
+	pubkey, peer, err := this.SnapshotPeer(ctx, pubkey, processId)
+	if err != nil {
+		return err
+	}
+	rpcCtx, cancel := context.WithTimeout(ctx, PEER_RPC_TIMEOUT)
+	manifest, err := peer.GetSnapshotManifest(rpcCtx, &message.GetSnapshotManifestRequest{Height: height})
+	cancel()
+	if err != nil {
+		glog.Infof("TouchstoneServer.BootstrapSnapshot GetSnapshotManifest %s %s %s", pubkey, err, processId)
+		return err
+	}
+	err = VerifySnapshotManifest(manifest, pubkey, time.Now())
+	if err != nil {
+		glog.Infof("TouchstoneServer.BootstrapSnapshot VerifySnapshotManifest %s %s %s", pubkey, err, processId)
+		return err
+	}
+	glog.Infof("TouchstoneServer.BootstrapSnapshot %d partitions from %s %s", len(manifest.PartitionHashes), pubkey, processId)
+	job.SetTotal(int64(len(manifest.PartitionHashes)))
+	incompletes := make([]int64, 0, 8)
+	for i, hash := range manifest.PartitionHashes {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		id := int64(i)
+		partitionInfo, err := this.PartitionInfoRepository.GetPartitionInfo(id)
+		if err == nil && partitionInfo.Hash == hex.EncodeToString(hash) {
+			job.AddDone(1)
+			continue
+		}
+		if err != nil && !strings.Contains(err.Error(), models.MONGO_NOT_FOUND) {
+			return err
+		}
+		complete, err := this.ImportSnapshotPartition(ctx, pubkey, peer, id, hash, processId)
+		if err != nil {
+			return fmt.Errorf("partition %d of %s: %s", id, pubkey, err)
+		}
+		if !complete {
+			incompletes = append(incompletes, id)
+		}
+		job.AddDone(1)
+	}
+	glog.Infof("TouchstoneServer.BootstrapSnapshot imported,%d partitions incomplete %s", len(incompletes), processId)
+	for _, id := range incompletes {
+		this.AddNeedRecomputehashPartition(id)
+		_, err = this.SyncPatitionsFromPeers(ctx, id, id, this.Peers(), nil, processId)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *TouchstoneServer) StartBootstrapSnapshotJob(pubkey string, height int64) (*Job, error) {
+	if height < 0 {
+		return nil, util.NewCodeError(util.ERR_PARAMETERS_CODE, "should be height >= 0")
+	}
+	if pubkey != "" {
+		_, ok := this.Peers()[pubkey]
+		if !ok {
+			return nil, util.NewCodeError(util.ERR_PARAMETERS_CODE, "peer not found")
+		}
+	}
+	params := &BootstrapParams{
+		Peer:   pubkey,
+		Height: height,
+	}
+	return this.StartJob(JOB_TYPE_BOOTSTRAP_SNAPSHOT, params, func(ctx context.Context, job *Job, processId string) error {
+		return this.BootstrapSnapshot(ctx, pubkey, height, job, processId)
+	})
+}
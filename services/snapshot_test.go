@@ -0,0 +1,188 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/dotwallet/touchstone/conf"
+	"github.com/dotwallet/touchstone/message"
+	"github.com/dotwallet/touchstone/models"
+	"github.com/dotwallet/touchstone/util"
+)
+
+func TestPartitionHash(t *testing.T) {
+	txids := []string{
+		"bb00000000000000000000000000000000000000000000000000000000000000",
+		"0a00000000000000000000000000000000000000000000000000000000000000",
+		"aa00000000000000000000000000000000000000000000000000000000000000",
+	}
+	// the order ComputePartitionHash reads txids in
+	hashComputer := sha256.New()
+	for _, txid := range []string{txids[1], txids[2], txids[0]} {
+		txidBytes, _ := hex.DecodeString(txid)
+		hashComputer.Write(txidBytes)
+	}
+	hash, err := PartitionHash(txids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(hash) != hex.EncodeToString(hashComputer.Sum(nil)) {
+		t.Fatalf("hash %x", hash)
+	}
+	if txids[0][:2] != "bb" {
+		t.Fatal("txids sorted in place")
+	}
+	empty := sha256.Sum256(nil)
+	hash, err = PartitionHash(nil)
+	if err != nil || hex.EncodeToString(hash) != hex.EncodeToString(empty[:]) {
+		t.Fatalf("empty hash %x %v", hash, err)
+	}
+	if _, err := PartitionHash([]string{"zz"}); err == nil {
+		t.Fatal("bad txid hashed")
+	}
+}
+
+func TestSnapshotManifest(t *testing.T) {
+	privateKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubkey := hex.EncodeToString(privateKey.PubKey().SerializeCompressed())
+	now := time.Now()
+	sign := func(params *message.HelloRequest) *message.SnapshotManifest {
+		manifest := &message.SnapshotManifest{
+			Params:          params,
+			PartitionHashes: [][]byte{{1}, {2}},
+			Timestamp:       now.Unix(),
+		}
+		err := SignSnapshotManifest(privateKey, manifest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return manifest
+	}
+	manifest := sign(OwnHello())
+	if err := VerifySnapshotManifest(manifest, pubkey, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifySnapshotManifest(manifest, "02aa", now); err == nil {
+		t.Fatal("manifest of another peer verified")
+	}
+	manifest.PartitionHashes[1] = []byte{3}
+	if err := VerifySnapshotManifest(manifest, pubkey, now); err == nil {
+		t.Fatal("tampered manifest verified")
+	}
+	params := OwnHello()
+	params.PartitionBlockCount++
+	if err := VerifySnapshotManifest(sign(params), pubkey, now); err == nil {
+		t.Fatal("manifest of other partition parameters verified")
+	}
+	if err := VerifySnapshotManifest(sign(nil), pubkey, now); err == nil {
+		t.Fatal("manifest without params verified")
+	}
+}
+
+func TestSameTxPoints(t *testing.T) {
+	txInventory := &TxInventory{
+		Vins:  []*models.TxPoint{{Txid: "t", Index: 0, Type: models.TX_POINT_TYPE_VIN, Addr: "a", Value: -5, PreTxid: "p", PreIndex: 1, BadgeCode: "c"}},
+		Vouts: []*models.TxPoint{{Txid: "t", Index: 0, Type: models.TX_POINT_TYPE_VOUT, Addr: "b", Value: 5, PreIndex: -1, BadgeCode: "c"}},
+	}
+	// other order,timestamps and states
+	txPoints := []*models.TxPoint{
+		{Txid: "t", Index: 0, Type: models.TX_POINT_TYPE_VOUT, Addr: "b", Value: 5, PreIndex: -1, BadgeCode: "c", Timestamp: 9, State: 2},
+		{Txid: "t", Index: 0, Type: models.TX_POINT_TYPE_VIN, Addr: "a", Value: -5, PreTxid: "p", PreIndex: 1, BadgeCode: "c", Timestamp: 9},
+	}
+	if !SameTxPoints(txInventory, txPoints) {
+		t.Fatal("same points differ")
+	}
+	if SameTxPoints(txInventory, txPoints[:1]) {
+		t.Fatal("missing point not found")
+	}
+	txPoints[0].Value = 6
+	if SameTxPoints(txInventory, txPoints) {
+		t.Fatal("other value not found")
+	}
+}
+
+func badgeTx(t *testing.T, prevOut *wire.OutPoint, vinScript []byte, address btcutil.Address, value int64) *wire.MsgTx {
+	script, err := util.CreateBadgeLockScript(address, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgTx := wire.NewMsgTx(1)
+	msgTx.AddTxIn(wire.NewTxIn(prevOut, vinScript, nil))
+	msgTx.AddTxOut(wire.NewTxOut(1, script))
+	return msgTx
+}
+
+func snapshotEntry(t *testing.T, server *TouchstoneServer, msgTx *wire.MsgTx, spent []*models.TxPoint) *SnapshotTxEntry {
+	getTxPoint := func(txid string, index int, processId string) (*models.TxPoint, error) {
+		for _, txPoint := range spent {
+			if txPoint.Txid == txid && txPoint.Index == index {
+				return txPoint, nil
+			}
+		}
+		return nil, util.NewCodeError(util.ERR_UNKNOW_UTXO_CODE, "unknown utxo")
+	}
+	// the points the peer serves,of its own timestamp and states
+	txInventory, err := server.ParseMsgTxBy(msgTx, 7, getTxPoint, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := &SnapshotTxEntry{
+		Txid:  msgTx.TxHash().String(),
+		MsgTx: msgTx,
+		Tx:    &message.SnapshotTx{Timestamp: 7},
+	}
+	for _, txPoint := range append(txInventory.Vins, txInventory.Vouts...) {
+		peerTxPoint := *txPoint
+		peerTxPoint.State = models.TX_POINT_STATE_MAY_BE_UNSPENT + 1
+		entry.TxPoints = append(entry.TxPoints, &peerTxPoint)
+	}
+	return entry
+}
+
+func TestVerifySnapshotTxsOrder(t *testing.T) {
+	address, err := btcutil.NewAddressPubKeyHash(make([]byte, 20), conf.GNetParam)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &TouchstoneServer{}
+	// creates a badge,its vin spends no badge
+	create := badgeTx(t, wire.NewOutPoint(&chainhash.Hash{1}, 0), nil, address, 100)
+	createEntry := snapshotEntry(t, server, create, nil)
+	createHash := create.TxHash()
+	transfer := badgeTx(t, wire.NewOutPoint(&createHash, 0), []byte(util.BADGE_FLAG), address, 100)
+	transferEntry := snapshotEntry(t, server, transfer, createEntry.TxPoints[len(createEntry.TxPoints)-1:])
+	if len(transferEntry.TxPoints) != 2 {
+		t.Fatalf("transfer points %d", len(transferEntry.TxPoints))
+	}
+	// the spending tx comes first,it is verified after the tx it spends
+	verified, err := server.VerifySnapshotTxs([]*SnapshotTxEntry{transferEntry, createEntry}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(verified) != 2 || verified[0] != createEntry || verified[1] != transferEntry {
+		t.Fatalf("verified %d", len(verified))
+	}
+	// our points are imported,only the timestamp of the peer is kept
+	for _, entry := range verified {
+		for _, txPoint := range entry.TxPoints {
+			if txPoint.State != models.TX_POINT_STATE_MAY_BE_UNSPENT || txPoint.Timestamp != 7 {
+				t.Fatalf("point %+v", txPoint)
+			}
+		}
+	}
+	// points other than ours fail
+	createEntry = snapshotEntry(t, server, create, nil)
+	createEntry.TxPoints[0].Value++
+	if _, err := server.VerifySnapshotTxs([]*SnapshotTxEntry{createEntry}, "test"); err == nil {
+		t.Fatal("other points verified")
+	}
+}
@@ -0,0 +1,66 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/dotwallet/touchstone/message"
+	"google.golang.org/grpc"
+)
+
+type failingP2PClient struct {
+	message.P2PClient
+	calls int
+}
+
+func (this *failingP2PClient) GetPartitionsHash(ctx context.Context, in *message.GetPartitionsHashRequest, opts ...grpc.CallOption) (*message.GetPartitionsHashResponse, error) {
+	this.calls++
+	return nil, errors.New("unavailable")
+}
+
+func TestSyncPatitionsFromPeersWithoutAnswer(t *testing.T) {
+	full := &failingP2PClient{}
+	downgraded := &failingP2PClient{}
+	peers := map[string]*Node{
+		"02aa": {P2PClient: full, protocol: &PeerProtocol{Status: PEER_PROTOCOL_FULL}},
+		"02bb": {P2PClient: downgraded, protocol: &PeerProtocol{Status: PEER_PROTOCOL_DOWNGRADED}},
+	}
+	server := &TouchstoneServer{
+		peers:                            peers,
+		NeedRecomputehashPartitionsCache: make(map[int64]bool),
+	}
+	compared, err := server.SyncPatitionsFromPeers(context.Background(), 0, 0, peers, nil, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compared != 0 {
+		t.Fatalf("compared %d", compared)
+	}
+	if full.calls != 1 || downgraded.calls != 0 {
+		t.Fatalf("calls %d %d", full.calls, downgraded.calls)
+	}
+	peerStatuses := server.GetPeers()
+	for _, peerStatus := range peerStatuses {
+		if peerStatus.Pubkey == "02aa" && (peerStatus.LastSyncResult == nil || peerStatus.LastSyncResult.Error == "") {
+			t.Fatalf("error of 02aa should be kept %+v", peerStatus.LastSyncResult)
+		}
+	}
+}
+
+func TestSyncStateSucceeded(t *testing.T) {
+	cases := []struct {
+		peerCount int
+		compared  int
+		succeeded bool
+	}{
+		{peerCount: 0, compared: 0, succeeded: true},
+		{peerCount: 2, compared: 0, succeeded: false},
+		{peerCount: 2, compared: 1, succeeded: true},
+	}
+	for _, c := range cases {
+		if SyncStateSucceeded(c.peerCount, c.compared) != c.succeeded {
+			t.Fatalf("case %+v", c)
+		}
+	}
+}
@@ -3,11 +3,9 @@ package services
 import (
 	"bytes"
 	"context"
-	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -20,15 +18,21 @@ import (
 	"github.com/dotwallet/touchstone/interceptor"
 	"github.com/dotwallet/touchstone/mapi"
 	"github.com/dotwallet/touchstone/message"
+	"github.com/dotwallet/touchstone/metrics"
 	"github.com/dotwallet/touchstone/models"
 	"github.com/dotwallet/touchstone/util"
 	"github.com/golang/glog"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
 )
 
 const (
-	TX_VERSION       = 2
-	BADGE_DUST_LIMIT = 888
+	TX_VERSION     = 2
+	MAX_PAGE_LIMIT = 1000
+
+	TXN_PURGE_INTERVAL = time.Hour
+	TXN_PURGE_AGE      = time.Hour
+	TXN_PURGE_BATCH    = 1000
 )
 
 type LocalSingleTxSource struct {
@@ -52,7 +56,7 @@ func NewLocalSingleTxSource(rawTx string) (*LocalSingleTxSource, error) {
 	}, nil
 }
 
-func (this *LocalSingleTxSource) GetTxBytes(txids [][]byte) ([][]byte, error) {
+func (this *LocalSingleTxSource) GetTxBytes(ctx context.Context, txids [][]byte) ([][]byte, error) {
 	if len(txids) == 0 {
 		return nil, nil
 	}
@@ -70,16 +74,28 @@ func (this *LocalSingleTxSource) GetTxBytes(txids [][]byte) ([][]byte, error) {
 
 type Node struct {
 	message.P2PClient
+	host         string
+	conn         *grpc.ClientConn
+	protocolLock sync.Mutex
+	protocol     *PeerProtocol
+	// txids notified by or to the peer
+	knownTxs TxidFilter
+}
+
+func (this *Node) Connected() bool {
+	return this.conn != nil && this.conn.GetState() == connectivity.Ready
 }
 
-func (this *Node) GetTxBytes(txids [][]byte) ([][]byte, error) {
+func (this *Node) GetTxBytes(ctx context.Context, txids [][]byte) ([][]byte, error) {
 	if len(txids) == 0 {
 		return nil, nil
 	}
 	request := &message.GetTxsRequest{
 		Txids: txids,
 	}
-	getTxsResponse, err := this.P2PClient.GetTxs(context.Background(), request)
+	ctx, cancel := context.WithTimeout(ctx, PEER_RPC_TIMEOUT)
+	defer cancel()
+	getTxsResponse, err := this.P2PClient.GetTxs(ctx, request)
 	if err != nil {
 		return nil, err
 	}
@@ -88,6 +104,15 @@ func (this *Node) GetTxBytes(txids [][]byte) ([][]byte, error) {
 
 type TouchstoneServer struct {
 	peers                            map[string]*Node
+	peerConfigs                      []*conf.PeerConfig
+	staticPeerConfigs                []*conf.PeerConfig
+	peersLock                        sync.RWMutex
+	connectLock                      sync.Mutex
+	applyLock                        sync.Mutex
+	PeerAllowList                    *interceptor.PeerAllowList
+	ConfigLoader                     func() (*conf.Config, error)
+	NodeRepository                   *models.NodeRepository
+	DiscoveryConfig                  *conf.DiscoveryConfig
 	TxInfoRepository                 *models.TxInfoRepository
 	PartitionInfoRepository          *models.PartitionInfoRepository
 	MapiClient                       *mapi.MapiClient
@@ -95,14 +120,41 @@ type TouchstoneServer struct {
 	NeedRecomputehashPartitionsCache map[int64]bool
 	cacheLock                        sync.Mutex
 	syncTxLock                       sync.RWMutex
+	syncPartitionsLock               sync.Mutex
 	privateKey                       *btcec.PrivateKey
 	AddrInfoRepository               *models.AddrInfoRepository
-}
-
+	ConsolidateInfoRepository        *models.ConsolidateInfoRepository
+	ConsolidateConfig                *conf.ConsolidateConfig
+	PayoutBatchRepository            *models.PayoutBatchRepository
+	PayoutConfig                     *conf.PayoutConfig
+	payoutLock                       sync.Mutex
+	AddrBalanceRepository            *models.AddrBalanceRepository
+	EventHub                         *EventHub
+	WebhookRepository                *models.WebhookRepository
+	WebhookDeliveryRepository        *models.WebhookDeliveryRepository
+	ApiKeyRepository                 *models.ApiKeyRepository
+	XpubInfoRepository               *models.XpubInfoRepository
+	xpubLocks                        map[string]*sync.Mutex
+	xpubLocksLock                    sync.Mutex
+	xpubEnabled                      int32
+	adminState                       AdminState
+	peerHealth                       PeerHealthBook
+	lifecycle                        Lifecycle
+}
+
+// the map is replaced as a whole and never changed after
 func (this *TouchstoneServer) Peers() map[string]*Node {
+	this.peersLock.RLock()
+	defer this.peersLock.RUnlock()
 	return this.peers
 }
 
+func (this *TouchstoneServer) PeerConfigs() []*conf.PeerConfig {
+	this.peersLock.RLock()
+	defer this.peersLock.RUnlock()
+	return this.peerConfigs
+}
+
 func (this *TouchstoneServer) AddNeedRecomputehashPartition(id int64) {
 	this.cacheLock.Lock()
 	defer this.cacheLock.Unlock()
@@ -113,7 +165,7 @@ func (this *TouchstoneServer) AddNeedRecomputehashPartitionByHeight(height int64
 	if height < *conf.GStartHeight {
 		return
 	}
-	patition := (height - *conf.GStartHeight) / conf.PARTITION_BLOCK_COUNT
+	patition := (height - *conf.GStartHeight) / conf.GTunables.PartitionBlockCount
 	this.AddNeedRecomputehashPartition(patition)
 	return
 }
@@ -191,6 +243,11 @@ func (this *TouchstoneServer) GetTxPoint(txid string, index int, processId strin
 }
 
 func (this *TouchstoneServer) ParseMsgTx(MsgTx *wire.MsgTx, timestamp int64, processId string) (*TxInventory, error) {
+	return this.ParseMsgTxBy(MsgTx, timestamp, this.GetTxPoint, processId)
+}
+
+// getTxPoint finds the vouts spent by vins,like GetTxPoint
+func (this *TouchstoneServer) ParseMsgTxBy(MsgTx *wire.MsgTx, timestamp int64, getTxPoint func(txid string, index int, processId string) (*models.TxPoint, error), processId string) (*TxInventory, error) {
 	txInventory := NewTxInventory()
 	badgeValues := make(map[string]int64)
 	illegalVin := false
@@ -200,7 +257,7 @@ func (this *TouchstoneServer) ParseMsgTx(MsgTx *wire.MsgTx, timestamp int64, pro
 			glog.Infof("ParseMsgTx check vin fomat continue %d %s", index, processId)
 			continue
 		}
-		txPoint, err := this.GetTxPoint(vin.PreviousOutPoint.Hash.String(), int(vin.PreviousOutPoint.Index), processId)
+		txPoint, err := getTxPoint(vin.PreviousOutPoint.Hash.String(), int(vin.PreviousOutPoint.Index), processId)
 		if err != nil {
 			codeErr, ok := err.(*util.CodeError)
 			if !ok {
@@ -210,6 +267,7 @@ func (this *TouchstoneServer) ParseMsgTx(MsgTx *wire.MsgTx, timestamp int64, pro
 				return nil, err
 			}
 			illegalVin = true
+			continue
 		}
 
 		_, ok := badgeValues[txPoint.BadgeCode]
@@ -275,53 +333,88 @@ func (this *TouchstoneServer) ParseMsgTx(MsgTx *wire.MsgTx, timestamp int64, pro
 	return txInventory, nil
 }
 
-func (this *TouchstoneServer) ParseAndAddTxPoints(msgTx *wire.MsgTx, timestamp int64, processId string) (*TxInventory, error) {
+func (this *TouchstoneServer) ParseAndCloseMsgTx(msgTx *wire.MsgTx, timestamp int64, processId string) (*TxInventory, error) {
 	txInventory, err := this.ParseMsgTx(msgTx, timestamp, processId)
 	if err != nil {
-		glog.Infof("TouchstoneServer.ParseAndAddTxPoints ParseMsgTx txid:%s err:%s", msgTx.TxHash().String(), err)
+		glog.Infof("TouchstoneServer.ParseAndCloseMsgTx ParseMsgTx txid:%s err:%s", msgTx.TxHash().String(), err)
 		return nil, err
 	}
-	glog.Infof("ParseAndAddTxPoints %s len(vin)=%d len(vout)=%d %s", msgTx.TxHash().String(), len(txInventory.Vins), len(txInventory.Vouts), processId)
-	for _, txPoint := range txInventory.Vins {
-		err := this.TxPointRepository.AddTxPoint(txPoint)
-		if err != nil {
-			if !strings.Contains(err.Error(), models.MONGO_ERROR_DUPLICATE) {
-				return nil, err
-			}
-		}
+	glog.Infof("ParseAndCloseMsgTx %s len(vin)=%d len(vout)=%d %s", msgTx.TxHash().String(), len(txInventory.Vins), len(txInventory.Vouts), processId)
+	txPoints := make([]*models.TxPoint, 0, len(txInventory.Vins)+len(txInventory.Vouts))
+	txPoints = append(txPoints, txInventory.Vins...)
+	txPoints = append(txPoints, txInventory.Vouts...)
+	msgTxBriefInfo, err := this.TxInfoRepository.GetMsgTxBriefInfo(msgTx.TxHash().String())
+	if err != nil {
+		return nil, err
 	}
-
-	for _, txPoint := range txInventory.Vouts {
-		err := this.TxPointRepository.AddTxPoint(txPoint)
-		if err != nil {
-			if !strings.Contains(err.Error(), models.MONGO_ERROR_DUPLICATE) {
-				return nil, err
-			}
-		}
+	if msgTxBriefInfo.State == models.TX_STATE_CLOSED {
+		return txInventory, nil
+	}
+	ops, err := this.TxPointRepository.InsertTxPointOps(msgTx.TxHash().String(), txPoints)
+	if err != nil {
+		return nil, err
+	}
+	ops = append(ops, this.AddrBalanceRepository.ChangeBalanceOps(txPoints, msgTxBriefInfo.Height, false)...)
+	err = this.TxInfoRepository.CloseMsgTx(msgTxBriefInfo, ops)
+	if err != nil {
+		return nil, err
+	}
+	this.PublishEvent(EVENT_TYPE_TX_CLOSED, msgTxBriefInfo.Txid, msgTxBriefInfo.Height, txPoints)
+	err = this.CheckXpubAddrsUsed(txPoints)
+	if err != nil {
+		glog.Infof("TouchstoneServer.ParseAndCloseMsgTx CheckXpubAddrsUsed txid:%s err:%s", msgTxBriefInfo.Txid, err)
 	}
 	return txInventory, nil
 }
 
 func (this *TouchstoneServer) ProcessMsgTx(msgTx *wire.MsgTx, timestamp int64, processId string) (*TxInventory, error) {
-	state := models.TX_STATE_CLOSED
-	txInventory, err := this.ParseAndAddTxPoints(msgTx, timestamp, processId)
-	if err != nil {
-		if !strings.Contains(err.Error(), "unknow utxo") {
-			glog.Infof("TouchstoneServer.ProcessMsgTx ProcessMsgTx txid:%s err:%s", msgTx.TxHash().String(), err)
-			return nil, err
-		}
-		state = models.TX_STATE_OPEN
+	txInventory, err := this.ParseAndCloseMsgTx(msgTx, timestamp, processId)
+	if err == nil {
+		return txInventory, nil
+	}
+	if !strings.Contains(err.Error(), "unknow utxo") {
+		glog.Infof("TouchstoneServer.ProcessMsgTx ProcessMsgTx txid:%s err:%s", msgTx.TxHash().String(), err)
+		return nil, err
 	}
 	{
-		err := this.TxInfoRepository.SetMsgTxState(msgTx.TxHash().String(), state)
+		err := this.TxInfoRepository.SetMsgTxState(msgTx.TxHash().String(), models.TX_STATE_OPEN)
 		if err != nil {
-			glog.Infof("TouchstoneServer.ProcessMsgTx SetMsgTxState txid:%s state:%d err:%s", msgTx.TxHash().String(), state, err)
+			glog.Infof("TouchstoneServer.ProcessMsgTx SetMsgTxState txid:%s state:%d err:%s", msgTx.TxHash().String(), models.TX_STATE_OPEN, err)
 			return nil, err
 		}
 	}
 	return txInventory, err
 }
 
+// txs stay in new state when crash after AddMsgTxInfo,and open txs may be closable now
+func (this *TouchstoneServer) RecoverMsgTxs(processId string) error {
+	err := this.TxInfoRepository.Db.ResumeTxns()
+	if err != nil {
+		glog.Infof("TouchstoneServer.RecoverMsgTxs ResumeTxns %s %s", err, processId)
+		return err
+	}
+	msgTxBriefInfos, err := this.TxInfoRepository.GetMsgTxBriefInfosByStates([]int{models.TX_STATE_NEW, models.TX_STATE_OPEN})
+	if err != nil {
+		glog.Infof("TouchstoneServer.RecoverMsgTxs GetMsgTxBriefInfosByStates %s %s", err, processId)
+		return err
+	}
+	msgTxs := make([]*wire.MsgTx, 0, len(msgTxBriefInfos))
+	for _, msgTxBriefInfo := range msgTxBriefInfos {
+		msgTxInfo, err := this.TxInfoRepository.GetMsgTxInfo(msgTxBriefInfo.Txid)
+		if err != nil {
+			glog.Infof("TouchstoneServer.RecoverMsgTxs GetMsgTxInfo %s %s %s", msgTxBriefInfo.Txid, err, processId)
+			return err
+		}
+		this.AddNeedRecomputehashPartitionByHeight(msgTxBriefInfo.Height)
+		msgTxs = append(msgTxs, msgTxInfo.MsgTx)
+	}
+	this.syncTxLock.RLock()
+	defer this.syncTxLock.RUnlock()
+	processMsgTxsResult := this.ProcessMsgTxs(msgTxs, time.Now().Unix(), processId)
+	glog.Infof("RecoverMsgTxs total:%d closed:%d err:%d %s", len(msgTxs), len(processMsgTxsResult.TxInventorys), len(processMsgTxsResult.ErrTxs), processId)
+	return nil
+}
+
 type TxidMsg struct {
 	Txid string `json:"txid"`
 	Msg  string `json:"msg"`
@@ -354,15 +447,6 @@ func (this *TouchstoneServer) ProcessMsgTxs(msgTxs []*wire.MsgTx, timestamp int6
 	return processMsgTxsResult
 }
 
-func (this *TouchstoneServer) NotifyTxs(notifyTxsRequest *message.NotifyTxsRequest) {
-	if len(notifyTxsRequest.Txids) == 0 {
-		return
-	}
-	for _, peer := range this.Peers() {
-		go peer.NotifyTxs(context.Background(), notifyTxsRequest)
-	}
-}
-
 type SyncTxsResult struct {
 	TxInventorys     []*TxInventory
 	ErrTxs           []*TxidMsg
@@ -370,10 +454,16 @@ type SyncTxsResult struct {
 }
 
 type TxSource interface {
-	GetTxBytes([][]byte) ([][]byte, error)
+	GetTxBytes(context.Context, [][]byte) ([][]byte, error)
 }
 
-func (this *TouchstoneServer) SyncTxs(txidBytes [][]byte, txSource TxSource, processId string) (*SyncTxsResult, error) {
+// shutdown waits for running SyncTxs
+func (this *TouchstoneServer) SyncTxs(ctx context.Context, txidBytes [][]byte, txSource TxSource, processId string) (*SyncTxsResult, error) {
+	err := this.lifecycle.Enter()
+	if err != nil {
+		return nil, err
+	}
+	defer this.lifecycle.Leave()
 	lackTxids := make([][]byte, 0, 8)
 	txStatesCache := make(map[string]*mapi.TxState)
 	needProcessTx := make([]*wire.MsgTx, 0, 8)
@@ -387,7 +477,7 @@ func (this *TouchstoneServer) SyncTxs(txidBytes [][]byte, txSource TxSource, pro
 				glog.Infof("TouchstoneServer.SyncTxs GetMsgTxBriefInfo err:%s %s", err, processId)
 				return nil, err
 			}
-			txState, err := this.MapiClient.GetTxState(txid)
+			txState, err := this.MapiClient.GetTxState(ctx, txid)
 			if err != nil {
 				glog.Infof("TouchstoneServer.SyncTxs GetTxState err:%s %s", err, processId)
 				return nil, err
@@ -424,16 +514,14 @@ func (this *TouchstoneServer) SyncTxs(txidBytes [][]byte, txSource TxSource, pro
 
 	}
 	glog.Infof("SyncTxs step search tx done %s", processId)
-	txsbytes, err := txSource.GetTxBytes(lackTxids)
+	txsbytes, err := txSource.GetTxBytes(ctx, lackTxids)
 	if err != nil {
 		glog.Infof("TouchstoneServer.SyncTxs GetTxBytes err:%s %s", err, processId)
 		return nil, err
 	}
 	glog.Infof("SyncTxs GetTxBytes %d done %s", len(lackTxids), processId)
 
-	notifyTxsRequest := &message.NotifyTxsRequest{
-		Txids: make([][]byte, 0, len(txsbytes)),
-	}
+	notifyTxs := make([]*message.PushedTx, 0, len(txsbytes))
 	getTxids := make(map[string]bool)
 	this.syncTxLock.RLock()
 	defer this.syncTxLock.RUnlock()
@@ -460,8 +548,9 @@ func (this *TouchstoneServer) SyncTxs(txidBytes [][]byte, txSource TxSource, pro
 		getTxids[msgTx.TxHash().String()] = true
 		this.AddNeedRecomputehashPartitionByHeight(txState.Payload.BlockHeight)
 		needProcessTx = append(needProcessTx, msgTx)
-		txhash := msgTx.TxHash()
-		notifyTxsRequest.Txids = append(notifyTxsRequest.Txids, util.GetHashByte(txhash))
+		notifyTxs = append(notifyTxs, &message.PushedTx{
+			Rawtx: txBytes,
+		})
 	}
 	glog.Infof("SyncTxs AddMsgTxInfo done %s", processId)
 	for _, lackTxid := range lackTxids {
@@ -479,34 +568,52 @@ func (this *TouchstoneServer) SyncTxs(txidBytes [][]byte, txSource TxSource, pro
 	processMsgTxsResult := this.ProcessMsgTxs(needProcessTx, time.Now().Unix(), processId)
 	glog.Infof("SyncTxs ProcessMsgTxs done %s", processId)
 	errTxs = append(errTxs, processMsgTxsResult.ErrTxs...)
-	this.NotifyTxs(notifyTxsRequest)
-	return &SyncTxsResult{
+	this.NotifyTxs(notifyTxs)
+	syncTxsResult := &SyncTxsResult{
 		AlreadyClosedTxs: alreadyClosedTxs,
 		ErrTxs:           errTxs,
 		TxInventorys:     processMsgTxsResult.TxInventorys,
-	}, nil
+	}
+	ObserveSyncTxsResult(syncTxsResult)
+	return syncTxsResult, nil
+}
+
+// err txs lacking utxos stay open and may be closed later
+func CountOpenErrTxs(syncTxsResult *SyncTxsResult) int {
+	openCount := 0
+	for _, errTx := range syncTxsResult.ErrTxs {
+		if strings.Contains(errTx.Msg, "unknow utxo") {
+			openCount++
+		}
+	}
+	return openCount
+}
+
+func ObserveSyncTxsResult(syncTxsResult *SyncTxsResult) {
+	openCount := CountOpenErrTxs(syncTxsResult)
+	metrics.SyncTxs.WithLabelValues(metrics.SYNC_TXS_RESULT_CLOSED).Add(float64(len(syncTxsResult.TxInventorys)))
+	metrics.SyncTxs.WithLabelValues(metrics.SYNC_TXS_RESULT_OPEN).Add(float64(openCount))
+	metrics.SyncTxs.WithLabelValues(metrics.SYNC_TXS_RESULT_ERROR).Add(float64(len(syncTxsResult.ErrTxs) - openCount))
+	metrics.SyncTxs.WithLabelValues(metrics.SYNC_TXS_RESULT_ALREADY_CLOSED).Add(float64(len(syncTxsResult.AlreadyClosedTxs)))
 }
 
 func (this *TouchstoneServer) ComputePartitionHash(id int64) ([]byte, error) {
-	startHeight := *conf.GStartHeight + id*conf.PARTITION_BLOCK_COUNT
-	txPoints, err := this.TxInfoRepository.GetTxidsByHeightRangeOrderByTxid(startHeight, startHeight+conf.PARTITION_BLOCK_COUNT, models.TX_STATE_CLOSED, false)
+	startHeight := *conf.GStartHeight + id*conf.GTunables.PartitionBlockCount
+	txPoints, err := this.TxInfoRepository.GetTxidsByHeightRangeOrderByTxid(startHeight, startHeight+conf.GTunables.PartitionBlockCount, models.TX_STATE_CLOSED, false)
 	if err != nil {
 		glog.Infof("TouchstoneServer.ComputePartitionHash GetClosedTxidsByHeightRange %d err:%s", id, err)
 		return nil, err
 	}
-	hashComputer := sha256.New()
+	txids := make([]string, 0, len(txPoints))
 	for _, txPoint := range txPoints {
-		txid, err := hex.DecodeString(txPoint.Txid)
-		if err != nil {
-			//todo here may not return err
-			return nil, err
-		}
-		_, err = hashComputer.Write(txid)
-		if err != nil {
-			return nil, err
-		}
+		txids = append(txids, txPoint.Txid)
+	}
+	// same as the hash of a snapshot partition
+	hash, err := PartitionHash(txids)
+	if err != nil {
+		//todo here may not return err
+		return nil, err
 	}
-	hash := hashComputer.Sum(nil)
 	//todo
 	glog.Infof("ComputePartitionHash id:%d hash %s", id, hex.EncodeToString(hash))
 	return hash, nil
@@ -529,87 +636,164 @@ func (this *TouchstoneServer) ComputeAndSetPartitionHash(id int64) error {
 	return this.PartitionInfoRepository.UpdatePartitionInfo(id, hashStr)
 }
 
-func (this *TouchstoneServer) SyncPatitions(start int64, end int64, processid string) error {
-	for offset := start; offset <= end; offset += conf.COMPARE_PARTITIONS_COUNT {
+func (this *TouchstoneServer) SyncPatitions(ctx context.Context, start int64, end int64, processid string) error {
+	_, err := this.SyncPatitionsFromPeers(ctx, start, end, this.Peers(), nil, processid)
+	return err
+}
+
+// ids of partitions whose hash differs from the one of the peer,peerHashs are in the order of partitionInfos
+func MismatchedPartitions(partitionInfos []*models.PartitionInfo, peerHashs [][]byte) []int64 {
+	ids := make([]int64, 0, 8)
+	for index, partitionInfo := range partitionInfos {
+		if index >= len(peerHashs) {
+			break
+		}
+		hash, err := hex.DecodeString(partitionInfo.Hash)
+		if err != nil {
+			//todo maybe
+			glog.Infof("MismatchedPartitions DecodeString %d %s err:%s", partitionInfo.Id, partitionInfo.Hash, err)
+			continue
+		}
+		if bytes.Equal(hash, peerHashs[index]) {
+			continue
+		}
+		ids = append(ids, partitionInfo.Id)
+	}
+	return ids
+}
+
+// mismatches of before that are still there
+func CountUnresolvedPartitions(before []int64, after []int64) int {
+	afterSet := make(map[int64]bool)
+	for _, id := range after {
+		afterSet[id] = true
+	}
+	unresolved := 0
+	for _, id := range before {
+		if afterSet[id] {
+			unresolved++
+		}
+	}
+	return unresolved
+}
+
+// SyncStateLoop and admin jobs take turns,they share the partitions cache,
+// returns the number of peers compared and synced without error at every offset
+func (this *TouchstoneServer) SyncPatitionsFromPeers(ctx context.Context, start int64, end int64, peers map[string]*Node, job *Job, processid string) (int, error) {
+	this.syncPartitionsLock.Lock()
+	defer this.syncPartitionsLock.Unlock()
+	comparedPeers := make(map[string]bool)
+	failedPeers := make(map[string]bool)
+	job.SetTotal((end-start)/conf.GTunables.ComparePartitionsCount + 1)
+	for offset := start; offset <= end; offset += conf.GTunables.ComparePartitionsCount {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
 		getPartitionsHashRequest := &message.GetPartitionsHashRequest{
 			Offset: offset,
-			Limit:  conf.COMPARE_PARTITIONS_COUNT,
+			Limit:  conf.GTunables.ComparePartitionsCount,
 		}
-		glog.Infof("SyncPatitions offset %d start", processid)
+		glog.Infof("SyncPatitions offset %d start %s", offset, processid)
 		err := this.ClearCacheAndSetHash()
 		if err != nil {
 			glog.Infof("TouchstoneServer.SyncPatitions ClearCacheAndSetHash err:%s", err)
-			return err
+			return 0, err
 		}
-		for pubkey, peer := range this.Peers() {
-			getPartitionsHashResponse, err := peer.GetPartitionsHash(context.Background(), getPartitionsHashRequest)
+		for _, pubkey := range this.RankPeers(peers) {
+			peer := peers[pubkey]
+			if !this.EnsurePeerProtocol(ctx, pubkey, peer, processid).PartitionSync() {
+				continue
+			}
+			rpcCtx, cancel := context.WithTimeout(ctx, PEER_RPC_TIMEOUT)
+			getPartitionsHashResponse, err := peer.GetPartitionsHash(rpcCtx, getPartitionsHashRequest)
+			cancel()
 			if err != nil {
 				glog.Infof("TouchstoneServer.SyncPatitions GetPartitionsHash %s err:%s %s", pubkey, err, processid)
+				this.SetPeerSyncResult(pubkey, PEER_SYNC_TYPE_PARTITIONS, nil, err)
+				failedPeers[pubkey] = true
 				continue
 			}
 			glog.Infof("SyncPatitions offset %d GetPartitionsHash %s done %s", offset, pubkey, processid)
-			partitionInfos, err := this.PartitionInfoRepository.GetPartitionInfos(int(offset), int(conf.COMPARE_PARTITIONS_COUNT))
+			partitionInfos, err := this.PartitionInfoRepository.GetPartitionInfos(int(offset), int(conf.GTunables.ComparePartitionsCount))
 			if err != nil {
 				glog.Infof("TouchstoneServer.SyncPatitions GetPartitionInfos err:%s %s", err, processid)
-				return err
+				return 0, err
 			}
 			getTxidsByPartitionsRequest := &message.GetTxidsByPartitionsRequest{
-				Ids: make([]int64, 0, 8),
+				Ids: MismatchedPartitions(partitionInfos, getPartitionsHashResponse.Hashs),
 			}
-			for index, partitionInfo := range partitionInfos {
-				if index >= len(getPartitionsHashResponse.Hashs) {
-					break
-				}
-				hash, err := hex.DecodeString(partitionInfo.Hash)
-				if err != nil {
-					//todo maybe
-					glog.Infof("TouchstoneServer.SyncPatitions DecodeString %d %s err:%s", partitionInfo.Id, partitionInfo.Hash, err)
-					continue
-				}
-				peerHash := getPartitionsHashResponse.Hashs[index]
-				if bytes.Equal(hash, peerHash) {
-					continue
-				}
-				glog.Infof("TouchstoneServer.SyncPatitions hash info diff:%s %s %s %d %s", hex.EncodeToString(hash), hex.EncodeToString(peerHash), pubkey, partitionInfo.Id, processid)
-				getTxidsByPartitionsRequest.Ids = append(getTxidsByPartitionsRequest.Ids, partitionInfo.Id)
+			if len(getTxidsByPartitionsRequest.Ids) > 0 {
+				glog.Infof("TouchstoneServer.SyncPatitions hash info diff:%v %s %s", getTxidsByPartitionsRequest.Ids, pubkey, processid)
 			}
+			metrics.PartitionHashMismatches.WithLabelValues(pubkey).Add(float64(len(getTxidsByPartitionsRequest.Ids)))
 			glog.Infof("SyncPatitions offset %d comparahash %s done %s", offset, pubkey, processid)
 			if len(getTxidsByPartitionsRequest.Ids) == 0 {
+				this.peerHealth.ObservePartitionMismatches(pubkey, 0, 0)
+				this.SetPeerSyncResult(pubkey, PEER_SYNC_TYPE_PARTITIONS, nil, nil)
+				comparedPeers[pubkey] = true
 				continue
 			}
-			getTxidsResponse, err := peer.GetTxidsByPartitions(context.Background(), getTxidsByPartitionsRequest)
+			rpcCtx, cancel = context.WithTimeout(ctx, PEER_RPC_TIMEOUT)
+			getTxidsResponse, err := peer.GetTxidsByPartitions(rpcCtx, getTxidsByPartitionsRequest)
+			cancel()
 			if err != nil {
 				glog.Infof("TouchstoneServer.SyncPatitions GetTxidsByPartitions %s err:%s", pubkey, err)
+				this.SetPeerSyncResult(pubkey, PEER_SYNC_TYPE_PARTITIONS, nil, err)
+				failedPeers[pubkey] = true
 				continue
 			}
 			glog.Infof("SyncPatitions offset %d GetTxidsByPartitions %s done %s", offset, pubkey, processid)
-			_, err = this.SyncTxs(getTxidsResponse.Txids, peer, processid)
+			syncTxsResult, err := this.SyncTxs(ctx, getTxidsResponse.Txids, peer, processid)
+			this.SetPeerSyncResult(pubkey, PEER_SYNC_TYPE_PARTITIONS, syncTxsResult, err)
 			if err != nil {
 				glog.Infof("TouchstoneServer.SyncPatitions SyncTxs %s err:%s", pubkey, err)
+				failedPeers[pubkey] = true
 				continue
 			}
+			comparedPeers[pubkey] = true
 			glog.Infof("SyncPatitions offset %d SyncTxs %s done %s", offset, pubkey, processid)
 			err = this.ClearCacheAndSetHash()
 			if err != nil {
 				glog.Infof("TouchstoneServer.SyncPatitions ClearCacheAndSetHash err:%s", err)
-				return err
+				return 0, err
 			}
 			glog.Infof("SyncPatitions offset %d ClearCacheAndSetHash %s done %s", offset, pubkey, processid)
+			partitionInfos, err = this.PartitionInfoRepository.GetPartitionInfos(int(offset), int(conf.GTunables.ComparePartitionsCount))
+			if err != nil {
+				glog.Infof("TouchstoneServer.SyncPatitions GetPartitionInfos err:%s %s", err, processid)
+				return 0, err
+			}
+			unresolved := CountUnresolvedPartitions(getTxidsByPartitionsRequest.Ids, MismatchedPartitions(partitionInfos, getPartitionsHashResponse.Hashs))
+			glog.Infof("SyncPatitions offset %d %s mismatches %d unresolved %d %s", offset, pubkey, len(getTxidsByPartitionsRequest.Ids), unresolved, processid)
+			this.peerHealth.ObservePartitionMismatches(pubkey, len(getTxidsByPartitionsRequest.Ids), unresolved)
 		}
-		glog.Infof("SyncPatitions offset %d done %s %s", offset, processid)
+		glog.Infof("SyncPatitions offset %d done %s", offset, processid)
+		job.AddDone(1)
 	}
-	return nil
+	compared := 0
+	for pubkey := range comparedPeers {
+		if !failedPeers[pubkey] {
+			compared++
+		}
+	}
+	return compared, nil
 }
 
-func (this *TouchstoneServer) SyncUnconfirmTx(processid string) {
+func (this *TouchstoneServer) SyncUnconfirmTx(ctx context.Context, processid string) {
 	getUnconfirmTxidsRequest := &message.GetUnconfirmTxidsRequest{}
-	for pubkey, peer := range this.Peers() {
-		getTxidsResponse, err := peer.GetUnconfirmTxids(context.Background(), getUnconfirmTxidsRequest)
+	peers := this.Peers()
+	for _, pubkey := range this.RankPeers(peers) {
+		peer := peers[pubkey]
+		rpcCtx, cancel := context.WithTimeout(ctx, PEER_RPC_TIMEOUT)
+		getTxidsResponse, err := peer.GetUnconfirmTxids(rpcCtx, getUnconfirmTxidsRequest)
+		cancel()
 		if err != nil {
 			glog.Infof("TouchstoneServer.SyncUnconfirmTx GetTxidsByHeights %s err:%s", pubkey, err)
+			this.SetPeerSyncResult(pubkey, PEER_SYNC_TYPE_UNCONFIRM, nil, err)
 			continue
 		}
-		_, err = this.SyncTxs(getTxidsResponse.Txids, peer, processid)
+		syncTxsResult, err := this.SyncTxs(ctx, getTxidsResponse.Txids, peer, processid)
+		this.SetPeerSyncResult(pubkey, PEER_SYNC_TYPE_UNCONFIRM, syncTxsResult, err)
 		if err != nil {
 			glog.Infof("TouchstoneServer.SyncUnconfirmTx SyncTxs %s err:%s", pubkey, err)
 			continue
@@ -617,8 +801,13 @@ func (this *TouchstoneServer) SyncUnconfirmTx(processid string) {
 	}
 }
 
-func (this *TouchstoneServer) SyncState(syncAll bool, processid string) error {
-	feeQuote, err := this.MapiClient.GetFeeQuote()
+// a node without peers has nothing to compare with
+func SyncStateSucceeded(peerCount int, compared int) bool {
+	return compared > 0 || peerCount == 0
+}
+
+func (this *TouchstoneServer) SyncState(ctx context.Context, syncAll bool, job *Job, processid string) error {
+	feeQuote, err := this.MapiClient.GetFeeQuote(ctx)
 	if err != nil {
 		glog.Infof("TouchstoneServer.SyncState GetFeeQuote %s", err)
 		return err
@@ -628,10 +817,10 @@ func (this *TouchstoneServer) SyncState(syncAll bool, processid string) error {
 		glog.Infof("TouchstoneServer.SyncState GetPartitionsCount %s %s", err, processid)
 		return err
 	}
-	this.SyncUnconfirmTx(processid)
+	this.SyncUnconfirmTx(ctx, processid)
 
-	expectPartitionsCount := (feeQuote.Payload.CurrentHighestBlockHeight-*conf.GStartHeight)/conf.PARTITION_BLOCK_COUNT + 1
-	start := count - conf.RE_CONPUTE_PARTITION_COUNT
+	expectPartitionsCount := (feeQuote.Payload.CurrentHighestBlockHeight-*conf.GStartHeight)/conf.GTunables.PartitionBlockCount + 1
+	start := count - conf.GTunables.RecomputePartitionCount
 	if start < 0 || syncAll {
 		start = 0
 	}
@@ -639,104 +828,204 @@ func (this *TouchstoneServer) SyncState(syncAll bool, processid string) error {
 	for i := start; i < expectPartitionsCount; i++ {
 		this.AddNeedRecomputehashPartition(i)
 	}
-	return this.SyncPatitions(start, expectPartitionsCount, processid)
+	compared, err := this.SyncPatitionsFromPeers(ctx, start, expectPartitionsCount, this.Peers(), job, processid)
+	if err != nil {
+		return err
+	}
+	if !SyncStateSucceeded(len(this.PeerConfigs()), compared) {
+		glog.Infof("TouchstoneServer.SyncState no peer compared partitions %s", processid)
+		return errors.New("no peer compared partitions")
+	}
+	this.SetLastSyncStateTime(time.Now().Unix())
+	return nil
 }
 
-func (this *TouchstoneServer) ConnectPeer(peerConfigs []*conf.PeerConfig) error {
+func (this *TouchstoneServer) DialPeer(pubkey string, host string) (*Node, error) {
 	var opts []grpc.DialOption
 	authPerRPCCredential := interceptor.NewAuthPerRPCCredential(this.privateKey)
 	opts = append(opts, grpc.WithPerRPCCredentials(authPerRPCCredential))
 	authCredential := interceptor.NewClientAuthCredential(this.privateKey)
 	opts = append(opts, grpc.WithTransportCredentials(authCredential))
+	opts = append(opts, grpc.WithChainUnaryInterceptor(metrics.PeerClientInterceptor(pubkey), this.PeerHealthInterceptor(pubkey)))
+	conn, err := grpc.Dial(host, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Node{
+		P2PClient: message.NewP2PClient(conn),
+		host:      host,
+		conn:      conn,
+	}, nil
+}
+
+// peers of the same pubkey and host are kept,removed ones are closed
+func (this *TouchstoneServer) ConnectPeer(peerConfigs []*conf.PeerConfig) error {
+	this.connectLock.Lock()
+	defer this.connectLock.Unlock()
 	oldPeers := this.Peers()
 	peers := make(map[string]*Node)
 	for _, peerConfig := range peerConfigs {
 		peer, ok := oldPeers[peerConfig.Pubkey]
-		if ok {
+		if ok && peer.host == peerConfig.Host {
 			peers[peerConfig.Pubkey] = peer
 			continue
 		}
-		conn, err := grpc.Dial(peerConfig.Host, opts...)
+		peer, err := this.DialPeer(peerConfig.Pubkey, peerConfig.Host)
 		if err != nil {
+			glog.Infof("TouchstoneServer.ConnectPeer DialPeer %s %s", peerConfig.Pubkey, err)
 			continue
 		}
-		c := message.NewP2PClient(conn)
-		peers[peerConfig.Pubkey] = &Node{
-			P2PClient: c,
-		}
+		peers[peerConfig.Pubkey] = peer
 	}
+	this.peersLock.Lock()
 	this.peers = peers
+	this.peerConfigs = peerConfigs
+	this.peersLock.Unlock()
+	for pubkey, peer := range oldPeers {
+		if peers[pubkey] == peer {
+			continue
+		}
+		glog.Infof("TouchstoneServer.ConnectPeer close %s %s", pubkey, peer.host)
+		peer.conn.Close()
+	}
 	if len(peers) == len(peerConfigs) {
 		return nil
 	}
 	return errors.New("still have connect failed")
 }
 
-func (this *TouchstoneServer) ConnectPeerLoop(peerConfigs []*conf.PeerConfig) {
+// dials peers failed to dial and redials dropped connections with backoff
+func (this *TouchstoneServer) ConnectPeerLoop(ctx context.Context) {
 	for {
-		processId := util.RandStringBytes(8)
-		glog.Infof("TouchstoneServer ConnectPeerLoop start %s", processId)
-		err := this.ConnectPeer(peerConfigs)
-		if err == nil {
-			glog.Infof("TouchstoneServer ConnectPeerLoop total done %s", processId)
+		if !SleepContext(ctx, PEER_CHECK_INTERVAL) {
 			return
 		}
-		glog.Infof("TouchstoneServer ConnectPeerLoop done %s", processId)
-		time.Sleep(time.Minute)
+		processId := util.RandStringBytes(8)
+		err := this.ConnectPeer(this.PeerConfigs())
+		if err != nil {
+			glog.Infof("TouchstoneServer ConnectPeerLoop ConnectPeer %s %s", processId, err)
+		}
+		now := time.Now()
+		for pubkey, peer := range this.Peers() {
+			if !this.peerHealth.ShouldRedial(pubkey, peer.Connected(), now) {
+				continue
+			}
+			glog.Infof("TouchstoneServer ConnectPeerLoop redial %s %s %s", processId, pubkey, peer.host)
+			err = this.RedialPeer(pubkey)
+			if err != nil {
+				glog.Infof("TouchstoneServer ConnectPeerLoop RedialPeer %s %s %s", processId, pubkey, err)
+			}
+		}
+		this.HandshakePeers(ctx, processId)
 	}
 }
 
-func (this *TouchstoneServer) SetSpent() error {
-	feeQuote, err := this.MapiClient.GetFeeQuote()
+func (this *TouchstoneServer) SetSpent(ctx context.Context, job *Job) error {
+	feeQuote, err := this.MapiClient.GetFeeQuote(ctx)
 	if err != nil {
 		glog.Infof("TouchstoneServer.SyncState GetFeeQuote %s", err)
 		return err
 	}
 	txPoint := &models.TxPoint{}
 	f := func() error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		msgTxBriefInfo, err := this.TxInfoRepository.GetMsgTxBriefInfo(txPoint.Txid)
 		if err != nil {
 			return err
 		}
-		if msgTxBriefInfo.Height == -1 || feeQuote.Payload.CurrentHighestBlockHeight-msgTxBriefInfo.Height <= 20 {
+		if msgTxBriefInfo.Height == -1 || feeQuote.Payload.CurrentHighestBlockHeight-msgTxBriefInfo.Height <= conf.GTunables.SpentDepth {
 			return nil
 		}
-		err = this.TxPointRepository.SetTxPointState(txPoint.PreTxid, txPoint.PreIndex, models.TX_POINT_TYPE_VOUT, models.TX_POINT_STATE_PRETTY_SURE_SPENT)
-		if err != nil {
-			return err
-		}
-		err = this.TxPointRepository.SetTxPointState(txPoint.Txid, txPoint.Index, models.TX_POINT_TYPE_VIN, models.TX_POINT_STATE_PRETTY_SURE_SPENT)
+		err = this.TxPointRepository.SetVinAndPreVoutState(txPoint, models.TX_POINT_STATE_PRETTY_SURE_SPENT)
 		if err != nil {
 			return err
 		}
+		spentTxPoint := *txPoint
+		spentTxPoint.State = models.TX_POINT_STATE_PRETTY_SURE_SPENT
+		this.PublishEvent(EVENT_TYPE_UTXO_SPENT, txPoint.Txid, msgTxBriefInfo.Height, []*models.TxPoint{&spentTxPoint})
+		job.AddDone(1)
 		return nil
 	}
 	return this.TxPointRepository.ForearchUnspentVinTxPoint(time.Now().Unix()-60*60, txPoint, f)
 }
 
-func (this *TouchstoneServer) SetSpentLoop() {
+// finished txns are kept TXN_PURGE_AGE,so a txn is never purged while a crashed runner may still resume it
+func (this *TouchstoneServer) PurgeTxnsLoop(ctx context.Context) {
 	for {
+		if this.LoopPaused(LOOP_PURGE_TXNS) {
+			if !SleepContext(ctx, conf.Seconds(conf.GTunables.LoopPausedIntervalSeconds)) {
+				return
+			}
+			continue
+		}
 		processId := util.RandStringBytes(8)
+		start := time.Now()
+		glog.Infof("TouchstoneServer PurgeTxnsLoop start %s", processId)
+		purged := 0
+		for ctx.Err() == nil {
+			count, err := this.TxInfoRepository.Db.PurgeTxns(start.Add(-TXN_PURGE_AGE), TXN_PURGE_BATCH)
+			if err != nil {
+				glog.Infof("TouchstoneServer PurgeTxnsLoop PurgeTxns %s %s", err, processId)
+				break
+			}
+			purged += count
+			if count < TXN_PURGE_BATCH {
+				break
+			}
+		}
+		glog.Infof("TouchstoneServer PurgeTxnsLoop done %d %s", purged, processId)
+		metrics.ObserveLoop(LOOP_PURGE_TXNS, start)
+		if !SleepContext(ctx, TXN_PURGE_INTERVAL) {
+			return
+		}
+	}
+}
+
+func (this *TouchstoneServer) SetSpentLoop(ctx context.Context) {
+	for {
+		if this.LoopPaused(LOOP_SET_SPENT) {
+			if !SleepContext(ctx, conf.Seconds(conf.GTunables.LoopPausedIntervalSeconds)) {
+				return
+			}
+			continue
+		}
+		processId := util.RandStringBytes(8)
+		start := time.Now()
 		glog.Infof("TouchstoneServer SetSpentLoop start %s", processId)
-		err := this.SetSpent()
+		err := this.SetSpent(ctx, nil)
 		if err != nil {
 			glog.Infof("TouchstoneServer CheckSpentLoop SetSpent %s %s", err, processId)
 		}
 		glog.Infof("TouchstoneServer SetSpentLoop done %s", processId)
-		time.Sleep(time.Minute * 10)
+		metrics.ObserveLoop(LOOP_SET_SPENT, start)
+		if !SleepContext(ctx, conf.Seconds(conf.GTunables.SetSpentIntervalSeconds)) {
+			return
+		}
 	}
 }
 
-func (this *TouchstoneServer) SyncStateLoop() {
+func (this *TouchstoneServer) SyncStateLoop(ctx context.Context) {
 	for {
+		if this.LoopPaused(LOOP_SYNC_STATE) {
+			if !SleepContext(ctx, conf.Seconds(conf.GTunables.LoopPausedIntervalSeconds)) {
+				return
+			}
+			continue
+		}
 		processId := util.RandStringBytes(8)
+		start := time.Now()
 		glog.Infof("TouchstoneServer SyncStateLoop start %s", processId)
-		err := this.SyncState(true, processId)
+		err := this.SyncState(ctx, true, nil, processId)
 		if err != nil {
 			glog.Infof("TouchstoneServer.SyncStateLoop SyncState err:%s", err)
 		}
 		glog.Infof("TouchstoneServer SyncStateLoop done %s", processId)
-		time.Sleep(time.Minute * 5)
+		metrics.ObserveLoop(LOOP_SYNC_STATE, start)
+		if !SleepContext(ctx, conf.Seconds(conf.GTunables.SyncStateIntervalSeconds)) {
+			return
+		}
 	}
 }
 
@@ -746,7 +1035,30 @@ func (this *TouchstoneServer) NotifiedTxs(request *message.NotifyTxsRequest, pee
 		glog.Infof("TouchstoneServer.NotifiedTxs err:peer not found %s", peerPubkey)
 		return
 	}
-	_, err := this.SyncTxs(request.Txids, peer, processid)
+	if this.peerHealth.Banned(peerPubkey, time.Now().Unix()) {
+		glog.Infof("TouchstoneServer.NotifiedTxs ignore banned peer %s %s", peerPubkey, processid)
+		return
+	}
+	if peer.Protocol().Refused() {
+		glog.Infof("TouchstoneServer.NotifiedTxs ignore refused peer %s %s", peerPubkey, processid)
+		return
+	}
+	txSource := NewPushedTxSource(request.Txs, peer, processid)
+	txids := request.Txids
+	listed := make(map[string]bool)
+	for _, txid := range txids {
+		listed[hex.EncodeToString(txid)] = true
+	}
+	for _, txid := range txSource.Txids() {
+		if !listed[hex.EncodeToString(txid)] {
+			txids = append(txids, txid)
+		}
+	}
+	for _, txid := range txids {
+		peer.knownTxs.Add(hex.EncodeToString(txid))
+	}
+	syncTxsResult, err := this.SyncTxs(this.Context(), txids, txSource, processid)
+	this.SetPeerSyncResult(peerPubkey, PEER_SYNC_TYPE_NOTIFIED, syncTxsResult, err)
 	if err != nil {
 		glog.Infof("TouchstoneServer.NotifiedTxs SyncTxs %s err:%s", peerPubkey, err)
 		return
@@ -776,15 +1088,35 @@ func (this *TouchstoneServer) GetTxs(request *message.GetTxsRequest) (*message.G
 func (this *TouchstoneServer) ClearMsgTx(txid string) error {
 	this.syncTxLock.Lock()
 	defer this.syncTxLock.Unlock()
-	err := this.TxPointRepository.DeleteTxPoints(txid)
+	msgTxBriefInfo, err := this.TxInfoRepository.GetMsgTxBriefInfo(txid)
+	if err != nil {
+		if !strings.Contains(err.Error(), models.MONGO_NOT_FOUND) {
+			return err
+		}
+		err := this.TxPointRepository.DeleteTxPoints(txid)
+		if err != nil {
+			return err
+		}
+		return this.TxInfoRepository.DeleteMsgTx(txid)
+	}
+	txPoints, err := this.TxPointRepository.GetTxPoints(txid)
+	if err != nil {
+		return err
+	}
+	ops := this.TxPointRepository.RemoveTxPointOps(txPoints)
+	if msgTxBriefInfo.State == models.TX_STATE_CLOSED {
+		ops = append(ops, this.AddrBalanceRepository.ChangeBalanceOps(txPoints, msgTxBriefInfo.Height, true)...)
+	}
+	err = this.TxInfoRepository.RemoveMsgTx(msgTxBriefInfo, ops)
 	if err != nil {
 		return err
 	}
-	return this.TxInfoRepository.DeleteMsgTx(txid)
+	this.PublishEvent(EVENT_TYPE_TX_REMOVED, txid, msgTxBriefInfo.Height, txPoints)
+	return nil
 }
 
-func (this *TouchstoneServer) CheckTxState() error {
-	feeQuote, err := this.MapiClient.GetFeeQuote()
+func (this *TouchstoneServer) CheckTxState(ctx context.Context) error {
+	feeQuote, err := this.MapiClient.GetFeeQuote(ctx)
 	if err != nil {
 		glog.Infof("TouchstoneServer.CheckTxState GetFeeQuote %s", err)
 		return err
@@ -795,7 +1127,10 @@ func (this *TouchstoneServer) CheckTxState() error {
 		return err
 	}
 	for _, msgTxBriefInfo := range msgTxBriefInfos {
-		txState, err := this.MapiClient.GetTxState(msgTxBriefInfo.Txid)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		txState, err := this.MapiClient.GetTxState(ctx, msgTxBriefInfo.Txid)
 		if err != nil {
 			glog.Infof("TouchstoneServer.CheckTxState GetTxState %s", err)
 			return err
@@ -820,22 +1155,51 @@ func (this *TouchstoneServer) CheckTxState() error {
 				glog.Infof("TouchstoneServer.CheckTxState ClearMsgTx %s", err)
 				return err
 			}
+			if msgTxBriefInfo.State == models.TX_STATE_CLOSED {
+				txPoints, err := this.TxPointRepository.GetTxPoints(msgTxBriefInfo.Txid)
+				if err != nil {
+					glog.Infof("TouchstoneServer.CheckTxState GetTxPoints %s", err)
+					return err
+				}
+				if currentheight != models.UNCONFIRM_TX_HEIGHT {
+					err = this.AddrBalanceRepository.SetLastHeight(txPoints, currentheight)
+					if err != nil {
+						glog.Infof("TouchstoneServer.CheckTxState SetLastHeight %s", err)
+						return err
+					}
+				}
+				eventType := EVENT_TYPE_TX_CONFIRMED
+				if msgTxBriefInfo.Height != models.UNCONFIRM_TX_HEIGHT {
+					eventType = EVENT_TYPE_TX_REORGED
+				}
+				this.PublishEvent(eventType, msgTxBriefInfo.Txid, currentheight, txPoints)
+			}
 			this.AddNeedRecomputehashPartitionByHeight(msgTxBriefInfo.Height)
 		}
 	}
 	return nil
 }
 
-func (this *TouchstoneServer) CheckTxStateLoop() {
+func (this *TouchstoneServer) CheckTxStateLoop(ctx context.Context) {
 	for {
+		if this.LoopPaused(LOOP_CHECK_TX_STATE) {
+			if !SleepContext(ctx, conf.Seconds(conf.GTunables.LoopPausedIntervalSeconds)) {
+				return
+			}
+			continue
+		}
 		processId := util.RandStringBytes(8)
+		start := time.Now()
 		glog.Infof("TouchstoneServer CheckTxStateLoop start %s", processId)
-		err := this.CheckTxState()
+		err := this.CheckTxState(ctx)
 		if err != nil {
 			glog.Infof("TouchstoneServer.CheckTxStateLoop CheckTxState %s", err)
 		}
 		glog.Infof("TouchstoneServer CheckTxStateLoop done %s", processId)
-		time.Sleep(time.Minute)
+		metrics.ObserveLoop(LOOP_CHECK_TX_STATE, start)
+		if !SleepContext(ctx, conf.Seconds(conf.GTunables.CheckTxStateIntervalSeconds)) {
+			return
+		}
 	}
 }
 
@@ -854,13 +1218,54 @@ func (this *TouchstoneServer) Init(nodeConfigs []*conf.PeerConfig, privateKeyHex
 	if err != nil {
 		return err
 	}
-	err = this.ConnectPeer(nodeConfigs)
+	if this.ConsolidateConfig != nil && this.ConsolidateConfig.Enable && this.ConsolidateConfig.MaxVins < MIN_CONSOLIDATE_VINS {
+		errStr := fmt.Sprintf("ConsolidateConfig.MaxVins < %d", MIN_CONSOLIDATE_VINS)
+		return errors.New(errStr)
+	}
+	if this.ConsolidateConfig != nil && this.ConsolidateConfig.Enable && this.ConsolidateConfig.MaxVins > MAX_CONSOLIDATE_VINS {
+		errStr := fmt.Sprintf("ConsolidateConfig.MaxVins > %d", MAX_CONSOLIDATE_VINS)
+		return errors.New(errStr)
+	}
+	err = this.LoadXpubEnabled()
+	if err != nil {
+		return err
+	}
+	err = this.RecoverMsgTxs(util.RandStringBytes(8))
+	if err != nil {
+		return err
+	}
+	err = this.InitWebhookCursor()
 	if err != nil {
-		go this.ConnectPeerLoop(nodeConfigs)
+		return err
+	}
+	loops := map[string]func(ctx context.Context){
+		LOOP_SYNC_STATE:     this.SyncStateLoop,
+		LOOP_CHECK_TX_STATE: this.CheckTxStateLoop,
+		LOOP_SET_SPENT:      this.SetSpentLoop,
+		LOOP_PAYOUT:         this.PayoutLoop,
+		LOOP_WEBHOOK:        this.WebhookLoop,
+		LOOP_PURGE_TXNS:     this.PurgeTxnsLoop,
+	}
+	this.peersLock.Lock()
+	this.staticPeerConfigs = nodeConfigs
+	this.peersLock.Unlock()
+	err = this.ApplyPeers()
+	if err != nil {
+		glog.Infof("TouchstoneServer.Init ApplyPeers %s", err)
+	}
+	loops[LOOP_CONNECT_PEER] = this.ConnectPeerLoop
+	if this.DiscoveryEnabled() {
+		loops[LOOP_DISCOVERY] = this.DiscoveryLoop
+	}
+	if this.ConsolidateConfig != nil && this.ConsolidateConfig.Enable {
+		loops[LOOP_CONSOLIDATE] = this.ConsolidateLoop
+	}
+	for name, loop := range loops {
+		err = this.lifecycle.Go(name, loop)
+		if err != nil {
+			return err
+		}
 	}
-	go this.SyncStateLoop()
-	go this.CheckTxStateLoop()
-	go this.SetSpentLoop()
 	return nil
 }
 
@@ -893,7 +1298,7 @@ func (this *TouchstoneServer) SendRawTransaction(rawTx string, processid string)
 	txidbytes := [][]byte{
 		util.GetHashByte(hash),
 	}
-	syncTxsResult, err := this.SyncTxs(txidbytes, localSingleTxSource, processid)
+	syncTxsResult, err := this.SyncTxs(this.Context(), txidbytes, localSingleTxSource, processid)
 	if err != nil {
 		return nil, err
 	}
@@ -965,8 +1370,8 @@ func (this *TouchstoneServer) GetPartitionsTxids(request *message.GetTxidsByPart
 	}
 	txidSet := make(map[string]bool)
 	for _, id := range request.Ids {
-		start := *conf.GStartHeight + conf.PARTITION_BLOCK_COUNT*id
-		txidBsons, err := this.TxInfoRepository.GetTxidsByHeightRangeOrderByTxid(start, start+conf.PARTITION_BLOCK_COUNT, models.TX_STATE_CLOSED, false)
+		start := *conf.GStartHeight + conf.GTunables.PartitionBlockCount*id
+		txidBsons, err := this.TxInfoRepository.GetTxidsByHeightRangeOrderByTxid(start, start+conf.GTunables.PartitionBlockCount, models.TX_STATE_CLOSED, false)
 		if err != nil {
 			return nil, err
 		}
@@ -986,7 +1391,18 @@ func (this *TouchstoneServer) GetPartitionsTxids(request *message.GetTxidsByPart
 	return getTxidsResponse, nil
 }
 
-func (this *TouchstoneServer) SetAddrInfo(appid string, userId int64, userIndex int64, addr string) error {
+// only admin can move an addr to another appid
+func (this *TouchstoneServer) SetAddrInfo(appid string, userId int64, userIndex int64, addr string, admin bool) error {
+	if !admin {
+		oldAddrInfo, err := this.AddrInfoRepository.GetAddrInfo(addr)
+		if err != nil {
+			if !strings.Contains(err.Error(), models.MONGO_NOT_FOUND) {
+				return err
+			}
+		} else if oldAddrInfo.Appid != appid {
+			return util.NewCodeError(util.ERR_FORBIDDEN_CODE, "addr belongs to another appid")
+		}
+	}
 	addrInfo := &models.AddrInfo{
 		Appid:     appid,
 		UserID:    userId,
@@ -997,6 +1413,33 @@ func (this *TouchstoneServer) SetAddrInfo(appid string, userId int64, userIndex
 	return this.AddrInfoRepository.AddOrUpdateAddrInfo(addrInfo)
 }
 
+// addrs not set by setaddrinfo of the appid are refused
+func (this *TouchstoneServer) CheckAddrsAppid(appid string, addrs []string) error {
+	addrInfos, err := this.GetAddrInfosMap(addrs)
+	if err != nil {
+		return err
+	}
+	return CheckAddrInfosAppid(appid, addrs, addrInfos)
+}
+
+func CheckAddrInfosAppid(appid string, addrs []string, addrInfos map[string]*models.AddrInfo) error {
+	for _, addr := range addrs {
+		addrInfo, ok := addrInfos[addr]
+		if !ok || addrInfo.Appid != appid {
+			return util.NewCodeError(util.ERR_FORBIDDEN_CODE, "addr does not belong to the appid")
+		}
+	}
+	return nil
+}
+
+// addr endpoints of http and grpc api are not scoped by a request appid,a caller can only read addrs of its own appid
+func (this *TouchstoneServer) CheckCallerAddrs(caller *interceptor.HttpCaller, addrs []string) error {
+	if caller.Admin {
+		return nil
+	}
+	return this.CheckAddrsAppid(caller.Appid, addrs)
+}
+
 type TxPointsSorter []*models.TxPoint
 
 func (this TxPointsSorter) Len() int {
@@ -1011,20 +1454,6 @@ func (this TxPointsSorter) Less(i, j int) bool {
 	return this[i].Timestamp < this[j].Timestamp
 }
 
-func PageTxPoints(txPoints []*models.TxPoint, offset int, limit int) []*models.TxPoint {
-	sort.Sort(TxPointsSorter(txPoints))
-	result := make([]*models.TxPoint, 0, 8)
-	if len(txPoints) <= offset {
-		return result
-	}
-	if len(txPoints) < limit+offset {
-		result = txPoints[offset:]
-		return result
-	}
-	result = txPoints[offset : limit+offset]
-	return result
-}
-
 func (this *TouchstoneServer) CalculateUtxos(txPoints []*models.TxPoint) []*models.TxPoint {
 	SpentUtxoSet := make(map[string]bool)
 	for _, txPoint := range txPoints {
@@ -1049,28 +1478,76 @@ func (this *TouchstoneServer) CalculateUtxos(txPoints []*models.TxPoint) []*mode
 	return result
 }
 
-func (this *TouchstoneServer) GetAllAddrUtxos(addr string, badgeCode string) ([]*models.TxPoint, error) {
-	txPoints, err := this.TxPointRepository.GetTxPointsByAddr(addr, badgeCode, models.TX_POINT_STATE_MAY_BE_UNSPENT)
+func CheckPageLimit(limit int) error {
+	if limit <= 0 || limit > MAX_PAGE_LIMIT {
+		errStr := fmt.Sprintf("limit should be in (0,%d]", MAX_PAGE_LIMIT)
+		return util.NewCodeError(util.ERR_PARAMETERS_CODE, errStr)
+	}
+	return nil
+}
+
+// empty cursor means the first page
+func DecodeTxPointCursor(cursor string) (*models.TxPointCursor, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	txPointCursor, err := models.DecodeTxPointCursor(cursor)
 	if err != nil {
-		return nil, err
+		return nil, util.NewCodeError(util.ERR_PARAMETERS_CODE, "illegal cursor")
 	}
-	return this.CalculateUtxos(txPoints), nil
+	return txPointCursor, nil
 }
 
 type GetUtxosResult struct {
-	Utxos []*models.TxPoint `json:"utxos"`
+	Utxos      []*models.TxPoint `json:"utxos"`
+	NextCursor string            `json:"next_cursor"`
 }
 
-func (this *TouchstoneServer) GetAddrUtxos(addr string, badgeCode string, offset int, limit int) (*GetUtxosResult, error) {
-	utxos, err := this.GetAllAddrUtxos(addr, badgeCode)
+// utxos in ascending (timestamp,txid,index) order,vouts spent in the page are skipped
+func (this *TouchstoneServer) PageUtxos(addrs []string, badgeCode string, cursor string, limit int) (*GetUtxosResult, error) {
+	txPointCursor, err := DecodeTxPointCursor(cursor)
 	if err != nil {
 		return nil, err
 	}
+	err = CheckPageLimit(limit)
+	if err != nil {
+		return nil, err
+	}
+	utxos := make([]*models.TxPoint, 0, limit)
+	for len(utxos) < limit {
+		size := limit - len(utxos)
+		txPoints, err := this.TxPointRepository.GetTxPointsPage(addrs, badgeCode, models.TX_POINT_TYPE_VOUT, models.TX_POINT_STATE_MAY_BE_UNSPENT, txPointCursor, false, size)
+		if err != nil {
+			return nil, err
+		}
+		vins, err := this.TxPointRepository.GetVinTxPointsByPreOutPoints(txPoints, models.TX_POINT_STATE_MAY_BE_UNSPENT)
+		if err != nil {
+			return nil, err
+		}
+		utxos = append(utxos, this.CalculateUtxos(append(txPoints, vins...))...)
+		if len(txPoints) < size {
+			return &GetUtxosResult{
+				Utxos: utxos,
+			}, nil
+		}
+		last := txPoints[len(txPoints)-1]
+		txPointCursor = &models.TxPointCursor{
+			Timestamp: last.Timestamp,
+			Txid:      last.Txid,
+			Index:     last.Index,
+			Type:      last.Type,
+		}
+	}
 	return &GetUtxosResult{
-		Utxos: PageTxPoints(utxos, offset, limit),
+		Utxos:      utxos,
+		NextCursor: txPointCursor.Encode(),
 	}, nil
 }
 
+func (this *TouchstoneServer) GetAddrUtxos(addr string, badgeCode string, cursor string, limit int) (*GetUtxosResult, error) {
+	return this.PageUtxos([]string{addr}, badgeCode, cursor, limit)
+}
+
 func (this *TouchstoneServer) GetAllUserUtxos(appid string, userid int64, userIndex int64, badgeCode string) ([]*models.TxPoint, error) {
 	txPoints, err := this.AddrInfoRepository.GetUserTxPoints(appid, userid, userIndex, badgeCode, models.TX_POINT_STATE_MAY_BE_UNSPENT)
 	if err != nil {
@@ -1079,14 +1556,28 @@ func (this *TouchstoneServer) GetAllUserUtxos(appid string, userid int64, userIn
 	return this.CalculateUtxos(txPoints), nil
 }
 
-func (this *TouchstoneServer) GetUserUtxos(appid string, userid int64, userIndex int64, badgeCode string, offset int, limit int) (*GetUtxosResult, error) {
-	utxos, err := this.GetAllUserUtxos(appid, userid, userIndex, badgeCode)
+// only addrs with a balance row of the badge,so a page of a user with many addrs does not query all of them
+func (this *TouchstoneServer) GetUserBadgeAddrs(appid string, userid int64, userIndex int64, badgeCode string, withUtxo bool) ([]string, error) {
+	addrBalances, err := this.AddrInfoRepository.GetUserAddrBalances(appid, userid, userIndex, badgeCode)
 	if err != nil {
 		return nil, err
 	}
-	return &GetUtxosResult{
-		Utxos: PageTxPoints(utxos, offset, limit),
-	}, nil
+	addrs := make([]string, 0, len(addrBalances))
+	for _, addrBalance := range addrBalances {
+		if withUtxo && addrBalance.UtxoCount <= 0 {
+			continue
+		}
+		addrs = append(addrs, addrBalance.Addr)
+	}
+	return addrs, nil
+}
+
+func (this *TouchstoneServer) GetUserUtxos(appid string, userid int64, userIndex int64, badgeCode string, cursor string, limit int) (*GetUtxosResult, error) {
+	addrs, err := this.GetUserBadgeAddrs(appid, userid, userIndex, badgeCode, true)
+	if err != nil {
+		return nil, err
+	}
+	return this.PageUtxos(addrs, badgeCode, cursor, limit)
 }
 
 func SumTxPoints(txPoints []*models.TxPoint) int64 {
@@ -1098,27 +1589,42 @@ func SumTxPoints(txPoints []*models.TxPoint) int64 {
 }
 
 type GetBalanceRsp struct {
-	Balance int64 `json:"balance"`
+	Balance    int64 `json:"balance"`
+	UtxoCount  int64 `json:"utxo_count"`
+	LastHeight int64 `json:"last_height"`
 }
 
 func (this *TouchstoneServer) GetAddrBalance(addr string, badgeCode string) (*GetBalanceRsp, error) {
-	utxos, err := this.GetAllAddrUtxos(addr, badgeCode)
+	addrBalance, err := this.AddrBalanceRepository.GetAddrBalance(addr, badgeCode)
 	if err != nil {
-		return nil, err
+		if !strings.Contains(err.Error(), models.MONGO_NOT_FOUND) {
+			return nil, err
+		}
+		addrBalance = models.NewAddrBalance(addr, badgeCode)
 	}
 	return &GetBalanceRsp{
-		Balance: SumTxPoints(utxos),
+		Balance:    addrBalance.Balance,
+		UtxoCount:  addrBalance.UtxoCount,
+		LastHeight: addrBalance.LastHeight,
 	}, nil
 }
 
 func (this *TouchstoneServer) GetUserBalance(appid string, userid int64, userIndex int64, badgeCode string) (*GetBalanceRsp, error) {
-	utxos, err := this.GetAllUserUtxos(appid, userid, userIndex, badgeCode)
+	addrBalances, err := this.AddrInfoRepository.GetUserAddrBalances(appid, userid, userIndex, badgeCode)
 	if err != nil {
 		return nil, err
 	}
-	return &GetBalanceRsp{
-		Balance: SumTxPoints(utxos),
-	}, nil
+	getBalanceRsp := &GetBalanceRsp{
+		LastHeight: models.UNCONFIRM_TX_HEIGHT,
+	}
+	for _, addrBalance := range addrBalances {
+		getBalanceRsp.Balance += addrBalance.Balance
+		getBalanceRsp.UtxoCount += addrBalance.UtxoCount
+		if addrBalance.LastHeight > getBalanceRsp.LastHeight {
+			getBalanceRsp.LastHeight = addrBalance.LastHeight
+		}
+	}
+	return getBalanceRsp, nil
 }
 
 type AddrInventory struct {
@@ -1128,20 +1634,6 @@ type AddrInventory struct {
 	Value     int64  `json:"value"`
 }
 
-type AddrInventorySorter []*AddrInventory
-
-func (this AddrInventorySorter) Len() int {
-	return len(this)
-}
-
-func (this AddrInventorySorter) Less(i, j int) bool {
-	return this[i].Timestamp > this[j].Timestamp
-}
-
-func (this AddrInventorySorter) Swap(i, j int) {
-	this[i], this[j] = this[j], this[i]
-}
-
 func TxPoints2AddrInventory(txPoints []*models.TxPoint) []*AddrInventory {
 	addrInventorys := make([]*AddrInventory, 0, 8)
 	addrInventorySet := make(map[string]*AddrInventory)
@@ -1161,58 +1653,66 @@ func TxPoints2AddrInventory(txPoints []*models.TxPoint) []*AddrInventory {
 	return addrInventorys
 }
 
-func (this *TouchstoneServer) GetAllAddrInventorys(addr string, badgeCode string) ([]*AddrInventory, error) {
-	txPoints, err := this.TxPointRepository.GetTxPointsByAddr(addr, badgeCode, models.TX_POINT_STATE_ALL)
-	if err != nil {
-		return nil, err
-	}
-	return TxPoints2AddrInventory(txPoints), nil
+type GetAddrInventoryRsp struct {
+	AddrInventorys []*AddrInventory `json:"addr_inventorys"`
+	NextCursor     string           `json:"next_cursor"`
 }
 
-func (this *TouchstoneServer) GetUserAddrInventorys(appid string, userid int64, userIndex int64, badgeCode string) ([]*AddrInventory, error) {
-	txPoints, err := this.AddrInfoRepository.GetUserTxPoints(appid, userid, userIndex, badgeCode, models.TX_POINT_STATE_ALL)
+// inventorys in descending (timestamp,txid) order,a page never splits the points of a tx
+func (this *TouchstoneServer) PageAddrInventorys(addrs []string, badgeCode string, cursor string, limit int) (*GetAddrInventoryRsp, error) {
+	txPointCursor, err := DecodeTxPointCursor(cursor)
 	if err != nil {
 		return nil, err
 	}
-	return TxPoints2AddrInventory(txPoints), nil
-}
-
-func PageAddrInventorys(addrInventorys []*AddrInventory, offset int, limit int) []*AddrInventory {
-	sort.Sort(AddrInventorySorter(addrInventorys))
-	result := make([]*AddrInventory, 0, 8)
-	if len(addrInventorys) <= offset {
-		return result
+	err = CheckPageLimit(limit)
+	if err != nil {
+		return nil, err
 	}
-	if len(addrInventorys) < limit+offset {
-		result = addrInventorys[offset:]
-		return result
+	txPoints := make([]*models.TxPoint, 0, limit)
+	for {
+		txPointsTmp, err := this.TxPointRepository.GetTxPointsPage(addrs, badgeCode, models.TX_POINT_TYPE_ALL, models.TX_POINT_STATE_ALL, txPointCursor, true, limit)
+		if err != nil {
+			return nil, err
+		}
+		txPoints = append(txPoints, txPointsTmp...)
+		addrInventorys := TxPoints2AddrInventory(txPoints)
+		if len(addrInventorys) > limit {
+			last := addrInventorys[limit-1]
+			return &GetAddrInventoryRsp{
+				AddrInventorys: addrInventorys[:limit],
+				// index -1 skips the rest points of the last tx
+				NextCursor: (&models.TxPointCursor{
+					Timestamp: last.Timestamp,
+					Txid:      last.Txid,
+					Index:     -1,
+				}).Encode(),
+			}, nil
+		}
+		if len(txPointsTmp) < limit {
+			return &GetAddrInventoryRsp{
+				AddrInventorys: addrInventorys,
+			}, nil
+		}
+		last := txPointsTmp[len(txPointsTmp)-1]
+		txPointCursor = &models.TxPointCursor{
+			Timestamp: last.Timestamp,
+			Txid:      last.Txid,
+			Index:     last.Index,
+			Type:      last.Type,
+		}
 	}
-	result = addrInventorys[offset : limit+offset]
-	return result
-}
-
-type GetAddrInventoryRsp struct {
-	AddrInventorys []*AddrInventory `json:"addr_inventorys"`
 }
 
-func (this *TouchstoneServer) GetAddrInventorys(addr string, badgeCode string, offset int, limit int) (*GetAddrInventoryRsp, error) {
-	addrInventorys, err := this.GetAllAddrInventorys(addr, badgeCode)
-	if err != nil {
-		return nil, err
-	}
-	return &GetAddrInventoryRsp{
-		AddrInventorys: PageAddrInventorys(addrInventorys, offset, limit),
-	}, nil
+func (this *TouchstoneServer) GetAddrInventorys(addr string, badgeCode string, cursor string, limit int) (*GetAddrInventoryRsp, error) {
+	return this.PageAddrInventorys([]string{addr}, badgeCode, cursor, limit)
 }
 
-func (this *TouchstoneServer) GetUserInventorys(appid string, userid int64, userIndex int64, badgeCode string, offset int, limit int) (*GetAddrInventoryRsp, error) {
-	addrInventorys, err := this.GetUserAddrInventorys(appid, userid, userIndex, badgeCode)
+func (this *TouchstoneServer) GetUserInventorys(appid string, userid int64, userIndex int64, badgeCode string, cursor string, limit int) (*GetAddrInventoryRsp, error) {
+	addrs, err := this.GetUserBadgeAddrs(appid, userid, userIndex, badgeCode, false)
 	if err != nil {
 		return nil, err
 	}
-	return &GetAddrInventoryRsp{
-		AddrInventorys: PageAddrInventorys(addrInventorys, offset, limit),
-	}, nil
+	return this.PageAddrInventorys(addrs, badgeCode, cursor, limit)
 }
 
 type AddrAmount struct {
@@ -1230,6 +1730,14 @@ func (this *TouchstoneServer) SendBadgeToAddress(appid string, userid int64, use
 	if err != nil {
 		return nil, err
 	}
+	txPoints, err := this.GetAllUserUtxos(appid, userid, userIndex, badgeCode)
+	if err != nil {
+		return nil, err
+	}
+	return BuildSendBadgeTx(txPoints, changeAddr, addrAmounts, amount2burn)
+}
+
+func BuildSendBadgeTx(txPoints []*models.TxPoint, changeAddr btcutil.Address, addrAmounts []*AddrAmount, amount2burn int64) (*SendBadgeToAddressRsp, error) {
 	msgTx := wire.NewMsgTx(TX_VERSION)
 	voutValue := amount2burn
 	for _, addrAmount := range addrAmounts {
@@ -1242,13 +1750,9 @@ func (this *TouchstoneServer) SendBadgeToAddress(appid string, userid int64, use
 			return nil, err
 		}
 		voutValue += addrAmount.Amount
-		vout := wire.NewTxOut(BADGE_DUST_LIMIT, script)
+		vout := wire.NewTxOut(conf.GTunables.BadgeDustLimit, script)
 		msgTx.AddTxOut(vout)
 	}
-	txPoints, err := this.GetAllUserUtxos(appid, userid, userIndex, badgeCode)
-	if err != nil {
-		return nil, err
-	}
 	usedVins := make([]*models.TxPoint, 0)
 	vinValue := int64(0)
 	for _, txPoint := range txPoints {
@@ -1280,7 +1784,7 @@ func (this *TouchstoneServer) SendBadgeToAddress(appid string, userid int64, use
 	if err != nil {
 		return nil, err
 	}
-	vout := wire.NewTxOut(BADGE_DUST_LIMIT, script)
+	vout := wire.NewTxOut(conf.GTunables.BadgeDustLimit, script)
 	msgTx.AddTxOut(vout)
 
 	UnFinishedTx := util.SeserializeMsgTxStr(msgTx)
@@ -1,6 +1,7 @@
 package services
 
 import (
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	"flag"
@@ -119,6 +120,23 @@ func init() {
 		panic(err)
 	}
 
+	addrBalanceRepository := &models.AddrBalanceRepository{
+		Db: db,
+	}
+	err = addrBalanceRepository.CreateIndex()
+	if err != nil {
+		glog.Infof("main 5 addrBalanceRepository CreateIndex %s", err)
+		glog.Flush()
+		panic(err)
+	}
+
+	eventHub, err := NewEventHub(&models.EventRepository{Db: db}, addrInfoRepository)
+	if err != nil {
+		glog.Infof("main 5 NewEventHub %s", err)
+		glog.Flush()
+		panic(err)
+	}
+
 	mapiClient, err := mapi.NewMempoolMapiClient(config.MempoolHost, config.MempoolPkiMnemonic, config.MempoolPkiMnemonicPassword)
 	if err != nil {
 		glog.Infof("main 6 NewMempoolMapiClient CreateIndex %s", err)
@@ -132,6 +150,8 @@ func init() {
 		PartitionInfoRepository:          partitionInfoRepository,
 		MapiClient:                       mapiClient,
 		AddrInfoRepository:               addrInfoRepository,
+		AddrBalanceRepository:            addrBalanceRepository,
+		EventHub:                         eventHub,
 		NeedRecomputehashPartitionsCache: make(map[int64]bool),
 	}
 	glbTestTouchStoneServer.SetPrivateKey(config.ServerPrivatekey)
@@ -148,7 +168,7 @@ func init() {
 
 func testSyncState(t *testing.T) {
 	for i := gstart; i < gend; i++ {
-		err := glbTestTouchStoneServer.SyncPatitions(i, i+1, fmt.Sprintf("processId-%d", i))
+		err := glbTestTouchStoneServer.SyncPatitions(context.Background(), i, i+1, fmt.Sprintf("processId-%d", i))
 		if err != nil {
 			glog.Infof("SyncPatitions %d err %s", i, err)
 			continue
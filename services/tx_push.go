@@ -0,0 +1,196 @@
+package services
+
+import (
+	"context"
+	"encoding/hex"
+	"sync"
+
+	"github.com/dotwallet/touchstone/message"
+	"github.com/dotwallet/touchstone/util"
+	"github.com/golang/glog"
+)
+
+const (
+	MAX_NOTIFY_BYTES = GRPC_MAX_MESSAGE_BYTES / 4
+	MAX_NOTIFY_TXS   = 1000
+	// bodies of bigger txs are not pushed,the receiver gets them by GetTxs
+	MAX_PUSH_TX_BYTES = 512 * 1024
+	KNOWN_TXS_LIMIT   = 10000
+)
+
+// remembers the latest txids,the oldest ones are forgotten first.zero value is usable
+type TxidFilter struct {
+	lock  sync.Mutex
+	txids map[string]bool
+	order []string
+}
+
+func (this *TxidFilter) Add(txids ...string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.txids == nil {
+		this.txids = make(map[string]bool)
+	}
+	for _, txid := range txids {
+		if this.txids[txid] {
+			continue
+		}
+		this.txids[txid] = true
+		this.order = append(this.order, txid)
+	}
+	for len(this.order) > KNOWN_TXS_LIMIT {
+		delete(this.txids, this.order[0])
+		this.order = this.order[1:]
+	}
+}
+
+func (this *TxidFilter) Has(txid string) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.txids[txid]
+}
+
+// pushed txs first,the others from fallback
+type PushedTxSource struct {
+	txs      map[string]*message.PushedTx
+	fallback TxSource
+}
+
+// keyed by the hash of the body,so a pushed body can not stand for another tx
+func NewPushedTxSource(txs []*message.PushedTx, fallback TxSource, processid string) *PushedTxSource {
+	pushedTxSource := &PushedTxSource{
+		txs:      make(map[string]*message.PushedTx),
+		fallback: fallback,
+	}
+	for _, tx := range txs {
+		msgTx, err := util.DeserializeTxBytes(tx.Rawtx)
+		if err != nil {
+			glog.Infof("NewPushedTxSource DeserializeTxBytes %s %s", err, processid)
+			continue
+		}
+		pushedTxSource.txs[msgTx.TxHash().String()] = tx
+	}
+	return pushedTxSource
+}
+
+// txids of pushed txs,for the ones only pushed but not listed
+func (this *PushedTxSource) Txids() [][]byte {
+	txids := make([][]byte, 0, len(this.txs))
+	for txid := range this.txs {
+		txidBytes, err := hex.DecodeString(txid)
+		if err != nil {
+			continue
+		}
+		txids = append(txids, txidBytes)
+	}
+	return txids
+}
+
+func (this *PushedTxSource) GetTxBytes(ctx context.Context, txids [][]byte) ([][]byte, error) {
+	result := make([][]byte, 0, len(txids))
+	lackTxids := make([][]byte, 0, 8)
+	for _, txidBytes := range txids {
+		tx, ok := this.txs[hex.EncodeToString(txidBytes)]
+		if !ok {
+			lackTxids = append(lackTxids, txidBytes)
+			continue
+		}
+		result = append(result, tx.Rawtx)
+	}
+	if len(lackTxids) == 0 || this.fallback == nil {
+		return result, nil
+	}
+	txsBytes, err := this.fallback.GetTxBytes(ctx, lackTxids)
+	if err != nil {
+		return nil, err
+	}
+	return append(result, txsBytes...), nil
+}
+
+// split by MAX_NOTIFY_TXS and MAX_NOTIFY_BYTES,txids[i] is the txid of txs[i],txs are pushed only when push is true
+func ChunkNotifyTxs(txids [][]byte, txs []*message.PushedTx, push bool) []*message.NotifyTxsRequest {
+	requests := make([]*message.NotifyTxsRequest, 0, 1)
+	request := &message.NotifyTxsRequest{}
+	size := 0
+	for i, tx := range txs {
+		txid := txids[i]
+		txSize := len(txid)
+		pushTx := push && len(tx.Rawtx) <= MAX_PUSH_TX_BYTES
+		if pushTx {
+			txSize += len(tx.Rawtx)
+		}
+		if len(request.Txids) > 0 && (len(request.Txids) >= MAX_NOTIFY_TXS || size+txSize > MAX_NOTIFY_BYTES) {
+			requests = append(requests, request)
+			request = &message.NotifyTxsRequest{}
+			size = 0
+		}
+		request.Txids = append(request.Txids, txid)
+		if pushTx {
+			request.Txs = append(request.Txs, tx)
+		}
+		size += txSize
+	}
+	if len(request.Txids) > 0 {
+		requests = append(requests, request)
+	}
+	return requests
+}
+
+// a tx that can not be parsed is logged and skipped,txids[i] is the txid of the returned txs[i]
+func PushedTxids(txs []*message.PushedTx) ([][]byte, []*message.PushedTx) {
+	txids := make([][]byte, 0, len(txs))
+	legalTxs := make([]*message.PushedTx, 0, len(txs))
+	for _, tx := range txs {
+		msgTx, err := util.DeserializeTxBytes(tx.Rawtx)
+		if err != nil {
+			glog.Infof("PushedTxids DeserializeTxBytes bytes:%d err:%s", len(tx.Rawtx), err)
+			continue
+		}
+		txids = append(txids, util.GetHashByte(msgTx.TxHash()))
+		legalTxs = append(legalTxs, tx)
+	}
+	return txids, legalTxs
+}
+
+// txs a peer already knows are skipped,refused peers are not notified.
+// txids are known by the peer once a notification of them succeeds,failed ones are not skipped next time
+func (this *TouchstoneServer) NotifyTxs(txs []*message.PushedTx) {
+	if len(txs) == 0 {
+		return
+	}
+	txids, txs := PushedTxids(txs)
+	for pubkey, peer := range this.Peers() {
+		protocol := peer.Protocol()
+		if protocol.Refused() {
+			continue
+		}
+		unknownTxids := make([][]byte, 0, len(txs))
+		unknownTxs := make([]*message.PushedTx, 0, len(txs))
+		for i, txid := range txids {
+			txidStr := hex.EncodeToString(txid)
+			if peer.knownTxs.Has(txidStr) {
+				continue
+			}
+			unknownTxids = append(unknownTxids, txid)
+			unknownTxs = append(unknownTxs, txs[i])
+		}
+		if len(unknownTxs) == 0 {
+			continue
+		}
+		requests := ChunkNotifyTxs(unknownTxids, unknownTxs, protocol.HasCapability(CAPABILITY_PUSH_TXS))
+		go func(pubkey string, peer *Node) {
+			for _, request := range requests {
+				ctx, cancel := context.WithTimeout(this.Context(), PEER_NOTIFY_TIMEOUT)
+				_, err := peer.NotifyTxs(ctx, request)
+				cancel()
+				if err != nil {
+					glog.Infof("TouchstoneServer.NotifyTxs %s %d txids %s", pubkey, len(request.Txids), err)
+					continue
+				}
+				for _, txid := range request.Txids {
+					peer.knownTxs.Add(hex.EncodeToString(txid))
+				}
+			}
+		}(pubkey, peer)
+	}
+}
@@ -0,0 +1,82 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/dotwallet/touchstone/message"
+	"github.com/dotwallet/touchstone/util"
+)
+
+func TestTxidFilter(t *testing.T) {
+	filter := &TxidFilter{}
+	if filter.Has("a") {
+		t.Fatal("empty filter has txid")
+	}
+	filter.Add("a", "b", "a")
+	if !filter.Has("a") || !filter.Has("b") || len(filter.order) != 2 {
+		t.Fatalf("order %v", filter.order)
+	}
+	for i := 0; i < KNOWN_TXS_LIMIT-1; i++ {
+		filter.Add(fmt.Sprintf("tx%d", i))
+	}
+	// the oldest txid is forgotten first
+	if filter.Has("a") || !filter.Has("b") || len(filter.order) != KNOWN_TXS_LIMIT {
+		t.Fatalf("a %t b %t %d", filter.Has("a"), filter.Has("b"), len(filter.order))
+	}
+}
+
+func TestChunkNotifyTxs(t *testing.T) {
+	txids := make([][]byte, 0, MAX_NOTIFY_TXS+1)
+	txs := make([]*message.PushedTx, 0, MAX_NOTIFY_TXS+1)
+	for i := 0; i < MAX_NOTIFY_TXS+1; i++ {
+		txids = append(txids, bytes.Repeat([]byte{byte(i)}, 32))
+		txs = append(txs, &message.PushedTx{Rawtx: []byte{byte(i)}})
+	}
+	requests := ChunkNotifyTxs(txids, txs, true)
+	if len(requests) != 2 || len(requests[0].Txids) != MAX_NOTIFY_TXS || len(requests[1].Txids) != 1 || len(requests[1].Txs) != 1 {
+		t.Fatalf("requests %d", len(requests))
+	}
+	requests = ChunkNotifyTxs(txids[:2], txs[:2], false)
+	if len(requests) != 1 || len(requests[0].Txids) != 2 || len(requests[0].Txs) != 0 {
+		t.Fatalf("txids only %+v", requests)
+	}
+	// a big tx is notified by txid only,bodies are split by size
+	big := &message.PushedTx{Rawtx: make([]byte, MAX_PUSH_TX_BYTES+1)}
+	half := &message.PushedTx{Rawtx: make([]byte, MAX_NOTIFY_BYTES/2)}
+	requests = ChunkNotifyTxs(txids[:4], []*message.PushedTx{big, half, half, txs[3]}, true)
+	if len(requests) != 2 {
+		t.Fatalf("requests %d", len(requests))
+	}
+	if len(requests[0].Txids) != 2 || len(requests[0].Txs) != 1 || requests[0].Txs[0] != half {
+		t.Fatalf("first %d txids %d txs", len(requests[0].Txids), len(requests[0].Txs))
+	}
+	if len(requests[1].Txids) != 2 || len(requests[1].Txs) != 2 {
+		t.Fatalf("second %d txids %d txs", len(requests[1].Txids), len(requests[1].Txs))
+	}
+	if len(ChunkNotifyTxs(nil, nil, true)) != 0 {
+		t.Fatal("requests without txs")
+	}
+}
+
+func TestPushedTxids(t *testing.T) {
+	msgTx := wire.NewMsgTx(1)
+	msgTx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{1}, 0), nil, nil))
+	msgTx.AddTxOut(wire.NewTxOut(1, nil))
+	rawtx := &bytes.Buffer{}
+	if err := msgTx.Serialize(rawtx); err != nil {
+		t.Fatal(err)
+	}
+	tx := &message.PushedTx{Rawtx: rawtx.Bytes()}
+	// a broken tx does not stop the others
+	txids, txs := PushedTxids([]*message.PushedTx{{Rawtx: []byte{1, 2}}, tx})
+	if len(txids) != 1 || len(txs) != 1 || txs[0] != tx {
+		t.Fatalf("txids %d txs %d", len(txids), len(txs))
+	}
+	if !bytes.Equal(txids[0], util.GetHashByte(msgTx.TxHash())) {
+		t.Fatalf("txid %x", txids[0])
+	}
+}
@@ -0,0 +1,499 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+
+	"github.com/dotwallet/touchstone/conf"
+	"github.com/dotwallet/touchstone/metrics"
+	"github.com/dotwallet/touchstone/models"
+	"github.com/dotwallet/touchstone/util"
+	"github.com/golang/glog"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	WEBHOOK_ENQUEUE_BATCH = 500
+	WEBHOOK_DELIVER_BATCH = 100
+	WEBHOOK_MAX_ATTEMPTS  = 12
+	WEBHOOK_RETRY_BASE    = 30
+	WEBHOOK_RETRY_MAX     = 6 * 60 * 60
+	WEBHOOK_TIMEOUT       = 10 * time.Second
+	MAX_WEBHOOKS_PER_APP  = 16
+	MAX_WEBHOOK_DELIVERY  = 100
+)
+
+// webhooks may only post to public addrs,never to touchstone itself or the internal network
+var NON_PUBLIC_NETS = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+var nonPublicNets = ParseCIDRs(NON_PUBLIC_NETS)
+
+func ParseCIDRs(cidrs []string) []*net.IPNet {
+	result := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		result = append(result, ipNet)
+	}
+	return result
+}
+
+// ipv4 mapped ipv6 addrs are checked as ipv4
+func IsPublicIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, ipNet := range nonPublicNets {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// checked again when dialing,the host may resolve to other addrs later
+func CheckWebhookHost(host string) error {
+	ip := net.ParseIP(host)
+	if ip != nil {
+		if !IsPublicIP(ip) {
+			return util.NewCodeError(util.ERR_PARAMETERS_CODE, "url should not be a loopback,link-local or private addr")
+		}
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), WEBHOOK_TIMEOUT)
+	defer cancel()
+	ipAddrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return util.NewCodeError(util.ERR_PARAMETERS_CODE, err.Error())
+	}
+	for _, ipAddr := range ipAddrs {
+		if !IsPublicIP(ipAddr.IP) {
+			return util.NewCodeError(util.ERR_PARAMETERS_CODE, "url should not resolve to a loopback,link-local or private addr")
+		}
+	}
+	return nil
+}
+
+func webhookDialControl(network string, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !IsPublicIP(ip) {
+		return errors.New("webhook to non public addr " + address)
+	}
+	return nil
+}
+
+// every dial,redirects included,is checked after resolving,no proxy is used as it would hide the target
+var webhookHttpClient = &http.Client{
+	Timeout: WEBHOOK_TIMEOUT,
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: WEBHOOK_TIMEOUT,
+			Control: webhookDialControl,
+		}).DialContext,
+		MaxIdleConnsPerHost: 2,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+type WebhookPayload struct {
+	DeliveryId  string        `json:"delivery_id"`
+	Appid       string        `json:"appid"`
+	WebhookType string        `json:"webhook_type"`
+	Event       *models.Event `json:"event"`
+	Timestamp   int64         `json:"timestamp"`
+}
+
+// same envelope as mapi,signature is over sha256 of payload
+type SignedWebhookPayload struct {
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+	PubKey    string `json:"pubKey"`
+}
+
+// 30s,60s,120s... at most 6h
+func WebhookRetryDelay(attempts int) int64 {
+	delay := int64(WEBHOOK_RETRY_BASE)
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= WEBHOOK_RETRY_MAX {
+			return WEBHOOK_RETRY_MAX
+		}
+	}
+	return delay
+}
+
+// deposit only when a vout goes to the addrs of the app
+func WebhookType(event *models.Event, appAddrs map[string]bool) string {
+	switch event.Type {
+	case EVENT_TYPE_TX_CLOSED:
+		for _, txPoint := range event.TxPoints {
+			if txPoint.Type == models.TX_POINT_TYPE_VOUT && appAddrs[txPoint.Addr] {
+				return models.WEBHOOK_TYPE_DEPOSIT
+			}
+		}
+	case EVENT_TYPE_TX_CONFIRMED:
+		return models.WEBHOOK_TYPE_CONFIRMATION
+	case EVENT_TYPE_TX_REORGED, EVENT_TYPE_TX_REMOVED:
+		return models.WEBHOOK_TYPE_REORG
+	case EVENT_TYPE_UTXO_SPENT:
+		return models.WEBHOOK_TYPE_SPEND
+	}
+	return ""
+}
+
+// the event as posted to an app,points,addrs and users of other apps are left out
+func AppEvent(event *models.Event, appid string, appAddrs map[string]bool) *models.Event {
+	appEvent := *event
+	appEvent.TxPoints = make([]*models.TxPoint, 0, len(event.TxPoints))
+	appEvent.Addrs = make([]string, 0, len(appAddrs))
+	appEvent.BadgeCodes = make([]string, 0, len(event.BadgeCodes))
+	appEvent.Users = make([]string, 0, len(event.Users))
+	addrSet := make(map[string]bool)
+	badgeCodeSet := make(map[string]bool)
+	for _, txPoint := range event.TxPoints {
+		if !appAddrs[txPoint.Addr] {
+			continue
+		}
+		appEvent.TxPoints = append(appEvent.TxPoints, txPoint)
+		if !addrSet[txPoint.Addr] {
+			addrSet[txPoint.Addr] = true
+			appEvent.Addrs = append(appEvent.Addrs, txPoint.Addr)
+		}
+		if !badgeCodeSet[txPoint.BadgeCode] {
+			badgeCodeSet[txPoint.BadgeCode] = true
+			appEvent.BadgeCodes = append(appEvent.BadgeCodes, txPoint.BadgeCode)
+		}
+	}
+	for _, user := range event.Users {
+		if models.UserKeyAppid(user) == appid {
+			appEvent.Users = append(appEvent.Users, user)
+		}
+	}
+	return &appEvent
+}
+
+func CheckWebhook(webhookUrl string, eventTypes []string) error {
+	u, err := url.Parse(webhookUrl)
+	if err != nil {
+		return util.NewCodeError(util.ERR_PARAMETERS_CODE, err.Error())
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return util.NewCodeError(util.ERR_PARAMETERS_CODE, "url should be http or https")
+	}
+	err = CheckWebhookHost(u.Hostname())
+	if err != nil {
+		return err
+	}
+	if len(eventTypes) == 0 {
+		return util.NewCodeError(util.ERR_PARAMETERS_CODE, "event_types is empty")
+	}
+	for _, eventType := range eventTypes {
+		known := false
+		for _, webhookType := range models.WEBHOOK_TYPES {
+			if eventType == webhookType {
+				known = true
+				break
+			}
+		}
+		if !known {
+			errStr := fmt.Sprintf("unknow event type %s", eventType)
+			return util.NewCodeError(util.ERR_PARAMETERS_CODE, errStr)
+		}
+	}
+	return nil
+}
+
+func (this *TouchstoneServer) SetWebhook(appid string, webhookUrl string, eventTypes []string) error {
+	err := CheckWebhook(webhookUrl, eventTypes)
+	if err != nil {
+		return err
+	}
+	webhooks, err := this.WebhookRepository.GetWebhooks(appid)
+	if err != nil {
+		return err
+	}
+	exist := false
+	for _, webhook := range webhooks {
+		if webhook.Url == webhookUrl {
+			exist = true
+		}
+	}
+	if !exist && len(webhooks) >= MAX_WEBHOOKS_PER_APP {
+		errStr := fmt.Sprintf("at most %d webhooks for an appid", MAX_WEBHOOKS_PER_APP)
+		return util.NewCodeError(util.ERR_PARAMETERS_CODE, errStr)
+	}
+	// a new webhook starts from now,not from the retained history
+	startSeq, err := this.EventHub.EventRepository.GetSeq()
+	if err != nil {
+		return err
+	}
+	return this.WebhookRepository.SetWebhook(&models.Webhook{
+		Appid:      appid,
+		Url:        webhookUrl,
+		EventTypes: eventTypes,
+		StartSeq:   startSeq,
+		Timestamp:  time.Now().Unix(),
+	})
+}
+
+func (this *TouchstoneServer) RemoveWebhook(appid string, webhookUrl string) error {
+	return this.WebhookRepository.RemoveWebhook(appid, webhookUrl)
+}
+
+func (this *TouchstoneServer) GetWebhooks(appid string) ([]*models.Webhook, error) {
+	return this.WebhookRepository.GetWebhooks(appid)
+}
+
+func (this *TouchstoneServer) GetWebhookDeliveries(appid string, state int, offset int, limit int) ([]*models.WebhookDelivery, error) {
+	if limit <= 0 || limit > MAX_WEBHOOK_DELIVERY {
+		errStr := fmt.Sprintf("limit should be in (0,%d]", MAX_WEBHOOK_DELIVERY)
+		return nil, util.NewCodeError(util.ERR_PARAMETERS_CODE, errStr)
+	}
+	return this.WebhookDeliveryRepository.GetWebhookDeliveries(appid, state, offset, limit)
+}
+
+func (this *TouchstoneServer) ReplayWebhookDeliveries(appid string, deliveryIds []string) error {
+	ids := make([]bson.ObjectId, 0, len(deliveryIds))
+	for _, deliveryId := range deliveryIds {
+		if !bson.IsObjectIdHex(deliveryId) {
+			errStr := fmt.Sprintf("illegal delivery id %s", deliveryId)
+			return util.NewCodeError(util.ERR_PARAMETERS_CODE, errStr)
+		}
+		ids = append(ids, bson.ObjectIdHex(deliveryId))
+	}
+	return this.WebhookDeliveryRepository.ReplayWebhookDeliveries(appid, ids)
+}
+
+func (this *TouchstoneServer) EnqueueWebhookEvent(event *models.Event) error {
+	addrInfos, err := this.AddrInfoRepository.GetAddrInfos(event.Addrs)
+	if err != nil {
+		return err
+	}
+	appAddrs := make(map[string]map[string]bool)
+	appids := make([]string, 0, 1)
+	for _, addrInfo := range addrInfos {
+		addrs, ok := appAddrs[addrInfo.Appid]
+		if !ok {
+			addrs = make(map[string]bool)
+			appAddrs[addrInfo.Appid] = addrs
+			appids = append(appids, addrInfo.Appid)
+		}
+		addrs[addrInfo.Addr] = true
+	}
+	if len(appids) == 0 {
+		return nil
+	}
+	webhooks, err := this.WebhookRepository.GetWebhooksByAppids(appids)
+	if err != nil {
+		return err
+	}
+	for _, webhook := range webhooks {
+		if event.Seq <= webhook.StartSeq {
+			continue
+		}
+		webhookType := WebhookType(event, appAddrs[webhook.Appid])
+		if webhookType == "" {
+			continue
+		}
+		for _, eventType := range webhook.EventTypes {
+			if eventType != webhookType {
+				continue
+			}
+			err := this.WebhookDeliveryRepository.AddWebhookDelivery(&models.WebhookDelivery{
+				Id:          models.WebhookDeliveryId(webhook.Appid, webhook.Url, event.Seq, webhookType, event.Timestamp),
+				Appid:       webhook.Appid,
+				Url:         webhook.Url,
+				WebhookType: webhookType,
+				EventSeq:    event.Seq,
+				Event:       AppEvent(event, webhook.Appid, appAddrs[webhook.Appid]),
+				State:       models.WEBHOOK_DELIVERY_STATE_PENDING,
+				NextRetry:   time.Now().Unix(),
+				Timestamp:   time.Now().Unix(),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// the cursor starts at the current seq the first time,and the event seq counter is raised to the cursor
+// in case it was reset before the counter doc existed
+func (this *TouchstoneServer) InitWebhookCursor() error {
+	seq, found, err := this.WebhookDeliveryRepository.GetEnqueuedSeq()
+	if err != nil {
+		return err
+	}
+	if found {
+		return this.EventHub.EventRepository.RaiseSeq(seq)
+	}
+	seq, err = this.EventHub.EventRepository.GetSeq()
+	if err != nil {
+		return err
+	}
+	return this.WebhookDeliveryRepository.SetEnqueuedSeq(seq)
+}
+
+func (this *TouchstoneServer) EnqueueWebhookDeliveries(processId string) error {
+	seq, _, err := this.WebhookDeliveryRepository.GetEnqueuedSeq()
+	if err != nil {
+		return err
+	}
+	for {
+		events, err := this.EventHub.EventRepository.GetAllEventsAfter(seq, WEBHOOK_ENQUEUE_BATCH)
+		if err != nil {
+			return err
+		}
+		for _, event := range events {
+			err := this.EnqueueWebhookEvent(event)
+			if err != nil {
+				glog.Infof("TouchstoneServer.EnqueueWebhookDeliveries EnqueueWebhookEvent seq:%d err:%s %s", event.Seq, err, processId)
+				return err
+			}
+			seq = event.Seq
+		}
+		if len(events) == 0 {
+			return nil
+		}
+		err = this.WebhookDeliveryRepository.SetEnqueuedSeq(seq)
+		if err != nil {
+			return err
+		}
+		if len(events) < WEBHOOK_ENQUEUE_BATCH {
+			return nil
+		}
+	}
+}
+
+func (this *TouchstoneServer) SignWebhookPayload(webhookPayload *WebhookPayload) (*SignedWebhookPayload, error) {
+	payloadBytes, err := json.Marshal(webhookPayload)
+	if err != nil {
+		return nil, err
+	}
+	hashForSign := sha256.Sum256(payloadBytes)
+	signature, err := this.privateKey.Sign(hashForSign[:])
+	if err != nil {
+		return nil, err
+	}
+	return &SignedWebhookPayload{
+		Payload:   string(payloadBytes),
+		Signature: hex.EncodeToString(signature.Serialize()),
+		PubKey:    hex.EncodeToString(this.privateKey.PubKey().SerializeCompressed()),
+	}, nil
+}
+
+func (this *TouchstoneServer) DeliverWebhook(webhookDelivery *models.WebhookDelivery) error {
+	signedWebhookPayload, err := this.SignWebhookPayload(&WebhookPayload{
+		DeliveryId:  webhookDelivery.Id.Hex(),
+		Appid:       webhookDelivery.Appid,
+		WebhookType: webhookDelivery.WebhookType,
+		Event:       webhookDelivery.Event,
+		Timestamp:   time.Now().Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(signedWebhookPayload)
+	if err != nil {
+		return err
+	}
+	rsp, err := webhookHttpClient.Post(webhookDelivery.Url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(rsp.Body, 4096))
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		return fmt.Errorf("http status %d", rsp.StatusCode)
+	}
+	return nil
+}
+
+func (this *TouchstoneServer) DeliverWebhooks(processId string) error {
+	webhookDeliveries, err := this.WebhookDeliveryRepository.GetDueWebhookDeliveries(time.Now().Unix(), WEBHOOK_DELIVER_BATCH)
+	if err != nil {
+		return err
+	}
+	for _, webhookDelivery := range webhookDeliveries {
+		err := this.DeliverWebhook(webhookDelivery)
+		webhookDelivery.Attempts++
+		if err == nil {
+			webhookDelivery.State = models.WEBHOOK_DELIVERY_STATE_DELIVERED
+			webhookDelivery.LastError = ""
+		} else {
+			glog.Infof("TouchstoneServer.DeliverWebhooks %s %s attempts:%d err:%s %s", webhookDelivery.Id.Hex(), webhookDelivery.Url, webhookDelivery.Attempts, err, processId)
+			webhookDelivery.LastError = err.Error()
+			webhookDelivery.NextRetry = time.Now().Unix() + WebhookRetryDelay(webhookDelivery.Attempts)
+			if webhookDelivery.Attempts >= WEBHOOK_MAX_ATTEMPTS {
+				webhookDelivery.State = models.WEBHOOK_DELIVERY_STATE_DEAD
+			}
+		}
+		err = this.WebhookDeliveryRepository.UpdateWebhookDelivery(webhookDelivery)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *TouchstoneServer) WebhookLoop(ctx context.Context) {
+	for {
+		if this.LoopPaused(LOOP_WEBHOOK) {
+			if !SleepContext(ctx, conf.Seconds(conf.GTunables.LoopPausedIntervalSeconds)) {
+				return
+			}
+			continue
+		}
+		processId := util.RandStringBytes(8)
+		start := time.Now()
+		err := this.EnqueueWebhookDeliveries(processId)
+		if err != nil {
+			glog.Infof("TouchstoneServer.WebhookLoop EnqueueWebhookDeliveries %s %s", err, processId)
+		}
+		err = this.DeliverWebhooks(processId)
+		if err != nil {
+			glog.Infof("TouchstoneServer.WebhookLoop DeliverWebhooks %s %s", err, processId)
+		}
+		metrics.ObserveLoop(LOOP_WEBHOOK, start)
+		if !SleepContext(ctx, conf.Seconds(conf.GTunables.WebhookIntervalSeconds)) {
+			return
+		}
+	}
+}
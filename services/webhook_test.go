@@ -0,0 +1,87 @@
+package services
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/dotwallet/touchstone/models"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	cases := map[string]bool{
+		"8.8.8.8":          true,
+		"2001:4860::8888":  true,
+		"127.0.0.1":        false,
+		"10.1.2.3":         false,
+		"172.20.0.1":       false,
+		"192.168.1.1":      false,
+		"169.254.169.254":  false,
+		"100.64.0.1":       false,
+		"0.0.0.0":          false,
+		"::1":              false,
+		"fe80::1":          false,
+		"fd00::1":          false,
+		"::ffff:127.0.0.1": false,
+	}
+	for ip, public := range cases {
+		if IsPublicIP(net.ParseIP(ip)) != public {
+			t.Fatalf("%s public should be %t", ip, public)
+		}
+	}
+}
+
+func TestCheckWebhook(t *testing.T) {
+	cases := map[string]bool{
+		"https://8.8.8.8/hook":                       true,
+		"ftp://8.8.8.8/hook":                         false,
+		"http://127.0.0.1:7789/v1/touchstone/admin/": false,
+		"http://[::1]/hook":                          false,
+		"http://169.254.169.254/latest/meta-data":    false,
+		"http://192.168.0.10/hook":                   false,
+	}
+	for webhookUrl, ok := range cases {
+		err := CheckWebhook(webhookUrl, []string{"deposit"})
+		if (err == nil) != ok {
+			t.Fatalf("%s ok should be %t,err %v", webhookUrl, ok, err)
+		}
+	}
+}
+
+func TestWebhookDialControl(t *testing.T) {
+	if webhookDialControl("tcp", "127.0.0.1:80", nil) == nil {
+		t.Fatal("loopback dial allowed")
+	}
+	if webhookDialControl("tcp", "8.8.8.8:443", nil) != nil {
+		t.Fatal("public dial refused")
+	}
+}
+
+func TestAppEvent(t *testing.T) {
+	event := &models.Event{
+		Seq:  7,
+		Type: EVENT_TYPE_TX_CLOSED,
+		TxPoints: []*models.TxPoint{
+			{Addr: "a", BadgeCode: "x", Type: models.TX_POINT_TYPE_VIN},
+			{Addr: "b", BadgeCode: "y", Type: models.TX_POINT_TYPE_VOUT},
+			{Addr: "a", BadgeCode: "x", Type: models.TX_POINT_TYPE_VOUT},
+		},
+		Addrs:      []string{"a", "b"},
+		BadgeCodes: []string{"x", "y"},
+		Users:      []string{models.UserKey("app", 1, 0), models.UserKey("other", 2, 0)},
+	}
+	appEvent := AppEvent(event, "app", map[string]bool{"a": true})
+	if len(appEvent.TxPoints) != 2 || appEvent.TxPoints[0].Addr != "a" || appEvent.TxPoints[1].Addr != "a" {
+		t.Fatalf("tx points %+v", appEvent.TxPoints)
+	}
+	if !reflect.DeepEqual(appEvent.Addrs, []string{"a"}) || !reflect.DeepEqual(appEvent.BadgeCodes, []string{"x"}) {
+		t.Fatalf("addrs %v badge codes %v", appEvent.Addrs, appEvent.BadgeCodes)
+	}
+	if !reflect.DeepEqual(appEvent.Users, []string{models.UserKey("app", 1, 0)}) || appEvent.Seq != 7 {
+		t.Fatalf("event %+v", appEvent)
+	}
+	// the published event is kept as it is
+	if len(event.TxPoints) != 3 || len(event.Users) != 2 {
+		t.Fatal("event changed")
+	}
+}
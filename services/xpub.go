@@ -0,0 +1,289 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/dotwallet/touchstone/conf"
+	"github.com/dotwallet/touchstone/models"
+	"github.com/dotwallet/touchstone/util"
+	"github.com/golang/glog"
+)
+
+const (
+	DEFAULT_XPUB_GAP_LIMIT = 20
+	MAX_XPUB_GAP_LIMIT     = 1000
+)
+
+var XPUB_CHAINS = []int{models.XPUB_CHAIN_RECEIVE, models.XPUB_CHAIN_CHANGE}
+
+func ParseXpub(xpub string) (*hdkeychain.ExtendedKey, error) {
+	key, err := hdkeychain.NewKeyFromString(xpub)
+	if err != nil {
+		return nil, util.NewCodeError(util.ERR_PARAMETERS_CODE, err.Error())
+	}
+	if key.IsPrivate() {
+		return nil, util.NewCodeError(util.ERR_PARAMETERS_CODE, "xpub should be a public key")
+	}
+	if !key.IsForNet(conf.GNetParam) {
+		return nil, util.NewCodeError(util.ERR_PARAMETERS_CODE, "xpub is not for this net")
+	}
+	return key, nil
+}
+
+// addrs of xpub/chain/[from,to)
+func DeriveXpubAddrs(key *hdkeychain.ExtendedKey, chain int, from int64, to int64) ([]string, error) {
+	chainKey, err := key.Child(uint32(chain))
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, to-from)
+	for index := from; index < to; index++ {
+		childKey, err := chainKey.Child(uint32(index))
+		if err != nil {
+			return nil, err
+		}
+		addr, err := childKey.Address(conf.GNetParam)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr.EncodeAddress())
+	}
+	return addrs, nil
+}
+
+func (this *TouchstoneServer) SetUserXpub(appid string, userid int64, userIndex int64, xpub string, gapLimit int64) (*models.XpubInfo, error) {
+	if gapLimit == 0 {
+		gapLimit = DEFAULT_XPUB_GAP_LIMIT
+	}
+	if gapLimit < 0 || gapLimit > MAX_XPUB_GAP_LIMIT {
+		errStr := fmt.Sprintf("gap_limit should be in (0,%d]", MAX_XPUB_GAP_LIMIT)
+		return nil, util.NewCodeError(util.ERR_PARAMETERS_CODE, errStr)
+	}
+	_, err := ParseXpub(xpub)
+	if err != nil {
+		return nil, err
+	}
+	xpubInfo, err := this.XpubInfoRepository.GetUserXpubInfo(appid, userid, userIndex)
+	if err == nil {
+		if xpubInfo.Xpub != xpub {
+			return nil, util.NewCodeError(util.ERR_PARAMETERS_CODE, "user already has another xpub")
+		}
+		return this.ExtendXpubWindow(xpub, gapLimit, nil)
+	}
+	if !strings.Contains(err.Error(), models.MONGO_NOT_FOUND) {
+		return nil, err
+	}
+	_, err = this.XpubInfoRepository.GetXpubInfo(xpub)
+	if err == nil {
+		return nil, util.NewCodeError(util.ERR_FORBIDDEN_CODE, "xpub belongs to another user")
+	}
+	if !strings.Contains(err.Error(), models.MONGO_NOT_FOUND) {
+		return nil, err
+	}
+	xpubInfo = &models.XpubInfo{
+		Appid:          appid,
+		UserID:         userid,
+		UserIndex:      userIndex,
+		Xpub:           xpub,
+		GapLimit:       gapLimit,
+		ReceiveSkipped: []int64{},
+		ChangeSkipped:  []int64{},
+		Timestamp:      time.Now().Unix(),
+	}
+	err = this.XpubInfoRepository.AddXpubInfo(xpubInfo)
+	if err != nil {
+		if strings.Contains(err.Error(), models.MONGO_ERROR_DUPLICATE) {
+			return nil, util.NewCodeError(util.ERR_PARAMETERS_CODE, "xpub is already set")
+		}
+		return nil, err
+	}
+	atomic.StoreInt32(&this.xpubEnabled, 1)
+	return this.ExtendXpubWindow(xpub, gapLimit, nil)
+}
+
+func (this *TouchstoneServer) GetUserXpub(appid string, userid int64, userIndex int64) (*models.XpubInfo, error) {
+	xpubInfo, err := this.XpubInfoRepository.GetUserXpubInfo(appid, userid, userIndex)
+	if err != nil {
+		if strings.Contains(err.Error(), models.MONGO_NOT_FOUND) {
+			return nil, util.NewCodeError(util.ERR_PARAMETERS_CODE, "user has no xpub")
+		}
+		return nil, err
+	}
+	return xpubInfo, nil
+}
+
+// one lock per xpub,tx closes of other xpubs are not blocked
+func (this *TouchstoneServer) lockXpub(xpub string) func() {
+	this.xpubLocksLock.Lock()
+	if this.xpubLocks == nil {
+		this.xpubLocks = make(map[string]*sync.Mutex)
+	}
+	lock, ok := this.xpubLocks[xpub]
+	if !ok {
+		lock = &sync.Mutex{}
+		this.xpubLocks[xpub] = lock
+	}
+	this.xpubLocksLock.Unlock()
+	lock.Lock()
+	return lock.Unlock
+}
+
+// xpubs are never removed,so once one is set the check of closed tx points is on for good
+func (this *TouchstoneServer) LoadXpubEnabled() error {
+	count, err := this.XpubInfoRepository.CountXpubInfos()
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		atomic.StoreInt32(&this.xpubEnabled, 1)
+	}
+	return nil
+}
+
+func (this *TouchstoneServer) XpubEnabled() bool {
+	return atomic.LoadInt32(&this.xpubEnabled) == 1
+}
+
+// derive until the chain has gap limit addrs of the user after the last used one,
+// add returns false when the addr is already set by another user,used returns addrs with history
+func ExtendXpubChain(key *hdkeychain.ExtendedKey, xpubInfo *models.XpubInfo, chain int, add func(addr string, index int64) (bool, error), used func(addrs []string) ([]string, error)) error {
+	for xpubInfo.GetCount(chain) < xpubInfo.WindowEnd(chain) {
+		from := xpubInfo.GetCount(chain)
+		to := xpubInfo.WindowEnd(chain)
+		addrs, err := DeriveXpubAddrs(key, chain, from, to)
+		if err != nil {
+			return err
+		}
+		addrIndexs := make(map[string]int64)
+		ownAddrs := make([]string, 0, len(addrs))
+		for i, addr := range addrs {
+			index := from + int64(i)
+			ok, err := add(addr, index)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				glog.Infof("ExtendXpubChain addr:%s is already set,skip it", addr)
+				xpubInfo.AddSkipped(chain, index)
+				continue
+			}
+			addrIndexs[addr] = index
+			ownAddrs = append(ownAddrs, addr)
+		}
+		// addrs with history before derived
+		usedAddrs, err := used(ownAddrs)
+		if err != nil {
+			return err
+		}
+		xpubInfo.SetCount(chain, to)
+		for _, addr := range usedAddrs {
+			if addrIndexs[addr]+1 > xpubInfo.GetUsed(chain) {
+				xpubInfo.SetUsed(chain, addrIndexs[addr]+1)
+			}
+		}
+	}
+	return nil
+}
+
+// gapLimit 0 keeps the old one,used is the max used index + 1 of chains
+func (this *TouchstoneServer) ExtendXpubWindow(xpub string, gapLimit int64, used map[int]int64) (*models.XpubInfo, error) {
+	unlock := this.lockXpub(xpub)
+	defer unlock()
+	xpubInfo, err := this.XpubInfoRepository.GetXpubInfo(xpub)
+	if err != nil {
+		return nil, err
+	}
+	if gapLimit != 0 {
+		xpubInfo.GapLimit = gapLimit
+	}
+	key, err := ParseXpub(xpub)
+	if err != nil {
+		return nil, err
+	}
+	for _, chain := range XPUB_CHAINS {
+		if used[chain] > xpubInfo.GetUsed(chain) {
+			xpubInfo.SetUsed(chain, used[chain])
+		}
+		chain := chain
+		add := func(addr string, index int64) (bool, error) {
+			return this.AddrInfoRepository.AddAddrInfoIfAbsent(&models.AddrInfo{
+				Appid:     xpubInfo.Appid,
+				UserID:    xpubInfo.UserID,
+				UserIndex: xpubInfo.UserIndex,
+				Addr:      addr,
+				Timestamp: time.Now().Unix(),
+				Xpub:      xpub,
+				XpubChain: chain,
+				XpubIndex: index,
+			})
+		}
+		err = ExtendXpubChain(key, xpubInfo, chain, add, this.AddrBalanceRepository.GetUsedAddrs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = this.XpubInfoRepository.UpdateXpubInfoProgress(xpubInfo)
+	if err != nil {
+		return nil, err
+	}
+	return xpubInfo, nil
+}
+
+// extends the windows of xpubs whose addrs are touched by closed tx points,
+// nothing is looked up before any xpub is set
+func (this *TouchstoneServer) CheckXpubAddrsUsed(txPoints []*models.TxPoint) error {
+	if !this.XpubEnabled() || len(txPoints) == 0 {
+		return nil
+	}
+	addrs := make([]string, 0, len(txPoints))
+	for _, txPoint := range txPoints {
+		addrs = append(addrs, txPoint.Addr)
+	}
+	addrInfos, err := this.AddrInfoRepository.GetAddrInfos(addrs)
+	if err != nil {
+		return err
+	}
+	xpubUseds := make(map[string]map[int]int64)
+	for _, addrInfo := range addrInfos {
+		if addrInfo.Xpub == "" {
+			continue
+		}
+		used, ok := xpubUseds[addrInfo.Xpub]
+		if !ok {
+			used = make(map[int]int64)
+			xpubUseds[addrInfo.Xpub] = used
+		}
+		if addrInfo.XpubIndex+1 > used[addrInfo.XpubChain] {
+			used[addrInfo.XpubChain] = addrInfo.XpubIndex + 1
+		}
+	}
+	for xpub, used := range xpubUseds {
+		xpubInfo, err := this.XpubInfoRepository.GetXpubInfo(xpub)
+		if err != nil {
+			return err
+		}
+		if !XpubUsedAdvanced(xpubInfo, used) {
+			continue
+		}
+		_, err = this.ExtendXpubWindow(xpub, 0, used)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the window only moves when an addr after the used one is used
+func XpubUsedAdvanced(xpubInfo *models.XpubInfo, used map[int]int64) bool {
+	for _, chain := range XPUB_CHAINS {
+		if used[chain] > xpubInfo.GetUsed(chain) {
+			return true
+		}
+	}
+	return false
+}
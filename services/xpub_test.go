@@ -0,0 +1,126 @@
+package services
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/dotwallet/touchstone/conf"
+	"github.com/dotwallet/touchstone/models"
+)
+
+func newTestXpub(t *testing.T) *hdkeychain.ExtendedKey {
+	master, err := hdkeychain.NewMaster(bytes.Repeat([]byte{7}, 32), conf.GNetParam)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := master.Neuter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestDeriveXpubAddrs(t *testing.T) {
+	key := newTestXpub(t)
+	addrs, err := DeriveXpubAddrs(key, models.XPUB_CHAIN_RECEIVE, 0, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tail, err := DeriveXpubAddrs(key, models.XPUB_CHAIN_RECEIVE, 3, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 5 || tail[0] != addrs[3] || tail[1] != addrs[4] {
+		t.Fatalf("derived %v and %v", addrs, tail)
+	}
+	change, err := DeriveXpubAddrs(key, models.XPUB_CHAIN_CHANGE, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change[0] == addrs[0] {
+		t.Fatal("chains should derive different addrs")
+	}
+	_, err = ParseXpub(key.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtendXpubChain(t *testing.T) {
+	key := newTestXpub(t)
+	addrs, err := DeriveXpubAddrs(key, models.XPUB_CHAIN_RECEIVE, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owned := map[string]bool{addrs[1]: true, addrs[2]: true}
+	history := map[string]bool{addrs[3]: true}
+	add := func(addr string, index int64) (bool, error) {
+		if owned[addr] {
+			return false, nil
+		}
+		return true, nil
+	}
+	used := func(addrs []string) ([]string, error) {
+		usedAddrs := make([]string, 0)
+		for _, addr := range addrs {
+			if history[addr] {
+				usedAddrs = append(usedAddrs, addr)
+			}
+		}
+		return usedAddrs, nil
+	}
+	xpubInfo := &models.XpubInfo{GapLimit: 3}
+	err = ExtendXpubChain(key, xpubInfo, models.XPUB_CHAIN_RECEIVE, add, used)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 3 has history,4 5 6 are the gap
+	if xpubInfo.ReceiveUsed != 4 || xpubInfo.ReceiveCount != 7 {
+		t.Fatalf("used %d count %d", xpubInfo.ReceiveUsed, xpubInfo.ReceiveCount)
+	}
+	if len(xpubInfo.ReceiveSkipped) != 0 {
+		t.Fatalf("skipped before used should be dropped %v", xpubInfo.ReceiveSkipped)
+	}
+
+	// 1 and 2 set by another user are not in the gap
+	history = map[string]bool{}
+	xpubInfo = &models.XpubInfo{GapLimit: 3}
+	err = ExtendXpubChain(key, xpubInfo, models.XPUB_CHAIN_RECEIVE, add, used)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if xpubInfo.ReceiveCount != 5 || len(xpubInfo.ReceiveSkipped) != 2 {
+		t.Fatalf("count %d skipped %v", xpubInfo.ReceiveCount, xpubInfo.ReceiveSkipped)
+	}
+
+	// history of a skipped addr does not move the window
+	history = map[string]bool{addrs[2]: true}
+	xpubInfo = &models.XpubInfo{GapLimit: 3}
+	err = ExtendXpubChain(key, xpubInfo, models.XPUB_CHAIN_RECEIVE, add, used)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if xpubInfo.ReceiveUsed != 0 || xpubInfo.ReceiveCount != 5 {
+		t.Fatalf("used %d count %d", xpubInfo.ReceiveUsed, xpubInfo.ReceiveCount)
+	}
+}
+
+func TestXpubUsedAdvanced(t *testing.T) {
+	xpubInfo := &models.XpubInfo{ReceiveUsed: 3, ChangeUsed: 1}
+	if XpubUsedAdvanced(xpubInfo, map[int]int64{models.XPUB_CHAIN_RECEIVE: 3, models.XPUB_CHAIN_CHANGE: 1}) {
+		t.Fatal("used addrs inside the used range should not move the window")
+	}
+	if !XpubUsedAdvanced(xpubInfo, map[int]int64{models.XPUB_CHAIN_CHANGE: 2}) {
+		t.Fatal("a used change addr after the used one should move the window")
+	}
+}
+
+func TestCheckXpubAddrsUsedWithoutXpub(t *testing.T) {
+	server := &TouchstoneServer{}
+	// repositories are nil,nothing should be looked up
+	err := server.CheckXpubAddrsUsed([]*models.TxPoint{{Addr: "a1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
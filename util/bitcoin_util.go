@@ -109,6 +109,24 @@ func CreateBadgeLockScript(address btcutil.Address, value int64) ([]byte, error)
 	return result, nil
 }
 
+func CreateOpReturnScript(data []byte) ([]byte, error) {
+	return txscript.NewScriptBuilder().AddOp(txscript.OP_FALSE).AddOp(txscript.OP_RETURN).AddFullData(data).Script()
+}
+
+func SumBadgeValues(values []int64) (int64, error) {
+	sum := int64(0)
+	for _, value := range values {
+		if value <= 0 {
+			return 0, errors.New("error value")
+		}
+		if value > MAX_CREATE_BADGE_VALUE-sum {
+			return 0, errors.New("sum of values exceeds max create badge value")
+		}
+		sum += value
+	}
+	return sum, nil
+}
+
 type BadgeVout struct {
 	BadgeValue int64
 	Address    btcutil.Address
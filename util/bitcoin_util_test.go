@@ -51,3 +51,21 @@ func TestSortAndDistinctMsgTxs(t *testing.T) {
 	}
 
 }
+
+func TestSumBadgeValues(t *testing.T) {
+	sum, err := SumBadgeValues([]int64{1, 2, MAX_CREATE_BADGE_VALUE - 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != MAX_CREATE_BADGE_VALUE {
+		t.Fatal("sum != MAX_CREATE_BADGE_VALUE")
+	}
+	_, err = SumBadgeValues([]int64{1, 2, MAX_CREATE_BADGE_VALUE - 2})
+	if err == nil {
+		t.Fatal("overflow not rejected")
+	}
+	_, err = SumBadgeValues([]int64{1, 0})
+	if err == nil {
+		t.Fatal("zero value not rejected")
+	}
+}
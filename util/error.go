@@ -12,8 +12,27 @@ const (
 	ERR_ILLEGAL_VIN_CODE         = -6
 	ERR_PARAMETERS_CODE          = -7
 	ERR_NOT_ENOUGH_BADGE_CODE    = -8
+	ERR_NOT_USER_ADDR_CODE       = -9
+	ERR_UNAUTHORIZED_CODE        = -10
+	ERR_FORBIDDEN_CODE           = -11
 )
 
+// keep it along with codes above,it is in api docs
+var ERROR_CODE_DESCRIBES = map[int]string{
+	HTTP_OK_RESPONSE_CODE:        "ok",
+	HTTP_READ_BODY_ERROR_CODE:    "read body failed",
+	HTTP_WRONG_FORMAT_ERROR_CODE: "body is not json or required fields are missing",
+	HTTP_SERVICE_ERROR_CODE:      "service error",
+	ERR_UNKNOW_UTXO_CODE:         "unknown utxo",
+	ERR_UNKNOW_TX_CODE:           "unknown tx",
+	ERR_ILLEGAL_VIN_CODE:         "illegal vin",
+	ERR_PARAMETERS_CODE:          "illegal parameters",
+	ERR_NOT_ENOUGH_BADGE_CODE:    "not enough badge",
+	ERR_NOT_USER_ADDR_CODE:       "addr is not the user's",
+	ERR_UNAUTHORIZED_CODE:        "missing or illegal token",
+	ERR_FORBIDDEN_CODE:           "appid or addr belongs to another caller",
+}
+
 type CodeError struct {
 	Code int
 	Err  error
@@ -2,6 +2,7 @@ package util
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -37,12 +38,17 @@ func ToCurlStr(method string, header map[string]string, body []byte, url string)
 }
 
 func HttpRequest(method string, url string, headers map[string]string, reqBody interface{}) ([]byte, error) {
+	return HttpRequestContext(context.Background(), method, url, headers, reqBody)
+}
+
+// the request is cancelled with ctx
+func HttpRequestContext(ctx context.Context, method string, url string, headers map[string]string, reqBody interface{}) ([]byte, error) {
 	httpClient := &http.Client{}
 	content, err := json.Marshal(reqBody)
 	if err != nil {
 		return nil, err
 	}
-	request, err := http.NewRequest(method, url, bytes.NewReader(content))
+	request, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(content))
 	if err != nil {
 		return nil, err
 	}